@@ -0,0 +1,285 @@
+// Package search is the client-side full-text index of decrypted messages.
+// The server cannot read end-to-end encrypted dialogs, so clients index
+// messages as they decrypt them and search offline; the index is persisted
+// encrypted with a device-local key (see Save and Load).
+package search
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultLimit  = 20
+	maxLimit      = 100
+	snippetLength = 160
+	// snippetLead is how much text a snippet keeps before the first match.
+	snippetLead = 40
+)
+
+// Document is a decrypted message to index. Message ids are assigned by the
+// server and grow over time, which orders results across dialogs.
+type Document struct {
+	DialogID  uuid.UUID
+	MessageID int64
+	SenderID  uuid.UUID
+	SentAt    time.Time
+	Text      string
+}
+
+// Query is a search over the index. Every word must match; the last one also
+// matches as a prefix unless the text ends with a space, so results follow
+// typing. DialogID and SenderID filter when non-nil, From (inclusive) and To
+// (exclusive) when non-zero. Before continues a listing after the hit with
+// that message id.
+type Query struct {
+	Text     string
+	DialogID *uuid.UUID
+	SenderID *uuid.UUID
+	From     time.Time
+	To       time.Time
+	Before   int64
+	Limit    int
+}
+
+// Range is a span of a text, in runes.
+type Range struct {
+	Offset int
+	Length int
+}
+
+// Hit is a matching message with a snippet of its text around the first
+// match; Highlights are the matched words within Snippet.
+type Hit struct {
+	DialogID   uuid.UUID
+	MessageID  int64
+	SenderID   uuid.UUID
+	SentAt     time.Time
+	Snippet    string
+	Highlights []Range
+}
+
+// Index is an inverted index of messages, safe for concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	docs     map[int64]Document
+	postings map[string]map[int64]struct{}
+	version  uint64
+}
+
+// New returns an empty index.
+func New() *Index {
+	return &Index{
+		docs:     make(map[int64]Document),
+		postings: make(map[string]map[int64]struct{}),
+	}
+}
+
+// Add indexes doc, replacing an earlier version of the same message, so edits
+// are applied by adding the new text.
+func (ix *Index) Add(doc Document) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(doc.MessageID)
+	ix.docs[doc.MessageID] = doc
+	for _, t := range tokenize(doc.Text) {
+		ids := ix.postings[t.term]
+		if ids == nil {
+			ids = make(map[int64]struct{})
+			ix.postings[t.term] = ids
+		}
+		ids[doc.MessageID] = struct{}{}
+	}
+	ix.version++
+}
+
+// Remove drops a deleted or expired message.
+func (ix *Index) Remove(messageID int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.remove(messageID) {
+		ix.version++
+	}
+}
+
+// RemoveDialog drops every message of a dialog the user left or cleared.
+func (ix *Index) RemoveDialog(dialogID uuid.UUID) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	removed := false
+	for id, doc := range ix.docs {
+		if doc.DialogID == dialogID {
+			removed = ix.remove(id) || removed
+		}
+	}
+	if removed {
+		ix.version++
+	}
+}
+
+func (ix *Index) remove(messageID int64) bool {
+	doc, ok := ix.docs[messageID]
+	if !ok {
+		return false
+	}
+	delete(ix.docs, messageID)
+	for _, t := range tokenize(doc.Text) {
+		if ids := ix.postings[t.term]; ids != nil {
+			delete(ids, messageID)
+			if len(ids) == 0 {
+				delete(ix.postings, t.term)
+			}
+		}
+	}
+	return true
+}
+
+// Len returns the number of indexed messages.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Version changes with every update; clients save the index when it differs
+// from the version they saved last.
+func (ix *Index) Version() uint64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.version
+}
+
+// Search returns messages matching q, newest first.
+func (ix *Index) Search(q Query) []Hit {
+	words := tokenize(q.Text)
+	if len(words) == 0 {
+		return nil
+	}
+	if q.Limit <= 0 || q.Limit > maxLimit {
+		q.Limit = defaultLimit
+	}
+	prefix := ""
+	if last, _ := utf8.DecodeLastRuneInString(q.Text); !unicode.IsSpace(last) {
+		prefix = words[len(words)-1].word
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	matchers := make([]termMatcher, len(words))
+	var ids map[int64]struct{}
+	for i, w := range words {
+		matchers[i] = termMatcher{term: w.term}
+		if i == len(words)-1 {
+			matchers[i].prefix = prefix
+		}
+		ids = intersect(ids, ix.lookup(matchers[i]), i == 0)
+		if len(ids) == 0 {
+			return nil
+		}
+	}
+
+	var hits []Hit
+	for id := range ids {
+		doc := ix.docs[id]
+		if (q.DialogID != nil && doc.DialogID != *q.DialogID) ||
+			(q.SenderID != nil && doc.SenderID != *q.SenderID) ||
+			(!q.From.IsZero() && doc.SentAt.Before(q.From)) ||
+			(!q.To.IsZero() && !doc.SentAt.Before(q.To)) ||
+			(q.Before != 0 && id >= q.Before) {
+			continue
+		}
+		hits = append(hits, Hit{DialogID: doc.DialogID, MessageID: id, SenderID: doc.SenderID, SentAt: doc.SentAt})
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].MessageID > hits[j].MessageID })
+	if len(hits) > q.Limit {
+		hits = hits[:q.Limit]
+	}
+	for i := range hits {
+		hits[i].Snippet, hits[i].Highlights = snippet(ix.docs[hits[i].MessageID].Text, matchers)
+	}
+	return hits
+}
+
+// termMatcher matches an indexed term exactly or, when prefix is set, any
+// term starting with it.
+type termMatcher struct {
+	term   string
+	prefix string
+}
+
+func (m termMatcher) match(term string) bool {
+	return term == m.term || (m.prefix != "" && strings.HasPrefix(term, m.prefix))
+}
+
+func (ix *Index) lookup(m termMatcher) map[int64]struct{} {
+	if m.prefix == "" {
+		return ix.postings[m.term]
+	}
+	res := make(map[int64]struct{})
+	for term, ids := range ix.postings {
+		if m.match(term) {
+			for id := range ids {
+				res[id] = struct{}{}
+			}
+		}
+	}
+	return res
+}
+
+// intersect returns the ids present in both sets; with first it copies b.
+func intersect(a, b map[int64]struct{}, first bool) map[int64]struct{} {
+	res := make(map[int64]struct{})
+	if first {
+		for id := range b {
+			res[id] = struct{}{}
+		}
+		return res
+	}
+	for id := range a {
+		if _, ok := b[id]; ok {
+			res[id] = struct{}{}
+		}
+	}
+	return res
+}
+
+// snippet cuts up to snippetLength runes of text around the first match and
+// returns the matched words within it.
+func snippet(text string, matchers []termMatcher) (string, []Range) {
+	var matches []Range
+	for _, t := range tokenize(text) {
+		if slices.ContainsFunc(matchers, func(m termMatcher) bool { return m.match(t.term) }) {
+			matches = append(matches, Range{Offset: t.offset, Length: t.length})
+		}
+	}
+	runes := []rune(text)
+	start := 0
+	if len(runes) > snippetLength && len(matches) > 0 {
+		start = max(0, min(matches[0].Offset-snippetLead, len(runes)-snippetLength))
+	}
+	end := min(len(runes), start+snippetLength)
+	var b strings.Builder
+	shift := start
+	if start > 0 {
+		b.WriteString("…")
+		shift--
+	}
+	b.WriteString(string(runes[start:end]))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	highlights := []Range{}
+	for _, m := range matches {
+		if m.Offset >= start && m.Offset+m.Length <= end {
+			highlights = append(highlights, Range{Offset: m.Offset - shift, Length: m.Length})
+		}
+	}
+	return b.String(), highlights
+}
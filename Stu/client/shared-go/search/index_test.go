@@ -0,0 +1,133 @@
+package search
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestStem(t *testing.T) {
+	cases := map[string]string{
+		"сообщения":   "сообщен",
+		"сообщениями": "сообщен",
+		"сообщение":   "сообщен",
+		"красивая":    "красив",
+		"красивые":    "красив",
+		"релизы":      "релиз",
+		"релизов":     "релиз",
+		"пятницу":     "пятниц",
+		"читали":      "чита",
+		"прочитав":    "прочита",
+		"умывшись":    "ум",
+		"быстрейший":  "быстр",
+		"радость":     "радост",
+		"в":           "в",
+	}
+	for word, want := range cases {
+		if got := Stem(word); got != want {
+			t.Errorf("Stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	team, family := uuid.New(), uuid.New()
+	alice, bob := uuid.New(), uuid.New()
+	day := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	ix := New()
+	ix.Add(Document{DialogID: team, MessageID: 1, SenderID: alice, SentAt: day, Text: "Релизы выходят по пятницам"})
+	ix.Add(Document{DialogID: team, MessageID: 2, SenderID: bob, SentAt: day.Add(time.Hour), Text: "Отложим релиз до Пятницы?"})
+	ix.Add(Document{DialogID: family, MessageID: 3, SenderID: alice, SentAt: day.Add(48 * time.Hour), Text: "Купи молоко"})
+
+	ids := func(hits []Hit) []int64 {
+		var res []int64
+		for _, h := range hits {
+			res = append(res, h.MessageID)
+		}
+		return res
+	}
+
+	hits := ix.Search(Query{Text: "релиз пятница "})
+	if !slices.Equal(ids(hits), []int64{2, 1}) {
+		t.Fatalf("stemmed search: %v", ids(hits))
+	}
+	if h := hits[0]; h.Snippet != "Отложим релиз до Пятницы?" ||
+		!slices.Equal(h.Highlights, []Range{{Offset: 8, Length: 5}, {Offset: 17, Length: 7}}) {
+		t.Fatalf("snippet: %+v", h)
+	}
+	if got := ids(ix.Search(Query{Text: "мол"})); !slices.Equal(got, []int64{3}) {
+		t.Fatalf("prefix of the last word: %v", got)
+	}
+	if got := ids(ix.Search(Query{Text: "мол "})); len(got) != 0 {
+		t.Fatalf("a finished word is not a prefix: %v", got)
+	}
+	if got := ids(ix.Search(Query{Text: "релиз", SenderID: &alice})); !slices.Equal(got, []int64{1}) {
+		t.Fatalf("sender filter: %v", got)
+	}
+	if got := ids(ix.Search(Query{Text: "купи", DialogID: &team})); len(got) != 0 {
+		t.Fatalf("dialog filter: %v", got)
+	}
+	if got := ids(ix.Search(Query{Text: "релиз", From: day.Add(time.Minute)})); !slices.Equal(got, []int64{2}) {
+		t.Fatalf("date filter: %v", got)
+	}
+	if got := ids(ix.Search(Query{Text: "релиз", Limit: 1})); !slices.Equal(got, []int64{2}) {
+		t.Fatalf("limit: %v", got)
+	}
+	if got := ids(ix.Search(Query{Text: "релиз", Before: 2})); !slices.Equal(got, []int64{1}) {
+		t.Fatalf("next page: %v", got)
+	}
+
+	v := ix.Version()
+	ix.Add(Document{DialogID: team, MessageID: 2, SenderID: bob, SentAt: day.Add(time.Hour), Text: "Отложим до понедельника"})
+	if got := ids(ix.Search(Query{Text: "релиз"})); !slices.Equal(got, []int64{1}) || ix.Version() == v {
+		t.Fatalf("edit: %v", got)
+	}
+	ix.Remove(1)
+	ix.RemoveDialog(family)
+	if ix.Len() != 1 || len(ix.Search(Query{Text: "релиз"})) != 0 || len(ix.Search(Query{Text: "молоко"})) != 0 {
+		t.Fatalf("removal left %d documents", ix.Len())
+	}
+}
+
+func TestSnippetWindow(t *testing.T) {
+	ix := New()
+	long := string(bytes.Repeat([]byte("слово "), 60)) + "находка " + string(bytes.Repeat([]byte("текст "), 60))
+	ix.Add(Document{MessageID: 1, Text: long})
+	hits := ix.Search(Query{Text: "находка"})
+	if len(hits) != 1 {
+		t.Fatalf("hits: %+v", hits)
+	}
+	s := []rune(hits[0].Snippet)
+	h := hits[0].Highlights
+	if len(s) != snippetLength+2 || len(h) != 1 || string(s[h[0].Offset:h[0].Offset+h[0].Length]) != "находка" {
+		t.Fatalf("snippet %q, highlights %+v", hits[0].Snippet, h)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	ix := New()
+	ix.Add(Document{DialogID: uuid.New(), MessageID: 5, SenderID: uuid.New(), SentAt: time.Now().UTC(), Text: "секретная встреча"})
+
+	var buf bytes.Buffer
+	if err := ix.Save(&buf, key); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("встреча")) {
+		t.Fatal("index stored in the clear")
+	}
+	loaded, err := Load(bytes.NewReader(buf.Bytes()), key)
+	if err != nil || loaded.Len() != 1 || len(loaded.Search(Query{Text: "встречи"})) != 1 {
+		t.Fatalf("load: %v", err)
+	}
+
+	if _, err := Load(bytes.NewReader(buf.Bytes()), bytes.Repeat([]byte{8}, 32)); err != ErrCorrupted {
+		t.Fatalf("wrong key, got %v", err)
+	}
+	if err := ix.Save(&buf, []byte("short")); err != ErrInvalidKey {
+		t.Fatalf("short key, got %v", err)
+	}
+}
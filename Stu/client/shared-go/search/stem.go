@@ -0,0 +1,150 @@
+package search
+
+// Stem reduces a lowercased Russian word to its stem following the Snowball
+// Russian algorithm. Words are expected to be normalized (ё → е).
+func Stem(word string) string {
+	w := []rune(word)
+	rv, r2 := regions(w)
+	if rv >= len(w) {
+		return word
+	}
+
+	// Step 1.
+	if n := matchGrouped(w, rv, perfectiveGerund1, perfectiveGerund2); n > 0 {
+		w = w[:len(w)-n]
+	} else {
+		if n := matchSuffix(w, rv, reflexive); n > 0 {
+			w = w[:len(w)-n]
+		}
+		if n := matchAdjectival(w, rv); n > 0 {
+			w = w[:len(w)-n]
+		} else if n := matchGrouped(w, rv, verb1, verb2); n > 0 {
+			w = w[:len(w)-n]
+		} else if n := matchSuffix(w, rv, noun); n > 0 {
+			w = w[:len(w)-n]
+		}
+	}
+
+	// Step 2.
+	if hasSuffixIn(w, rv, "и") {
+		w = w[:len(w)-1]
+	}
+
+	// Step 3.
+	if n := matchSuffix(w, r2, derivational); n > 0 {
+		w = w[:len(w)-n]
+	}
+
+	// Step 4.
+	switch {
+	case hasSuffixIn(w, rv, "нн"):
+		w = w[:len(w)-1]
+	case hasSuffixIn(w, rv, "ь"):
+		w = w[:len(w)-1]
+	default:
+		if n := matchSuffix(w, rv, superlative); n > 0 {
+			w = w[:len(w)-n]
+			if hasSuffixIn(w, rv, "нн") {
+				w = w[:len(w)-1]
+			}
+		}
+	}
+	return string(w)
+}
+
+var (
+	perfectiveGerund1 = []string{"в", "вши", "вшись"}
+	perfectiveGerund2 = []string{"ив", "ивши", "ившись", "ыв", "ывши", "ывшись"}
+	adjective         = []string{"ее", "ие", "ые", "ое", "ими", "ыми", "ей", "ий", "ый", "ой", "ем", "им", "ым", "ом",
+		"его", "ого", "ему", "ому", "их", "ых", "ую", "юю", "ая", "яя", "ою", "ею"}
+	participle1 = []string{"ем", "нн", "вш", "ющ", "щ"}
+	participle2 = []string{"ивш", "ывш", "ующ"}
+	reflexive   = []string{"ся", "сь"}
+	verb1       = []string{"ла", "на", "ете", "йте", "ли", "й", "л", "ем", "н", "ло", "но", "ет", "ют", "ны", "ть", "ешь", "нно"}
+	verb2       = []string{"ила", "ыла", "ена", "ейте", "уйте", "ите", "или", "ыли", "ей", "уй", "ил", "ыл", "им", "ым", "ен",
+		"ило", "ыло", "ено", "ят", "ует", "уют", "ит", "ыт", "ены", "ить", "ыть", "ишь", "ую", "ю"}
+	noun = []string{"а", "ев", "ов", "ие", "ье", "е", "иями", "ями", "ами", "еи", "ии", "и", "ией", "ей", "ой", "ий", "й",
+		"иям", "ям", "ием", "ем", "ам", "ом", "о", "у", "ах", "иях", "ях", "ы", "ь", "ию", "ью", "ю", "ия", "ья", "я"}
+	superlative  = []string{"ейш", "ейше"}
+	derivational = []string{"ост", "ость"}
+)
+
+func isVowel(r rune) bool {
+	switch r {
+	case 'а', 'е', 'и', 'о', 'у', 'ы', 'э', 'ю', 'я':
+		return true
+	}
+	return false
+}
+
+// regions returns the start of RV (after the first vowel) and of R2.
+func regions(w []rune) (rv, r2 int) {
+	rv = len(w)
+	for i, r := range w {
+		if isVowel(r) {
+			rv = i + 1
+			break
+		}
+	}
+	r1 := afterVowelConsonant(w, 0)
+	return rv, afterVowelConsonant(w, r1)
+}
+
+// afterVowelConsonant returns the position after the first non-vowel that
+// follows a vowel at or after from.
+func afterVowelConsonant(w []rune, from int) int {
+	for i := from + 1; i < len(w); i++ {
+		if !isVowel(w[i]) && isVowel(w[i-1]) {
+			return i + 1
+		}
+	}
+	return len(w)
+}
+
+func hasSuffixIn(w []rune, region int, suffix string) bool {
+	s := []rune(suffix)
+	start := len(w) - len(s)
+	if start < region {
+		return false
+	}
+	for i, r := range s {
+		if w[start+i] != r {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSuffix returns the length of the longest suffix lying in the region.
+func matchSuffix(w []rune, region int, suffixes []string) int {
+	best := 0
+	for _, s := range suffixes {
+		if n := len([]rune(s)); n > best && hasSuffixIn(w, region, s) {
+			best = n
+		}
+	}
+	return best
+}
+
+// matchGrouped matches the longest suffix of both groups; a group 1 suffix
+// only counts when preceded by а or я, which stays in the word.
+func matchGrouped(w []rune, region int, group1, group2 []string) int {
+	n1, n2 := matchSuffix(w, region, group1), matchSuffix(w, region, group2)
+	if n2 >= n1 {
+		return n2
+	}
+	if i := len(w) - n1 - 1; i >= region && (w[i] == 'а' || w[i] == 'я') {
+		return n1
+	}
+	return 0
+}
+
+// matchAdjectival matches an adjective ending optionally preceded by a
+// participle suffix.
+func matchAdjectival(w []rune, region int) int {
+	n := matchSuffix(w, region, adjective)
+	if n == 0 {
+		return 0
+	}
+	return n + matchGrouped(w[:len(w)-n], region, participle1, participle2)
+}
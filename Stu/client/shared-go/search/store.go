@@ -0,0 +1,84 @@
+package search
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// storeHeader starts every saved index and is authenticated with it. Only
+// documents are stored; postings are rebuilt on Load, so a stemmer change
+// does not need a format change.
+const storeHeader = "STUIDX\x01"
+
+var (
+	ErrInvalidKey = errors.New("search: index key must be 32 bytes")
+	// ErrCorrupted means the data is not a saved index or the key is wrong.
+	ErrCorrupted = errors.New("search: index is corrupted or the key is wrong")
+)
+
+// Save writes the index encrypted with key (XChaCha20-Poly1305). The key
+// stays on the device, e.g. in the platform keystore, so the decrypted
+// history never reaches disk in the clear.
+func (ix *Index) Save(w io.Writer, key []byte) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return ErrInvalidKey
+	}
+	ix.mu.RLock()
+	docs := make([]Document, 0, len(ix.docs))
+	for _, doc := range ix.docs {
+		docs = append(docs, doc)
+	}
+	ix.mu.RUnlock()
+
+	var plain bytes.Buffer
+	if err := gob.NewEncoder(&plain).Encode(docs); err != nil {
+		return fmt.Errorf("search: encode index: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+plain.Len()+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, plain.Bytes(), []byte(storeHeader))
+	if _, err := io.WriteString(w, storeHeader); err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// Load reads an index written by Save with the same key.
+func Load(r io.Reader, key []byte) (*Index, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(storeHeader)+aead.NonceSize() || string(data[:len(storeHeader)]) != storeHeader {
+		return nil, ErrCorrupted
+	}
+	data = data[len(storeHeader):]
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(storeHeader))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	var docs []Document
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(&docs); err != nil {
+		return nil, ErrCorrupted
+	}
+	ix := New()
+	for _, doc := range docs {
+		ix.Add(doc)
+	}
+	ix.version = 0
+	return ix, nil
+}
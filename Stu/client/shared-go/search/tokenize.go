@@ -0,0 +1,71 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// token is a word of a text: its normalized form, index term and position
+// in runes.
+type token struct {
+	word   string
+	term   string
+	offset int
+	length int
+}
+
+// stopWords are not indexed and ignored in queries.
+var stopWords = map[string]struct{}{
+	"и": {}, "в": {}, "во": {}, "не": {}, "что": {}, "он": {}, "на": {}, "я": {}, "с": {}, "со": {}, "как": {},
+	"а": {}, "то": {}, "все": {}, "она": {}, "так": {}, "его": {}, "но": {}, "да": {}, "ты": {}, "к": {}, "у": {},
+	"же": {}, "вы": {}, "за": {}, "бы": {}, "по": {}, "ее": {}, "мне": {}, "есть": {}, "от": {}, "из": {}, "о": {},
+	"ли": {}, "или": {}, "ни": {}, "до": {}, "это": {}, "для": {}, "мы": {}, "их": {},
+	"a": {}, "an": {}, "the": {}, "and": {}, "or": {}, "of": {}, "to": {}, "in": {}, "on": {}, "is": {},
+	"are": {}, "be": {}, "it": {}, "for": {}, "at": {},
+}
+
+// tokenize splits text into words of letters and digits, lowercased with ё
+// folded into е. Cyrillic words are indexed by their stem, others as is.
+func tokenize(text string) []token {
+	var (
+		res   []token
+		word  []rune
+		start int
+		pos   int
+	)
+	flush := func() {
+		if len(word) == 0 {
+			return
+		}
+		w := string(word)
+		if _, stop := stopWords[w]; !stop {
+			term := w
+			if isCyrillic(word) {
+				term = Stem(w)
+			}
+			res = append(res, token{word: w, term: term, offset: start, length: len(word)})
+		}
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if len(word) == 0 {
+				start = pos
+			}
+			r = unicode.ToLower(r)
+			if r == 'ё' {
+				r = 'е'
+			}
+			word = append(word, r)
+		} else {
+			flush()
+		}
+		pos++
+	}
+	flush()
+	return res
+}
+
+func isCyrillic(word []rune) bool {
+	return strings.IndexFunc(string(word), func(r rune) bool { return unicode.Is(unicode.Cyrillic, r) }) >= 0
+}
@@ -9,6 +9,8 @@
     dialogs: [],
     messages: {}, // dialogId -> [{...}]
     meta: {}, // messageId -> {delivered, read}
+    drafts: {}, // dialogId -> {text, updated_at}
+    threads: {}, // rootId -> [replies], for open threads
     currentDialog: null,
     ws: null,
     wsConnected: false,
@@ -103,6 +105,7 @@
     userBadge.textContent = `ID: ${state.userId}`;
     btnLogout.classList.remove('hidden');
     loadDialogs();
+    loadDrafts();
     connectWs();
   }
 
@@ -179,6 +182,25 @@
   };
 
   // Dialogs
+  // catchUp pulls updates missed while offline; the first call only records the position.
+  async function catchUp() {
+    if (state.pts == null) {
+      state.pts = (await apiFetch('/v1/sync/state')).pts;
+      return;
+    }
+    let changed = false;
+    for (;;) {
+      const diff = await apiFetch(`/v1/sync?since=${state.pts}`);
+      state.pts = diff.state.pts;
+      (diff.drafts || []).forEach(applyDraft);
+      if (diff.too_long || diff.updates.length) changed = true;
+      if (diff.too_long || !diff.has_more) break;
+    }
+    if (!changed) return;
+    await loadDialogs();
+    if (state.currentDialog) openDialog(state.currentDialog, chatTitleEl.textContent);
+  }
+
   async function loadDialogs() {
     sidebarStatusEl.textContent = 'Загрузка...';
     try {
@@ -194,24 +216,179 @@
     }
   }
 
+  // Drafts are stored on the server and follow the user across devices; the
+  // latest updated_at wins. The web client has no E2EE yet, so the blob is
+  // plain UTF-8.
+  function encodeDraft(text) {
+    return btoa(String.fromCharCode(...new TextEncoder().encode(text)));
+  }
+
+  function decodeDraft(blob) {
+    if (!blob) return '';
+    return new TextDecoder().decode(Uint8Array.from(atob(blob), (c) => c.charCodeAt(0)));
+  }
+
+  function applyDraft(d) {
+    const cur = state.drafts[d.dialog_id];
+    if (cur && Date.parse(cur.updated_at) >= Date.parse(d.updated_at)) return;
+    state.drafts[d.dialog_id] = { text: decodeDraft(d.blob), updated_at: d.updated_at };
+    if (state.currentDialog === d.dialog_id) el('messageInput').value = state.drafts[d.dialog_id].text;
+  }
+
+  async function loadDrafts() {
+    try {
+      (await apiFetch('/v1/drafts')).forEach(applyDraft);
+    } catch (_) {}
+  }
+
+  let draftTimer = null;
+  async function saveDraft(dialogId, text) {
+    clearTimeout(draftTimer);
+    const cur = state.drafts[dialogId];
+    if ((cur ? cur.text : '') === text) return;
+    const updatedAt = new Date().toISOString();
+    state.drafts[dialogId] = { text, updated_at: updatedAt };
+    try {
+      const stored = await apiFetch(`/v1/dialogs/${dialogId}/draft`, {
+        method: 'PUT',
+        body: JSON.stringify({ blob: encodeDraft(text), updated_at: updatedAt }),
+      });
+      state.drafts[dialogId] = { text: decodeDraft(stored.blob), updated_at: stored.updated_at };
+    } catch (_) {}
+  }
+
+  el('messageInput').addEventListener('input', () => {
+    const dialogId = state.currentDialog;
+    if (!dialogId) return;
+    clearTimeout(draftTimer);
+    draftTimer = setTimeout(() => saveDraft(dialogId, el('messageInput').value), 1000);
+  });
+
+  const systemLabels = {
+    'group.created': 'Группа создана',
+    'group.title_changed': 'Название группы изменено',
+    'channel.created': 'Канал создан',
+    'channel.title_changed': 'Название канала изменено',
+    'member.added': 'Участник добавлен',
+    'member.removed': 'Участник удалён',
+    'member.joined': 'Участник вступил по ссылке',
+    'member.left': 'Участник вышел',
+    'member.role_changed': 'Роль участника изменена',
+    'message.pinned': 'Сообщение закреплено',
+    'dialog.ttl_changed': 'Таймер исчезающих сообщений изменён',
+  };
+
+  function systemText(m) {
+    try {
+      const payload = JSON.parse(m.text);
+      return systemLabels[payload.type] || payload.type;
+    } catch (e) {
+      return m.text;
+    }
+  }
+
+  function dialogTitle(d) {
+    if (d.kind === 'saved') return 'Избранное';
+    return d.title || 'Диалог';
+  }
+
   function renderDialogs() {
     dialogListEl.innerHTML = '';
     state.dialogs.forEach((d) => {
       const item = document.createElement('div');
       item.className = 'dialog' + (state.currentDialog === d.id ? ' active' : '');
-      item.onclick = () => openDialog(d.id, d.title || 'Диалог');
-      const preview = d.last_message ? d.last_message.text : 'Нет сообщений';
+      item.onclick = () => openDialog(d.id, dialogTitle(d));
+      const preview = d.last_message
+        ? escapeHtml(d.last_message.kind === 'system' ? systemText(d.last_message) : d.last_message.text)
+        : 'Нет сообщений';
       const time = d.last_message ? new Date(d.last_message.created_at).toLocaleTimeString() : '';
       item.innerHTML = `
-        <div class="title">${d.title || 'Без имени'}</div>
+        <div class="title">${d.pinned ? '📌 ' : ''}${dialogTitle(d)}${d.muted_until ? ' 🔕' : ''}${d.unread_mentions ? ` <button class="ghost small mention-badge">@ ${d.unread_mentions}</button>` : ''}</div>
         <div class="preview"><span>${preview}</span><span>${time}</span></div>
       `;
+      const mentionBadge = item.querySelector('.mention-badge');
+      if (mentionBadge) {
+        mentionBadge.onclick = (e) => {
+          e.stopPropagation();
+          jumpToMention(d);
+        };
+      }
       dialogListEl.appendChild(item);
     });
   }
 
+  // jumpToMention opens the dialog at its oldest unread mention; reading up to
+  // it marks it read, so the next jump goes further.
+  async function jumpToMention(d) {
+    try {
+      const m = await apiFetch(`/v1/dialogs/${d.id}/mentions/next`);
+      await openDialog(d.id, dialogTitle(d));
+      const root = m.thread_root_id ? (state.messages[d.id] || []).find((x) => x.id === m.thread_root_id) : null;
+      if (root && !state.threads[root.id]) await toggleThread(root);
+      const target = messagesEl.querySelector(`[data-id="${m.thread_root_id || m.id}"]`);
+      if (target) target.scrollIntoView({ block: 'center' });
+      else showToast('Упоминание в более ранней истории');
+      await loadDialogs();
+    } catch (e) {
+      showToast(e.message, true);
+    }
+  }
+
+  // Search covers unencrypted dialogs only; highlights are rune ranges of the
+  // snippet, so the text is escaped piece by piece.
+  function highlightSnippet(hit) {
+    const chars = Array.from(hit.snippet);
+    let html = '';
+    let pos = 0;
+    hit.highlights.forEach((h) => {
+      html += escapeHtml(chars.slice(pos, h.offset).join(''));
+      html += `<mark>${escapeHtml(chars.slice(h.offset, h.offset + h.length).join(''))}</mark>`;
+      pos = h.offset + h.length;
+    });
+    return html + escapeHtml(chars.slice(pos).join(''));
+  }
+
+  async function searchMessages(text) {
+    const resultsEl = el('searchResults');
+    if (!text) {
+      resultsEl.classList.add('hidden');
+      return;
+    }
+    try {
+      const hits = await apiFetch(`/v1/search/messages?q=${encodeURIComponent(text)}`);
+      resultsEl.innerHTML = hits.length ? '' : '<div class="muted">Ничего не найдено</div>';
+      hits.forEach((hit) => {
+        const d = state.dialogs.find((x) => x.id === hit.dialog_id);
+        const item = document.createElement('div');
+        item.className = 'dialog';
+        item.innerHTML = `
+          <div class="title">${escapeHtml(d ? dialogTitle(d) : 'Диалог')}</div>
+          <div class="preview"><span>${highlightSnippet(hit)}</span><span>${new Date(hit.created_at).toLocaleDateString()}</span></div>
+        `;
+        item.onclick = async () => {
+          await openDialog(hit.dialog_id, d ? dialogTitle(d) : 'Диалог');
+          const target = messagesEl.querySelector(`[data-id="${hit.thread_root_id || hit.message_id}"]`);
+          if (target) target.scrollIntoView({ block: 'center' });
+          else showToast('Сообщение в более ранней истории');
+        };
+        resultsEl.appendChild(item);
+      });
+      resultsEl.classList.remove('hidden');
+    } catch (e) {
+      showToast(e.message, true);
+    }
+  }
+
+  let searchTimer = null;
+  el('searchInput').addEventListener('input', () => {
+    clearTimeout(searchTimer);
+    searchTimer = setTimeout(() => searchMessages(el('searchInput').value.trim()), 400);
+  });
+
   // Messages
   async function openDialog(id, title) {
+    if (state.currentDialog && state.currentDialog !== id) saveDraft(state.currentDialog, el('messageInput').value);
+    if (state.currentDialog !== id) el('messageInput').value = (state.drafts[id] || {}).text || '';
     state.currentDialog = id;
     chatTitleEl.textContent = title;
     chatStatusEl.textContent = 'Загрузка...';
@@ -241,9 +418,19 @@
     const msgs = state.messages[state.currentDialog] || [];
     messagesEl.innerHTML = '';
     msgs.forEach((m) => {
+      // votes of encrypted polls are tallied by clients, not shown
+      if (m.kind === 'poll_vote') return;
+      if (m.kind === 'system') {
+        const note = document.createElement('div');
+        note.className = 'system-note';
+        note.textContent = systemText(m);
+        messagesEl.appendChild(note);
+        return;
+      }
       const bubble = document.createElement('div');
       const mine = m.sender_id === state.userId;
       bubble.className = 'bubble' + (mine ? ' me' : '');
+      bubble.dataset.id = m.id;
       const meta = state.meta[m.id] || {};
       let ticks = '';
       if (mine) {
@@ -251,13 +438,37 @@
         else if (meta.pending) ticks = `<span class="tick">…</span>`;
         else ticks = `<span class="tick ${meta.read ? 'read' : ''}">${meta.read ? '✓✓' : meta.delivered ? '✓' : '·'}</span>`;
       }
+      const quoted = m.reply_to
+        ? `<div class="reply-preview">${escapeHtml(m.reply_to.deleted ? 'Сообщение удалено' : (m.reply_to.quote || m.reply_to.text))}</div>`
+        : '';
+      const forwarded = m.forwarded_from
+        ? `<div class="forwarded">Переслано от ${escapeHtml(m.forwarded_from.name || 'пользователя')}</div>`
+        : '';
+      const body = m.deleted
+        ? '<div class="deleted">Сообщение удалено</div>'
+        : `${forwarded}${quoted}<div>${renderText(m)}</div>`;
+      const poll = m.poll && !m.deleted ? renderPoll(m) : '';
+      const thread = renderThread(m);
+      const reactions = (m.reactions || [])
+        .map((r) => `<span class="reaction${r.mine ? ' mine' : ''}">${escapeHtml(r.reaction)} ${r.count}</span>`)
+        .join('');
       bubble.innerHTML = `
-        <div>${escapeHtml(m.text)}</div>
+        ${body}
+        ${poll}
+        ${reactions ? `<div class="reactions">${reactions}</div>` : ''}
+        ${thread}
         <div class="meta">
-          <span>${new Date(m.created_at).toLocaleTimeString()}</span>
+          <span>${new Date(m.created_at).toLocaleTimeString()}${m.edited_at && !m.deleted ? ' · изм.' : ''}${m.pinned ? ' · 📌' : ''}${m.expires_at ? ' · ⏱' : ''}</span>
           ${ticks}
         </div>
       `;
+      bubble.querySelectorAll('.poll-option').forEach((btn) => {
+        btn.onclick = () => vote(m, Number(btn.dataset.option));
+      });
+      const threadLink = bubble.querySelector('.thread-link');
+      if (threadLink) threadLink.onclick = () => toggleThread(m);
+      const threadReply = bubble.querySelector('.thread-reply');
+      if (threadReply) threadReply.onclick = () => replyInThread(m);
       if (meta.failed) {
         const retry = document.createElement('button');
         retry.textContent = 'Повторить';
@@ -269,6 +480,140 @@
     });
   }
 
+  // renderText escapes the text and highlights its mentions; entity offsets
+  // count code points.
+  function renderText(m) {
+    const chars = Array.from(m.text || '');
+    let out = '';
+    let pos = 0;
+    (m.mentions || [])
+      .slice()
+      .sort((a, b) => a.offset - b.offset)
+      .forEach((e) => {
+        if (e.offset < pos) return;
+        out += escapeHtml(chars.slice(pos, e.offset).join(''));
+        const me = e.all || e.user_id === state.userId;
+        out += `<span class="mention${me ? ' me' : ''}">${escapeHtml(chars.slice(e.offset, e.offset + e.length).join(''))}</span>`;
+        pos = e.offset + e.length;
+      });
+    return out + escapeHtml(chars.slice(pos).join(''));
+  }
+
+  // renderThread shows the thread summary of a root message of a group or
+  // channel and, once opened, its replies.
+  function renderThread(m) {
+    const dialog = state.dialogs.find((d) => d.id === m.dialog_id);
+    if (m.deleted || m.kind === 'system' || !dialog || (dialog.kind !== 'group' && dialog.kind !== 'channel')) return '';
+    const t = m.thread;
+    const label = t
+      ? `💬 ${t.reply_count}${t.unread_count ? ` · новых: ${t.unread_count}` : ''}`
+      : (dialog.kind === 'channel' ? '💬 Комментировать' : '💬 Ответить в треде');
+    const replies = state.threads[m.id];
+    if (!replies) return `<div class="thread"><button class="ghost small thread-link">${label}</button></div>`;
+    const items = replies
+      .map((r) => `<div class="thread-item${r.sender_id === state.userId ? ' me' : ''}">${r.deleted ? '<span class="deleted">Сообщение удалено</span>' : renderText(r)}</div>`)
+      .join('');
+    return `<div class="thread open"><button class="ghost small thread-link">${label}</button>${items}
+      <button class="ghost small thread-reply">Ответить</button></div>`;
+  }
+
+  async function toggleThread(m) {
+    if (state.threads[m.id]) {
+      delete state.threads[m.id];
+      renderMessages();
+      return;
+    }
+    try {
+      const replies = await apiFetch(`/v1/dialogs/${m.dialog_id}/messages/${m.id}/thread?limit=100`);
+      state.threads[m.id] = (replies || []).reverse();
+      renderMessages();
+      await markThreadRead(m);
+    } catch (e) {
+      showToast(e.message, true);
+    }
+  }
+
+  async function markThreadRead(m) {
+    if (!m.thread || !m.thread.last_reply_id || m.thread.last_read_id >= m.thread.last_reply_id) return;
+    const upTo = m.thread.last_reply_id;
+    await apiFetch(`/v1/dialogs/${m.dialog_id}/messages/${m.id}/thread/read`, {
+      method: 'POST',
+      body: JSON.stringify({ message_id: upTo }),
+    });
+    m.thread = { ...m.thread, last_read_id: upTo, unread_count: 0 };
+    renderMessages();
+  }
+
+  async function replyInThread(m) {
+    const text = (window.prompt('Ответ в треде') || '').trim();
+    if (!text) return;
+    try {
+      const reply = await apiFetch(`/v1/dialogs/${m.dialog_id}/messages`, {
+        method: 'POST',
+        body: JSON.stringify({ text, thread_root_id: m.id, client_message_id: newClientMessageId() }),
+      });
+      addThreadReply(reply);
+    } catch (e) {
+      showToast(e.message, true);
+    }
+  }
+
+  // addThreadReply puts a reply into its open thread and updates the root's summary.
+  function addThreadReply(reply) {
+    const root = (state.messages[reply.dialog_id] || []).find((m) => m.id === reply.thread_root_id);
+    const replies = state.threads[reply.thread_root_id];
+    if (replies) {
+      if (replies.some((r) => r.id === reply.id)) return;
+      replies.push(reply);
+    }
+    if (root) {
+      const t = root.thread || { reply_count: 0, recent_repliers: [], last_read_id: 0, unread_count: 0 };
+      const mine = reply.sender_id === state.userId;
+      root.thread = {
+        ...t,
+        reply_count: t.reply_count + 1,
+        last_reply_id: reply.id,
+        recent_repliers: [reply.sender_id, ...t.recent_repliers.filter((id) => id !== reply.sender_id)].slice(0, 3),
+        unread_count: t.unread_count + (mine || replies ? 0 : 1),
+        last_read_id: mine || replies ? reply.id : t.last_read_id,
+      };
+      if (replies && !mine) markThreadRead(root).catch(() => {});
+    }
+    if (state.currentDialog === reply.dialog_id) renderMessages();
+  }
+
+  function renderPoll(m) {
+    const p = m.poll;
+    const options = p.options
+      .map((o) => {
+        const share = p.voters ? Math.round((o.votes * 100) / p.voters) : 0;
+        return `<button class="ghost small poll-option${o.chosen ? ' mine' : ''}" data-option="${o.id}" ${p.closed ? 'disabled' : ''}>
+          ${o.chosen ? '✓ ' : ''}${escapeHtml(o.text)} · ${o.votes} (${share}%)</button>`;
+      })
+      .join('');
+    const mode = [p.anonymous ? 'анонимный' : 'открытый', p.multiple ? 'несколько ответов' : '', p.closed ? 'завершён' : '']
+      .filter(Boolean)
+      .join(', ');
+    return `<div class="poll">${options}<div class="meta">${mode} · голосов: ${p.voters}</div></div>`;
+  }
+
+  // vote toggles the option: a chosen one is withdrawn, in a single-choice
+  // poll another one replaces the vote.
+  async function vote(m, option) {
+    const chosen = m.poll.options.filter((o) => o.chosen).map((o) => o.id);
+    let next;
+    if (chosen.includes(option)) next = chosen.filter((id) => id !== option);
+    else next = m.poll.multiple ? [...chosen, option] : [option];
+    try {
+      m.poll = await apiFetch(`/v1/dialogs/${m.dialog_id}/messages/${m.id}/vote`, next.length
+        ? { method: 'POST', body: JSON.stringify({ options: next }) }
+        : { method: 'DELETE' });
+      renderMessages();
+    } catch (e) {
+      showToast(e.message, true);
+    }
+  }
+
   function scrollMessagesBottom() {
     messagesEl.scrollTop = messagesEl.scrollHeight;
   }
@@ -281,11 +626,19 @@
     }
   });
 
+  function newClientMessageId() {
+    if (window.crypto && crypto.randomUUID) return crypto.randomUUID();
+    return `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}`;
+  }
+
   async function sendMessage() {
     if (!state.currentDialog) return;
     const text = el('messageInput').value.trim();
     if (!text) return;
     el('messageInput').value = '';
+    // the server clears the draft when the message is stored
+    clearTimeout(draftTimer);
+    state.drafts[state.currentDialog] = { text: '', updated_at: new Date().toISOString() };
     const tempId = Date.now();
     const pendingMsg = {
       id: tempId,
@@ -293,6 +646,8 @@
       dialog_id: state.currentDialog,
       text,
       created_at: new Date().toISOString(),
+      // reused on retry so the server stores the message once
+      client_message_id: newClientMessageId(),
     };
     state.messages[state.currentDialog] = state.messages[state.currentDialog] || [];
     state.messages[state.currentDialog].push(pendingMsg);
@@ -310,9 +665,12 @@
     try {
       const sent = await apiFetch(`/v1/dialogs/${msg.dialog_id}/messages`, {
         method: 'POST',
-        body: JSON.stringify({ text: msg.text }),
+        body: JSON.stringify({ text: msg.text, client_message_id: msg.client_message_id }),
       });
-      state.messages[msg.dialog_id] = state.messages[msg.dialog_id].map((m) => (m.id === msg.id ? sent : m));
+      // in saved messages the echo of message.new may arrive before the response
+      state.messages[msg.dialog_id] = state.messages[msg.dialog_id]
+        .filter((m) => m.id !== sent.id)
+        .map((m) => (m.id === msg.id ? sent : m));
       state.meta[sent.id] = { delivered: sent.delivered_by_peer, read: sent.read_by_peer };
       delete state.meta[msg.id];
       renderMessages();
@@ -328,15 +686,10 @@
     const msgs = state.messages[state.currentDialog] || [];
     const others = msgs.filter((m) => m.sender_id !== state.userId);
     if (!others.length) return;
+    // read is a watermark: marking the newest message covers everything before it
+    const last = others[others.length - 1];
     try {
-      await Promise.all(
-        others.map((m) =>
-          apiFetch(`/v1/dialogs/${state.currentDialog}/messages/${m.id}/delivered`, { method: 'POST' })
-        )
-      );
-      await Promise.all(
-        others.map((m) => apiFetch(`/v1/dialogs/${state.currentDialog}/messages/${m.id}/read`, { method: 'POST' }))
-      );
+      await apiFetch(`/v1/dialogs/${state.currentDialog}/messages/${last.id}/read`, { method: 'POST' });
       others.forEach((m) => {
         state.meta[m.id] = { ...(state.meta[m.id] || {}), delivered: true, read: true };
       });
@@ -348,14 +701,24 @@
 
   // New dialog form
   el('btnNewDialog').onclick = () => newDialogForm.classList.toggle('hidden');
+  el('btnSaved').onclick = async () => {
+    try {
+      const res = await apiFetch('/v1/dialogs/saved');
+      await loadDialogs();
+      openDialog(res.dialog_id, 'Избранное');
+    } catch (e) {
+      showToast(e.message, true);
+    }
+  };
   el('cancelDialog').onclick = () => newDialogForm.classList.add('hidden');
   el('createDialogSubmit').onclick = async () => {
-    const email = el('newDialogEmail').value.trim();
-    if (!email) return;
+    const target = el('newDialogEmail').value.trim();
+    if (!target) return;
+    const body = target.includes('@') && !target.startsWith('@') ? { email: target } : { username: target };
     try {
       const res = await apiFetch('/v1/dialogs', {
         method: 'POST',
-        body: JSON.stringify({ email }),
+        body: JSON.stringify(body),
       });
       newDialogForm.classList.add('hidden');
       el('newDialogEmail').value = '';
@@ -387,6 +750,7 @@
       wsBackoff = 500;
       wsStatusEl.classList.add('ok');
       wsStatusEl.title = 'Онлайн';
+      catchUp().catch(() => {});
     };
     ws.onclose = async () => {
       state.wsConnected = false;
@@ -408,13 +772,26 @@
     if (evt.type === 'message.new') {
       const d = evt.dialog_id;
       state.messages[d] = state.messages[d] || [];
+      // saved messages echo notes back to the device that sent them
+      if (state.messages[d].some((m) => m.id === evt.message_id)) return;
       const msgObj = {
         id: evt.message_id,
         dialog_id: d,
         sender_id: evt.sender_id,
+        kind: evt.kind,
         text: evt.text,
+        poll: evt.poll,
         created_at: evt.created_at,
+        reply_to: evt.reply_to,
+        forwarded_from: evt.forwarded_from,
+        thread_root_id: evt.thread_root_id,
+        mentions: evt.mentions,
       };
+      // thread replies stay out of the main timeline
+      if (msgObj.thread_root_id) {
+        addThreadReply(msgObj);
+        return;
+      }
       state.messages[d].push(msgObj);
       state.meta[evt.message_id] = { delivered: false, read: false };
       if (state.currentDialog === d) {
@@ -424,11 +801,69 @@
       }
       loadDialogs();
     }
+    if (
+      evt.type === 'message.edited' ||
+      evt.type === 'message.deleted' ||
+      evt.type === 'message.hidden' ||
+      evt.type === 'message.expired'
+    ) {
+      const d = evt.dialog_id;
+      const list = state.messages[d] || [];
+      const idx = list.findIndex((m) => m.id === evt.message_id);
+      if (idx >= 0) {
+        if (evt.type === 'message.hidden' || evt.type === 'message.expired') list.splice(idx, 1);
+        else if (evt.type === 'message.deleted') list[idx] = { ...list[idx], text: '', deleted: true, pinned: false };
+        else list[idx] = { ...list[idx], text: evt.text, edited_at: evt.edited_at, mentions: evt.mentions };
+        if (state.currentDialog === d) renderMessages();
+      }
+      loadDialogs();
+    }
+    if (evt.type === 'message.pinned' || evt.type === 'message.unpinned') {
+      const msg = (state.messages[evt.dialog_id] || []).find((m) => m.id === evt.message_id);
+      if (msg) {
+        msg.pinned = evt.type === 'message.pinned';
+        if (state.currentDialog === evt.dialog_id) renderMessages();
+      }
+    }
+    if (evt.type === 'reaction.updated') {
+      const list = state.messages[evt.dialog_id] || [];
+      const msg = list.find((m) => m.id === evt.message_id);
+      if (msg) {
+        const mine = new Set((msg.reactions || []).filter((r) => r.mine).map((r) => r.reaction));
+        if (evt.actor_id === state.userId) {
+          if (evt.added) mine.add(evt.reaction);
+          else mine.delete(evt.reaction);
+        }
+        msg.reactions = (evt.reactions || []).map((r) => ({ ...r, mine: mine.has(r.reaction) }));
+        if (state.currentDialog === evt.dialog_id) renderMessages();
+      }
+    }
+    if (evt.type === 'poll.updated') {
+      const msg = (state.messages[evt.dialog_id] || []).find((m) => m.id === evt.message_id);
+      if (msg && msg.poll) {
+        // events carry no per-user flags; keep our own choice
+        const chosen = new Set(msg.poll.options.filter((o) => o.chosen).map((o) => o.id));
+        msg.poll = { ...evt.poll, options: evt.poll.options.map((o) => ({ ...o, chosen: chosen.has(o.id) })) };
+        if (state.currentDialog === evt.dialog_id) renderMessages();
+      }
+    }
+    if (evt.type === 'draft.updated') applyDraft(evt);
+    if (evt.type === 'mention.new') {
+      // sent even for muted dialogs unless notify_mentions is off
+      const d = state.dialogs.find((x) => x.id === evt.dialog_id);
+      if (state.currentDialog !== evt.dialog_id) showToast(`Вас упомянули: ${d ? dialogTitle(d) : 'диалог'}`);
+      loadDialogs();
+    }
     if (evt.type === 'message.delivered' || evt.type === 'message.read') {
-      const meta = state.meta[evt.message_id] || {};
-      if (evt.type === 'message.delivered') meta.delivered = true;
-      if (evt.type === 'message.read') { meta.delivered = true; meta.read = true; }
-      state.meta[evt.message_id] = meta;
+      // receipts cover every message up to message_id
+      (state.messages[evt.dialog_id] || [])
+        .filter((m) => m.id <= evt.message_id)
+        .forEach((m) => {
+          const meta = state.meta[m.id] || {};
+          meta.delivered = true;
+          if (evt.type === 'message.read') meta.read = true;
+          state.meta[m.id] = meta;
+        });
       if (state.currentDialog === evt.dialog_id) renderMessages();
     }
   }
@@ -461,6 +896,7 @@
         userBadge.textContent = `ID: ${state.userId || ''}`;
         btnLogout.classList.remove('hidden');
         await loadDialogs();
+        await loadDrafts();
         connectWs();
         return;
       }
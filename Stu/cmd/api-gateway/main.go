@@ -18,14 +18,17 @@ import (
 	"stu/internal/app"
 	"stu/internal/auth"
 	"stu/internal/config"
+	"stu/internal/dataexport"
 	"stu/internal/dialogs"
 	"stu/internal/mailer"
 	"stu/internal/middleware"
 	"stu/internal/observability"
+	"stu/internal/platform/minio"
 	"stu/internal/platform/postgres"
 	rediscfg "stu/internal/platform/redis"
 	"stu/internal/realtime"
 	"stu/internal/reports"
+	"stu/internal/users"
 )
 
 func writeJSON(w http.ResponseWriter, payload any, status int) {
@@ -59,10 +62,6 @@ func main() {
 		RefreshTokenTTL:     time.Hour * 24 * 30,
 		VerificationCodeTTL: time.Minute * 15,
 	})
-	dialogRepo := dialogs.NewRepository(db)
-	dialogService := dialogs.NewService(dialogRepo, authRepo.GetUserByEmail)
-	dialogPublisher := realtime.NewRedisPublisher(rdb)
-	dialogService.SetPublisher(dialogPublisher)
 	wsProxy := realtime.NewGatewayWSProxy("http://realtime:8082/v1/ws", validator, logger)
 	reportsRepo := reports.NewRepository(db)
 	aiClient := reports.NewAgentClient(cfg.ModerationAgentURL, logger)
@@ -70,6 +69,19 @@ func main() {
 	adminUsers := admin.NewUsersRepo(db)
 	adminAuthRepo := adminauth.NewRepository(db)
 	adminAuthSvc := adminauth.NewService(authRepo, adminAuthRepo, authSvc, mail, logger)
+	usersService := users.NewService(users.NewRepository(db))
+	usersService.SetPresence(realtime.NewPresence(rdb))
+	dialogService := app.NewDialogService(dialogs.NewRepository(db), rdb, authRepo, usersService)
+	dialogService.SetMediaStore(minio.New(cfg.MinIO))
+	go dialogService.RunReaper(context.Background(), 5*time.Second, logger)
+	go dialogService.RunScheduler(context.Background(), 5*time.Second, logger)
+	go dialogService.RunUpdatePruner(context.Background(), time.Hour, cfg.Sync.UpdateRetention, logger)
+	exportService := dataexport.NewService(dataexport.NewRepository(db), dataexport.Config{
+		SigningKey:    []byte(cfg.Export.SigningKey),
+		LinkTTL:       cfg.Export.LinkTTL,
+		PublicBaseURL: cfg.PublicBaseURL,
+	}, logger)
+	go exportService.RunWorker(context.Background(), 30*time.Second)
 	authTarget, _ := url.Parse("http://auth:8081")
 	authProxy := httputil.NewSingleHostReverseProxy(authTarget)
 	authProxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
@@ -108,7 +120,32 @@ func main() {
 					"ban_reason": user.BanReason,
 				}, http.StatusOK)
 			})
+			users.RegisterMeHandlers(pr, usersService, logger)
+			pr.Route("/users", func(ur chi.Router) {
+				users.RegisterHandlers(ur, usersService, logger)
+			})
+			pr.Route("/channels", func(cr chi.Router) {
+				dialogs.RegisterChannelHandlers(cr, dialogService, logger)
+			})
+			pr.Route("/invites", func(ir chi.Router) {
+				dialogs.RegisterInviteHandlers(ir, dialogService, logger)
+			})
+			pr.Route("/sync", func(sr chi.Router) {
+				dialogs.RegisterSyncHandlers(sr, dialogService, logger)
+			})
+			pr.Route("/drafts", func(dr chi.Router) {
+				dialogs.RegisterDraftHandlers(dr, dialogService, logger)
+			})
+			pr.Route("/search", func(sr chi.Router) {
+				sr.Use(middleware.RateLimiter(rdb, 60))
+				dialogs.RegisterSearchHandlers(sr, dialogService, logger)
+			})
+			pr.Route("/me/export", func(er chi.Router) {
+				er.Use(middleware.RateLimiter(rdb, 10))
+				dataexport.RegisterHandlers(er, exportService, logger)
+			})
 		})
+		dataexport.RegisterDownload(r, exportService, logger)
 		r.Route("/dialogs", func(dr chi.Router) {
 			dr.Use(auth.AuthMiddleware(logger, validator))
 			dialogs.RegisterHandlers(dr, dialogService, logger)
@@ -9,10 +9,12 @@ import (
 	"stu/internal/app"
 	"stu/internal/auth"
 	"stu/internal/config"
+	"stu/internal/dialogs"
 	"stu/internal/observability"
 	"stu/internal/platform/postgres"
 	rediscfg "stu/internal/platform/redis"
 	"stu/internal/realtime"
+	"stu/internal/users"
 )
 
 func main() {
@@ -36,6 +38,12 @@ func main() {
 	authRepo := auth.NewRepository(db)
 	validator := auth.NewAccessValidator(authRepo)
 	hub := realtime.NewHub(logger, rdb, validator)
+	dialogRepo := dialogs.NewRepository(db)
+	hub.SetChannelSource(dialogRepo)
+
+	// message.send frames go through the same service as the HTTP API
+	usersService := users.NewService(users.NewRepository(db))
+	hub.SetMessageSender(app.NewDialogService(dialogRepo, rdb, authRepo, usersService))
 
 	server.Router.Route("/v1", func(r chi.Router) {
 		r.Get("/ws", hub.HandleWS)
@@ -0,0 +1,24 @@
+package app
+
+import (
+	"github.com/redis/go-redis/v9"
+
+	"stu/internal/auth"
+	"stu/internal/dialogs"
+	"stu/internal/realtime"
+	"stu/internal/users"
+)
+
+// NewDialogService wires the dialog service for every binary that accepts
+// messages, so sends over HTTP and over the socket apply the same privacy,
+// blocking and mention rules.
+func NewDialogService(repo dialogs.Repository, rdb *redis.Client, authRepo auth.Repository, usersService *users.Service) *dialogs.Service {
+	publisher := realtime.NewRedisPublisher(rdb)
+	publisher.SetBlockFilter(usersService)
+	svc := dialogs.NewService(repo, authRepo.GetUserByEmail)
+	svc.SetUsernameFetcher(authRepo.GetUserByUsername)
+	svc.SetPublisher(publisher)
+	svc.SetPrivacy(usersService)
+	svc.SetBlocker(usersService.Block)
+	return svc
+}
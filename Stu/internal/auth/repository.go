@@ -54,6 +54,7 @@ type Repository interface {
 	ActivateUser(ctx context.Context, userID uuid.UUID) error
 	GetUserByEmail(ctx context.Context, email string) (User, error)
 	GetUserByID(ctx context.Context, id uuid.UUID) (User, error)
+	GetUserByUsername(ctx context.Context, username string) (User, error)
 	SaveVerificationCode(ctx context.Context, userID uuid.UUID, codeHash []byte, expiresAt time.Time) error
 	ValidateVerificationCode(ctx context.Context, email string, codeHash []byte) (User, error)
 	CreateDevice(ctx context.Context, userID uuid.UUID, name, platform string) (uuid.UUID, error)
@@ -114,6 +115,16 @@ func (r *pgRepository) GetUserByID(ctx context.Context, id uuid.UUID) (User, err
 	return u, err
 }
 
+func (r *pgRepository) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	query := `SELECT id, email, password_hash, is_active, is_admin, banned_at, ban_reason, admin_totp_secret, created_at FROM users WHERE username = $1 AND is_deleted = FALSE LIMIT 1`
+	var u User
+	err := r.pool.QueryRow(ctx, query, username).Scan(&u.ID, &u.Email, &u.PasswordHash, &u.IsActive, &u.IsAdmin, &u.BannedAt, &u.BanReason, &u.AdminTOTPSecret, &u.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return u, err
+}
+
 func (r *pgRepository) SaveVerificationCode(ctx context.Context, userID uuid.UUID, codeHash []byte, expiresAt time.Time) error {
 	_, err := r.pool.Exec(ctx, `
 		INSERT INTO verification_codes (user_id, code_hash, expires_at)
@@ -87,6 +87,10 @@ func (r *inMemoryRepo) GetUserByID(ctx context.Context, id uuid.UUID) (User, err
 	return User{}, ErrUserNotFound
 }
 
+func (r *inMemoryRepo) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	return User{}, ErrUserNotFound
+}
+
 func (r *inMemoryRepo) SaveVerificationCode(ctx context.Context, userID uuid.UUID, codeHash []byte, expiresAt time.Time) error {
 	for email, u := range r.users {
 		if u.ID == userID {
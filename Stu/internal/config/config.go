@@ -79,10 +79,24 @@ type RateLimitConfig struct {
 	RequestsPerMinute int `env:"RATE_LIMIT_RPM" envDefault:"60"`
 }
 
+// ExportConfig controls personal data export archives.
+type ExportConfig struct {
+	SigningKey string        `env:"EXPORT_SIGNING_KEY"`
+	LinkTTL    time.Duration `env:"EXPORT_LINK_TTL" envDefault:"24h"`
+}
+
+// SyncConfig controls the per-user update log behind delta sync.
+type SyncConfig struct {
+	// UpdateRetention is how long updates are kept; clients further behind
+	// get too_long and reload.
+	UpdateRetention time.Duration `env:"SYNC_UPDATE_RETENTION" envDefault:"720h"`
+}
+
 // ServiceConfig is the shared config across services.
 type ServiceConfig struct {
 	ServiceName        string `env:"SERVICE_NAME" envDefault:"stu"`
 	Environment        string `env:"ENV" envDefault:"dev"`
+	PublicBaseURL      string `env:"PUBLIC_BASE_URL" envDefault:"http://localhost:8080"`
 	HTTP               HTTPConfig
 	GRPC               GRPCConfig
 	Database           DatabaseConfig
@@ -94,6 +108,8 @@ type ServiceConfig struct {
 	Security           SecurityConfig
 	Metrics            MetricsConfig
 	RateLimit          RateLimitConfig
+	Export             ExportConfig
+	Sync               SyncConfig
 	LogLevel           string `env:"LOG_LEVEL" envDefault:"info"`
 }
 
@@ -0,0 +1,114 @@
+package dataexport
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// manifest lists archive entries with their SHA-256 so the signature covers every file.
+type manifest struct {
+	Format      string            `json:"format"`
+	UserID      uuid.UUID         `json:"user_id"`
+	ExportID    uuid.UUID         `json:"export_id"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	Files       map[string]string `json:"files"`
+	Algorithm   string            `json:"signature_algorithm"`
+}
+
+const (
+	manifestName  = "manifest.json"
+	signatureName = "manifest.sig"
+)
+
+// buildArchive packs the snapshot into a ZIP with a manifest signed by HMAC-SHA256.
+func buildArchive(exportID uuid.UUID, snap Snapshot, key []byte, now time.Time) ([]byte, error) {
+	files := []struct {
+		name    string
+		payload any
+	}{
+		{"profile.json", snap.Profile},
+		{"settings.json", snap.Settings},
+		{"devices.json", emptyIfNil(snap.Devices)},
+		{"sessions.json", emptyIfNil(snap.Sessions)},
+		{"dialogs.json", emptyIfNil(snap.Memberships)},
+		{"messages.json", emptyIfNil(snap.Messages)},
+		{"reports.json", emptyIfNil(snap.Reports)},
+		{"bans.json", emptyIfNil(snap.Bans)},
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	man := manifest{
+		Format:      "stu-export/1",
+		UserID:      snap.Profile.ID,
+		ExportID:    exportID,
+		GeneratedAt: now.UTC(),
+		Files:       make(map[string]string, len(files)),
+		Algorithm:   "HMAC-SHA256",
+	}
+	for _, f := range files {
+		data, err := json.MarshalIndent(f.payload, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeEntry(zw, f.name, data, now); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		man.Files[f.name] = hex.EncodeToString(sum[:])
+	}
+	manData, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEntry(zw, manifestName, manData, now); err != nil {
+		return nil, err
+	}
+	if err := writeEntry(zw, signatureName, []byte(sign(key, manData)), now); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeEntry(zw *zip.Writer, name string, data []byte, now time.Time) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now.UTC()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func sign(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(key, data []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// emptyIfNil keeps JSON arrays as [] instead of null.
+func emptyIfNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
@@ -0,0 +1,92 @@
+package dataexport
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"stu/internal/auth"
+)
+
+// RegisterHandlers mounts export routes under /v1/me/export.
+func RegisterHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Post("/", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		job, err := svc.Request(req.Context(), uuid.MustParse(curUser))
+		if err != nil {
+			logger.Error().Err(err).Msg("export request failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, job, http.StatusAccepted)
+	})
+
+	r.Get("/{id}", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		jobID, err := uuid.Parse(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid export id", http.StatusBadRequest)
+			return
+		}
+		job, err := svc.Status(req.Context(), uuid.MustParse(curUser), jobID)
+		if err != nil {
+			if errors.Is(err, ErrJobNotFound) {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			logger.Error().Err(err).Msg("export status failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, job, http.StatusOK)
+	})
+}
+
+// RegisterDownload mounts the signed download link; it needs no bearer token.
+func RegisterDownload(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Get("/exports/{id}/download", func(w http.ResponseWriter, req *http.Request) {
+		jobID, err := uuid.Parse(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid export id", http.StatusBadRequest)
+			return
+		}
+		q := req.URL.Query()
+		archive, err := svc.Download(req.Context(), jobID, q.Get("expires"), q.Get("sig"))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrLinkInvalid):
+				http.Error(w, "forbidden", http.StatusForbidden)
+			case errors.Is(err, ErrLinkExpired), errors.Is(err, ErrJobNotFound):
+				http.Error(w, "link expired", http.StatusGone)
+			default:
+				logger.Error().Err(err).Msg("export download failed")
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="stu-export-`+jobID.String()+`.zip"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(archive)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, payload any, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,360 @@
+package dataexport
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrJobNotFound = errors.New("export not found")
+)
+
+// Job is a single export request.
+type Job struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"-"`
+	Status      string     `json:"status"`
+	Size        *int64     `json:"size,omitempty"`
+	Error       *string    `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type Profile struct {
+	ID          uuid.UUID  `json:"id"`
+	Email       string     `json:"email"`
+	Username    *string    `json:"username,omitempty"`
+	DisplayName *string    `json:"display_name,omitempty"`
+	Bio         *string    `json:"bio,omitempty"`
+	AvatarURL   *string    `json:"avatar_url,omitempty"`
+	IsActive    bool       `json:"is_active"`
+	IsAdmin     bool       `json:"is_admin"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+}
+
+type Settings struct {
+	TwoFAEnabled        *bool   `json:"twofa_enabled,omitempty"`
+	AllowMessagesFrom   *string `json:"allow_messages_from,omitempty"`
+	AllowAddToGroup     *string `json:"allow_add_to_group,omitempty"`
+	ShowLastSeen        *bool   `json:"show_last_seen,omitempty"`
+	ShowOnline          *bool   `json:"show_online,omitempty"`
+	AllowProfileByEmail *bool   `json:"allow_profile_by_email,omitempty"`
+	AllowForwardLink    *bool   `json:"allow_forward_link,omitempty"`
+}
+
+type Device struct {
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	Platform  *string    `json:"platform,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type SessionRecord struct {
+	ID            uuid.UUID  `json:"id"`
+	DeviceID      *uuid.UUID `json:"device_id,omitempty"`
+	IP            *string    `json:"ip,omitempty"`
+	UserAgent     *string    `json:"user_agent,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason *string    `json:"revoked_reason,omitempty"`
+}
+
+type Membership struct {
+	DialogID    uuid.UUID  `json:"dialog_id"`
+	Kind        string     `json:"kind"`
+	Title       *string    `json:"title,omitempty"`
+	Role        *string    `json:"role,omitempty"`
+	IsEncrypted *bool      `json:"is_encrypted,omitempty"`
+	JoinedAt    time.Time  `json:"joined_at"`
+	MutedUntil  *time.Time `json:"muted_until,omitempty"`
+	Archived    bool       `json:"archived"`
+	PinnedAt    *time.Time `json:"pinned_at,omitempty"`
+}
+
+// MessageRecord is message metadata; CipherText is exported as an opaque blob.
+type MessageRecord struct {
+	ID          int64      `json:"id"`
+	DialogID    uuid.UUID  `json:"dialog_id"`
+	Kind        string     `json:"kind"`
+	ContentType *string    `json:"content_type,omitempty"`
+	CipherText  []byte     `json:"cipher_text"`
+	ReplyTo     *int64     `json:"reply_to,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	EditedAt    *time.Time `json:"edited_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+}
+
+type ReportRecord struct {
+	ID             uuid.UUID  `json:"id"`
+	ReportedUserID uuid.UUID  `json:"reported_user_id"`
+	DialogID       *uuid.UUID `json:"dialog_id,omitempty"`
+	MessageID      *int64     `json:"message_id,omitempty"`
+	Reason         string     `json:"reason"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type Ban struct {
+	BannedAt  time.Time `json:"banned_at"`
+	BanReason *string   `json:"ban_reason,omitempty"`
+}
+
+// Snapshot is everything the server stores about a user.
+type Snapshot struct {
+	Profile     Profile
+	Settings    *Settings
+	Devices     []Device
+	Sessions    []SessionRecord
+	Memberships []Membership
+	Messages    []MessageRecord
+	Reports     []ReportRecord
+	Bans        []Ban
+}
+
+type Repository interface {
+	CreateJob(ctx context.Context, userID uuid.UUID) (Job, error)
+	ActiveJob(ctx context.Context, userID uuid.UUID) (Job, error)
+	GetJob(ctx context.Context, id uuid.UUID) (Job, error)
+	ClaimJob(ctx context.Context, staleAfter time.Duration, maxAttempts int) (Job, error)
+	Complete(ctx context.Context, id uuid.UUID, archive []byte, expiresAt time.Time) error
+	Fail(ctx context.Context, id uuid.UUID, reason string) error
+	GetArchive(ctx context.Context, id uuid.UUID) ([]byte, time.Time, error)
+	PurgeExpired(ctx context.Context) error
+	Collect(ctx context.Context, userID uuid.UUID) (Snapshot, error)
+}
+
+type pgRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewRepository(pool *pgxpool.Pool) Repository {
+	return &pgRepository{pool: pool}
+}
+
+const jobColumns = `id, user_id, status, archive_size, error, created_at, completed_at, expires_at`
+
+func scanJob(row pgx.Row) (Job, error) {
+	var j Job
+	err := row.Scan(&j.ID, &j.UserID, &j.Status, &j.Size, &j.Error, &j.CreatedAt, &j.CompletedAt, &j.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Job{}, ErrJobNotFound
+	}
+	return j, err
+}
+
+func (r *pgRepository) CreateJob(ctx context.Context, userID uuid.UUID) (Job, error) {
+	return scanJob(r.pool.QueryRow(ctx, `
+		INSERT INTO data_exports (user_id, status)
+		VALUES ($1, 'pending')
+		RETURNING `+jobColumns, userID))
+}
+
+// ActiveJob returns a recent pending/processing job; stale ones are ignored.
+func (r *pgRepository) ActiveJob(ctx context.Context, userID uuid.UUID) (Job, error) {
+	return scanJob(r.pool.QueryRow(ctx, `
+		SELECT `+jobColumns+`
+		FROM data_exports
+		WHERE user_id = $1 AND status IN ('pending','processing')
+		  AND created_at > NOW() - INTERVAL '1 hour'
+		ORDER BY created_at DESC
+		LIMIT 1`, userID))
+}
+
+func (r *pgRepository) GetJob(ctx context.Context, id uuid.UUID) (Job, error) {
+	return scanJob(r.pool.QueryRow(ctx, `SELECT `+jobColumns+` FROM data_exports WHERE id = $1`, id))
+}
+
+// ClaimJob marks the oldest pending job processing and returns it. A job left
+// processing for longer than staleAfter lost its worker and is claimed again
+// until it has been started maxAttempts times; then it fails.
+func (r *pgRepository) ClaimJob(ctx context.Context, staleAfter time.Duration, maxAttempts int) (Job, error) {
+	if _, err := r.pool.Exec(ctx, `
+		UPDATE data_exports SET status = 'failed', error = 'export failed', completed_at = NOW()
+		WHERE status = 'processing' AND started_at < NOW() - $1::interval AND attempts >= $2
+	`, staleAfter, maxAttempts); err != nil {
+		return Job{}, err
+	}
+	return scanJob(r.pool.QueryRow(ctx, `
+		UPDATE data_exports SET status = 'processing', started_at = NOW(), attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM data_exports
+			WHERE status = 'pending'
+			   OR (status = 'processing' AND started_at < NOW() - $1::interval AND attempts < $2)
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns, staleAfter, maxAttempts))
+}
+
+func (r *pgRepository) Complete(ctx context.Context, id uuid.UUID, archive []byte, expiresAt time.Time) error {
+	_, err := r.pool.Exec(ctx, `
+		UPDATE data_exports
+		SET status = 'ready',
+		    archive = $2,
+		    archive_size = $3,
+		    completed_at = NOW(),
+		    expires_at = $4
+		WHERE id = $1
+	`, id, archive, int64(len(archive)), expiresAt)
+	return err
+}
+
+func (r *pgRepository) Fail(ctx context.Context, id uuid.UUID, reason string) error {
+	_, err := r.pool.Exec(ctx, `
+		UPDATE data_exports SET status = 'failed', error = $2, completed_at = NOW() WHERE id = $1
+	`, id, reason)
+	return err
+}
+
+func (r *pgRepository) GetArchive(ctx context.Context, id uuid.UUID) ([]byte, time.Time, error) {
+	var (
+		archive   []byte
+		expiresAt time.Time
+	)
+	err := r.pool.QueryRow(ctx, `
+		SELECT archive, expires_at FROM data_exports
+		WHERE id = $1 AND status = 'ready' AND archive IS NOT NULL
+	`, id).Scan(&archive, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, time.Time{}, ErrJobNotFound
+	}
+	return archive, expiresAt, err
+}
+
+// PurgeExpired drops archive bytes once download links can no longer be used.
+func (r *pgRepository) PurgeExpired(ctx context.Context) error {
+	_, err := r.pool.Exec(ctx, `
+		UPDATE data_exports SET status = 'expired', archive = NULL
+		WHERE archive IS NOT NULL AND expires_at < NOW()
+	`)
+	return err
+}
+
+func (r *pgRepository) Collect(ctx context.Context, userID uuid.UUID) (Snapshot, error) {
+	var snap Snapshot
+	p := &snap.Profile
+	var (
+		bannedAt  *time.Time
+		banReason *string
+	)
+	err := r.pool.QueryRow(ctx, `
+		SELECT id, email, username, display_name, bio, avatar_url, COALESCE(is_active, FALSE), is_admin,
+		       created_at, updated_at, last_seen, banned_at, ban_reason
+		FROM users WHERE id = $1
+	`, userID).Scan(&p.ID, &p.Email, &p.Username, &p.DisplayName, &p.Bio, &p.AvatarURL, &p.IsActive, &p.IsAdmin,
+		&p.CreatedAt, &p.UpdatedAt, &p.LastSeen, &bannedAt, &banReason)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if bannedAt != nil {
+		snap.Bans = append(snap.Bans, Ban{BannedAt: *bannedAt, BanReason: banReason})
+	}
+
+	var st Settings
+	err = r.pool.QueryRow(ctx, `
+		SELECT twofa_enabled, allow_messages_from, allow_add_to_group, show_last_seen, show_online, allow_profile_by_email, allow_forward_link
+		FROM user_settings WHERE user_id = $1
+	`, userID).Scan(&st.TwoFAEnabled, &st.AllowMessagesFrom, &st.AllowAddToGroup, &st.ShowLastSeen, &st.ShowOnline, &st.AllowProfileByEmail, &st.AllowForwardLink)
+	switch {
+	case err == nil:
+		snap.Settings = &st
+	case !errors.Is(err, pgx.ErrNoRows):
+		return Snapshot{}, err
+	}
+
+	rows, err := r.pool.Query(ctx, `
+		SELECT id, name, platform, last_seen, created_at, revoked_at
+		FROM devices WHERE user_id = $1 ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap.Devices, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Device, error) {
+		var d Device
+		err := row.Scan(&d.ID, &d.Name, &d.Platform, &d.LastSeen, &d.CreatedAt, &d.RevokedAt)
+		return d, err
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	rows, err = r.pool.Query(ctx, `
+		SELECT id, device_id, host(ip), user_agent, created_at, expires_at, revoked_at, revoked_reason
+		FROM sessions WHERE user_id = $1 ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap.Sessions, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (SessionRecord, error) {
+		var s SessionRecord
+		err := row.Scan(&s.ID, &s.DeviceID, &s.IP, &s.UserAgent, &s.CreatedAt, &s.ExpiresAt, &s.RevokedAt, &s.RevokedReason)
+		return s, err
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	rows, err = r.pool.Query(ctx, `
+		SELECT d.id, d.kind::text, d.title, dm.role, d.is_encrypted, dm.joined_at, dm.muted_until, dm.archived, dm.pinned_at
+		FROM dialog_members dm
+		JOIN dialogs d ON d.id = dm.dialog_id
+		WHERE dm.user_id = $1
+		ORDER BY dm.joined_at
+	`, userID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap.Memberships, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Membership, error) {
+		var m Membership
+		err := row.Scan(&m.DialogID, &m.Kind, &m.Title, &m.Role, &m.IsEncrypted, &m.JoinedAt, &m.MutedUntil, &m.Archived, &m.PinnedAt)
+		return m, err
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	rows, err = r.pool.Query(ctx, `
+		SELECT id, dialog_id, kind::text, content_type, cipher_text, reply_to, created_at, edited_at, deleted_at
+		FROM messages WHERE sender_id = $1 ORDER BY id
+	`, userID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap.Messages, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (MessageRecord, error) {
+		var m MessageRecord
+		err := row.Scan(&m.ID, &m.DialogID, &m.Kind, &m.ContentType, &m.CipherText, &m.ReplyTo, &m.CreatedAt, &m.EditedAt, &m.DeletedAt)
+		return m, err
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	rows, err = r.pool.Query(ctx, `
+		SELECT id, reported_user_id, dialog_id, message_id, reason, status, created_at
+		FROM reports WHERE reporter_id = $1 ORDER BY created_at
+	`, userID)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap.Reports, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (ReportRecord, error) {
+		var rep ReportRecord
+		err := row.Scan(&rep.ID, &rep.ReportedUserID, &rep.DialogID, &rep.MessageID, &rep.Reason, &rep.Status, &rep.CreatedAt)
+		return rep, err
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snap, nil
+}
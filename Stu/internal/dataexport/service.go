@@ -0,0 +1,201 @@
+package dataexport
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// jobTimeout bounds one export; a job processing for longer than
+	// staleJobAfter is considered abandoned by a crashed worker.
+	jobTimeout    = 10 * time.Minute
+	staleJobAfter = 15 * time.Minute
+	// failTimeout bounds marking a job failed, which must outlive the job
+	// context when the job ran out of time.
+	failTimeout    = 10 * time.Second
+	maxJobAttempts = 3
+)
+
+var (
+	ErrLinkInvalid = errors.New("invalid download link")
+	ErrLinkExpired = errors.New("download link expired")
+)
+
+// Config controls archive signing and link lifetime.
+type Config struct {
+	SigningKey    []byte
+	LinkTTL       time.Duration
+	PublicBaseURL string
+}
+
+// Service runs personal data exports.
+type Service struct {
+	repo   Repository
+	config Config
+	logger zerolog.Logger
+	now    func() time.Time
+	// wake lets Request start the worker without waiting for its next tick.
+	wake chan struct{}
+}
+
+// JobView is a job with a download link once the archive is ready.
+type JobView struct {
+	Job
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+func NewService(repo Repository, cfg Config, logger zerolog.Logger) *Service {
+	if len(cfg.SigningKey) == 0 {
+		cfg.SigningKey = make([]byte, 32)
+		_, _ = rand.Read(cfg.SigningKey)
+		logger.Warn().Msg("EXPORT_SIGNING_KEY not set, export links are valid only until restart")
+	}
+	if cfg.LinkTTL <= 0 {
+		cfg.LinkTTL = 24 * time.Hour
+	}
+	return &Service{repo: repo, config: cfg, logger: logger, now: time.Now, wake: make(chan struct{}, 1)}
+}
+
+// Request queues an export for the user or returns the one already queued or
+// running. RunWorker builds the archive.
+func (s *Service) Request(ctx context.Context, userID uuid.UUID) (JobView, error) {
+	if err := s.repo.PurgeExpired(ctx); err != nil {
+		s.logger.Warn().Err(err).Msg("purge expired exports failed")
+	}
+	if job, err := s.repo.ActiveJob(ctx, userID); err == nil {
+		return JobView{Job: job}, nil
+	} else if !errors.Is(err, ErrJobNotFound) {
+		return JobView{}, err
+	}
+	job, err := s.repo.CreateJob(ctx, userID)
+	if err != nil {
+		return JobView{}, err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return JobView{Job: job}, nil
+}
+
+// Status returns the job if it belongs to the user.
+func (s *Service) Status(ctx context.Context, userID, jobID uuid.UUID) (JobView, error) {
+	job, err := s.repo.GetJob(ctx, jobID)
+	if err != nil {
+		return JobView{}, err
+	}
+	if job.UserID != userID {
+		return JobView{}, ErrJobNotFound
+	}
+	view := JobView{Job: job}
+	if job.Status == "ready" && job.ExpiresAt != nil && job.ExpiresAt.After(s.now()) {
+		view.DownloadURL = s.downloadURL(job.ID, *job.ExpiresAt)
+	}
+	return view, nil
+}
+
+// Download checks the signed link and returns the archive.
+func (s *Service) Download(ctx context.Context, jobID uuid.UUID, expires, signature string) ([]byte, error) {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !verify(s.config.SigningKey, []byte(linkPayload(jobID, exp)), signature) {
+		return nil, ErrLinkInvalid
+	}
+	if s.now().Unix() > exp {
+		return nil, ErrLinkExpired
+	}
+	archive, expiresAt, err := s.repo.GetArchive(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if s.now().After(expiresAt) {
+		return nil, ErrLinkExpired
+	}
+	return archive, nil
+}
+
+// RunWorker processes queued exports every interval, and right away when one
+// is requested, until ctx is done. Jobs live in the database, so exports
+// requested before a restart are picked up by the next worker.
+func (s *Service) RunWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.ProcessPending(ctx); err != nil {
+			s.logger.Warn().Err(err).Msg("process exports failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// ProcessPending runs claimed jobs until none are left. Several gateways may
+// run it concurrently; each job is claimed by one of them.
+func (s *Service) ProcessPending(ctx context.Context) error {
+	for ctx.Err() == nil {
+		job, err := s.repo.ClaimJob(ctx, staleJobAfter, maxJobAttempts)
+		if errors.Is(err, ErrJobNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.run(ctx, job)
+	}
+	return ctx.Err()
+}
+
+func (s *Service) run(ctx context.Context, job Job) {
+	ctx, cancel := context.WithTimeout(ctx, jobTimeout)
+	defer cancel()
+	snap, err := s.repo.Collect(ctx, job.UserID)
+	if err != nil {
+		s.fail(ctx, job.ID, fmt.Errorf("collect: %w", err))
+		return
+	}
+	now := s.now()
+	archive, err := buildArchive(job.ID, snap, s.config.SigningKey, now)
+	if err != nil {
+		s.fail(ctx, job.ID, fmt.Errorf("archive: %w", err))
+		return
+	}
+	if err := s.repo.Complete(ctx, job.ID, archive, now.Add(s.config.LinkTTL)); err != nil {
+		s.fail(ctx, job.ID, fmt.Errorf("save: %w", err))
+	}
+}
+
+// fail marks the job failed on a fresh context: the job context may be the
+// reason it failed, and a job left processing waits for the stale reclaim.
+func (s *Service) fail(ctx context.Context, id uuid.UUID, err error) {
+	s.logger.Error().Err(err).Str("export_id", id.String()).Msg("export failed")
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), failTimeout)
+	defer cancel()
+	if ferr := s.repo.Fail(ctx, id, "export failed"); ferr != nil {
+		s.logger.Warn().Err(ferr).Msg("export mark failed")
+	}
+}
+
+func (s *Service) downloadURL(jobID uuid.UUID, expiresAt time.Time) string {
+	exp := expiresAt.Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(exp, 10))
+	q.Set("sig", sign(s.config.SigningKey, []byte(linkPayload(jobID, exp))))
+	base := strings.TrimRight(s.config.PublicBaseURL, "/")
+	return base + "/v1/exports/" + jobID.String() + "/download?" + q.Encode()
+}
+
+func linkPayload(jobID uuid.UUID, expires int64) string {
+	return "export-download:" + jobID.String() + ":" + strconv.FormatInt(expires, 10)
+}
@@ -0,0 +1,212 @@
+package dataexport
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+type memRepo struct {
+	jobs     map[uuid.UUID]Job
+	archives map[uuid.UUID][]byte
+	snapshot Snapshot
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{jobs: make(map[uuid.UUID]Job), archives: make(map[uuid.UUID][]byte)}
+}
+
+func (m *memRepo) CreateJob(ctx context.Context, userID uuid.UUID) (Job, error) {
+	job := Job{ID: uuid.New(), UserID: userID, Status: "pending", CreatedAt: time.Now()}
+	m.jobs[job.ID] = job
+	return job, nil
+}
+
+func (m *memRepo) ActiveJob(ctx context.Context, userID uuid.UUID) (Job, error) {
+	for _, j := range m.jobs {
+		if j.UserID == userID && (j.Status == "pending" || j.Status == "processing") {
+			return j, nil
+		}
+	}
+	return Job{}, ErrJobNotFound
+}
+
+func (m *memRepo) GetJob(ctx context.Context, id uuid.UUID) (Job, error) {
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return j, nil
+}
+
+func (m *memRepo) ClaimJob(ctx context.Context, staleAfter time.Duration, maxAttempts int) (Job, error) {
+	for id, j := range m.jobs {
+		if j.Status == "pending" {
+			j.Status = "processing"
+			m.jobs[id] = j
+			return j, nil
+		}
+	}
+	return Job{}, ErrJobNotFound
+}
+
+func (m *memRepo) Complete(ctx context.Context, id uuid.UUID, archive []byte, expiresAt time.Time) error {
+	j := m.jobs[id]
+	j.Status = "ready"
+	j.ExpiresAt = &expiresAt
+	m.jobs[id] = j
+	m.archives[id] = archive
+	return nil
+}
+
+func (m *memRepo) Fail(ctx context.Context, id uuid.UUID, reason string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	j := m.jobs[id]
+	j.Status = "failed"
+	m.jobs[id] = j
+	return nil
+}
+
+func (m *memRepo) GetArchive(ctx context.Context, id uuid.UUID) ([]byte, time.Time, error) {
+	a, ok := m.archives[id]
+	if !ok {
+		return nil, time.Time{}, ErrJobNotFound
+	}
+	return a, *m.jobs[id].ExpiresAt, nil
+}
+
+func (m *memRepo) PurgeExpired(ctx context.Context) error { return nil }
+
+func (m *memRepo) Collect(ctx context.Context, userID uuid.UUID) (Snapshot, error) {
+	return m.snapshot, ctx.Err()
+}
+
+func TestArchiveIsSigned(t *testing.T) {
+	key := []byte("test-key")
+	userID := uuid.New()
+	snap := Snapshot{
+		Profile:  Profile{ID: userID, Email: "a@example.com"},
+		Messages: []MessageRecord{{ID: 1, DialogID: uuid.New(), Kind: "text", CipherText: []byte{0x01, 0xff}}},
+	}
+	data, err := buildArchive(uuid.New(), snap, key, time.Now())
+	if err != nil {
+		t.Fatalf("build archive: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", f.Name, err)
+		}
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	if !verify(key, files[manifestName], string(files[signatureName])) {
+		t.Fatalf("manifest signature does not verify")
+	}
+	var man manifest
+	if err := json.Unmarshal(files[manifestName], &man); err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	for name, digest := range man.Files {
+		sum := sha256.Sum256(files[name])
+		if hex.EncodeToString(sum[:]) != digest {
+			t.Fatalf("digest mismatch for %s", name)
+		}
+	}
+	var msgs []MessageRecord
+	if err := json.Unmarshal(files["messages.json"], &msgs); err != nil || len(msgs) != 1 || !bytes.Equal(msgs[0].CipherText, []byte{0x01, 0xff}) {
+		t.Fatalf("ciphertext not exported as opaque blob: %v %+v", err, msgs)
+	}
+}
+
+func TestDownloadLinkExpires(t *testing.T) {
+	repo := newMemRepo()
+	userID := uuid.New()
+	repo.snapshot = Snapshot{Profile: Profile{ID: userID}}
+	svc := NewService(repo, Config{SigningKey: []byte("k"), LinkTTL: time.Hour, PublicBaseURL: "https://stu.example"}, zerolog.Nop())
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+
+	job, err := svc.Request(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("request export: %v", err)
+	}
+	if err := svc.ProcessPending(context.Background()); err != nil {
+		t.Fatalf("process exports: %v", err)
+	}
+
+	if _, err := svc.Status(context.Background(), uuid.New(), job.ID); err != ErrJobNotFound {
+		t.Fatalf("expected other user to get not found, got %v", err)
+	}
+	view, err := svc.Status(context.Background(), userID, job.ID)
+	if err != nil || view.DownloadURL == "" {
+		t.Fatalf("expected download url, got %+v %v", view, err)
+	}
+	u, _ := url.Parse(view.DownloadURL)
+	q := u.Query()
+	if _, err := svc.Download(context.Background(), job.ID, q.Get("expires"), q.Get("sig")); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if _, err := svc.Download(context.Background(), job.ID, q.Get("expires"), q.Get("sig")+"00"); err != ErrLinkInvalid {
+		t.Fatalf("expected invalid link, got %v", err)
+	}
+	if _, err := svc.Download(context.Background(), uuid.New(), q.Get("expires"), q.Get("sig")); err != ErrLinkInvalid {
+		t.Fatalf("expected link bound to export id, got %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := svc.Download(context.Background(), job.ID, q.Get("expires"), q.Get("sig")); err != ErrLinkExpired {
+		t.Fatalf("expected expired link, got %v", err)
+	}
+}
+
+func TestPendingJobSurvivesRestart(t *testing.T) {
+	repo := newMemRepo()
+	userID := uuid.New()
+	// queued by a gateway that stopped before building the archive
+	job, _ := repo.CreateJob(context.Background(), userID)
+
+	// RunWorker starts with a pass over the queue
+	svc := NewService(repo, Config{SigningKey: []byte("k")}, zerolog.Nop())
+	if err := svc.ProcessPending(context.Background()); err != nil {
+		t.Fatalf("process exports: %v", err)
+	}
+	if view, _ := svc.Status(context.Background(), userID, job.ID); view.Status != "ready" {
+		t.Fatalf("pending export was not picked up after restart: %+v", view)
+	}
+	if _, err := svc.Request(context.Background(), userID); err != nil {
+		t.Fatalf("new export after the previous one finished: %v", err)
+	}
+}
+
+func TestTimedOutJobIsMarkedFailed(t *testing.T) {
+	repo := newMemRepo()
+	repo.CreateJob(context.Background(), uuid.New())
+	job, _ := repo.ClaimJob(context.Background(), staleJobAfter, maxJobAttempts)
+	svc := NewService(repo, Config{SigningKey: []byte("k")}, zerolog.Nop())
+
+	// the job ran out of time while collecting
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	svc.run(ctx, job)
+	if got := repo.jobs[job.ID].Status; got != "failed" {
+		t.Fatalf("expected the job marked failed, got %q", got)
+	}
+}
@@ -0,0 +1,112 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"stu/internal/users"
+)
+
+const maxChannelDescription = 255
+
+var ErrInvalidChannel = errors.New("invalid channel")
+
+// CreateChannel creates a broadcast channel owned by currentUser.
+// A non-empty username makes the channel public and joinable by link.
+func (s *Service) CreateChannel(ctx context.Context, currentUser uuid.UUID, title, username, description string) (Channel, error) {
+	title, err := normalizeTitle(title)
+	if err != nil {
+		return Channel{}, err
+	}
+	username = strings.TrimPrefix(strings.TrimSpace(username), "@")
+	if username != "" {
+		if err := users.ValidateUsername(username); err != nil {
+			return Channel{}, ErrInvalidChannel
+		}
+	}
+	description = strings.TrimSpace(description)
+	if utf8.RuneCountInString(description) > maxChannelDescription {
+		return Channel{}, ErrInvalidChannel
+	}
+	var id uuid.UUID
+	err = s.inTx(ctx, func(ctx context.Context) error {
+		var err error
+		if id, err = s.repo.CreateChannel(ctx, currentUser, title, username, description); err != nil {
+			return err
+		}
+		return s.systemMessage(ctx, id, KindChannel, systemPayload{Type: "channel.created", ActorID: currentUser.String(), Title: title})
+	})
+	if err != nil {
+		return Channel{}, err
+	}
+	return s.repo.GetChannel(ctx, id)
+}
+
+// Channel returns the channel card. Private channels are visible to subscribers only.
+func (s *Service) Channel(ctx context.Context, currentUser, dialogID uuid.UUID) (Channel, error) {
+	ch, err := s.repo.GetChannel(ctx, dialogID)
+	if err != nil {
+		return Channel{}, err
+	}
+	if ch.Username == nil {
+		ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+		if err != nil {
+			return Channel{}, err
+		}
+		if !ok {
+			return Channel{}, ErrDialogNotFound
+		}
+	}
+	return ch, nil
+}
+
+// ChannelByUsername resolves a public channel link.
+func (s *Service) ChannelByUsername(ctx context.Context, username string) (Channel, error) {
+	return s.repo.GetChannelByUsername(ctx, strings.TrimPrefix(strings.TrimSpace(username), "@"))
+}
+
+// JoinChannel subscribes currentUser to a public channel.
+func (s *Service) JoinChannel(ctx context.Context, currentUser, dialogID uuid.UUID) (Channel, error) {
+	ch, err := s.repo.GetChannel(ctx, dialogID)
+	if err != nil {
+		return Channel{}, err
+	}
+	if ch.Username == nil {
+		return Channel{}, ErrDialogNotFound
+	}
+	if err := s.repo.AddMember(ctx, dialogID, currentUser, RoleMember); err != nil {
+		if errors.Is(err, ErrAlreadyMember) {
+			return ch, nil
+		}
+		return Channel{}, err
+	}
+	if s.publisher != nil {
+		_ = s.publisher.PublishSubscription(ctx, dialogID, currentUser, true)
+	}
+	ch.SubscriberCount++
+	return ch, nil
+}
+
+// canPost reports whether the sender may write into the dialog:
+// in channels only the owner and admins post.
+func (s *Service) canPost(ctx context.Context, dialogID, sender uuid.UUID) (string, error) {
+	kind, err := s.repo.DialogKind(ctx, dialogID)
+	if err != nil {
+		return "", err
+	}
+	if kind != KindChannel {
+		return kind, nil
+	}
+	role, err := s.repo.MemberRole(ctx, dialogID, sender)
+	if err != nil {
+		return "", err
+	}
+	if roleRank[role] < roleRank[RoleAdmin] {
+		return "", ErrForbidden
+	}
+	return kind, nil
+}
@@ -0,0 +1,64 @@
+package dialogs
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxDialogPage caps one page of the dialog list.
+const maxDialogPage = 100
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// DialogCursor is a position in the dialog list. The list is ordered by
+// pinned first, then by At (pin time for pinned dialogs, last activity for
+// the rest) descending, then by ID descending.
+type DialogCursor struct {
+	Pinned bool
+	At     time.Time
+	ID     uuid.UUID
+}
+
+// cursorOf returns the position right after d.
+func cursorOf(d Dialog) DialogCursor {
+	if d.pinnedAt != nil {
+		return DialogCursor{Pinned: true, At: *d.pinnedAt, ID: d.ID}
+	}
+	return DialogCursor{At: d.LastActivityAt, ID: d.ID}
+}
+
+// String encodes the cursor as an opaque URL-safe token. Timestamps keep
+// microseconds, the precision Postgres stores.
+func (c DialogCursor) String() string {
+	pinned := 0
+	if c.Pinned {
+		pinned = 1
+	}
+	raw := fmt.Sprintf("%d:%d:%s", pinned, c.At.UnixMicro(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseDialogCursor decodes a token produced by DialogCursor.String.
+func ParseDialogCursor(token string) (DialogCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return DialogCursor{}, ErrInvalidCursor
+	}
+	var (
+		pinned int
+		micros int64
+		id     string
+	)
+	if n, err := fmt.Sscanf(string(raw), "%d:%d:%s", &pinned, &micros, &id); err != nil || n != 3 || pinned > 1 || pinned < 0 {
+		return DialogCursor{}, ErrInvalidCursor
+	}
+	dialogID, err := uuid.Parse(id)
+	if err != nil {
+		return DialogCursor{}, ErrInvalidCursor
+	}
+	return DialogCursor{Pinned: pinned == 1, At: time.UnixMicro(micros).UTC(), ID: dialogID}, nil
+}
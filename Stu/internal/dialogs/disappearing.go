@@ -0,0 +1,141 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	minMessageTTL = 5                  // seconds
+	maxMessageTTL = 365 * 24 * 60 * 60 // one year
+	reapBatch     = 500
+	// EventDialogTTLChanged is the system message announcing a new timer.
+	EventDialogTTLChanged = "dialog.ttl_changed"
+)
+
+var ErrInvalidTTL = errors.New("invalid message ttl")
+
+// ExpiredMessage identifies a message removed by the reaper.
+type ExpiredMessage struct {
+	ID         int64
+	DialogID   uuid.UUID
+	DialogKind string
+}
+
+// SetMessageTTL sets the disappearing-messages timer of a dialog; 0 turns it
+// off. Any member may change it, in channels only admins. The change applies
+// to messages sent afterwards and is announced with a system message.
+func (s *Service) SetMessageTTL(ctx context.Context, currentUser, dialogID uuid.UUID, seconds int) error {
+	if seconds != 0 && (seconds < minMessageTTL || seconds > maxMessageTTL) {
+		return ErrInvalidTTL
+	}
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrForbidden
+	}
+	kind, err := s.repo.DialogKind(ctx, dialogID)
+	if err != nil {
+		return err
+	}
+	if kind == KindChannel {
+		role, err := s.repo.MemberRole(ctx, dialogID, currentUser)
+		if err != nil {
+			return err
+		}
+		if roleRank[role] < roleRank[RoleAdmin] {
+			return ErrForbidden
+		}
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		changed, err := s.repo.SetMessageTTL(ctx, dialogID, seconds)
+		if err != nil || !changed {
+			return err
+		}
+		return s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventDialogTTLChanged, ActorID: currentUser.String(), TTL: seconds})
+	})
+}
+
+// ReapExpired removes expired messages in batches, notifies members with
+// message.expired and deletes the attached blobs once the rows are gone. It
+// returns how many messages were removed; a blob that failed to delete does
+// not stop the reaper and is reported with the result.
+func (s *Service) ReapExpired(ctx context.Context) (int, error) {
+	var (
+		total    int
+		blobErrs []error
+	)
+	for {
+		var (
+			expired []ExpiredMessage
+			blobs   []MediaObject
+		)
+		err := s.inTx(ctx, func(ctx context.Context) error {
+			var err error
+			if expired, blobs, err = s.repo.ReapExpiredMessages(ctx, reapBatch); err != nil {
+				return err
+			}
+			return s.publishExpired(ctx, expired)
+		})
+		if err != nil {
+			return total, errors.Join(append(blobErrs, err)...)
+		}
+		total += len(expired)
+		if err := s.deleteBlobs(ctx, blobs); err != nil {
+			blobErrs = append(blobErrs, err)
+		}
+		if len(expired) < reapBatch {
+			return total, errors.Join(blobErrs...)
+		}
+	}
+}
+
+// RunReaper calls ReapExpired every interval until ctx is done.
+func (s *Service) RunReaper(ctx context.Context, interval time.Duration, logger zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.ReapExpired(ctx); err != nil {
+				logger.Warn().Err(err).Msg("reap expired messages failed")
+			} else if n > 0 {
+				logger.Debug().Int("count", n).Msg("expired messages reaped")
+			}
+		}
+	}
+}
+
+// publishExpired tells every member about removed messages. The messages are
+// gone for everyone, so no block filtering applies.
+func (s *Service) publishExpired(ctx context.Context, expired []ExpiredMessage) error {
+	members := map[uuid.UUID][]uuid.UUID{}
+	for _, e := range expired {
+		ev := MessageEvent{Type: EventMessageExpired, DialogID: e.DialogID, MessageID: e.ID}
+		if e.DialogKind == KindChannel {
+			s.publish(ctx, func(ctx context.Context, p EventPublisher) error { return p.PublishChannelEvent(ctx, ev) })
+			continue
+		}
+		list, ok := members[e.DialogID]
+		if !ok {
+			var err error
+			if list, err = s.repo.Members(ctx, e.DialogID); err != nil {
+				return err
+			}
+			members[e.DialogID] = list
+		}
+		if err := s.recordUpdate(ctx, list, Update{Type: EventMessageExpired, DialogID: e.DialogID, MessageID: &e.ID}); err != nil {
+			return err
+		}
+		s.publish(ctx, func(ctx context.Context, p EventPublisher) error { return p.PublishMessageEvent(ctx, ev, list) })
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxDraftSize caps an encrypted draft blob.
+const maxDraftSize = 64 << 10
+
+// EventDraftUpdated goes to the user's own devices when a draft changes.
+const EventDraftUpdated = "draft.updated"
+
+var ErrDraftTooLarge = errors.New("draft too large")
+
+// Draft is the caller's unsent text in a dialog, encrypted by the client.
+// An empty Blob means the draft was cleared at UpdatedAt.
+type Draft struct {
+	DialogID  uuid.UUID `json:"dialog_id"`
+	Blob      []byte    `json:"blob"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SaveDraft stores the caller's draft unless a newer one is already stored:
+// the latest UpdatedAt wins. A zero UpdatedAt, or one from the future, is
+// taken as now. It returns the draft in effect after the call.
+func (s *Service) SaveDraft(ctx context.Context, currentUser uuid.UUID, d Draft) (Draft, error) {
+	if len(d.Blob) > maxDraftSize {
+		return Draft{}, ErrDraftTooLarge
+	}
+	ok, err := s.repo.CheckMember(ctx, d.DialogID, currentUser)
+	if err != nil {
+		return Draft{}, err
+	}
+	if !ok {
+		return Draft{}, ErrForbidden
+	}
+	now := time.Now().UTC()
+	if d.UpdatedAt.IsZero() || d.UpdatedAt.After(now) {
+		d.UpdatedAt = now
+	}
+	var stored Draft
+	err = s.inTx(ctx, func(ctx context.Context) error {
+		var (
+			applied bool
+			err     error
+		)
+		if stored, applied, err = s.repo.SaveDraft(ctx, currentUser, d); err != nil || !applied {
+			return err
+		}
+		return s.publishDraft(ctx, currentUser, stored)
+	})
+	if err != nil {
+		return Draft{}, err
+	}
+	return stored, nil
+}
+
+// ListDrafts returns the caller's non-empty drafts in dialogs they are in.
+func (s *Service) ListDrafts(ctx context.Context, currentUser uuid.UUID) ([]Draft, error) {
+	drafts, err := s.repo.ListDrafts(ctx, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	if drafts == nil {
+		drafts = []Draft{}
+	}
+	return drafts, nil
+}
+
+// clearDraft drops the sender's draft once the message is sent. The message
+// is stored by then, so a failure only leaves the draft in place.
+func (s *Service) clearDraft(ctx context.Context, userID, dialogID uuid.UUID) {
+	d := Draft{DialogID: dialogID, UpdatedAt: time.Now().UTC()}
+	_ = s.inTx(ctx, func(ctx context.Context) error {
+		cleared, err := s.repo.ClearDraft(ctx, userID, d)
+		if err != nil || !cleared {
+			return err
+		}
+		return s.publishDraft(ctx, userID, d)
+	})
+}
+
+func (s *Service) publishDraft(ctx context.Context, userID uuid.UUID, d Draft) error {
+	if err := s.recordUpdate(ctx, []uuid.UUID{userID}, Update{Type: EventDraftUpdated, DialogID: d.DialogID}); err != nil {
+		return err
+	}
+	s.publish(ctx, func(ctx context.Context, p EventPublisher) error { return p.PublishDraft(ctx, userID, d) })
+	return nil
+}
@@ -0,0 +1,139 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// editWindow limits how long after sending a message may be edited.
+const editWindow = 48 * time.Hour
+
+var ErrEditWindow = errors.New("edit window expired")
+
+// EditMessage replaces the text of the caller's own message within editWindow.
+// Mentions in a group are re-resolved for display; edits notify no one.
+func (s *Service) EditMessage(ctx context.Context, currentUser, dialogID uuid.UUID, messageID int64, text string) (Message, error) {
+	msg, kind, err := s.ownMessage(ctx, currentUser, dialogID, messageID)
+	if err != nil {
+		return Message{}, err
+	}
+	if msg.Kind == "poll" || msg.Kind == "poll_vote" {
+		return Message{}, ErrForbidden
+	}
+	if time.Since(msg.CreatedAt) > editWindow {
+		return Message{}, ErrEditWindow
+	}
+	var mentions []Mention
+	if kind == KindGroup && msg.ForwardedFrom == nil {
+		if mentions, _, err = s.mentions(ctx, dialogID, currentUser, text); err != nil {
+			return Message{}, err
+		}
+	}
+	err = s.inTx(ctx, func(ctx context.Context) error {
+		edited, err := s.repo.EditMessage(ctx, dialogID, messageID, text, mentions)
+		if err != nil {
+			return err
+		}
+		msg.EditedAt = &edited
+		return s.publishMessageEvent(ctx, kind, MessageEvent{
+			Type: EventMessageEdited, DialogID: dialogID, MessageID: messageID, ActorID: currentUser, Text: text, EditedAt: &edited,
+			Mentions: mentions,
+		})
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	msg.Text = text
+	msg.Mentions = mentions
+	return msg, nil
+}
+
+// DeleteMessage removes a message. With forEveryone the sender turns it into a
+// tombstone for all members; otherwise any member hides it from their own history.
+func (s *Service) DeleteMessage(ctx context.Context, currentUser, dialogID uuid.UUID, messageID int64, forEveryone bool) error {
+	if !forEveryone {
+		ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrForbidden
+		}
+		if _, err := s.repo.GetMessage(ctx, dialogID, messageID); err != nil {
+			return err
+		}
+		return s.inTx(ctx, func(ctx context.Context) error {
+			if err := s.repo.HideMessage(ctx, dialogID, messageID, currentUser); err != nil {
+				return err
+			}
+			if err := s.recordUpdate(ctx, []uuid.UUID{currentUser}, Update{Type: EventMessageHidden, DialogID: dialogID, MessageID: &messageID}); err != nil {
+				return err
+			}
+			s.publish(ctx, func(ctx context.Context, p EventPublisher) error {
+				return p.PublishMessageEvent(ctx, MessageEvent{
+					Type: EventMessageHidden, DialogID: dialogID, MessageID: messageID, ActorID: currentUser,
+				}, []uuid.UUID{currentUser})
+			})
+			return nil
+		})
+	}
+	_, kind, err := s.ownMessage(ctx, currentUser, dialogID, messageID)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.DeleteMessage(ctx, dialogID, messageID); err != nil {
+			return err
+		}
+		return s.publishMessageEvent(ctx, kind, MessageEvent{
+			Type: EventMessageDeleted, DialogID: dialogID, MessageID: messageID, ActorID: currentUser,
+		})
+	})
+}
+
+// ownMessage loads a live text message sent by currentUser.
+func (s *Service) ownMessage(ctx context.Context, currentUser, dialogID uuid.UUID, messageID int64) (Message, string, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return Message{}, "", err
+	}
+	if !ok {
+		return Message{}, "", ErrForbidden
+	}
+	msg, err := s.repo.GetMessage(ctx, dialogID, messageID)
+	if err != nil {
+		return Message{}, "", err
+	}
+	if msg.Deleted {
+		return Message{}, "", ErrMessageNotFound
+	}
+	if msg.SenderID != currentUser || msg.Kind == "system" {
+		return Message{}, "", ErrForbidden
+	}
+	kind, err := s.repo.DialogKind(ctx, dialogID)
+	if err != nil {
+		return Message{}, "", err
+	}
+	return msg, kind, nil
+}
+
+// publishMessageEvent logs ev for the audience in the transaction of ctx and
+// publishes it once that commits.
+func (s *Service) publishMessageEvent(ctx context.Context, kind string, ev MessageEvent) error {
+	if kind == KindChannel {
+		s.publish(ctx, func(ctx context.Context, p EventPublisher) error { return p.PublishChannelEvent(ctx, ev) })
+		return nil
+	}
+	members, err := s.audience(ctx, ev.DialogID, ev.ActorID)
+	if err != nil {
+		return err
+	}
+	if err := s.recordUpdate(ctx, members, Update{Type: ev.Type, DialogID: ev.DialogID, MessageID: &ev.MessageID, ActorID: &ev.ActorID}); err != nil {
+		return err
+	}
+	s.publish(ctx, func(ctx context.Context, p EventPublisher) error { return p.PublishMessageEvent(ctx, ev, members) })
+	return nil
+}
@@ -2,13 +2,94 @@ package dialogs
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// Member event types.
+const (
+	EventMemberAdded       = "member.added"
+	EventMemberRemoved     = "member.removed"
+	EventMemberLeft        = "member.left"
+	EventMemberRoleChanged = "member.role_changed"
+	EventMemberJoined      = "member.joined"
+	EventJoinRequested     = "member.join_requested"
+)
+
+// MemberEvent describes a membership change in a group or channel.
+type MemberEvent struct {
+	Type    string
+	ActorID uuid.UUID
+	UserID  uuid.UUID
+	Role    string
+}
+
+// Message event types.
+const (
+	EventMessageNew     = "message.new"
+	EventMessageRead    = "message.read"
+	EventMessageEdited  = "message.edited"
+	EventMessageDeleted = "message.deleted"
+	// EventMessageHidden goes to the actor's own devices after "delete for me".
+	EventMessageHidden   = "message.hidden"
+	EventMessagePinned   = "message.pinned"
+	EventMessageUnpinned = "message.unpinned"
+	// EventMessageExpired reports that the reaper removed a disappearing message.
+	EventMessageExpired = "message.expired"
+)
+
+// MessageEvent describes a change to an existing message.
+type MessageEvent struct {
+	Type      string
+	DialogID  uuid.UUID
+	MessageID int64
+	ActorID   uuid.UUID
+	Text      string
+	EditedAt  *time.Time
+	// Mentions are the entities of an edited text.
+	Mentions []Mention
+}
+
+// EventReactionUpdated carries the new aggregated reactions of a message.
+const EventReactionUpdated = "reaction.updated"
+
+// ReactionEvent reports that ActorID added or removed Reaction; Reactions holds
+// the resulting counts without per-user flags.
+type ReactionEvent struct {
+	DialogID  uuid.UUID
+	MessageID int64
+	ActorID   uuid.UUID
+	Reaction  string
+	Added     bool
+	Reactions []Reaction
+}
+
 // EventPublisher pushes dialog events to realtime.
 type EventPublisher interface {
 	PublishMessage(ctx context.Context, msg Message, members []uuid.UUID) error
 	PublishDelivery(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64, members []uuid.UUID) error
 	PublishRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64, members []uuid.UUID) error
+	PublishTyping(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, members []uuid.UUID) error
+	PublishMember(ctx context.Context, dialogID uuid.UUID, ev MemberEvent, members []uuid.UUID) error
+	// PublishChannelMessage publishes a channel post once; realtime nodes fan it out
+	// to their locally connected subscribers.
+	PublishChannelMessage(ctx context.Context, msg Message) error
+	PublishMessageEvent(ctx context.Context, ev MessageEvent, members []uuid.UUID) error
+	// PublishChannelEvent is PublishMessageEvent for channels: published once to the channel topic.
+	PublishChannelEvent(ctx context.Context, ev MessageEvent) error
+	// PublishReaction sends reaction.updated to members; nil members means a
+	// channel, published once to the channel topic.
+	PublishReaction(ctx context.Context, ev ReactionEvent, members []uuid.UUID) error
+	// PublishSubscription tells realtime that userID joined or left a channel.
+	PublishSubscription(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, subscribed bool) error
+	// PublishPoll sends poll.updated to members; nil members means a channel.
+	PublishPoll(ctx context.Context, ev PollEvent, members []uuid.UUID) error
+	// PublishDraft sends draft.updated to all of userID's connections.
+	PublishDraft(ctx context.Context, userID uuid.UUID, d Draft) error
+	// PublishMention sends mention.new about msg to the mentioned recipients.
+	PublishMention(ctx context.Context, msg Message, recipients []uuid.UUID) error
+	// PublishSavedMessage sends message.new for a saved messages note to all
+	// of its author's connections, the sending one included.
+	PublishSavedMessage(ctx context.Context, msg Message) error
 }
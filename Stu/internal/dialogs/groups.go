@@ -0,0 +1,438 @@
+package dialogs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Member roles, from the most to the least privileged.
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Dialog kinds (dialog_kind enum).
+const (
+	KindDirect  = "direct"
+	KindGroup   = "group"
+	KindChannel = "channel"
+	// KindSaved is a user's own notes dialog; see saved.go.
+	KindSaved = "saved"
+)
+
+const (
+	maxGroupMembers = 200
+	maxTitleLength  = 128
+)
+
+var (
+	ErrNotGroup     = errors.New("not a group")
+	ErrInvalidRole  = errors.New("invalid role")
+	ErrInvalidTitle = errors.New("invalid title")
+	ErrGroupFull    = errors.New("group is full")
+	// ErrCannotAdd hides whether the user is missing, blocked or restricts invites.
+	ErrCannotAdd = errors.New("cannot add user")
+	// ErrOwnerMustTransfer refuses a channel owner's leave while no admin can
+	// take over.
+	ErrOwnerMustTransfer = errors.New("owner must transfer ownership first")
+)
+
+var roleRank = map[string]int{
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+	RoleOwner:     4,
+}
+
+// systemPayload is stored as the body of kind 'system' messages.
+type systemPayload struct {
+	Type    string `json:"type"`
+	ActorID string `json:"actor_id"`
+	UserID  string `json:"user_id,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Title   string `json:"title,omitempty"`
+	// MessageID refers to the affected message, e.g. of a pin.
+	MessageID int64 `json:"message_id,omitempty"`
+	// TTL is the new disappearing-messages timer in seconds.
+	TTL int `json:"ttl,omitempty"`
+}
+
+// CreateGroup creates a group owned by currentUser. Users whose
+// allow_add_to_group forbids it are skipped; only their number is returned,
+// so the creator cannot tell who restricts invites (see ErrCannotAdd).
+// Groups are end-to-end encrypted unless created with encrypted false, which
+// lets the server read them for polls, mentions and search.
+func (s *Service) CreateGroup(ctx context.Context, currentUser uuid.UUID, title string, memberIDs []uuid.UUID, encrypted bool) (uuid.UUID, int, error) {
+	title, err := normalizeTitle(title)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	seen := map[uuid.UUID]bool{currentUser: true}
+	var (
+		added   []uuid.UUID
+		skipped int
+	)
+	for _, id := range memberIDs {
+		if id == uuid.Nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ok, err := s.canAddToGroup(ctx, currentUser, id)
+		if err != nil {
+			return uuid.Nil, 0, err
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		added = append(added, id)
+	}
+	if len(added)+1 > maxGroupMembers {
+		return uuid.Nil, 0, ErrGroupFull
+	}
+	var dialogID uuid.UUID
+	err = s.inTx(ctx, func(ctx context.Context) error {
+		var err error
+		if dialogID, err = s.repo.CreateGroup(ctx, currentUser, title, added, encrypted); err != nil {
+			return err
+		}
+		if err := s.systemMessage(ctx, dialogID, KindGroup, systemPayload{Type: "group.created", ActorID: currentUser.String(), Title: title}); err != nil {
+			return err
+		}
+		for _, id := range added {
+			if err := s.publishMember(ctx, dialogID, KindGroup, MemberEvent{Type: EventMemberAdded, ActorID: currentUser, UserID: id, Role: RoleMember}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	return dialogID, skipped, nil
+}
+
+// GroupMembers lists members of a group or channel. In channels only
+// admins may see the subscriber list.
+func (s *Service) GroupMembers(ctx context.Context, currentUser, dialogID uuid.UUID) ([]Member, error) {
+	role, kind, err := s.managedRole(ctx, dialogID, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	if kind == KindChannel && roleRank[role] < roleRank[RoleAdmin] {
+		return nil, ErrForbidden
+	}
+	return s.repo.ListMembers(ctx, dialogID)
+}
+
+// AddMember adds target to a group or channel; requires admin or owner.
+func (s *Service) AddMember(ctx context.Context, currentUser, dialogID, target uuid.UUID) error {
+	role, kind, err := s.managedRole(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if roleRank[role] < roleRank[RoleAdmin] {
+		return ErrForbidden
+	}
+	ok, err := s.canAddToGroup(ctx, currentUser, target)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCannotAdd
+	}
+	if kind == KindGroup {
+		members, err := s.repo.Members(ctx, dialogID)
+		if err != nil {
+			return err
+		}
+		if len(members) >= maxGroupMembers {
+			return ErrGroupFull
+		}
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.AddMember(ctx, dialogID, target, RoleMember); err != nil {
+			return err
+		}
+		if kind == KindGroup {
+			if err := s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventMemberAdded, ActorID: currentUser.String(), UserID: target.String()}); err != nil {
+				return err
+			}
+		}
+		return s.publishMember(ctx, dialogID, kind, MemberEvent{Type: EventMemberAdded, ActorID: currentUser, UserID: target, Role: RoleMember})
+	})
+}
+
+// RemoveMember removes target; the actor must be at least a moderator
+// and rank above the target.
+func (s *Service) RemoveMember(ctx context.Context, currentUser, dialogID, target uuid.UUID) error {
+	if currentUser == target {
+		return s.LeaveGroup(ctx, currentUser, dialogID)
+	}
+	role, kind, err := s.managedRole(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	targetRole, err := s.repo.MemberRole(ctx, dialogID, target)
+	if err != nil {
+		return err
+	}
+	if roleRank[role] < roleRank[RoleModerator] || roleRank[role] <= roleRank[targetRole] {
+		return ErrForbidden
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.RemoveMember(ctx, dialogID, target); err != nil {
+			return err
+		}
+		if kind == KindGroup {
+			if err := s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventMemberRemoved, ActorID: currentUser.String(), UserID: target.String()}); err != nil {
+				return err
+			}
+		}
+		return s.publishMember(ctx, dialogID, kind, MemberEvent{Type: EventMemberRemoved, ActorID: currentUser, UserID: target})
+	})
+}
+
+// heirRoles lists, best first, who may inherit a dialog from its owner. A
+// channel goes to an admin only: a subscriber would gain posting rights to
+// the whole audience.
+var heirRoles = map[string][]string{
+	KindGroup:   {RoleAdmin, RoleModerator, RoleMember},
+	KindChannel: {RoleAdmin},
+}
+
+// LeaveGroup removes the caller from a group or channel. An owner hands
+// the dialog over to the highest-ranked, longest-standing member, in a
+// channel to an admin; a channel owner without admins gets
+// ErrOwnerMustTransfer.
+func (s *Service) LeaveGroup(ctx context.Context, currentUser, dialogID uuid.UUID) error {
+	role, kind, err := s.managedRole(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		if role == RoleOwner {
+			heir, ok, err := s.repo.Heir(ctx, dialogID, currentUser, heirRoles[kind])
+			if err != nil {
+				return err
+			}
+			if !ok && kind == KindChannel {
+				return ErrOwnerMustTransfer
+			}
+			if ok {
+				if err := s.repo.SetRole(ctx, dialogID, heir, RoleOwner); err != nil {
+					return err
+				}
+				if err := s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventMemberRoleChanged, ActorID: currentUser.String(), UserID: heir.String(), Role: RoleOwner}); err != nil {
+					return err
+				}
+				if err := s.publishMember(ctx, dialogID, kind, MemberEvent{Type: EventMemberRoleChanged, ActorID: currentUser, UserID: heir, Role: RoleOwner}); err != nil {
+					return err
+				}
+			}
+		}
+		if err := s.repo.RemoveMember(ctx, dialogID, currentUser); err != nil {
+			return err
+		}
+		if kind == KindGroup {
+			if err := s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventMemberLeft, ActorID: currentUser.String(), UserID: currentUser.String()}); err != nil {
+				return err
+			}
+		}
+		return s.publishMember(ctx, dialogID, kind, MemberEvent{Type: EventMemberLeft, ActorID: currentUser, UserID: currentUser})
+	})
+}
+
+// SetMemberRole changes target's role. Only admins and the owner may do it,
+// only for members ranked below them and only up to their own rank minus one.
+// The owner may pass ownership, becoming an admin.
+func (s *Service) SetMemberRole(ctx context.Context, currentUser, dialogID, target uuid.UUID, newRole string) error {
+	if _, ok := roleRank[newRole]; !ok {
+		return ErrInvalidRole
+	}
+	role, kind, err := s.managedRole(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	targetRole, err := s.repo.MemberRole(ctx, dialogID, target)
+	if err != nil {
+		return err
+	}
+	if currentUser == target || roleRank[role] < roleRank[RoleAdmin] || roleRank[role] <= roleRank[targetRole] {
+		return ErrForbidden
+	}
+	if newRole == RoleOwner {
+		if role != RoleOwner {
+			return ErrForbidden
+		}
+		return s.inTx(ctx, func(ctx context.Context) error {
+			if err := s.repo.SetRole(ctx, dialogID, target, RoleOwner); err != nil {
+				return err
+			}
+			if err := s.repo.SetRole(ctx, dialogID, currentUser, RoleAdmin); err != nil {
+				return err
+			}
+			if kind == KindGroup {
+				if err := s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventMemberRoleChanged, ActorID: currentUser.String(), UserID: target.String(), Role: RoleOwner}); err != nil {
+					return err
+				}
+			}
+			if err := s.publishMember(ctx, dialogID, kind, MemberEvent{Type: EventMemberRoleChanged, ActorID: currentUser, UserID: target, Role: RoleOwner}); err != nil {
+				return err
+			}
+			return s.publishMember(ctx, dialogID, kind, MemberEvent{Type: EventMemberRoleChanged, ActorID: currentUser, UserID: currentUser, Role: RoleAdmin})
+		})
+	}
+	if roleRank[newRole] >= roleRank[role] {
+		return ErrForbidden
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.SetRole(ctx, dialogID, target, newRole); err != nil {
+			return err
+		}
+		if kind == KindGroup {
+			if err := s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventMemberRoleChanged, ActorID: currentUser.String(), UserID: target.String(), Role: newRole}); err != nil {
+				return err
+			}
+		}
+		return s.publishMember(ctx, dialogID, kind, MemberEvent{Type: EventMemberRoleChanged, ActorID: currentUser, UserID: target, Role: newRole})
+	})
+}
+
+// SetTitle renames a group or channel; requires admin or owner.
+func (s *Service) SetTitle(ctx context.Context, currentUser, dialogID uuid.UUID, title string) error {
+	title, err := normalizeTitle(title)
+	if err != nil {
+		return err
+	}
+	role, kind, err := s.managedRole(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if roleRank[role] < roleRank[RoleAdmin] {
+		return ErrForbidden
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.SetTitle(ctx, dialogID, title); err != nil {
+			return err
+		}
+		return s.systemMessage(ctx, dialogID, kind, systemPayload{Type: kind + ".title_changed", ActorID: currentUser.String(), Title: title})
+	})
+}
+
+// managedRole returns the caller's role and the kind of a group or channel.
+func (s *Service) managedRole(ctx context.Context, dialogID, userID uuid.UUID) (string, string, error) {
+	kind, err := s.repo.DialogKind(ctx, dialogID)
+	if errors.Is(err, ErrDialogNotFound) {
+		return "", "", ErrForbidden
+	}
+	if err != nil {
+		return "", "", err
+	}
+	role, err := s.repo.MemberRole(ctx, dialogID, userID)
+	if errors.Is(err, ErrNotMember) {
+		return "", "", ErrForbidden
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if kind != KindGroup && kind != KindChannel {
+		return "", "", ErrNotGroup
+	}
+	return role, kind, nil
+}
+
+func (s *Service) canAddToGroup(ctx context.Context, actor, target uuid.UUID) (bool, error) {
+	if s.privacy == nil {
+		return true, nil
+	}
+	return s.privacy.CanAddToGroup(ctx, actor, target)
+}
+
+// systemMessage stores a service message in the transaction of ctx, so it
+// lands together with the change it describes, and publishes it once that
+// commits.
+func (s *Service) systemMessage(ctx context.Context, dialogID uuid.UUID, kind string, payload systemPayload) error {
+	body, _ := json.Marshal(payload)
+	actor := uuid.MustParse(payload.ActorID)
+	return s.inTx(ctx, func(ctx context.Context) error {
+		id, created, err := s.repo.SaveSystemMessage(ctx, dialogID, actor, string(body))
+		if err != nil {
+			return err
+		}
+		msg := Message{ID: id, DialogID: dialogID, SenderID: actor, Kind: "system", Text: string(body), CreatedAt: created}
+		if kind == KindChannel {
+			s.publish(ctx, func(ctx context.Context, p EventPublisher) error { return p.PublishChannelMessage(ctx, msg) })
+			return nil
+		}
+		members, err := s.repo.Members(ctx, dialogID)
+		if err != nil {
+			return err
+		}
+		if err := s.recordUpdate(ctx, members, Update{Type: EventMessageNew, DialogID: dialogID, MessageID: &id}); err != nil {
+			return err
+		}
+		s.publish(ctx, func(ctx context.Context, p EventPublisher) error { return p.PublishMessage(ctx, msg, members) })
+		return nil
+	})
+}
+
+// publishMember notifies about a membership change. In groups every member and
+// the affected user get the event; in channels only the actor and the affected
+// user do, plus a subscription update for realtime routing.
+func (s *Service) publishMember(ctx context.Context, dialogID uuid.UUID, kind string, ev MemberEvent) error {
+	var recipients []uuid.UUID
+	if kind == KindChannel {
+		recipients = []uuid.UUID{ev.ActorID}
+		switch ev.Type {
+		case EventMemberAdded, EventMemberJoined:
+			s.publish(ctx, func(ctx context.Context, p EventPublisher) error {
+				return p.PublishSubscription(ctx, dialogID, ev.UserID, true)
+			})
+		case EventMemberRemoved, EventMemberLeft:
+			s.publish(ctx, func(ctx context.Context, p EventPublisher) error {
+				return p.PublishSubscription(ctx, dialogID, ev.UserID, false)
+			})
+		}
+	} else {
+		members, err := s.repo.Members(ctx, dialogID)
+		if err != nil {
+			return err
+		}
+		recipients = members
+	}
+	if !contains(recipients, ev.UserID) {
+		recipients = append(recipients, ev.UserID)
+	}
+	if err := s.recordUpdate(ctx, recipients, Update{Type: ev.Type, DialogID: dialogID, ActorID: &ev.ActorID, UserID: &ev.UserID, Role: ev.Role}); err != nil {
+		return err
+	}
+	s.publish(ctx, func(ctx context.Context, p EventPublisher) error {
+		return p.PublishMember(ctx, dialogID, ev, recipients)
+	})
+	return nil
+}
+
+func contains(list []uuid.UUID, id uuid.UUID) bool {
+	for _, v := range list {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeTitle(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" || utf8.RuneCountInString(title) > maxTitleLength {
+		return "", ErrInvalidTitle
+	}
+	return title, nil
+}
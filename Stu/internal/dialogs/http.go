@@ -1,9 +1,13 @@
 package dialogs
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -13,14 +17,67 @@ import (
 )
 
 type createDialogRequest struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
 }
 
-type sendMessageRequest struct {
+type editMessageRequest struct {
 	Text string `json:"text"`
 }
 
+type forwardRequest struct {
+	FromDialogID uuid.UUID `json:"from_dialog_id"`
+	MessageIDs   []int64   `json:"message_ids"`
+	HideSender   bool      `json:"hide_sender"`
+}
+
+type createChannelRequest struct {
+	Title       string `json:"title"`
+	Username    string `json:"username"`
+	Description string `json:"description"`
+}
+
+type createGroupRequest struct {
+	Title     string      `json:"title"`
+	MemberIDs []uuid.UUID `json:"member_ids"`
+	// Encrypted is true when omitted.
+	Encrypted *bool `json:"encrypted"`
+}
+
+type reactionRequest struct {
+	Reaction string `json:"reaction"`
+}
+
+// reactionSettings.Allowed is null when any reaction is allowed.
+type reactionSettings struct {
+	Allowed []string `json:"allowed"`
+}
+
+type ttlSettings struct {
+	TTL int `json:"ttl"`
+}
+
+type pollRequest struct {
+	PollInput
+	ClientMessageID string `json:"client_message_id"`
+}
+
+type voteRequest struct {
+	Options []int `json:"options"`
+}
+
+type threadReadRequest struct {
+	MessageID int64 `json:"message_id"`
+}
+
+type scheduleRequest struct {
+	Text    string    `json:"text"`
+	ReplyTo *int64    `json:"reply_to"`
+	Quote   string    `json:"quote"`
+	SendAt  time.Time `json:"send_at"`
+}
+
 // RegisterHandlers mounts dialog routes under /v1/dialogs.
 func RegisterHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
 	r.Post("/", func(w http.ResponseWriter, req *http.Request) {
@@ -42,8 +99,11 @@ func RegisterHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
 		if target == "" {
 			target = payload.Email
 		}
+		if target == "" && payload.Username != "" {
+			target = "@" + strings.TrimPrefix(payload.Username, "@")
+		}
 		if target == "" {
-			http.Error(w, "user_id or email required", http.StatusBadRequest)
+			http.Error(w, "user_id, email or username required", http.StatusBadRequest)
 			return
 		}
 		dialogID, err := svc.CreateDirect(req.Context(), uuid.MustParse(curUser), target)
@@ -55,14 +115,100 @@ func RegisterHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
 		writeJSON(w, map[string]string{"dialog_id": dialogID.String()}, http.StatusCreated)
 	})
 
+	r.Post("/groups", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if auth.IsBanned(req.Context()) {
+			http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+			return
+		}
+		var payload createGroupRequest
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		encrypted := payload.Encrypted == nil || *payload.Encrypted
+		dialogID, skipped, err := svc.CreateGroup(req.Context(), uuid.MustParse(curUser), payload.Title, payload.MemberIDs, encrypted)
+		if err != nil {
+			writeGroupError(w, err, logger)
+			return
+		}
+		writeJSON(w, map[string]any{"dialog_id": dialogID, "not_added": skipped, "encrypted": encrypted}, http.StatusCreated)
+	})
+
+	r.Post("/channels", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if auth.IsBanned(req.Context()) {
+			http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+			return
+		}
+		var payload createChannelRequest
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		ch, err := svc.CreateChannel(req.Context(), uuid.MustParse(curUser), payload.Title, payload.Username, payload.Description)
+		if err != nil {
+			writeChannelError(w, err, logger)
+			return
+		}
+		writeJSON(w, ch, http.StatusCreated)
+	})
+
+	// Saved messages: created on first request, so clients can always open it.
+	r.Get("/saved", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		dialogID, err := svc.SavedMessages(req.Context(), uuid.MustParse(curUser))
+		if err != nil {
+			logger.Error().Err(err).Msg("saved messages failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"dialog_id": dialogID.String()}, http.StatusOK)
+	})
+
 	r.Get("/", func(w http.ResponseWriter, req *http.Request) {
 		curUser, _, ok := auth.UserFromContext(req.Context())
 		if !ok {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-		dialogs, err := svc.ListDialogs(req.Context(), uuid.MustParse(curUser), 50)
+		q := req.URL.Query()
+		var filter DialogFilter
+		for key, dst := range map[string]**bool{"archived": &filter.Archived, "muted": &filter.Muted, "pinned": &filter.Pinned} {
+			v, err := queryBool(q.Get(key))
+			if err != nil {
+				http.Error(w, "invalid "+key, http.StatusBadRequest)
+				return
+			}
+			*dst = v
+		}
+		if token := q.Get("cursor"); token != "" {
+			after, err := ParseDialogCursor(token)
+			if err != nil {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+			filter.After = &after
+		}
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		dialogs, err := svc.ListDialogs(req.Context(), uuid.MustParse(curUser), q.Get("folder"), filter, limit)
 		if err != nil {
+			if err == ErrInvalidFolder {
+				http.Error(w, "invalid folder", http.StatusBadRequest)
+				return
+			}
 			logger.Error().Err(err).Msg("list dialogs failed")
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
@@ -71,6 +217,173 @@ func RegisterHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
 	})
 
 	r.Route("/{id}", func(rt chi.Router) {
+		rt.Patch("/", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload struct {
+				Title string `json:"title"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := svc.SetTitle(req.Context(), uuid.MustParse(curUser), dialogID, payload.Title); err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Get("/channel", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			ch, err := svc.Channel(req.Context(), uuid.MustParse(curUser), dialogID)
+			if err != nil {
+				writeChannelError(w, err, logger)
+				return
+			}
+			writeJSON(w, ch, http.StatusOK)
+		})
+
+		rt.Get("/members", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			members, err := svc.GroupMembers(req.Context(), uuid.MustParse(curUser), dialogID)
+			if err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			writeJSON(w, members, http.StatusOK)
+		})
+
+		rt.Post("/members", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload struct {
+				UserID uuid.UUID `json:"user_id"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil || payload.UserID == uuid.Nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := svc.AddMember(req.Context(), uuid.MustParse(curUser), dialogID, payload.UserID); err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Patch("/members/{uid}", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			target, err := uuid.Parse(chi.URLParam(req, "uid"))
+			if err != nil {
+				http.Error(w, "invalid user id", http.StatusBadRequest)
+				return
+			}
+			var payload struct {
+				Role string `json:"role"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := svc.SetMemberRole(req.Context(), uuid.MustParse(curUser), dialogID, target, payload.Role); err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Delete("/members/{uid}", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			target, err := uuid.Parse(chi.URLParam(req, "uid"))
+			if err != nil {
+				http.Error(w, "invalid user id", http.StatusBadRequest)
+				return
+			}
+			if err := svc.RemoveMember(req.Context(), uuid.MustParse(curUser), dialogID, target); err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Post("/leave", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			if err := svc.LeaveGroup(req.Context(), uuid.MustParse(curUser), dialogID); err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
 		rt.Get("/messages", func(w http.ResponseWriter, req *http.Request) {
 			curUser, _, ok := auth.UserFromContext(req.Context())
 			if !ok {
@@ -116,21 +429,21 @@ func RegisterHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
 				http.Error(w, "invalid dialog id", http.StatusBadRequest)
 				return
 			}
-			var payload sendMessageRequest
+			var payload OutgoingMessage
 			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
 				http.Error(w, "invalid payload", http.StatusBadRequest)
 				return
 			}
-			if payload.Text == "" {
-				http.Error(w, "text required", http.StatusBadRequest)
-				return
-			}
-			msg, err := svc.SendMessage(req.Context(), uuid.MustParse(curUser), dialogID, payload.Text)
+			msg, err := svc.Send(req.Context(), uuid.MustParse(curUser), dialogID, payload)
 			if err != nil {
 				if err == ErrForbidden {
 					http.Error(w, "forbidden", http.StatusForbidden)
 					return
 				}
+				if err == ErrInvalidReply || err == ErrEmptyMessage || err == ErrInvalidClientID || err == ErrInvalidMessageKind || err == ErrInvalidThread || err == ErrInvalidAttachment {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
 				logger.Error().Err(err).Msg("send message failed")
 				http.Error(w, "internal error", http.StatusInternalServerError)
 				return
@@ -199,7 +512,1041 @@ func RegisterHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
 			}
 			writeJSON(w, map[string]string{"status": "ok"}, http.StatusOK)
 		})
-	})
+
+		rt.Post("/forward", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload forwardRequest
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil || payload.FromDialogID == uuid.Nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			msgs, err := svc.ForwardMessages(req.Context(), uuid.MustParse(curUser), payload.FromDialogID, payload.MessageIDs, dialogID, payload.HideSender)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, msgs, http.StatusCreated)
+		})
+
+		rt.Patch("/messages/{mid}", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			mid, err := strconv.ParseInt(chi.URLParam(req, "mid"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid message id", http.StatusBadRequest)
+				return
+			}
+			var payload editMessageRequest
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if payload.Text == "" {
+				http.Error(w, "text required", http.StatusBadRequest)
+				return
+			}
+			msg, err := svc.EditMessage(req.Context(), uuid.MustParse(curUser), dialogID, mid, payload.Text)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, msg, http.StatusOK)
+		})
+
+		rt.Delete("/messages/{mid}", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			mid, err := strconv.ParseInt(chi.URLParam(req, "mid"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid message id", http.StatusBadRequest)
+				return
+			}
+			forEveryone, _ := strconv.ParseBool(req.URL.Query().Get("for_everyone"))
+			if err := svc.DeleteMessage(req.Context(), uuid.MustParse(curUser), dialogID, mid, forEveryone); err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Post("/messages/{mid}/reactions", func(w http.ResponseWriter, req *http.Request) {
+			handleReaction(w, req, svc, logger, true)
+		})
+
+		rt.Delete("/messages/{mid}/reactions", func(w http.ResponseWriter, req *http.Request) {
+			handleReaction(w, req, svc, logger, false)
+		})
+
+		rt.Post("/polls", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload pollRequest
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			msg, err := svc.CreatePoll(req.Context(), uuid.MustParse(curUser), dialogID, payload.PollInput, payload.ClientMessageID)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, msg, http.StatusCreated)
+		})
+
+		rt.Post("/messages/{mid}/vote", func(w http.ResponseWriter, req *http.Request) {
+			handleVote(w, req, svc, logger, true)
+		})
+
+		rt.Delete("/messages/{mid}/vote", func(w http.ResponseWriter, req *http.Request) {
+			handleVote(w, req, svc, logger, false)
+		})
+
+		rt.Get("/messages/{mid}/thread", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			mid, err := strconv.ParseInt(chi.URLParam(req, "mid"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid message id", http.StatusBadRequest)
+				return
+			}
+			limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+			before, _ := strconv.ParseInt(req.URL.Query().Get("before"), 10, 64)
+			msgs, err := svc.ListThread(req.Context(), uuid.MustParse(curUser), dialogID, mid, limit, before)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, msgs, http.StatusOK)
+		})
+
+		rt.Post("/messages/{mid}/thread/read", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			mid, err := strconv.ParseInt(chi.URLParam(req, "mid"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid message id", http.StatusBadRequest)
+				return
+			}
+			var payload threadReadRequest
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := svc.MarkThreadRead(req.Context(), uuid.MustParse(curUser), dialogID, mid, payload.MessageID); err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Get("/mentions/next", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			after, _ := strconv.ParseInt(req.URL.Query().Get("after"), 10, 64)
+			msg, err := svc.NextMention(req.Context(), uuid.MustParse(curUser), dialogID, after)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, msg, http.StatusOK)
+		})
+
+		rt.Get("/pins", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			pins, err := svc.PinnedMessages(req.Context(), uuid.MustParse(curUser), dialogID)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, pins, http.StatusOK)
+		})
+
+		rt.Post("/messages/{mid}/pin", func(w http.ResponseWriter, req *http.Request) {
+			handlePin(w, req, svc, logger, true)
+		})
+
+		rt.Delete("/messages/{mid}/pin", func(w http.ResponseWriter, req *http.Request) {
+			handlePin(w, req, svc, logger, false)
+		})
+
+		rt.Patch("/settings", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload DialogSettingsUpdate
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			st, err := svc.UpdateDialogSettings(req.Context(), uuid.MustParse(curUser), dialogID, payload)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, st, http.StatusOK)
+		})
+
+		rt.Get("/reactions", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			allowed, err := svc.AllowedReactions(req.Context(), uuid.MustParse(curUser), dialogID)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, reactionSettings{Allowed: allowed}, http.StatusOK)
+		})
+
+		rt.Put("/reactions", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload reactionSettings
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			allowed, err := svc.SetAllowedReactions(req.Context(), uuid.MustParse(curUser), dialogID, payload.Allowed)
+			if err != nil {
+				if errors.Is(err, ErrForbidden) || errors.Is(err, ErrNotGroup) {
+					writeGroupError(w, err, logger)
+					return
+				}
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, reactionSettings{Allowed: allowed}, http.StatusOK)
+		})
+
+		rt.Put("/ttl", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload ttlSettings
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			if err := svc.SetMessageTTL(req.Context(), uuid.MustParse(curUser), dialogID, payload.TTL); err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, payload, http.StatusOK)
+		})
+
+		rt.Put("/draft", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload Draft
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 2*maxDraftSize)).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			payload.DialogID = dialogID
+			draft, err := svc.SaveDraft(req.Context(), uuid.MustParse(curUser), payload)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, draft, http.StatusOK)
+		})
+
+		rt.Get("/scheduled", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			list, err := svc.ListScheduled(req.Context(), uuid.MustParse(curUser), dialogID)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			if list == nil {
+				list = []ScheduledMessage{}
+			}
+			writeJSON(w, list, http.StatusOK)
+		})
+
+		rt.Post("/scheduled", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload scheduleRequest
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			out := OutgoingMessage{Text: payload.Text, ReplyTo: payload.ReplyTo, Quote: payload.Quote}
+			msg, err := svc.ScheduleMessage(req.Context(), uuid.MustParse(curUser), dialogID, out, payload.SendAt)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, msg, http.StatusCreated)
+		})
+
+		rt.Patch("/scheduled/{sid}", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			sid, err := strconv.ParseInt(chi.URLParam(req, "sid"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid scheduled message id", http.StatusBadRequest)
+				return
+			}
+			var payload ScheduledUpdate
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			msg, err := svc.EditScheduled(req.Context(), uuid.MustParse(curUser), dialogID, sid, payload)
+			if err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			writeJSON(w, msg, http.StatusOK)
+		})
+
+		rt.Delete("/scheduled/{sid}", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			sid, err := strconv.ParseInt(chi.URLParam(req, "sid"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid scheduled message id", http.StatusBadRequest)
+				return
+			}
+			if err := svc.CancelScheduled(req.Context(), uuid.MustParse(curUser), dialogID, sid); err != nil {
+				writeMessageError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Post("/typing", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			if err := svc.Typing(req.Context(), uuid.MustParse(curUser), dialogID); err != nil {
+				if err == ErrForbidden {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				logger.Error().Err(err).Msg("typing failed")
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Get("/invites", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			list, err := svc.Invites(req.Context(), uuid.MustParse(curUser), dialogID)
+			if err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			writeJSON(w, list, http.StatusOK)
+		})
+
+		rt.Post("/invites", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if auth.IsBanned(req.Context()) {
+				http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			var payload InviteOptions
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			inv, err := svc.CreateInvite(req.Context(), uuid.MustParse(curUser), dialogID, payload)
+			if err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			writeJSON(w, inv, http.StatusCreated)
+		})
+
+		rt.Delete("/invites/{inviteID}", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			inviteID, err := uuid.Parse(chi.URLParam(req, "inviteID"))
+			if err != nil {
+				http.Error(w, "invalid invite id", http.StatusBadRequest)
+				return
+			}
+			if err := svc.RevokeInvite(req.Context(), uuid.MustParse(curUser), dialogID, inviteID); err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		rt.Get("/join-requests", func(w http.ResponseWriter, req *http.Request) {
+			curUser, _, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+			if err != nil {
+				http.Error(w, "invalid dialog id", http.StatusBadRequest)
+				return
+			}
+			list, err := svc.JoinRequests(req.Context(), uuid.MustParse(curUser), dialogID)
+			if err != nil {
+				writeGroupError(w, err, logger)
+				return
+			}
+			writeJSON(w, list, http.StatusOK)
+		})
+
+		joinActions := map[string]func(ctx context.Context, userID, dialogID, target uuid.UUID) error{
+			"/join-requests/{uid}/approve": svc.ApproveJoinRequest,
+			"/join-requests/{uid}/decline": svc.DeclineJoinRequest,
+		}
+		for path, action := range joinActions {
+			rt.Post(path, func(w http.ResponseWriter, req *http.Request) {
+				curUser, _, ok := auth.UserFromContext(req.Context())
+				if !ok {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+				if err != nil {
+					http.Error(w, "invalid dialog id", http.StatusBadRequest)
+					return
+				}
+				target, err := uuid.Parse(chi.URLParam(req, "uid"))
+				if err != nil {
+					http.Error(w, "invalid user id", http.StatusBadRequest)
+					return
+				}
+				if err := action(req.Context(), uuid.MustParse(curUser), dialogID, target); err != nil {
+					writeGroupError(w, err, logger)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+		}
+
+		requestActions := map[string]func(ctx context.Context, userID, dialogID uuid.UUID) error{
+			"/accept":  svc.AcceptRequest,
+			"/decline": svc.DeclineRequest,
+			"/block":   svc.BlockRequest,
+		}
+		for path, action := range requestActions {
+			rt.Post(path, func(w http.ResponseWriter, req *http.Request) {
+				curUser, _, ok := auth.UserFromContext(req.Context())
+				if !ok {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+				if err != nil {
+					http.Error(w, "invalid dialog id", http.StatusBadRequest)
+					return
+				}
+				if err := action(req.Context(), uuid.MustParse(curUser), dialogID); err != nil {
+					switch err {
+					case ErrForbidden:
+						http.Error(w, "forbidden", http.StatusForbidden)
+					case ErrNoRequest:
+						http.Error(w, "no message request", http.StatusConflict)
+					default:
+						logger.Error().Err(err).Str("action", path).Msg("message request action failed")
+						http.Error(w, "internal error", http.StatusInternalServerError)
+					}
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+		}
+	})
+}
+
+// RegisterChannelHandlers mounts public channel links under /v1/channels.
+func RegisterChannelHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Get("/{username}", func(w http.ResponseWriter, req *http.Request) {
+		if _, _, ok := auth.UserFromContext(req.Context()); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ch, err := svc.ChannelByUsername(req.Context(), chi.URLParam(req, "username"))
+		if err != nil {
+			writeChannelError(w, err, logger)
+			return
+		}
+		writeJSON(w, ch, http.StatusOK)
+	})
+
+	r.Post("/{username}/join", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if auth.IsBanned(req.Context()) {
+			http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+			return
+		}
+		ch, err := svc.ChannelByUsername(req.Context(), chi.URLParam(req, "username"))
+		if err != nil {
+			writeChannelError(w, err, logger)
+			return
+		}
+		ch, err = svc.JoinChannel(req.Context(), uuid.MustParse(curUser), ch.ID)
+		if err != nil {
+			writeChannelError(w, err, logger)
+			return
+		}
+		writeJSON(w, ch, http.StatusOK)
+	})
+}
+
+// RegisterInviteHandlers mounts invite link routes under /v1/invites.
+func RegisterInviteHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Get("/{code}", func(w http.ResponseWriter, req *http.Request) {
+		if _, _, ok := auth.UserFromContext(req.Context()); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		preview, err := svc.PreviewInvite(req.Context(), chi.URLParam(req, "code"))
+		if err != nil {
+			writeGroupError(w, err, logger)
+			return
+		}
+		writeJSON(w, preview, http.StatusOK)
+	})
+
+	r.Post("/{code}/join", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if auth.IsBanned(req.Context()) {
+			http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+			return
+		}
+		res, err := svc.JoinByInvite(req.Context(), uuid.MustParse(curUser), chi.URLParam(req, "code"))
+		if err != nil {
+			writeGroupError(w, err, logger)
+			return
+		}
+		status := http.StatusOK
+		if res.Status == JoinRequested {
+			status = http.StatusAccepted
+		}
+		writeJSON(w, res, status)
+	})
+}
+
+// RegisterSyncHandlers mounts the delta sync routes under /v1/sync.
+func RegisterSyncHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		since, err := strconv.ParseInt(req.URL.Query().Get("since"), 10, 64)
+		if err != nil || since < 0 {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		diff, err := svc.Difference(req.Context(), uuid.MustParse(curUser), since, limit)
+		if err != nil {
+			logger.Error().Err(err).Msg("sync failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, diff, http.StatusOK)
+	})
+
+	r.Get("/state", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		st, err := svc.SyncState(req.Context(), uuid.MustParse(curUser))
+		if err != nil {
+			logger.Error().Err(err).Msg("sync state failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, st, http.StatusOK)
+	})
+}
+
+// RegisterDraftHandlers serves the caller's drafts across dialogs.
+func RegisterDraftHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		drafts, err := svc.ListDrafts(req.Context(), uuid.MustParse(curUser))
+		if err != nil {
+			logger.Error().Err(err).Msg("list drafts failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, drafts, http.StatusOK)
+	})
+}
+
+// RegisterSearchHandlers mounts message search under /v1/search.
+func RegisterSearchHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Get("/messages", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		q := req.URL.Query()
+		query := SearchQuery{Text: q.Get("q")}
+		for key, dst := range map[string]**uuid.UUID{"dialog_id": &query.DialogID, "sender_id": &query.SenderID} {
+			if v := q.Get(key); v != "" {
+				id, err := uuid.Parse(v)
+				if err != nil {
+					http.Error(w, "invalid "+key, http.StatusBadRequest)
+					return
+				}
+				*dst = &id
+			}
+		}
+		for key, dst := range map[string]**time.Time{"from": &query.From, "to": &query.To} {
+			if v := q.Get(key); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, "invalid "+key, http.StatusBadRequest)
+					return
+				}
+				*dst = &t
+			}
+		}
+		query.Limit, _ = strconv.Atoi(q.Get("limit"))
+		query.Before, _ = strconv.ParseInt(q.Get("before"), 10, 64)
+		hits, err := svc.SearchMessages(req.Context(), uuid.MustParse(curUser), query)
+		if err != nil {
+			writeMessageError(w, err, logger)
+			return
+		}
+		if hits == nil {
+			hits = []SearchHit{}
+		}
+		writeJSON(w, hits, http.StatusOK)
+	})
+}
+
+func writeChannelError(w http.ResponseWriter, err error, logger zerolog.Logger) {
+	switch {
+	case errors.Is(err, ErrDialogNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidChannel), errors.Is(err, ErrInvalidTitle):
+		http.Error(w, "invalid channel", http.StatusBadRequest)
+	case errors.Is(err, ErrChannelTaken):
+		http.Error(w, "channel username already taken", http.StatusConflict)
+	default:
+		logger.Error().Err(err).Msg("channel operation failed")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+func writeGroupError(w http.ResponseWriter, err error, logger zerolog.Logger) {
+	switch {
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	case errors.Is(err, ErrNotGroup):
+		http.Error(w, "not a group", http.StatusBadRequest)
+	case errors.Is(err, ErrNotMember):
+		http.Error(w, "not a member", http.StatusNotFound)
+	case errors.Is(err, ErrAlreadyMember):
+		http.Error(w, "already a member", http.StatusConflict)
+	case errors.Is(err, ErrInvalidRole):
+		http.Error(w, "invalid role", http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidTitle):
+		http.Error(w, "invalid title", http.StatusBadRequest)
+	case errors.Is(err, ErrGroupFull):
+		http.Error(w, "group is full", http.StatusConflict)
+	case errors.Is(err, ErrOwnerMustTransfer):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrCannotAdd):
+		http.Error(w, "cannot add user", http.StatusForbidden)
+	case errors.Is(err, ErrInvalidInvite):
+		http.Error(w, "invalid invite", http.StatusBadRequest)
+	case errors.Is(err, ErrInviteInvalid):
+		http.Error(w, "invite link is invalid or expired", http.StatusNotFound)
+	case errors.Is(err, ErrNoRequest):
+		http.Error(w, "no join request", http.StatusNotFound)
+	default:
+		logger.Error().Err(err).Msg("group operation failed")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// handleReaction adds a reaction from the JSON body or removes the one given
+// in the "reaction" query parameter.
+func handleReaction(w http.ResponseWriter, req *http.Request, svc *Service, logger zerolog.Logger, add bool) {
+	curUser, _, ok := auth.UserFromContext(req.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if auth.IsBanned(req.Context()) {
+		http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+		return
+	}
+	dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(w, "invalid dialog id", http.StatusBadRequest)
+		return
+	}
+	mid, err := strconv.ParseInt(chi.URLParam(req, "mid"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+	reaction := req.URL.Query().Get("reaction")
+	if add {
+		var payload reactionRequest
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		reaction = payload.Reaction
+	}
+	res, err := svc.React(req.Context(), uuid.MustParse(curUser), dialogID, mid, reaction, add)
+	if err != nil {
+		writeMessageError(w, err, logger)
+		return
+	}
+	writeJSON(w, res, http.StatusOK)
+}
+
+// handlePin pins (pin=true) or unpins a message.
+func handleVote(w http.ResponseWriter, req *http.Request, svc *Service, logger zerolog.Logger, vote bool) {
+	curUser, _, ok := auth.UserFromContext(req.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if auth.IsBanned(req.Context()) {
+		http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+		return
+	}
+	dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(w, "invalid dialog id", http.StatusBadRequest)
+		return
+	}
+	mid, err := strconv.ParseInt(chi.URLParam(req, "mid"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+	var payload voteRequest
+	if vote {
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil || len(payload.Options) == 0 {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+	}
+	poll, err := svc.Vote(req.Context(), uuid.MustParse(curUser), dialogID, mid, payload.Options)
+	if err != nil {
+		writeMessageError(w, err, logger)
+		return
+	}
+	writeJSON(w, poll, http.StatusOK)
+}
+
+func handlePin(w http.ResponseWriter, req *http.Request, svc *Service, logger zerolog.Logger, pin bool) {
+	curUser, _, ok := auth.UserFromContext(req.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if auth.IsBanned(req.Context()) {
+		http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+		return
+	}
+	dialogID, err := uuid.Parse(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(w, "invalid dialog id", http.StatusBadRequest)
+		return
+	}
+	mid, err := strconv.ParseInt(chi.URLParam(req, "mid"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+	if pin {
+		err = svc.PinMessage(req.Context(), uuid.MustParse(curUser), dialogID, mid)
+	} else {
+		err = svc.UnpinMessage(req.Context(), uuid.MustParse(curUser), dialogID, mid)
+	}
+	if err != nil {
+		writeMessageError(w, err, logger)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryBool parses an optional boolean query parameter; empty means unset.
+func queryBool(v string) (*bool, error) {
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func writeMessageError(w http.ResponseWriter, err error, logger zerolog.Logger) {
+	switch {
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	case errors.Is(err, ErrMessageNotFound):
+		http.Error(w, "message not found", http.StatusNotFound)
+	case errors.Is(err, ErrEditWindow):
+		http.Error(w, "edit window expired", http.StatusConflict)
+	case errors.Is(err, ErrInvalidReaction):
+		http.Error(w, "invalid reaction", http.StatusBadRequest)
+	case errors.Is(err, ErrReactionNotAllowed):
+		http.Error(w, "reaction not allowed", http.StatusForbidden)
+	case errors.Is(err, ErrTooManyReactions):
+		http.Error(w, "too many reactions", http.StatusConflict)
+	case errors.Is(err, ErrPinLimit):
+		http.Error(w, "pin limit reached", http.StatusConflict)
+	case errors.Is(err, ErrInvalidSettings):
+		http.Error(w, "invalid dialog settings", http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidTTL):
+		http.Error(w, "invalid message ttl", http.StatusBadRequest)
+	case errors.Is(err, ErrScheduledNotFound):
+		http.Error(w, "scheduled message not found", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidSchedule), errors.Is(err, ErrEmptyMessage), errors.Is(err, ErrInvalidReply):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidPoll), errors.Is(err, ErrInvalidVote), errors.Is(err, ErrInvalidMessageKind), errors.Is(err, ErrInvalidClientID),
+		errors.Is(err, ErrInvalidAttachment):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidThread):
+		http.Error(w, "invalid thread", http.StatusBadRequest)
+	case errors.Is(err, ErrInvalidSearch), errors.Is(err, ErrSearchEncrypted):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrPollClosed):
+		http.Error(w, "poll closed", http.StatusConflict)
+	case errors.Is(err, ErrDraftTooLarge):
+		http.Error(w, "draft too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, ErrScheduleLimit):
+		http.Error(w, "too many scheduled messages", http.StatusConflict)
+	case errors.Is(err, ErrDialogNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	default:
+		logger.Error().Err(err).Msg("message operation failed")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
 }
 
 func writeJSON(w http.ResponseWriter, payload any, status int) {
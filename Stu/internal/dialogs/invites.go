@@ -0,0 +1,267 @@
+package dialogs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const inviteCodeBytes = 16
+
+var ErrInvalidInvite = errors.New("invalid invite")
+
+// InviteOptions configure a new invite link; zero values mean no limit.
+type InviteOptions struct {
+	Title            string     `json:"title"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	MaxUses          *int       `json:"max_uses"`
+	RequiresApproval bool       `json:"requires_approval"`
+}
+
+// JoinResult tells whether the caller became a member or is waiting for approval.
+type JoinResult struct {
+	DialogID uuid.UUID `json:"dialog_id"`
+	Status   string    `json:"status"`
+}
+
+// Join statuses.
+const (
+	JoinJoined    = "joined"
+	JoinRequested = "requested"
+)
+
+// CreateInvite issues a new invite link; requires admin or owner.
+func (s *Service) CreateInvite(ctx context.Context, currentUser, dialogID uuid.UUID, opts InviteOptions) (Invite, error) {
+	if err := s.requireAdmin(ctx, dialogID, currentUser); err != nil {
+		return Invite{}, err
+	}
+	inv := Invite{DialogID: dialogID, CreatedBy: currentUser, ExpiresAt: opts.ExpiresAt, RequiresApproval: opts.RequiresApproval}
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return Invite{}, ErrInvalidInvite
+	}
+	if opts.MaxUses != nil {
+		if *opts.MaxUses <= 0 {
+			return Invite{}, ErrInvalidInvite
+		}
+		inv.MaxUses = opts.MaxUses
+	}
+	if title := strings.TrimSpace(opts.Title); title != "" {
+		if utf8.RuneCountInString(title) > maxTitleLength {
+			return Invite{}, ErrInvalidInvite
+		}
+		inv.Title = &title
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return Invite{}, err
+	}
+	inv.Code = code
+	return s.repo.CreateInvite(ctx, inv)
+}
+
+// Invites lists all links of the dialog, including revoked ones; requires admin or owner.
+func (s *Service) Invites(ctx context.Context, currentUser, dialogID uuid.UUID) ([]Invite, error) {
+	if err := s.requireAdmin(ctx, dialogID, currentUser); err != nil {
+		return nil, err
+	}
+	list, err := s.repo.ListInvites(ctx, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []Invite{}
+	}
+	return list, nil
+}
+
+// RevokeInvite disables a link; already admitted members stay.
+func (s *Service) RevokeInvite(ctx context.Context, currentUser, dialogID, inviteID uuid.UUID) error {
+	if err := s.requireAdmin(ctx, dialogID, currentUser); err != nil {
+		return err
+	}
+	return s.repo.RevokeInvite(ctx, dialogID, inviteID)
+}
+
+// PreviewInvite describes the dialog behind a usable link.
+func (s *Service) PreviewInvite(ctx context.Context, code string) (InvitePreview, error) {
+	inv, err := s.usableInvite(ctx, code)
+	if err != nil {
+		return InvitePreview{}, err
+	}
+	return s.repo.GetInvitePreview(ctx, inv.ID)
+}
+
+// JoinByInvite admits currentUser through a link. Approval-mode links create
+// a join request for the admins instead. Joining twice is a no-op.
+func (s *Service) JoinByInvite(ctx context.Context, currentUser uuid.UUID, code string) (JoinResult, error) {
+	inv, err := s.usableInvite(ctx, code)
+	if err != nil {
+		return JoinResult{}, err
+	}
+	res := JoinResult{DialogID: inv.DialogID, Status: JoinJoined}
+	member, err := s.repo.CheckMember(ctx, inv.DialogID, currentUser)
+	if err != nil {
+		return JoinResult{}, err
+	}
+	if member {
+		return res, nil
+	}
+	kind, err := s.repo.DialogKind(ctx, inv.DialogID)
+	if err != nil {
+		return JoinResult{}, err
+	}
+	if inv.RequiresApproval {
+		if err := s.repo.CreateJoinRequest(ctx, inv.DialogID, currentUser, inv.ID); err != nil {
+			return JoinResult{}, err
+		}
+		s.notifyAdmins(ctx, inv.DialogID, MemberEvent{Type: EventJoinRequested, ActorID: currentUser, UserID: currentUser})
+		res.Status = JoinRequested
+		return res, nil
+	}
+	if err := s.checkCapacity(ctx, inv.DialogID, kind); err != nil {
+		return JoinResult{}, err
+	}
+	err = s.inTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.JoinByInvite(ctx, inv.ID, currentUser); err != nil {
+			return err
+		}
+		if kind == KindGroup {
+			if err := s.systemMessage(ctx, inv.DialogID, kind, systemPayload{Type: EventMemberJoined, ActorID: currentUser.String(), UserID: currentUser.String()}); err != nil {
+				return err
+			}
+		}
+		return s.publishMember(ctx, inv.DialogID, kind, MemberEvent{Type: EventMemberJoined, ActorID: currentUser, UserID: currentUser, Role: RoleMember})
+	})
+	if err != nil && !errors.Is(err, ErrAlreadyMember) {
+		return JoinResult{}, err
+	}
+	return res, nil
+}
+
+// JoinRequests lists pending joins; requires admin or owner.
+func (s *Service) JoinRequests(ctx context.Context, currentUser, dialogID uuid.UUID) ([]JoinRequest, error) {
+	if err := s.requireAdmin(ctx, dialogID, currentUser); err != nil {
+		return nil, err
+	}
+	list, err := s.repo.ListJoinRequests(ctx, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []JoinRequest{}
+	}
+	return list, nil
+}
+
+// ApproveJoinRequest admits a pending user on behalf of the approving admin.
+func (s *Service) ApproveJoinRequest(ctx context.Context, currentUser, dialogID, target uuid.UUID) error {
+	role, kind, err := s.managedRole(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if roleRank[role] < roleRank[RoleAdmin] {
+		return ErrForbidden
+	}
+	if err := s.checkCapacity(ctx, dialogID, kind); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteJoinRequest(ctx, dialogID, target); err != nil {
+		return err
+	}
+	err = s.inTx(ctx, func(ctx context.Context) error {
+		if err := s.repo.AddMember(ctx, dialogID, target, RoleMember); err != nil {
+			return err
+		}
+		if kind == KindGroup {
+			if err := s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventMemberAdded, ActorID: currentUser.String(), UserID: target.String()}); err != nil {
+				return err
+			}
+		}
+		return s.publishMember(ctx, dialogID, kind, MemberEvent{Type: EventMemberAdded, ActorID: currentUser, UserID: target, Role: RoleMember})
+	})
+	if errors.Is(err, ErrAlreadyMember) {
+		return nil
+	}
+	return err
+}
+
+// DeclineJoinRequest drops a pending join silently.
+func (s *Service) DeclineJoinRequest(ctx context.Context, currentUser, dialogID, target uuid.UUID) error {
+	if err := s.requireAdmin(ctx, dialogID, currentUser); err != nil {
+		return err
+	}
+	return s.repo.DeleteJoinRequest(ctx, dialogID, target)
+}
+
+// usableInvite resolves a code; revoked, expired and exhausted links all look invalid.
+func (s *Service) usableInvite(ctx context.Context, code string) (Invite, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return Invite{}, ErrInviteInvalid
+	}
+	inv, err := s.repo.GetInviteByCode(ctx, code)
+	if err != nil {
+		return Invite{}, err
+	}
+	if !inv.Usable(time.Now()) {
+		return Invite{}, ErrInviteInvalid
+	}
+	return inv, nil
+}
+
+func (s *Service) requireAdmin(ctx context.Context, dialogID, userID uuid.UUID) error {
+	role, _, err := s.managedRole(ctx, dialogID, userID)
+	if err != nil {
+		return err
+	}
+	if roleRank[role] < roleRank[RoleAdmin] {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (s *Service) checkCapacity(ctx context.Context, dialogID uuid.UUID, kind string) error {
+	if kind != KindGroup {
+		return nil
+	}
+	members, err := s.repo.Members(ctx, dialogID)
+	if err != nil {
+		return err
+	}
+	if len(members) >= maxGroupMembers {
+		return ErrGroupFull
+	}
+	return nil
+}
+
+// notifyAdmins sends a membership event to admins and the owner only.
+func (s *Service) notifyAdmins(ctx context.Context, dialogID uuid.UUID, ev MemberEvent) {
+	if s.publisher == nil {
+		return
+	}
+	members, err := s.repo.ListMembers(ctx, dialogID)
+	if err != nil {
+		return
+	}
+	var admins []uuid.UUID
+	for _, m := range members {
+		if roleRank[m.Role] >= roleRank[RoleAdmin] {
+			admins = append(admins, m.UserID)
+		}
+	}
+	_ = s.publisher.PublishMember(ctx, dialogID, ev, admins)
+}
+
+func newInviteCode() (string, error) {
+	buf := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
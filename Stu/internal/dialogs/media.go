@@ -0,0 +1,93 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// maxAttachments bounds the media of one message.
+const maxAttachments = 10
+
+var ErrInvalidAttachment = errors.New("invalid attachment")
+
+// MediaStore deletes uploaded blobs from object storage.
+type MediaStore interface {
+	DeleteObject(ctx context.Context, bucket, key string) error
+}
+
+// MediaObject locates the blob of a deleted media_objects row.
+type MediaObject struct {
+	Bucket string
+	Key    string
+}
+
+// SetMediaStore enables deleting the blobs of expired messages.
+func (s *Service) SetMediaStore(store MediaStore) {
+	s.media = store
+}
+
+// checkAttachments accepts up to maxAttachments distinct uploads of the
+// sender that no other message uses yet: a blob belongs to one message and
+// goes away with it.
+func (s *Service) checkAttachments(ctx context.Context, sender uuid.UUID, ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if len(ids) > maxAttachments {
+		return ErrInvalidAttachment
+	}
+	seen := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return ErrInvalidAttachment
+		}
+		seen[id] = true
+	}
+	ok, err := s.repo.UsableMedia(ctx, sender, ids)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidAttachment
+	}
+	return nil
+}
+
+// attachMedia fills the attachments of msgs.
+func (s *Service) attachMedia(ctx context.Context, msgs []Message) error {
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		if !m.Deleted {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	byMessage, err := s.repo.MessageMedia(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		msgs[i].Attachments = byMessage[msgs[i].ID]
+	}
+	return nil
+}
+
+// deleteBlobs removes the blobs of media rows deleted with their messages.
+// The rows are gone by then, so a failure leaves an orphaned blob and is
+// only reported.
+func (s *Service) deleteBlobs(ctx context.Context, objects []MediaObject) error {
+	if s.media == nil {
+		return nil
+	}
+	var errs []error
+	for _, o := range objects {
+		if err := s.media.DeleteObject(ctx, o.Bucket, o.Key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,175 @@
+package dialogs
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// maxMentions caps the entities kept per message; further @names stay plain text.
+const maxMentions = 50
+
+// EventMentionNew notifies a mentioned member even when the dialog is muted,
+// unless the member turned that off with notify_mentions.
+const EventMentionNew = "mention.new"
+
+// Mention is an @username or @all entity of a message text. Offset and
+// Length count runes and cover the "@". UserID is unset for @all.
+type Mention struct {
+	Offset int        `json:"offset"`
+	Length int        `json:"length"`
+	UserID *uuid.UUID `json:"user_id,omitempty"`
+	All    bool       `json:"all,omitempty"`
+}
+
+// mentionToken is an @name found in a text, before it is resolved.
+type mentionToken struct {
+	offset, length int
+	name           string
+}
+
+// mentions resolves the @username and @all mentions of a group message from
+// sender. @username counts only for members; @all, reserved to moderators
+// and above, notifies every other member. It returns the entities and the
+// members to notify.
+func (s *Service) mentions(ctx context.Context, dialogID, sender uuid.UUID, text string) ([]Mention, []uuid.UUID, error) {
+	tokens := scanMentions(text)
+	if len(tokens) == 0 {
+		return nil, nil, nil
+	}
+	// the text of an encrypted group is ciphertext to the server
+	encrypted, err := s.repo.DialogEncrypted(ctx, dialogID)
+	if err != nil || encrypted {
+		return nil, nil, err
+	}
+	var names []string
+	all := false
+	for _, t := range tokens {
+		if t.name == "all" {
+			all = true
+		} else {
+			names = append(names, t.name)
+		}
+	}
+	byName, err := s.repo.MembersByUsername(ctx, dialogID, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	if all {
+		role, err := s.repo.MemberRole(ctx, dialogID, sender)
+		if err != nil {
+			return nil, nil, err
+		}
+		all = roleRank[role] >= roleRank[RoleModerator]
+	}
+	var (
+		entities  []Mention
+		mentioned []uuid.UUID
+	)
+	for _, t := range tokens {
+		if len(entities) == maxMentions {
+			break
+		}
+		m := Mention{Offset: t.offset, Length: t.length}
+		if t.name == "all" {
+			if !all {
+				continue
+			}
+			m.All = true
+		} else {
+			id, ok := byName[t.name]
+			if !ok {
+				continue
+			}
+			m.UserID = &id
+			if id != sender && !slices.Contains(mentioned, id) {
+				mentioned = append(mentioned, id)
+			}
+		}
+		entities = append(entities, m)
+	}
+	if slices.ContainsFunc(entities, func(m Mention) bool { return m.All }) {
+		members, err := s.repo.Members(ctx, dialogID)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range members {
+			if id != sender && !slices.Contains(mentioned, id) {
+				mentioned = append(mentioned, id)
+			}
+		}
+	}
+	return entities, mentioned, nil
+}
+
+// scanMentions finds the "@name" tokens that start a word, with lowercased
+// names that could be usernames or "all".
+func scanMentions(text string) []mentionToken {
+	var (
+		tokens []mentionToken
+		prev   rune
+		offset int
+	)
+	for i, r := range text {
+		if r == '@' && !unicode.IsLetter(prev) && !unicode.IsDigit(prev) && prev != '_' && prev != '@' {
+			end := i + 1
+			for end < len(text) && isNameRune(rune(text[end])) {
+				end++
+			}
+			name := strings.ToLower(text[i+1 : end])
+			if name == "all" || usernameLike(name) {
+				tokens = append(tokens, mentionToken{offset: offset, length: utf8.RuneCountInString(text[i:end]), name: name})
+			}
+		}
+		prev = r
+		offset++
+	}
+	return tokens
+}
+
+func isNameRune(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_')
+}
+
+// usernameLike mirrors the shape users.ValidateUsername accepts.
+func usernameLike(name string) bool {
+	return len(name) >= 5 && len(name) <= 32 && name[0] >= 'a' && name[0] <= 'z'
+}
+
+// publishMentions sends mention.new to the mentioned members whose settings
+// let it through.
+func (s *Service) publishMentions(ctx context.Context, msg Message, mentioned []uuid.UUID) {
+	if s.publisher == nil || len(mentioned) == 0 {
+		return
+	}
+	recipients, err := s.repo.MentionRecipients(ctx, msg.DialogID, mentioned)
+	if err != nil || len(recipients) == 0 {
+		return
+	}
+	_ = s.publisher.PublishMention(ctx, msg, recipients)
+}
+
+// NextMention returns the oldest unread message after the given id that
+// mentions the caller, to jump to it. Reading past it marks it read.
+func (s *Service) NextMention(ctx context.Context, currentUser, dialogID uuid.UUID, after int64) (Message, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, ErrForbidden
+	}
+	id, err := s.repo.NextMention(ctx, dialogID, currentUser, after)
+	if err != nil {
+		return Message{}, err
+	}
+	msg, err := s.repo.GetMessage(ctx, dialogID, id)
+	if err != nil {
+		return Message{}, err
+	}
+	return s.withPoll(ctx, currentUser, msg)
+}
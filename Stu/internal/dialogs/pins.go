@@ -0,0 +1,177 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxPinnedMessages = 50
+	maxPinnedDialogs  = 5
+)
+
+// muteForever is stored as muted_until for an indefinite mute.
+var muteForever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+var (
+	ErrPinLimit        = errors.New("pin limit reached")
+	ErrInvalidSettings = errors.New("invalid dialog settings")
+)
+
+// DialogSettingsUpdate changes the caller's state of a dialog; nil fields stay.
+// MuteFor is in seconds: 0 unmutes, -1 mutes forever.
+type DialogSettingsUpdate struct {
+	MuteFor  *int64 `json:"mute_for"`
+	Archived *bool  `json:"archived"`
+	Pinned   *bool  `json:"pinned"`
+	// NotifyMentions lets mentions notify while the dialog is muted.
+	NotifyMentions *bool `json:"notify_mentions"`
+}
+
+// PinMessage pins a message for all members. Any member may pin in a direct
+// dialog, moderators and above in a group, admins and above in a channel.
+func (s *Service) PinMessage(ctx context.Context, currentUser, dialogID uuid.UUID, messageID int64) error {
+	kind, err := s.canPin(ctx, currentUser, dialogID)
+	if err != nil {
+		return err
+	}
+	msg, err := s.repo.GetMessage(ctx, dialogID, messageID)
+	if err != nil {
+		return err
+	}
+	if msg.Deleted || msg.Kind == "system" || msg.Kind == "poll_vote" {
+		return ErrMessageNotFound
+	}
+	pins, err := s.repo.PinnedMessages(ctx, dialogID)
+	if err != nil {
+		return err
+	}
+	if len(pins) >= maxPinnedMessages {
+		return ErrPinLimit
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		added, err := s.repo.PinMessage(ctx, dialogID, messageID, currentUser)
+		if err != nil || !added {
+			return err
+		}
+		if kind == KindGroup {
+			if err := s.systemMessage(ctx, dialogID, kind, systemPayload{Type: EventMessagePinned, ActorID: currentUser.String(), MessageID: messageID}); err != nil {
+				return err
+			}
+		}
+		return s.publishMessageEvent(ctx, kind, MessageEvent{Type: EventMessagePinned, DialogID: dialogID, MessageID: messageID, ActorID: currentUser})
+	})
+}
+
+// UnpinMessage removes a pin; unpinning a message that is not pinned is a no-op.
+func (s *Service) UnpinMessage(ctx context.Context, currentUser, dialogID uuid.UUID, messageID int64) error {
+	kind, err := s.canPin(ctx, currentUser, dialogID)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(ctx context.Context) error {
+		removed, err := s.repo.UnpinMessage(ctx, dialogID, messageID)
+		if err != nil || !removed {
+			return err
+		}
+		return s.publishMessageEvent(ctx, kind, MessageEvent{Type: EventMessageUnpinned, DialogID: dialogID, MessageID: messageID, ActorID: currentUser})
+	})
+}
+
+// PinnedMessages lists the dialog's pins, most recently pinned first.
+func (s *Service) PinnedMessages(ctx context.Context, currentUser, dialogID uuid.UUID) ([]Message, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrForbidden
+	}
+	pins, err := s.repo.PinnedMessages(ctx, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	if pins == nil {
+		pins = []Message{}
+	}
+	return pins, nil
+}
+
+// UpdateDialogSettings applies the caller's mute, archive and pin state.
+// At most maxPinnedDialogs dialogs may be pinned at once.
+func (s *Service) UpdateDialogSettings(ctx context.Context, currentUser, dialogID uuid.UUID, upd DialogSettingsUpdate) (DialogSettings, error) {
+	st, err := s.repo.MemberSettings(ctx, dialogID, currentUser)
+	if errors.Is(err, ErrNotMember) {
+		return DialogSettings{}, ErrForbidden
+	}
+	if err != nil {
+		return DialogSettings{}, err
+	}
+	if upd.MuteFor != nil {
+		switch d := *upd.MuteFor; {
+		case d == 0:
+			st.MutedUntil = nil
+		case d == -1:
+			st.MutedUntil = &muteForever
+		case d > 0:
+			until := time.Now().Add(time.Duration(d) * time.Second).UTC()
+			st.MutedUntil = &until
+		default:
+			return DialogSettings{}, ErrInvalidSettings
+		}
+	}
+	if upd.Archived != nil {
+		st.Archived = *upd.Archived
+	}
+	if upd.NotifyMentions != nil {
+		st.NotifyMentions = *upd.NotifyMentions
+	}
+	if upd.Pinned != nil {
+		if *upd.Pinned && !st.Pinned {
+			n, err := s.repo.CountPinnedDialogs(ctx, currentUser)
+			if err != nil {
+				return DialogSettings{}, err
+			}
+			if n >= maxPinnedDialogs {
+				return DialogSettings{}, ErrPinLimit
+			}
+		}
+		st.Pinned = *upd.Pinned
+	}
+	if err := s.repo.SetMemberSettings(ctx, dialogID, currentUser, st); err != nil {
+		return DialogSettings{}, err
+	}
+	return st, nil
+}
+
+// canPin returns the dialog kind when currentUser may manage its pins.
+func (s *Service) canPin(ctx context.Context, currentUser, dialogID uuid.UUID) (string, error) {
+	kind, err := s.repo.DialogKind(ctx, dialogID)
+	if errors.Is(err, ErrDialogNotFound) {
+		return "", ErrForbidden
+	}
+	if err != nil {
+		return "", err
+	}
+	role, err := s.repo.MemberRole(ctx, dialogID, currentUser)
+	if errors.Is(err, ErrNotMember) {
+		return "", ErrForbidden
+	}
+	if err != nil {
+		return "", err
+	}
+	need := RoleMember
+	switch kind {
+	case KindGroup:
+		need = RoleModerator
+	case KindChannel:
+		need = RoleAdmin
+	}
+	if roleRank[role] < roleRank[need] {
+		return "", ErrForbidden
+	}
+	return kind, nil
+}
@@ -0,0 +1,280 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 100
+	minPollOptions        = 2
+	maxPollOptions        = 10
+	maxPollDuration       = 365 * 24 * time.Hour
+	// maxPollVoters caps the voters listed per option of a public poll.
+	maxPollVoters = 100
+)
+
+// EventPollUpdated carries the new results of a poll.
+const EventPollUpdated = "poll.updated"
+
+var (
+	ErrInvalidPoll        = errors.New("invalid poll")
+	ErrInvalidVote        = errors.New("invalid vote")
+	ErrPollClosed         = errors.New("poll closed")
+	ErrInvalidMessageKind = errors.New("invalid message kind")
+)
+
+// PollInput describes a new poll. Anonymous polls hide who voted for what.
+type PollInput struct {
+	Question  string     `json:"question"`
+	Options   []string   `json:"options"`
+	Multiple  bool       `json:"multiple"`
+	Anonymous bool       `json:"anonymous"`
+	ClosesAt  *time.Time `json:"closes_at"`
+}
+
+// Poll is a poll with its results. Chosen marks the viewer's own votes;
+// VoterIDs is empty for anonymous polls.
+type Poll struct {
+	Options   []PollOption `json:"options"`
+	Multiple  bool         `json:"multiple"`
+	Anonymous bool         `json:"anonymous"`
+	ClosesAt  *time.Time   `json:"closes_at,omitempty"`
+	Closed    bool         `json:"closed"`
+	// Voters counts distinct users who voted.
+	Voters int `json:"voters"`
+}
+
+type PollOption struct {
+	ID       int         `json:"id"`
+	Text     string      `json:"text"`
+	Votes    int         `json:"votes"`
+	Chosen   bool        `json:"chosen,omitempty"`
+	VoterIDs []uuid.UUID `json:"voter_ids,omitempty"`
+}
+
+// PollEvent reports a vote or retraction; ActorID is uuid.Nil for anonymous polls.
+type PollEvent struct {
+	DialogID  uuid.UUID
+	MessageID int64
+	ActorID   uuid.UUID
+	Poll      Poll
+}
+
+// CreatePoll posts a poll into an unencrypted dialog; the question is the
+// message text. Encrypted dialogs carry polls inside the message content
+// instead, see Send.
+func (s *Service) CreatePoll(ctx context.Context, currentUser, dialogID uuid.UUID, in PollInput, clientMessageID string) (Message, error) {
+	in, err := normalizePoll(in)
+	if err != nil {
+		return Message{}, err
+	}
+	if clientMessageID != "" && !validClientID(clientMessageID) {
+		return Message{}, ErrInvalidClientID
+	}
+	encrypted, err := s.repo.DialogEncrypted(ctx, dialogID)
+	if err != nil {
+		return Message{}, err
+	}
+	if encrypted {
+		return Message{}, ErrInvalidMessageKind
+	}
+	if clientMessageID != "" {
+		orig, err := s.repo.MessageByClientID(ctx, dialogID, currentUser, clientMessageID)
+		if err == nil {
+			return s.withPoll(ctx, currentUser, orig)
+		}
+		if !errors.Is(err, ErrMessageNotFound) {
+			return Message{}, err
+		}
+	}
+	kind, err := s.checkSend(ctx, currentUser, dialogID)
+	if err != nil {
+		return Message{}, err
+	}
+	return s.store(ctx, kind, NewMessage{
+		DialogID: dialogID, SenderID: currentUser, Kind: "poll", Text: in.Question, Poll: &in, ClientMessageID: clientMessageID,
+	}, nil)
+}
+
+// Vote sets the caller's choice in a poll, replacing an earlier one; no
+// options retracts the vote. It returns the results as seen by the caller.
+func (s *Service) Vote(ctx context.Context, currentUser, dialogID uuid.UUID, messageID int64, options []int) (Poll, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return Poll{}, err
+	}
+	if !ok {
+		return Poll{}, ErrForbidden
+	}
+	msg, err := s.repo.GetMessage(ctx, dialogID, messageID)
+	if err != nil {
+		return Poll{}, err
+	}
+	if msg.Deleted || msg.Kind != "poll" {
+		return Poll{}, ErrMessageNotFound
+	}
+	polls, err := s.repo.Polls(ctx, currentUser, []int64{messageID})
+	if err != nil {
+		return Poll{}, err
+	}
+	poll := polls[messageID]
+	if poll == nil {
+		// an encrypted poll: votes go as poll_vote messages
+		return Poll{}, ErrMessageNotFound
+	}
+	if poll.Closed {
+		return Poll{}, ErrPollClosed
+	}
+	options = slices.Clone(options)
+	slices.Sort(options)
+	options = slices.Compact(options)
+	if len(options) > 1 && !poll.Multiple {
+		return Poll{}, ErrInvalidVote
+	}
+	for _, o := range options {
+		if o < 0 || o >= len(poll.Options) {
+			return Poll{}, ErrInvalidVote
+		}
+	}
+	if len(options) > 0 {
+		if err := s.checkCanMessage(ctx, dialogID, currentUser); err != nil {
+			return Poll{}, err
+		}
+	}
+	changed, err := s.repo.SetPollVote(ctx, messageID, currentUser, options)
+	if err != nil {
+		return Poll{}, err
+	}
+	if polls, err = s.repo.Polls(ctx, currentUser, []int64{messageID}); err != nil {
+		return Poll{}, err
+	}
+	res := *polls[messageID]
+	if changed {
+		s.publishPoll(ctx, currentUser, PollEvent{DialogID: dialogID, MessageID: messageID, Poll: res})
+	}
+	return res, nil
+}
+
+// open returns the results of the poll before anyone voted.
+func (in PollInput) open() *Poll {
+	p := &Poll{Multiple: in.Multiple, Anonymous: in.Anonymous, ClosesAt: in.ClosesAt, Options: make([]PollOption, len(in.Options))}
+	for i, text := range in.Options {
+		p.Options[i] = PollOption{ID: i, Text: text}
+	}
+	return p
+}
+
+// attachPolls fills Poll of the listed poll messages for the viewer.
+func (s *Service) attachPolls(ctx context.Context, viewer uuid.UUID, msgs []Message) error {
+	var ids []int64
+	for _, m := range msgs {
+		if m.Kind == "poll" && !m.Deleted {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	byMessage, err := s.repo.Polls(ctx, viewer, ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		msgs[i].Poll = byMessage[msgs[i].ID]
+	}
+	return nil
+}
+
+func (s *Service) withPoll(ctx context.Context, viewer uuid.UUID, msg Message) (Message, error) {
+	msgs := []Message{msg}
+	if err := s.attachPolls(ctx, viewer, msgs); err != nil {
+		return Message{}, err
+	}
+	return msgs[0], nil
+}
+
+// publishPoll sends the results without the actor's own choices, and without
+// the actor for anonymous polls.
+func (s *Service) publishPoll(ctx context.Context, actor uuid.UUID, ev PollEvent) {
+	if s.publisher == nil {
+		return
+	}
+	plain := make([]PollOption, len(ev.Poll.Options))
+	for i, o := range ev.Poll.Options {
+		o.Chosen = false
+		plain[i] = o
+	}
+	ev.Poll.Options = plain
+	if !ev.Poll.Anonymous {
+		ev.ActorID = actor
+	}
+	kind, err := s.repo.DialogKind(ctx, ev.DialogID)
+	if err != nil {
+		return
+	}
+	if kind == KindChannel {
+		_ = s.publisher.PublishPoll(ctx, ev, nil)
+		return
+	}
+	if members, err := s.audience(ctx, ev.DialogID, actor); err == nil {
+		_ = s.publisher.PublishPoll(ctx, ev, members)
+	}
+}
+
+// checkMessageKind validates the kind of a message sent through Send. Polls
+// and votes sent that way are opaque to the server and belong to encrypted
+// dialogs; unencrypted ones use CreatePoll and Vote.
+func (s *Service) checkMessageKind(ctx context.Context, dialogID uuid.UUID, out OutgoingMessage) error {
+	switch out.Kind {
+	case "", "text":
+		return nil
+	case "poll", "poll_vote":
+		if out.Kind == "poll_vote" && out.ReplyTo == nil {
+			return ErrInvalidReply
+		}
+		encrypted, err := s.repo.DialogEncrypted(ctx, dialogID)
+		if err != nil {
+			return err
+		}
+		if !encrypted {
+			return ErrInvalidMessageKind
+		}
+		return nil
+	default:
+		return ErrInvalidMessageKind
+	}
+}
+
+func normalizePoll(in PollInput) (PollInput, error) {
+	in.Question = strings.TrimSpace(in.Question)
+	if in.Question == "" || utf8.RuneCountInString(in.Question) > maxPollQuestionLength {
+		return PollInput{}, ErrInvalidPoll
+	}
+	if len(in.Options) < minPollOptions || len(in.Options) > maxPollOptions {
+		return PollInput{}, ErrInvalidPoll
+	}
+	options := make([]string, len(in.Options))
+	for i, o := range in.Options {
+		o = strings.TrimSpace(o)
+		if o == "" || utf8.RuneCountInString(o) > maxPollOptionLength || slices.Contains(options[:i], o) {
+			return PollInput{}, ErrInvalidPoll
+		}
+		options[i] = o
+	}
+	in.Options = options
+	if in.ClosesAt != nil {
+		now := time.Now()
+		if !in.ClosesAt.After(now) || in.ClosesAt.After(now.Add(maxPollDuration)) {
+			return PollInput{}, ErrInvalidPoll
+		}
+	}
+	return in, nil
+}
@@ -0,0 +1,169 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxReactionLength   = 32
+	maxReactionsPerUser = 3
+	maxAllowedReactions = 50
+)
+
+var (
+	ErrInvalidReaction    = errors.New("invalid reaction")
+	ErrReactionNotAllowed = errors.New("reaction not allowed")
+	ErrTooManyReactions   = errors.New("too many reactions")
+)
+
+// React adds (add=true) or removes a reaction of currentUser and returns the
+// message's reactions as seen by the caller.
+func (s *Service) React(ctx context.Context, currentUser, dialogID uuid.UUID, messageID int64, reaction string, add bool) ([]Reaction, error) {
+	reaction, err := normalizeReaction(reaction)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrForbidden
+	}
+	msg, err := s.repo.GetMessage(ctx, dialogID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Deleted || msg.Kind == "system" || msg.Kind == "poll_vote" {
+		return nil, ErrMessageNotFound
+	}
+	if add {
+		allowed, err := s.repo.AllowedReactions(ctx, dialogID)
+		if err != nil {
+			return nil, err
+		}
+		if allowed != nil && !slices.Contains(allowed, reaction) {
+			return nil, ErrReactionNotAllowed
+		}
+		if err := s.checkCanMessage(ctx, dialogID, currentUser); err != nil {
+			return nil, err
+		}
+		present, err := s.repo.AddReaction(ctx, messageID, currentUser, reaction, maxReactionsPerUser)
+		if err != nil {
+			return nil, err
+		}
+		if !present {
+			return nil, ErrTooManyReactions
+		}
+	} else if err := s.repo.RemoveReaction(ctx, messageID, currentUser, reaction); err != nil {
+		return nil, err
+	}
+	byMessage, err := s.repo.MessageReactions(ctx, currentUser, []int64{messageID})
+	if err != nil {
+		return nil, err
+	}
+	res := byMessage[messageID]
+	if res == nil {
+		res = []Reaction{}
+	}
+	s.publishReaction(ctx, ReactionEvent{
+		DialogID: dialogID, MessageID: messageID, ActorID: currentUser, Reaction: reaction, Added: add, Reactions: res,
+	})
+	return res, nil
+}
+
+// AllowedReactions returns the dialog's allowed set; nil means any reaction.
+func (s *Service) AllowedReactions(ctx context.Context, currentUser, dialogID uuid.UUID) ([]string, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrForbidden
+	}
+	return s.repo.AllowedReactions(ctx, dialogID)
+}
+
+// SetAllowedReactions configures reactions of a group or channel; requires admin
+// or owner. nil allows any reaction, an empty list disables reactions.
+func (s *Service) SetAllowedReactions(ctx context.Context, currentUser, dialogID uuid.UUID, allowed []string) ([]string, error) {
+	if err := s.requireAdmin(ctx, dialogID, currentUser); err != nil {
+		return nil, err
+	}
+	if allowed != nil {
+		if len(allowed) > maxAllowedReactions {
+			return nil, ErrInvalidReaction
+		}
+		set := make([]string, 0, len(allowed))
+		for _, r := range allowed {
+			r, err := normalizeReaction(r)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(set, r) {
+				set = append(set, r)
+			}
+		}
+		allowed = set
+	}
+	if err := s.repo.SetAllowedReactions(ctx, dialogID, allowed); err != nil {
+		return nil, err
+	}
+	return allowed, nil
+}
+
+// attachReactions fills Reactions of the listed messages for the viewer.
+func (s *Service) attachReactions(ctx context.Context, viewer uuid.UUID, msgs []Message) error {
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		if !m.Deleted {
+			ids = append(ids, m.ID)
+		}
+	}
+	byMessage, err := s.repo.MessageReactions(ctx, viewer, ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		msgs[i].Reactions = byMessage[msgs[i].ID]
+	}
+	return nil
+}
+
+func (s *Service) publishReaction(ctx context.Context, ev ReactionEvent) {
+	if s.publisher == nil {
+		return
+	}
+	plain := make([]Reaction, len(ev.Reactions))
+	for i, r := range ev.Reactions {
+		plain[i] = Reaction{Reaction: r.Reaction, Count: r.Count}
+	}
+	ev.Reactions = plain
+	kind, err := s.repo.DialogKind(ctx, ev.DialogID)
+	if err != nil {
+		return
+	}
+	if kind == KindChannel {
+		_ = s.publisher.PublishReaction(ctx, ev, nil)
+		return
+	}
+	if members, err := s.audience(ctx, ev.DialogID, ev.ActorID); err == nil {
+		_ = s.publisher.PublishReaction(ctx, ev, members)
+	}
+}
+
+// normalizeReaction accepts a short token without whitespace, e.g. an emoji.
+func normalizeReaction(r string) (string, error) {
+	r = strings.TrimSpace(r)
+	if r == "" || len(r) > maxReactionLength || !utf8.ValidString(r) || strings.IndexFunc(r, unicode.IsSpace) >= 0 {
+		return "", ErrInvalidReaction
+	}
+	return r, nil
+}
@@ -0,0 +1,155 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxQuoteLength   = 1024
+	maxForwardBatch  = 100
+	hiddenSenderName = "Hidden sender"
+)
+
+var ErrInvalidReply = errors.New("invalid reply")
+
+// SendReply sends a message replying to replyTo from the same dialog. quote,
+// when set, must be a fragment of the original text.
+func (s *Service) SendReply(ctx context.Context, currentUser, dialogID uuid.UUID, text string, replyTo int64, quote string) (Message, error) {
+	return s.sendReply(ctx, currentUser, dialogID, OutgoingMessage{Text: text, ReplyTo: &replyTo, Quote: quote})
+}
+
+func (s *Service) sendReply(ctx context.Context, currentUser, dialogID uuid.UUID, out OutgoingMessage) (Message, error) {
+	kind, err := s.checkSend(ctx, currentUser, dialogID)
+	if err != nil {
+		return Message{}, err
+	}
+	orig, quote, err := s.replyTarget(ctx, dialogID, *out.ReplyTo, out.Quote)
+	if err != nil {
+		return Message{}, err
+	}
+	if (out.Kind == "poll_vote" && orig.Kind != "poll") || orig.ThreadRootID != nil {
+		return Message{}, ErrInvalidReply
+	}
+	preview := &ReplyPreview{ID: orig.ID, SenderID: orig.SenderID, Kind: orig.Kind, Text: truncateRunes(orig.Text, replyPreviewLength), Quote: quote}
+	return s.store(ctx, kind, NewMessage{
+		DialogID: dialogID, SenderID: currentUser, Kind: out.Kind, Text: out.Text, ReplyTo: &orig.ID, Quote: quote, ClientMessageID: out.ClientMessageID,
+		Attachments: out.Attachments,
+	}, preview)
+}
+
+// replyTarget loads the message being replied to and checks that quote, trimmed,
+// is a fragment of it.
+func (s *Service) replyTarget(ctx context.Context, dialogID uuid.UUID, replyTo int64, quote string) (Message, string, error) {
+	orig, err := s.repo.GetMessage(ctx, dialogID, replyTo)
+	if errors.Is(err, ErrMessageNotFound) {
+		return Message{}, "", ErrInvalidReply
+	}
+	if err != nil {
+		return Message{}, "", err
+	}
+	if orig.Deleted || orig.Kind == "poll_vote" {
+		return Message{}, "", ErrInvalidReply
+	}
+	quote = strings.TrimSpace(quote)
+	if quote != "" && (utf8.RuneCountInString(quote) > maxQuoteLength || !strings.Contains(orig.Text, quote)) {
+		return Message{}, "", ErrInvalidReply
+	}
+	return orig, quote, nil
+}
+
+// ForwardMessages copies messages from one dialog into another in the given
+// order. Unless hideSender is set, each copy is attributed to the original
+// author (or channel); a sender who disallows forward links is shown by name only.
+// Forwarding an already forwarded message keeps the first attribution.
+func (s *Service) ForwardMessages(ctx context.Context, currentUser, fromDialog uuid.UUID, messageIDs []int64, toDialog uuid.UUID, hideSender bool) ([]Message, error) {
+	if len(messageIDs) == 0 || len(messageIDs) > maxForwardBatch {
+		return nil, ErrMessageNotFound
+	}
+	ok, err := s.repo.CheckMember(ctx, fromDialog, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrForbidden
+	}
+	fromKind, err := s.repo.DialogKind(ctx, fromDialog)
+	if err != nil {
+		return nil, err
+	}
+	originals := make([]Message, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		orig, err := s.repo.GetMessage(ctx, fromDialog, id)
+		if err != nil {
+			return nil, err
+		}
+		// polls are bound to their dialog's votes
+		if orig.Deleted || orig.Kind == "system" || orig.Kind == "poll" || orig.Kind == "poll_vote" {
+			return nil, ErrMessageNotFound
+		}
+		originals = append(originals, orig)
+	}
+	kind, err := s.checkSend(ctx, currentUser, toDialog)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Message, 0, len(originals))
+	for _, orig := range originals {
+		var attr *ForwardedFrom
+		if !hideSender {
+			if attr, err = s.forwardAttribution(ctx, fromKind, orig); err != nil {
+				return nil, err
+			}
+		}
+		msg, err := s.store(ctx, kind, NewMessage{DialogID: toDialog, SenderID: currentUser, Text: orig.Text, ForwardedFrom: attr}, nil)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (s *Service) forwardAttribution(ctx context.Context, fromKind string, orig Message) (*ForwardedFrom, error) {
+	if orig.ForwardedFrom != nil {
+		return orig.ForwardedFrom, nil
+	}
+	attr := &ForwardedFrom{Date: orig.CreatedAt}
+	if fromKind == KindChannel {
+		ch, err := s.repo.GetChannel(ctx, orig.DialogID)
+		if err != nil {
+			return nil, err
+		}
+		attr.DialogID = &ch.ID
+		attr.Name = ch.Title
+		return attr, nil
+	}
+	sender := orig.SenderID
+	if s.privacy == nil {
+		attr.UserID = &sender
+		return attr, nil
+	}
+	name, link, err := s.privacy.ForwardAttribution(ctx, sender)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = hiddenSenderName
+	}
+	attr.Name = name
+	if link {
+		attr.UserID = &sender
+	}
+	return attr, nil
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
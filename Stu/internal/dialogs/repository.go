@@ -1,50 +1,321 @@
 package dialogs
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var (
-	ErrNotMember      = errors.New("not a dialog member")
-	ErrDialogExist    = errors.New("dialog already exists")
-	ErrDialogNotFound = errors.New("dialog not found")
+	ErrNotMember       = errors.New("not a dialog member")
+	ErrDialogExist     = errors.New("dialog already exists")
+	ErrDialogNotFound  = errors.New("dialog not found")
+	ErrAlreadyMember   = errors.New("already a dialog member")
+	ErrChannelTaken    = errors.New("channel username already taken")
+	ErrInviteInvalid   = errors.New("invite link is invalid or expired")
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrDuplicateMessage means the sender already stored a message with this client id.
+	ErrDuplicateMessage = errors.New("duplicate client message id")
 )
 
 type Message struct {
-	ID            int64     `json:"id"`
-	SenderID      uuid.UUID `json:"sender_id"`
-	DialogID      uuid.UUID `json:"dialog_id"`
-	Text          string    `json:"text"`
-	CreatedAt     time.Time `json:"created_at"`
-	DeliveredToMe bool      `json:"delivered_to_me"`
-	ReadByMe      bool      `json:"read_by_me"`
-	DeliveredPeer bool      `json:"delivered_by_peer"`
-	ReadPeer      bool      `json:"read_by_peer"`
+	ID            int64          `json:"id"`
+	SenderID      uuid.UUID      `json:"sender_id"`
+	DialogID      uuid.UUID      `json:"dialog_id"`
+	Kind          string         `json:"kind"`
+	Text          string         `json:"text"`
+	CreatedAt     time.Time      `json:"created_at"`
+	DeliveredToMe bool           `json:"delivered_to_me"`
+	ReadByMe      bool           `json:"read_by_me"`
+	DeliveredPeer bool           `json:"delivered_by_peer"`
+	ReadPeer      bool           `json:"read_by_peer"`
+	EditedAt      *time.Time     `json:"edited_at,omitempty"`
+	Reactions     []Reaction     `json:"reactions,omitempty"`
+	ReplyTo       *ReplyPreview  `json:"reply_to,omitempty"`
+	ForwardedFrom *ForwardedFrom `json:"forwarded_from,omitempty"`
+	Pinned        bool           `json:"pinned,omitempty"`
+	// ExpiresAt is set while the dialog has a disappearing-messages timer.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ClientMessageID is the sender's idempotency key, shown to the sender only.
+	ClientMessageID string `json:"client_message_id,omitempty"`
+	// Deleted marks a tombstone: the message was deleted for everyone and has no text.
+	Deleted bool `json:"deleted,omitempty"`
+	// Poll holds the options and results of a poll kept by the server.
+	Poll *Poll `json:"poll,omitempty"`
+	// ThreadRootID is set on thread replies and names the message they comment on.
+	ThreadRootID *int64 `json:"thread_root_id,omitempty"`
+	// Thread summarizes the replies of a thread root, nil when it has none.
+	Thread *Thread `json:"thread,omitempty"`
+	// Mentions are the @username and @all entities of the text.
+	Mentions []Mention `json:"mentions,omitempty"`
+	// Attachments are the ids of uploaded media objects sent with the message.
+	Attachments []uuid.UUID `json:"attachments,omitempty"`
 }
 
 type Dialog struct {
 	ID          uuid.UUID `json:"id"`
+	Kind        string    `json:"kind"`
 	Title       string    `json:"title"`
 	LastMessage *Message  `json:"last_message,omitempty"`
 	UnreadCount int64     `json:"unread_count"`
+	// UnreadMentions counts unread messages that mention the caller.
+	UnreadMentions int64 `json:"unread_mentions"`
+	// LastActivityAt is when the last message was posted, or when the
+	// caller joined a dialog without messages.
+	LastActivityAt time.Time `json:"last_activity_at"`
+	// Cursor continues the listing after this dialog.
+	Cursor string `json:"cursor"`
+	// MessageTTL is the disappearing-messages timer in seconds, 0 when off.
+	MessageTTL int `json:"message_ttl"`
+	// Encrypted tells clients to encrypt what they send; the server cannot
+	// read such dialogs, so polls, mentions and search are client-side there.
+	Encrypted bool `json:"encrypted"`
+	DialogSettings
+	pinnedAt *time.Time
+}
+
+// DialogSettings is the caller's personal state of a dialog. MutedUntil is
+// nil unless the mute is still in effect.
+type DialogSettings struct {
+	MutedUntil *time.Time `json:"muted_until"`
+	Archived   bool       `json:"archived"`
+	Pinned     bool       `json:"pinned"`
+	// NotifyMentions lets mentions notify while the dialog is muted.
+	NotifyMentions bool `json:"notify_mentions"`
+}
+
+// DialogFilter narrows ListDialogs; nil fields do not filter.
+type DialogFilter struct {
+	State    string
+	Archived *bool
+	Muted    *bool
+	Pinned   *bool
+	// After continues a previous listing.
+	After *DialogCursor
+}
+
+// Member is a dialog participant with its role.
+type Member struct {
+	UserID   uuid.UUID `json:"user_id"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// Channel is the public card of a broadcast channel.
+type Channel struct {
+	ID              uuid.UUID `json:"id"`
+	Title           string    `json:"title"`
+	Username        *string   `json:"username"`
+	Description     *string   `json:"description"`
+	SubscriberCount int64     `json:"subscriber_count"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// ReplyPreview is a short view of the message being replied to. Quote is the
+// fragment of it the reply quotes, if any.
+type ReplyPreview struct {
+	ID       int64     `json:"id"`
+	SenderID uuid.UUID `json:"sender_id"`
+	Kind     string    `json:"kind"`
+	Text     string    `json:"text"`
+	Quote    string    `json:"quote,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// ForwardedFrom attributes a forwarded message. UserID is omitted when the
+// original sender does not allow linking to their account; DialogID is set for
+// channel posts.
+type ForwardedFrom struct {
+	UserID   *uuid.UUID `json:"user_id,omitempty"`
+	DialogID *uuid.UUID `json:"dialog_id,omitempty"`
+	Name     string     `json:"name"`
+	Date     time.Time  `json:"date"`
+}
+
+// NewMessage is a text message to store.
+type NewMessage struct {
+	DialogID        uuid.UUID
+	SenderID        uuid.UUID
+	Text            string
+	ReplyTo         *int64
+	Quote           string
+	ForwardedFrom   *ForwardedFrom
+	ClientMessageID string
+	// Kind is "text" when empty.
+	Kind string
+	// Poll, when set, makes the message a server-side poll with Text as the question.
+	Poll *PollInput
+	// ThreadRootID, when set, posts the message into the thread of that root.
+	ThreadRootID *int64
+	// Mentions are stored with the message; Mentioned lists the members they
+	// notify, each counted once.
+	Mentions  []Mention
+	Mentioned []uuid.UUID
+	// Attachments are uploads of the sender linked to the message.
+	Attachments []uuid.UUID
+}
+
+// messageMeta is the messages.metadata document.
+type messageMeta struct {
+	Quote         string         `json:"quote,omitempty"`
+	ForwardedFrom *ForwardedFrom `json:"forwarded_from,omitempty"`
+	Mentions      []Mention      `json:"mentions,omitempty"`
+}
+
+// Reaction is an aggregated reaction on a message; Mine is set when the caller
+// is among those who reacted.
+type Reaction struct {
+	Reaction string `json:"reaction"`
+	Count    int64  `json:"count"`
+	Mine     bool   `json:"mine,omitempty"`
+}
+
+// Invite is a revocable link into a group or channel.
+type Invite struct {
+	ID               uuid.UUID  `json:"id"`
+	DialogID         uuid.UUID  `json:"dialog_id"`
+	Code             string     `json:"code"`
+	CreatedBy        uuid.UUID  `json:"created_by"`
+	Title            *string    `json:"title"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	MaxUses          *int       `json:"max_uses"`
+	Uses             int        `json:"uses"`
+	RequiresApproval bool       `json:"requires_approval"`
+	RevokedAt        *time.Time `json:"revoked_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// Usable reports whether the invite can still admit someone at now.
+func (i Invite) Usable(now time.Time) bool {
+	if i.RevokedAt != nil {
+		return false
+	}
+	if i.ExpiresAt != nil && !now.Before(*i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == nil || i.Uses < *i.MaxUses
+}
+
+// InvitePreview is what a link holder sees before joining.
+type InvitePreview struct {
+	DialogID         uuid.UUID `json:"dialog_id"`
+	Kind             string    `json:"kind"`
+	Title            *string   `json:"title"`
+	MemberCount      int64     `json:"member_count"`
+	RequiresApproval bool      `json:"requires_approval"`
+}
+
+// JoinRequest is a pending join through an approval-mode invite.
+type JoinRequest struct {
+	UserID    uuid.UUID  `json:"user_id"`
+	InviteID  *uuid.UUID `json:"invite_id"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Update is one entry of a user's update log. UserID is the member affected
+// by a membership change, Role its new role.
+type Update struct {
+	Pts       int64      `json:"pts"`
+	Type      string     `json:"type"`
+	DialogID  uuid.UUID  `json:"dialog_id"`
+	MessageID *int64     `json:"message_id,omitempty"`
+	ActorID   *uuid.UUID `json:"actor_id,omitempty"`
+	UserID    *uuid.UUID `json:"user_id,omitempty"`
+	Role      string     `json:"role,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
 }
 
 type Repository interface {
-	CreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID) (uuid.UUID, error)
-	GetOrCreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID) (uuid.UUID, error)
-	ListDialogs(ctx context.Context, userID uuid.UUID, limit int) ([]Dialog, error)
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+	CreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID, peerState string) (uuid.UUID, error)
+	GetOrCreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID, peerState string) (uuid.UUID, error)
+	GetOrCreateSaved(ctx context.Context, userID uuid.UUID) (uuid.UUID, error)
+	ListDialogs(ctx context.Context, userID uuid.UUID, limit int, filter DialogFilter) ([]Dialog, error)
+	MemberSettings(ctx context.Context, dialogID, userID uuid.UUID) (DialogSettings, error)
+	SetMemberSettings(ctx context.Context, dialogID, userID uuid.UUID, settings DialogSettings) error
+	CountPinnedDialogs(ctx context.Context, userID uuid.UUID) (int, error)
+	RequestState(ctx context.Context, dialogID, userID uuid.UUID) (string, error)
+	SetRequestState(ctx context.Context, dialogID, userID uuid.UUID, state string) error
 	CheckMember(ctx context.Context, dialogID, userID uuid.UUID) (bool, error)
 	Members(ctx context.Context, dialogID uuid.UUID) ([]uuid.UUID, error)
-	SaveMessage(ctx context.Context, dialogID, sender uuid.UUID, text string) (int64, time.Time, error)
+	DirectPeer(ctx context.Context, dialogID, userID uuid.UUID) (uuid.UUID, bool, error)
+	SaveMessage(ctx context.Context, msg NewMessage) (Message, error)
+	SetMessageTTL(ctx context.Context, dialogID uuid.UUID, seconds int) (bool, error)
+	CreateScheduled(ctx context.Context, msg ScheduledMessage) (ScheduledMessage, error)
+	ListScheduled(ctx context.Context, dialogID, senderID uuid.UUID) ([]ScheduledMessage, error)
+	CountScheduled(ctx context.Context, dialogID, senderID uuid.UUID) (int, error)
+	UpdateScheduled(ctx context.Context, msg ScheduledMessage) (ScheduledMessage, error)
+	DeleteScheduled(ctx context.Context, dialogID, senderID uuid.UUID, id int64) error
+	ClaimDueScheduled(ctx context.Context, limit int, send func(ScheduledMessage) error) (int, error)
+	ReapExpiredMessages(ctx context.Context, limit int) ([]ExpiredMessage, []MediaObject, error)
+	UsableMedia(ctx context.Context, owner uuid.UUID, ids []uuid.UUID) (bool, error)
+	MessageMedia(ctx context.Context, messageIDs []int64) (map[int64][]uuid.UUID, error)
+	SaveSystemMessage(ctx context.Context, dialogID, actor uuid.UUID, text string) (int64, time.Time, error)
+	CreateGroup(ctx context.Context, owner uuid.UUID, title string, members []uuid.UUID, encrypted bool) (uuid.UUID, error)
+	DialogKind(ctx context.Context, dialogID uuid.UUID) (string, error)
+	MemberRole(ctx context.Context, dialogID, userID uuid.UUID) (string, error)
+	ListMembers(ctx context.Context, dialogID uuid.UUID) ([]Member, error)
+	Heir(ctx context.Context, dialogID, leaving uuid.UUID, roles []string) (uuid.UUID, bool, error)
+	AddMember(ctx context.Context, dialogID, userID uuid.UUID, role string) error
+	RemoveMember(ctx context.Context, dialogID, userID uuid.UUID) error
+	SetRole(ctx context.Context, dialogID, userID uuid.UUID, role string) error
+	SetTitle(ctx context.Context, dialogID uuid.UUID, title string) error
+	CreateChannel(ctx context.Context, owner uuid.UUID, title, username, description string) (uuid.UUID, error)
+	GetChannel(ctx context.Context, dialogID uuid.UUID) (Channel, error)
+	GetChannelByUsername(ctx context.Context, username string) (Channel, error)
+	UserChannels(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
+	CreateInvite(ctx context.Context, inv Invite) (Invite, error)
+	ListInvites(ctx context.Context, dialogID uuid.UUID) ([]Invite, error)
+	GetInviteByCode(ctx context.Context, code string) (Invite, error)
+	GetInvitePreview(ctx context.Context, inviteID uuid.UUID) (InvitePreview, error)
+	RevokeInvite(ctx context.Context, dialogID, inviteID uuid.UUID) error
+	JoinByInvite(ctx context.Context, inviteID, userID uuid.UUID) error
+	CreateJoinRequest(ctx context.Context, dialogID, userID, inviteID uuid.UUID) error
+	ListJoinRequests(ctx context.Context, dialogID uuid.UUID) ([]JoinRequest, error)
+	DeleteJoinRequest(ctx context.Context, dialogID, userID uuid.UUID) error
+	GetMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) (Message, error)
+	MessageByClientID(ctx context.Context, dialogID, senderID uuid.UUID, clientID string) (Message, error)
+	EditMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, text string, mentions []Mention) (time.Time, error)
+	DeleteMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) error
+	HideMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, userID uuid.UUID) error
+	AddReaction(ctx context.Context, messageID int64, userID uuid.UUID, reaction string, limit int) (bool, error)
+	RemoveReaction(ctx context.Context, messageID int64, userID uuid.UUID, reaction string) error
+	MessageReactions(ctx context.Context, userID uuid.UUID, messageIDs []int64) (map[int64][]Reaction, error)
+	AllowedReactions(ctx context.Context, dialogID uuid.UUID) ([]string, error)
+	SetAllowedReactions(ctx context.Context, dialogID uuid.UUID, allowed []string) error
+	PinMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, userID uuid.UUID) (bool, error)
+	UnpinMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) (bool, error)
+	PinnedMessages(ctx context.Context, dialogID uuid.UUID) ([]Message, error)
 	ListMessages(ctx context.Context, dialogID, userID uuid.UUID, limit int, before int64) ([]Message, error)
-	MarkDelivered(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) error
-	MarkRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) error
+	ListThread(ctx context.Context, dialogID, userID uuid.UUID, rootID int64, limit int, before int64) ([]Message, error)
+	ThreadSummaries(ctx context.Context, userID uuid.UUID, rootIDs []int64) (map[int64]*Thread, error)
+	MarkThreadRead(ctx context.Context, rootID int64, userID uuid.UUID, messageID int64) (bool, error)
+	MembersByUsername(ctx context.Context, dialogID uuid.UUID, usernames []string) (map[string]uuid.UUID, error)
+	MentionRecipients(ctx context.Context, dialogID uuid.UUID, userIDs []uuid.UUID) ([]uuid.UUID, error)
+	NextMention(ctx context.Context, dialogID, userID uuid.UUID, after int64) (int64, error)
+	MarkDelivered(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) (bool, error)
+	MarkRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) (bool, error)
+	AppendUpdate(ctx context.Context, userIDs []uuid.UUID, u Update) error
+	Updates(ctx context.Context, userID uuid.UUID, since int64, limit int) ([]Update, error)
+	UpdateState(ctx context.Context, userID uuid.UUID) (pts, minPts int64, err error)
+	PruneUpdates(ctx context.Context, before time.Time, limit int) (int, error)
+	MessagesByID(ctx context.Context, userID uuid.UUID, messageIDs []int64) ([]Message, error)
+	DialogEncrypted(ctx context.Context, dialogID uuid.UUID) (bool, error)
+	Polls(ctx context.Context, userID uuid.UUID, messageIDs []int64) (map[int64]*Poll, error)
+	SetPollVote(ctx context.Context, messageID int64, userID uuid.UUID, options []int) (bool, error)
+	SaveDraft(ctx context.Context, userID uuid.UUID, d Draft) (Draft, bool, error)
+	ClearDraft(ctx context.Context, userID uuid.UUID, d Draft) (bool, error)
+	ListDrafts(ctx context.Context, userID uuid.UUID) ([]Draft, error)
+	DraftsByDialog(ctx context.Context, userID uuid.UUID, dialogIDs []uuid.UUID) ([]Draft, error)
+	SearchMessages(ctx context.Context, userID uuid.UUID, q SearchQuery) ([]SearchHit, error)
 }
 
 type pgRepository struct {
@@ -55,9 +326,46 @@ func NewRepository(pool *pgxpool.Pool) Repository {
 	return &pgRepository{pool: pool}
 }
 
+// querier is what the pool and a transaction have in common. Begin on a
+// transaction opens a savepoint, so methods with their own transaction
+// nest inside InTx.
+type querier interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type txKey struct{}
+
+// db returns the transaction InTx put into ctx, or the pool outside of one.
+func (r *pgRepository) db(ctx context.Context) querier {
+	if tx, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return r.pool
+}
+
+// InTx runs fn in one transaction; repository calls made with the context fn
+// receives join it. A nested InTx joins the outer transaction.
+func (r *pgRepository) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := fn(context.WithValue(ctx, txKey{}, tx)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
 func (r *pgRepository) CheckMember(ctx context.Context, dialogID, userID uuid.UUID) (bool, error) {
 	var exists bool
-	err := r.pool.QueryRow(ctx, `
+	err := r.db(ctx).QueryRow(ctx, `
 		SELECT EXISTS(
 			SELECT 1 FROM dialog_members
 			WHERE dialog_id = $1 AND user_id = $2
@@ -65,9 +373,10 @@ func (r *pgRepository) CheckMember(ctx context.Context, dialogID, userID uuid.UU
 	return exists, err
 }
 
-func (r *pgRepository) CreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID) (uuid.UUID, error) {
+// CreateDirect creates a direct dialog; peerState is the peer's request_state.
+func (r *pgRepository) CreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID, peerState string) (uuid.UUID, error) {
 	dialogID := uuid.New()
-	tx, err := r.pool.Begin(ctx)
+	tx, err := r.db(ctx).Begin(ctx)
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -79,10 +388,11 @@ func (r *pgRepository) CreateDirect(ctx context.Context, initiator uuid.UUID, pe
 	if err != nil {
 		return uuid.Nil, err
 	}
+	states := map[uuid.UUID]string{initiator: RequestAccepted, peer: peerState}
 	for _, uid := range []uuid.UUID{initiator, peer} {
 		if _, err := tx.Exec(ctx, `
-			INSERT INTO dialog_members (dialog_id, user_id, role)
-			VALUES ($1, $2, 'member')`, dialogID, uid); err != nil {
+			INSERT INTO dialog_members (dialog_id, user_id, role, request_state)
+			VALUES ($1, $2, 'member', $3)`, dialogID, uid, states[uid]); err != nil {
 			return uuid.Nil, err
 		}
 	}
@@ -92,9 +402,9 @@ func (r *pgRepository) CreateDirect(ctx context.Context, initiator uuid.UUID, pe
 	return dialogID, nil
 }
 
-func (r *pgRepository) GetOrCreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID) (uuid.UUID, error) {
+func (r *pgRepository) GetOrCreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID, peerState string) (uuid.UUID, error) {
 	var id uuid.UUID
-	err := r.pool.QueryRow(ctx, `
+	err := r.db(ctx).QueryRow(ctx, `
 		SELECT d.id FROM dialogs d
 		JOIN dialog_members m1 ON m1.dialog_id = d.id AND m1.user_id = $1
 		JOIN dialog_members m2 ON m2.dialog_id = d.id AND m2.user_id = $2
@@ -106,36 +416,128 @@ func (r *pgRepository) GetOrCreateDirect(ctx context.Context, initiator uuid.UUI
 	if !errors.Is(err, pgx.ErrNoRows) {
 		return uuid.Nil, err
 	}
-	return r.CreateDirect(ctx, initiator, peer)
+	return r.CreateDirect(ctx, initiator, peer, peerState)
 }
 
-func (r *pgRepository) ListDialogs(ctx context.Context, userID uuid.UUID, limit int) ([]Dialog, error) {
-	if limit <= 0 || limit > 50 {
-		limit = 50
+// GetOrCreateSaved returns the user's saved messages dialog, creating it on
+// first use. A concurrent creation loses the saved_dialogs insert and falls
+// back to the winner's dialog.
+func (r *pgRepository) GetOrCreateSaved(ctx context.Context, userID uuid.UUID) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := r.db(ctx).QueryRow(ctx, `SELECT dialog_id FROM saved_dialogs WHERE user_id = $1`, userID).Scan(&id)
+	if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+		return id, err
 	}
-	rows, err := r.pool.Query(ctx, `
-WITH last_msg AS (
-  SELECT DISTINCT ON (dialog_id) dialog_id, id, sender_id, created_at, convert_from(cipher_text, 'UTF8') AS text
-  FROM messages
-  ORDER BY dialog_id, id DESC
-),
-unreads AS (
-  SELECT dialog_id, COUNT(*) AS unread
-  FROM messages m
-  WHERE NOT EXISTS (
-    SELECT 1 FROM message_reads r WHERE r.message_id = m.id AND r.user_id = $1
-  ) AND m.sender_id <> $1
-  GROUP BY dialog_id
+
+	dialogID := uuid.New()
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO dialogs (id, kind, owner_id, is_encrypted, created_at, updated_at)
+		VALUES ($1, 'saved', $2, TRUE, NOW(), NOW())`, dialogID, userID); err != nil {
+		return uuid.Nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO dialog_members (dialog_id, user_id, role, request_state)
+		VALUES ($1, $2, 'member', $3)`, dialogID, userID, RequestAccepted); err != nil {
+		return uuid.Nil, err
+	}
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO saved_dialogs (user_id, dialog_id) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO NOTHING`, userID, dialogID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		tx.Rollback(ctx)
+		err = r.db(ctx).QueryRow(ctx, `SELECT dialog_id FROM saved_dialogs WHERE user_id = $1`, userID).Scan(&id)
+		return id, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, err
+	}
+	return dialogID, nil
+}
+
+// dialogFilterSQL applies the archived ($4) and muted ($5) filters of
+// ListDialogs to member dm.
+const dialogFilterSQL = `
+       AND ($4::boolean IS NULL OR dm.archived = $4)
+       AND ($5::boolean IS NULL OR COALESCE(dm.muted_until > NOW(), FALSE) = $5)`
+
+// ListDialogs lists dialogs matching filter, pinned ones first (most recently
+// pinned on top), then by last activity.
+func (r *pgRepository) ListDialogs(ctx context.Context, userID uuid.UUID, limit int, filter DialogFilter) ([]Dialog, error) {
+	if limit <= 0 || limit > maxDialogPage {
+		limit = maxDialogPage
+	}
+	var (
+		afterPinned *bool
+		afterAt     *time.Time
+		afterID     *uuid.UUID
+	)
+	if c := filter.After; c != nil {
+		afterPinned, afterAt, afterID = &c.Pinned, &c.At, &c.ID
+	}
+	// Pinned dialogs, unpinned dialogs with member summaries and unpinned
+	// channels are read as three index-ordered streams and merged: a
+	// channel's activity lives on the channel row, so it is ordered through
+	// idx_dialog_members_channels, over the user's subscriptions rather than
+	// over posts. A channel's unread count is its post counter minus the
+	// subscriber's read position and the gaps left by removed posts after it
+	// (see dropPostsSQL); posts hidden by the subscriber still count.
+	rows, err := r.db(ctx).Query(ctx, `
+WITH page AS (
+    (SELECT dm.dialog_id, dm.pinned_at AS at
+     FROM dialog_members dm
+     WHERE dm.user_id = $1 AND dm.pinned_at IS NOT NULL AND dm.request_state = $3`+dialogFilterSQL+`
+       AND ($6::boolean IS NULL OR $6)
+       AND ($7::boolean IS NULL OR ($7 AND (dm.pinned_at, dm.dialog_id) < ($8::timestamptz, $9::uuid)))
+     ORDER BY dm.pinned_at DESC, dm.dialog_id DESC
+     LIMIT $2)
+    UNION ALL
+    (SELECT dm.dialog_id, dm.last_activity_at
+     FROM dialog_members dm
+     WHERE dm.user_id = $1 AND dm.request_state = $3 AND NOT dm.is_channel AND dm.pinned_at IS NULL`+dialogFilterSQL+`
+       AND ($6::boolean IS NULL OR NOT $6)
+       AND ($7::boolean IS NULL OR $7 OR (dm.last_activity_at, dm.dialog_id) < ($8, $9))
+     ORDER BY dm.last_activity_at DESC, dm.dialog_id DESC
+     LIMIT $2)
+    UNION ALL
+    (SELECT dm.dialog_id, GREATEST(dm.last_activity_at, d.last_activity_at)
+     FROM dialog_members dm
+     JOIN dialogs d ON d.id = dm.dialog_id
+     WHERE dm.user_id = $1 AND dm.request_state = $3 AND dm.is_channel AND dm.pinned_at IS NULL`+dialogFilterSQL+`
+       AND ($6::boolean IS NULL OR NOT $6)
+       AND ($7::boolean IS NULL OR $7 OR (GREATEST(dm.last_activity_at, d.last_activity_at), dm.dialog_id) < ($8, $9))
+     ORDER BY 2 DESC, 1 DESC
+     LIMIT $2)
 )
-SELECT d.id, COALESCE(d.title,''), lm.id, lm.sender_id, lm.created_at, lm.text,
-       COALESCE(u.unread,0)
-FROM dialogs d
-JOIN dialog_members dm ON dm.dialog_id = d.id AND dm.user_id = $1
-LEFT JOIN last_msg lm ON lm.dialog_id = d.id
-LEFT JOIN unreads u ON u.dialog_id = d.id
-ORDER BY lm.created_at DESC NULLS LAST, d.created_at DESC
+SELECT d.id, d.kind::text, COALESCE(d.title,''), lm.id, lm.sender_id, lm.kind::text, lm.created_at,
+       convert_from(lm.cipher_text, 'UTF8'),
+       CASE WHEN d.kind = 'channel' THEN GREATEST(d.post_seq - rp.seq - (
+           SELECT COUNT(*) FROM channel_post_gaps g WHERE g.dialog_id = d.id AND g.post_seq > rp.seq), 0)
+       ELSE dm.unread_count END,
+       dm.unread_mentions, CASE WHEN d.kind = 'channel' THEN GREATEST(dm.last_activity_at, d.last_activity_at) ELSE dm.last_activity_at END,
+       CASE WHEN dm.muted_until > NOW() THEN dm.muted_until END, dm.archived, dm.pinned_at, dm.notify_mentions,
+       d.message_ttl_seconds, COALESCE(d.is_encrypted, TRUE)
+FROM page p
+JOIN dialog_members dm ON dm.dialog_id = p.dialog_id AND dm.user_id = $1
+JOIN dialogs d ON d.id = dm.dialog_id
+CROSS JOIN LATERAL (SELECT GREATEST(dm.read_post_seq, d.post_floor) AS seq) rp
+LEFT JOIN messages lm ON lm.id = CASE WHEN d.kind = 'channel' THEN (
+    SELECT m.id FROM messages m
+    WHERE m.dialog_id = d.id AND m.post_seq IS NOT NULL AND m.deleted_at IS NULL
+      AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+    ORDER BY m.post_seq DESC LIMIT 1
+) ELSE dm.last_message_id END
+ORDER BY dm.pinned_at IS NULL, p.at DESC, p.dialog_id DESC
 LIMIT $2
-`, userID, limit)
+`, userID, limit, filter.State, filter.Archived, filter.Muted, filter.Pinned, afterPinned, afterAt, afterID)
 	if err != nil {
 		return nil, err
 	}
@@ -143,32 +545,67 @@ LIMIT $2
 	var res []Dialog
 	for rows.Next() {
 		var (
-			id       uuid.UUID
-			title    string
+			d        Dialog
 			msgID    *int64
 			senderID *uuid.UUID
+			msgKind  *string
 			created  *time.Time
 			text     *string
-			unread   int64
 		)
-		if err := rows.Scan(&id, &title, &msgID, &senderID, &created, &text, &unread); err != nil {
+		if err := rows.Scan(&d.ID, &d.Kind, &d.Title, &msgID, &senderID, &msgKind, &created, &text, &d.UnreadCount, &d.UnreadMentions,
+			&d.LastActivityAt, &d.MutedUntil, &d.Archived, &d.pinnedAt, &d.NotifyMentions, &d.MessageTTL, &d.Encrypted); err != nil {
 			return nil, err
 		}
-		var last *Message
-		if msgID != nil && senderID != nil && created != nil && text != nil {
-			last = &Message{
-				ID: *msgID, SenderID: *senderID, DialogID: id, Text: *text, CreatedAt: *created,
+		d.Pinned = d.pinnedAt != nil
+		if msgID != nil && senderID != nil && msgKind != nil && created != nil && text != nil {
+			d.LastMessage = &Message{
+				ID: *msgID, SenderID: *senderID, DialogID: d.ID, Kind: *msgKind, Text: *text, CreatedAt: *created,
 			}
 		}
-		res = append(res, Dialog{
-			ID: id, Title: title, LastMessage: last, UnreadCount: unread,
-		})
+		res = append(res, d)
 	}
 	return res, rows.Err()
 }
 
+func (r *pgRepository) MemberSettings(ctx context.Context, dialogID, userID uuid.UUID) (DialogSettings, error) {
+	var st DialogSettings
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT CASE WHEN muted_until > NOW() THEN muted_until END, archived, pinned_at IS NOT NULL, notify_mentions
+		FROM dialog_members
+		WHERE dialog_id = $1 AND user_id = $2`, dialogID, userID).Scan(&st.MutedUntil, &st.Archived, &st.Pinned, &st.NotifyMentions)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return DialogSettings{}, ErrNotMember
+	}
+	return st, err
+}
+
+// SetMemberSettings stores the member's state; an already pinned dialog keeps
+// its original pin time.
+func (r *pgRepository) SetMemberSettings(ctx context.Context, dialogID, userID uuid.UUID, st DialogSettings) error {
+	tag, err := r.db(ctx).Exec(ctx, `
+		UPDATE dialog_members
+		SET muted_until = $3, archived = $4,
+		    pinned_at = CASE WHEN $5 THEN COALESCE(pinned_at, NOW()) END,
+		    notify_mentions = $6
+		WHERE dialog_id = $1 AND user_id = $2`, dialogID, userID, st.MutedUntil, st.Archived, st.Pinned, st.NotifyMentions)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+func (r *pgRepository) CountPinnedDialogs(ctx context.Context, userID uuid.UUID) (int, error) {
+	var n int
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT COUNT(*) FROM dialog_members WHERE user_id = $1 AND pinned_at IS NOT NULL`, userID).Scan(&n)
+	return n, err
+}
+
 func (r *pgRepository) Members(ctx context.Context, dialogID uuid.UUID) ([]uuid.UUID, error) {
-	rows, err := r.pool.Query(ctx, `
+	rows, err := r.db(ctx).Query(ctx, `
 		SELECT user_id FROM dialog_members WHERE dialog_id = $1
 	`, dialogID)
 	if err != nil {
@@ -186,49 +623,465 @@ func (r *pgRepository) Members(ctx context.Context, dialogID uuid.UUID) ([]uuid.
 	return ids, rows.Err()
 }
 
-func (r *pgRepository) SaveMessage(ctx context.Context, dialogID, sender uuid.UUID, text string) (int64, time.Time, error) {
-	var id int64
-	var created time.Time
-	err := r.pool.QueryRow(ctx, `
-		INSERT INTO messages (dialog_id, sender_id, cipher_text, created_at)
-		VALUES ($1, $2, $3, NOW())
-		RETURNING id, created_at
-	`, dialogID, sender, []byte(text)).Scan(&id, &created)
-	return id, created, err
+// DirectPeer returns the other member of a direct dialog; ok is false for other kinds.
+func (r *pgRepository) DirectPeer(ctx context.Context, dialogID, userID uuid.UUID) (uuid.UUID, bool, error) {
+	var peer uuid.UUID
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT m.user_id FROM dialogs d
+		JOIN dialog_members m ON m.dialog_id = d.id
+		WHERE d.id = $1 AND d.kind = 'direct' AND m.user_id <> $2
+		LIMIT 1`, dialogID, userID).Scan(&peer)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, false, nil
+	}
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	return peer, true, nil
+}
+
+func (r *pgRepository) RequestState(ctx context.Context, dialogID, userID uuid.UUID) (string, error) {
+	var state string
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT request_state FROM dialog_members
+		WHERE dialog_id = $1 AND user_id = $2`, dialogID, userID).Scan(&state)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotMember
+	}
+	return state, err
+}
+
+func (r *pgRepository) SetRequestState(ctx context.Context, dialogID, userID uuid.UUID, state string) error {
+	tag, err := r.db(ctx).Exec(ctx, `
+		UPDATE dialog_members SET request_state = $3
+		WHERE dialog_id = $1 AND user_id = $2`, dialogID, userID, state)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+// SaveMessage stores a message, with its poll if any; the dialog's
+// disappearing-messages timer decides its expiry.
+func (r *pgRepository) SaveMessage(ctx context.Context, msg NewMessage) (Message, error) {
+	meta, err := json.Marshal(messageMeta{Quote: msg.Quote, ForwardedFrom: msg.ForwardedFrom, Mentions: msg.Mentions})
+	if err != nil {
+		return Message{}, err
+	}
+	if msg.Kind == "" {
+		msg.Kind = "text"
+	}
+	m := Message{
+		DialogID: msg.DialogID, SenderID: msg.SenderID, Kind: msg.Kind, Text: msg.Text,
+		ForwardedFrom: msg.ForwardedFrom, ClientMessageID: msg.ClientMessageID, ThreadRootID: msg.ThreadRootID, Mentions: msg.Mentions,
+		Attachments: msg.Attachments,
+	}
+	var poll PollInput
+	if msg.Poll != nil {
+		poll = *msg.Poll
+	}
+	// a retry with a stored client id takes no post number; one that races
+	// the original past the check leaves its number as a gap
+	err = r.db(ctx).QueryRow(ctx, `
+		WITH seq AS (
+			UPDATE dialogs
+			SET post_seq = post_seq + 1, last_activity_at = GREATEST(last_activity_at, NOW())
+			WHERE id = $1 AND kind = 'channel' AND $7::message_kind <> 'poll_vote' AND $12::bigint IS NULL
+			  AND NOT EXISTS (
+			      SELECT 1 FROM messages
+			      WHERE dialog_id = $1 AND sender_id = $2 AND client_message_id = NULLIF($6, ''))
+			RETURNING post_seq
+		), ins AS (
+			INSERT INTO messages (dialog_id, sender_id, kind, cipher_text, reply_to, metadata, client_message_id, thread_root_id, created_at, expires_at, post_seq)
+			SELECT $1, $2, $7::message_kind, $3, $4, $5, NULLIF($6, ''), $12, NOW(),
+			       CASE WHEN d.message_ttl_seconds > 0 THEN NOW() + make_interval(secs => d.message_ttl_seconds) END,
+			       (SELECT post_seq FROM seq)
+			FROM dialogs d WHERE d.id = $1
+			ON CONFLICT (dialog_id, sender_id, client_message_id) WHERE client_message_id IS NOT NULL DO NOTHING
+			RETURNING id, dialog_id, sender_id, kind, thread_root_id, created_at, expires_at, post_seq,
+			          COALESCE($13::uuid[], '{}') AS mentioned
+		), lost AS (
+			INSERT INTO channel_post_gaps (dialog_id, post_seq)
+			SELECT $1, post_seq FROM seq WHERE NOT EXISTS (SELECT 1 FROM ins)
+		)`+bumpMembersSQL+`, poll AS (
+			INSERT INTO polls (message_id, options, multiple, anonymous, closes_at)
+			SELECT id, $8, $9, $10, $11 FROM ins WHERE $8::text[] IS NOT NULL
+		), mention AS (
+			INSERT INTO message_mentions (message_id, dialog_id, user_id)
+			SELECT ins.id, ins.dialog_id, u FROM ins, unnest(ins.mentioned) AS u
+		), media AS (
+			INSERT INTO message_media (message_id, media_id)
+			SELECT ins.id, a FROM ins, unnest($14::uuid[]) AS a
+		)
+		SELECT id, created_at, expires_at FROM ins
+	`, msg.DialogID, msg.SenderID, []byte(msg.Text), msg.ReplyTo, string(meta), msg.ClientMessageID, msg.Kind,
+		poll.Options, poll.Multiple, poll.Anonymous, poll.ClosesAt, msg.ThreadRootID, msg.Mentioned, msg.Attachments).Scan(&m.ID, &m.CreatedAt, &m.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Message{}, ErrDuplicateMessage
+	}
+	return m, err
+}
+
+// bumpMembersSQL continues a WITH whose "ins" CTE returns a new message: every
+// member gets it as the last message and, except the sender, one more unread;
+// the members in its "mentioned" column get one more unread mention.
+// Concurrent sends may lock member rows out of id order, hence GREATEST.
+// Poll votes of encrypted dialogs are control messages and thread replies
+// live outside the main timeline, so neither changes the summary; a mention
+// in a thread reply still counts (see unreadMentionsSQL). Rewriting every
+// subscriber row would make posting cost grow with the audience, so a
+// channel post only moves the channel's post counter and activity time in
+// the "seq" CTE before "ins", which numbers the post, and the poster's read
+// position; ListDialogs derives channel summaries from those.
+const bumpMembersSQL = `, bump AS (
+			UPDATE dialog_members dm
+			SET last_message_id = GREATEST(COALESCE(dm.last_message_id, 0), ins.id),
+			    last_activity_at = GREATEST(dm.last_activity_at, ins.created_at),
+			    unread_count = dm.unread_count + (dm.user_id <> ins.sender_id)::int,
+			    unread_mentions = dm.unread_mentions + (dm.user_id = ANY(ins.mentioned))::int
+			FROM ins
+			JOIN dialogs d ON d.id = ins.dialog_id
+			WHERE dm.dialog_id = ins.dialog_id AND ins.kind <> 'poll_vote' AND ins.thread_root_id IS NULL
+			  AND d.kind <> 'channel'
+		), channel_read AS (
+			UPDATE dialog_members dm
+			SET read_post_seq = GREATEST(dm.read_post_seq, ins.post_seq),
+			    last_read_message_id = GREATEST(dm.last_read_message_id, ins.id),
+			    last_delivered_message_id = GREATEST(dm.last_delivered_message_id, ins.id)
+			FROM ins
+			WHERE dm.dialog_id = ins.dialog_id AND dm.user_id = ins.sender_id AND ins.post_seq IS NOT NULL
+		), thread_mention AS (
+			UPDATE dialog_members dm SET unread_mentions = dm.unread_mentions + 1
+			FROM ins
+			WHERE dm.dialog_id = ins.dialog_id AND ins.thread_root_id IS NOT NULL AND dm.user_id = ANY(ins.mentioned)
+		)`
+
+// refreshMembersSQL recomputes the last visible message and unread count of
+// the members of dialog $1 (only of $2 unless NULL) whose summary can depend
+// on messages from id $3 on (any message if NULL). Used when messages
+// disappear, which is rare compared to sends. Channels keep no member
+// summaries (see bumpMembersSQL) and are skipped.
+const refreshMembersSQL = `
+		UPDATE dialog_members dm
+		SET last_message_id = lm.id,
+		    last_activity_at = COALESCE(lm.created_at, dm.last_activity_at),
+		    unread_count = (
+		        SELECT COUNT(*) FROM messages m
+		        WHERE m.dialog_id = dm.dialog_id AND m.id > dm.last_read_message_id
+		          AND m.sender_id <> dm.user_id AND m.deleted_at IS NULL AND m.kind <> 'poll_vote' AND m.thread_root_id IS NULL
+		          AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = dm.user_id)),
+		    unread_mentions = (` + unreadMentionsSQL + `)
+		FROM dialog_members cur
+		JOIN dialogs d ON d.id = cur.dialog_id AND d.kind <> 'channel'
+		LEFT JOIN LATERAL (
+		    SELECT m.id, m.created_at FROM messages m
+		    WHERE m.dialog_id = cur.dialog_id AND m.deleted_at IS NULL AND m.kind <> 'poll_vote' AND m.thread_root_id IS NULL
+		      AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = cur.user_id)
+		    ORDER BY m.id DESC LIMIT 1
+		) lm ON true
+		WHERE cur.dialog_id = dm.dialog_id AND cur.user_id = dm.user_id
+		  AND dm.dialog_id = $1
+		  AND ($2::uuid IS NULL OR dm.user_id = $2)
+		  AND ($3::bigint IS NULL OR dm.last_message_id >= $3 OR dm.last_read_message_id < $3 OR dm.unread_mentions > 0)`
+
+// dropPostsSQL records the channel posts among messages $1 as gaps in their
+// channel's numbering before they are deleted or expire; ListDialogs
+// subtracts the gaps after a subscriber's read position from the unread
+// count.
+const dropPostsSQL = `
+		INSERT INTO channel_post_gaps (dialog_id, post_seq)
+		SELECT dialog_id, post_seq FROM messages WHERE id = ANY($1) AND post_seq IS NOT NULL
+		ON CONFLICT DO NOTHING`
+
+// channelFloorSQL moves the post_floor of channel $1 under its oldest
+// remaining post and prunes the gaps at or below it, which no read position
+// counts any more; gaps thus stay bounded by the removed posts between
+// remaining ones.
+const channelFloorSQL = `
+		WITH floor AS (
+			UPDATE dialogs d
+			SET post_floor = GREATEST(d.post_floor, COALESCE((
+			        SELECT m.post_seq - 1 FROM messages m
+			        WHERE m.dialog_id = d.id AND m.post_seq IS NOT NULL AND m.deleted_at IS NULL
+			        ORDER BY m.post_seq LIMIT 1), d.post_seq))
+			WHERE d.id = $1 AND d.kind = 'channel'
+			RETURNING d.post_floor
+		)
+		DELETE FROM channel_post_gaps g USING floor WHERE g.dialog_id = $1 AND g.post_seq <= floor.post_floor`
+
+// unreadMentionsSQL counts the unread mentions of member dm. Mentions in
+// thread replies count too: MarkRead clears those of the main timeline and
+// MarkThreadRead those of a thread, each subtracting only mentions this count
+// includes (see mentionCountedSQL).
+const unreadMentionsSQL = `
+		    SELECT COUNT(*) FROM message_mentions mm
+		    JOIN messages m ON m.id = mm.message_id
+		    WHERE mm.dialog_id = dm.dialog_id AND mm.user_id = dm.user_id AND NOT mm.read AND m.deleted_at IS NULL
+		      AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = dm.user_id)`
+
+// mentionCountedSQL tells whether a mention in message m of user $2 is in
+// unreadMentionsSQL.
+const mentionCountedSQL = `m.deleted_at IS NULL
+			  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $2)`
+
+// SetMessageTTL sets the disappearing-messages timer of a dialog and reports
+// whether it changed.
+func (r *pgRepository) SetMessageTTL(ctx context.Context, dialogID uuid.UUID, seconds int) (bool, error) {
+	tag, err := r.db(ctx).Exec(ctx, `
+		UPDATE dialogs SET message_ttl_seconds = $2, updated_at = NOW()
+		WHERE id = $1 AND message_ttl_seconds <> $2`, dialogID, seconds)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ReapExpiredMessages hard-deletes up to limit expired messages with their
+// attached media and returns them with the blobs to delete; reactions, pins,
+// edits and thread replies go with them by cascade, so the replies are
+// returned too. Rows locked by a concurrent reaper are skipped, so several
+// instances can run.
+func (r *pgRepository) ReapExpiredMessages(ctx context.Context, limit int) ([]ExpiredMessage, []MediaObject, error) {
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `
+		SELECT m.id, m.dialog_id, d.kind::text
+		FROM messages m
+		JOIN dialogs d ON d.id = m.dialog_id
+		WHERE m.expires_at <= NOW()
+		ORDER BY m.expires_at
+		LIMIT $1
+		FOR UPDATE OF m SKIP LOCKED`, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		expired []ExpiredMessage
+		ids     []int64
+		oldest  = map[uuid.UUID]int64{}
+	)
+	for rows.Next() {
+		var e ExpiredMessage
+		if err := rows.Scan(&e.ID, &e.DialogID, &e.DialogKind); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		expired = append(expired, e)
+		ids = append(ids, e.ID)
+		if cur, ok := oldest[e.DialogID]; !ok || e.ID < cur {
+			oldest[e.DialogID] = e.ID
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+	rows, err = tx.Query(ctx, `
+		SELECT m.id, m.dialog_id, d.kind::text
+		FROM messages m
+		JOIN dialogs d ON d.id = m.dialog_id
+		WHERE m.thread_root_id = ANY($1) AND NOT m.id = ANY($1)`, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var e ExpiredMessage
+		if err := rows.Scan(&e.ID, &e.DialogID, &e.DialogKind); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		expired = append(expired, e)
+		ids = append(ids, e.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows, err = tx.Query(ctx, `
+		DELETE FROM media_objects
+		WHERE id IN (SELECT media_id FROM message_media WHERE message_id = ANY($1))
+		RETURNING COALESCE(bucket, ''), object_key`, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	var blobs []MediaObject
+	for rows.Next() {
+		var o MediaObject
+		if err := rows.Scan(&o.Bucket, &o.Key); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		blobs = append(blobs, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(ctx, dropPostsSQL, ids); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM messages WHERE id = ANY($1)`, ids); err != nil {
+		return nil, nil, err
+	}
+	for dialogID, from := range oldest {
+		if _, err := tx.Exec(ctx, refreshMembersSQL, dialogID, nil, from); err != nil {
+			return nil, nil, err
+		}
+		if _, err := tx.Exec(ctx, channelFloorSQL, dialogID); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+	return expired, blobs, nil
+}
+
+// UsableMedia reports whether every one of ids is an upload of owner that no
+// message uses yet.
+func (r *pgRepository) UsableMedia(ctx context.Context, owner uuid.UUID, ids []uuid.UUID) (bool, error) {
+	var n int
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT COUNT(*) FROM media_objects o
+		WHERE o.id = ANY($2) AND o.owner_id = $1
+		  AND NOT EXISTS (SELECT 1 FROM message_media mm WHERE mm.media_id = o.id)`, owner, ids).Scan(&n)
+	return n == len(ids), err
+}
+
+// MessageMedia returns the attachments of messageIDs in attach order.
+func (r *pgRepository) MessageMedia(ctx context.Context, messageIDs []int64) (map[int64][]uuid.UUID, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT mm.message_id, mm.media_id
+		FROM message_media mm
+		JOIN media_objects o ON o.id = mm.media_id
+		WHERE mm.message_id = ANY($1)
+		ORDER BY mm.message_id, o.created_at, o.id`, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := map[int64][]uuid.UUID{}
+	for rows.Next() {
+		var (
+			id    int64
+			media uuid.UUID
+		)
+		if err := rows.Scan(&id, &media); err != nil {
+			return nil, err
+		}
+		res[id] = append(res[id], media)
+	}
+	return res, rows.Err()
+}
+
+// replyPreviewLength is how many characters of the original a reply preview keeps.
+const replyPreviewLength = 100
+
+// applyMeta decodes messages.metadata and the joined reply columns into m.
+func applyMeta(m *Message, meta []byte, replyID *int64, replySender *uuid.UUID, replyKind, replyText *string, replyDeleted *bool) error {
+	var md messageMeta
+	if len(meta) > 0 {
+		if err := json.Unmarshal(meta, &md); err != nil {
+			return err
+		}
+	}
+	m.ForwardedFrom = md.ForwardedFrom
+	m.Mentions = md.Mentions
+	if replyID != nil && replySender != nil && replyKind != nil && replyText != nil && replyDeleted != nil {
+		m.ReplyTo = &ReplyPreview{
+			ID: *replyID, SenderID: *replySender, Kind: *replyKind, Text: *replyText, Quote: md.Quote, Deleted: *replyDeleted,
+		}
+	}
+	return nil
 }
 
+// ListMessages returns the main timeline of the dialog, without thread replies.
 func (r *pgRepository) ListMessages(ctx context.Context, dialogID, userID uuid.UUID, limit int, before int64) ([]Message, error) {
+	return r.listMessages(ctx, dialogID, userID, 0, limit, before)
+}
+
+// ListThread returns the replies in the thread of rootID, newest first.
+func (r *pgRepository) ListThread(ctx context.Context, dialogID, userID uuid.UUID, rootID int64, limit int, before int64) ([]Message, error) {
+	return r.listMessages(ctx, dialogID, userID, rootID, limit, before)
+}
+
+// listMessages lists the thread of rootID, or the main timeline when it is 0.
+func (r *pgRepository) listMessages(ctx context.Context, dialogID, userID uuid.UUID, rootID int64, limit int, before int64) ([]Message, error) {
 	if limit <= 0 || limit > 100 {
 		limit = 50
 	}
-	rows, err := r.pool.Query(ctx, `
-WITH other_member AS (
-  SELECT user_id FROM dialog_members WHERE dialog_id = $1 AND user_id <> $2 LIMIT 1
+	thread, args := `thread_root_id IS NULL`, []any{dialogID, userID, before, limit, replyPreviewLength}
+	if rootID != 0 {
+		thread, args = `thread_root_id = $6`, append(args, rootID)
+	}
+	rows, err := r.db(ctx).Query(ctx, `
+WITH me AS (
+  SELECT last_read_message_id AS read_id, last_delivered_message_id AS delivered_id
+  FROM dialog_members WHERE dialog_id = $1 AND user_id = $2
+),
+-- a message counts as read by peers once any other accepted member read it
+peers AS (
+  SELECT COALESCE(MAX(last_read_message_id), 0) AS read_id, COALESCE(MAX(last_delivered_message_id), 0) AS delivered_id
+  FROM dialog_members WHERE dialog_id = $1 AND user_id <> $2 AND request_state = 'accepted'
 ),
 filtered AS (
   SELECT *
   FROM messages
-  WHERE dialog_id = $1 AND ($3 = 0 OR id < $3)
+  WHERE dialog_id = $1 AND ($3 = 0 OR id < $3) AND `+thread+`
+    AND (expires_at IS NULL OR expires_at > NOW())
+    AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = $2)
   ORDER BY id DESC
   LIMIT $4
 )
-SELECT m.id, m.sender_id, m.dialog_id, convert_from(m.cipher_text,'UTF8') AS text, m.created_at,
-       EXISTS(SELECT 1 FROM message_deliveries d WHERE d.message_id = m.id AND d.user_id = $2) AS delivered_to_me,
-       EXISTS(SELECT 1 FROM message_reads r WHERE r.message_id = m.id AND r.user_id = $2) AS read_by_me,
-       EXISTS(SELECT 1 FROM message_deliveries d WHERE d.message_id = m.id AND d.user_id = COALESCE(om.user_id, $2)) AS delivered_peer,
-       EXISTS(SELECT 1 FROM message_reads r WHERE r.message_id = m.id AND r.user_id = COALESCE(om.user_id, $2)) AS read_peer
+SELECT m.id, m.sender_id, m.dialog_id, m.kind::text,
+       CASE WHEN m.deleted_at IS NULL THEN convert_from(m.cipher_text,'UTF8') ELSE '' END AS text, m.created_at,
+       m.edited_at, m.deleted_at IS NOT NULL, COALESCE(m.metadata, '{}'),
+       rp.id, rp.sender_id, rp.kind::text,
+       CASE WHEN rp.deleted_at IS NULL THEN left(convert_from(rp.cipher_text,'UTF8'), $5) ELSE '' END,
+       rp.deleted_at IS NOT NULL,
+       m.id <= COALESCE(me.delivered_id, 0) AS delivered_to_me,
+       m.id <= COALESCE(me.read_id, 0) AS read_by_me,
+       m.id <= p.delivered_id AS delivered_peer,
+       m.id <= p.read_id AS read_peer,
+       EXISTS(SELECT 1 FROM dialog_pins p WHERE p.dialog_id = m.dialog_id AND p.message_id = m.id) AS pinned,
+       CASE WHEN m.sender_id = $2 THEN COALESCE(m.client_message_id, '') ELSE '' END,
+       m.expires_at, m.thread_root_id
 FROM filtered m
-LEFT JOIN other_member om ON true
+CROSS JOIN peers p
+LEFT JOIN me ON true
+LEFT JOIN messages rp ON rp.id = m.reply_to
 ORDER BY m.id DESC
-	`, dialogID, userID, before, limit)
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var msgs []Message
 	for rows.Next() {
-		var m Message
-		if err := rows.Scan(&m.ID, &m.SenderID, &m.DialogID, &m.Text, &m.CreatedAt, &m.DeliveredToMe, &m.ReadByMe, &m.DeliveredPeer, &m.ReadPeer); err != nil {
+		var (
+			m            Message
+			meta         []byte
+			replyID      *int64
+			replySender  *uuid.UUID
+			replyKind    *string
+			replyText    *string
+			replyDeleted *bool
+		)
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.DialogID, &m.Kind, &m.Text, &m.CreatedAt, &m.EditedAt, &m.Deleted, &meta,
+			&replyID, &replySender, &replyKind, &replyText, &replyDeleted,
+			&m.DeliveredToMe, &m.ReadByMe, &m.DeliveredPeer, &m.ReadPeer, &m.Pinned, &m.ClientMessageID, &m.ExpiresAt, &m.ThreadRootID); err != nil {
+			return nil, err
+		}
+		if err := applyMeta(&m, meta, replyID, replySender, replyKind, replyText, replyDeleted); err != nil {
 			return nil, err
 		}
 		msgs = append(msgs, m)
@@ -236,20 +1089,1357 @@ ORDER BY m.id DESC
 	return msgs, rows.Err()
 }
 
-func (r *pgRepository) MarkDelivered(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) error {
-	_, err := r.pool.Exec(ctx, `
-		INSERT INTO message_deliveries (message_id, user_id, delivered_at)
-		VALUES ($1, $2, NOW())
-		ON CONFLICT DO NOTHING
-	`, messageID, userID)
+// GetMessage returns a message of the dialog; tombstones are returned with Deleted set.
+func (r *pgRepository) GetMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) (Message, error) {
+	return r.queryMessage(ctx, `m.id = $3 AND m.dialog_id = $1`, dialogID, replyPreviewLength, messageID)
+}
+
+// MessageByClientID finds the message senderID stored under clientID.
+func (r *pgRepository) MessageByClientID(ctx context.Context, dialogID, senderID uuid.UUID, clientID string) (Message, error) {
+	return r.queryMessage(ctx, `m.dialog_id = $1 AND m.sender_id = $3 AND m.client_message_id = $4`,
+		dialogID, replyPreviewLength, senderID, clientID)
+}
+
+// queryMessage loads one message with its reply preview; $1 is the dialog id
+// and $2 the preview length.
+func (r *pgRepository) queryMessage(ctx context.Context, where string, args ...any) (Message, error) {
+	var (
+		m            Message
+		meta         []byte
+		replyID      *int64
+		replySender  *uuid.UUID
+		replyKind    *string
+		replyText    *string
+		replyDeleted *bool
+	)
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT m.id, m.sender_id, m.dialog_id, m.kind::text,
+		       CASE WHEN m.deleted_at IS NULL THEN convert_from(m.cipher_text,'UTF8') ELSE '' END,
+		       m.created_at, m.edited_at, m.deleted_at IS NOT NULL, COALESCE(m.metadata, '{}'),
+		       COALESCE(m.client_message_id, ''), m.expires_at, m.thread_root_id,
+		       rp.id, rp.sender_id, rp.kind::text,
+		       CASE WHEN rp.deleted_at IS NULL THEN left(convert_from(rp.cipher_text,'UTF8'), $2) ELSE '' END,
+		       rp.deleted_at IS NOT NULL
+		FROM messages m
+		LEFT JOIN messages rp ON rp.id = m.reply_to
+		WHERE (m.expires_at IS NULL OR m.expires_at > NOW()) AND `+where, args...).
+		Scan(&m.ID, &m.SenderID, &m.DialogID, &m.Kind, &m.Text, &m.CreatedAt, &m.EditedAt, &m.Deleted, &meta,
+			&m.ClientMessageID, &m.ExpiresAt, &m.ThreadRootID, &replyID, &replySender, &replyKind, &replyText, &replyDeleted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	if err := applyMeta(&m, meta, replyID, replySender, replyKind, replyText, replyDeleted); err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+// EditMessage replaces the text and its mention entities; nil mentions drop them.
+func (r *pgRepository) EditMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, text string, mentions []Mention) (time.Time, error) {
+	var entities []byte
+	if mentions != nil {
+		var err error
+		if entities, err = json.Marshal(mentions); err != nil {
+			return time.Time{}, err
+		}
+	}
+	var edited time.Time
+	err := r.db(ctx).QueryRow(ctx, `
+		UPDATE messages SET cipher_text = $3, edited_at = NOW(),
+		    metadata = CASE WHEN $4::jsonb IS NULL THEN COALESCE(metadata, '{}') - 'mentions'
+		                    ELSE jsonb_set(COALESCE(metadata, '{}'), '{mentions}', $4::jsonb) END
+		WHERE id = $1 AND dialog_id = $2 AND deleted_at IS NULL
+		RETURNING edited_at`, messageID, dialogID, []byte(text), entities).Scan(&edited)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, ErrMessageNotFound
+	}
+	return edited, err
+}
+
+// DeleteMessage leaves a tombstone: the row stays for ordering and replies,
+// the content and any pin are wiped.
+func (r *pgRepository) DeleteMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) error {
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var n int
+	err = tx.QueryRow(ctx, `
+		WITH del AS (
+			UPDATE messages SET cipher_text = ''::bytea, metadata = '{}', deleted_at = NOW()
+			WHERE id = $1 AND dialog_id = $2 AND deleted_at IS NULL
+			RETURNING id
+		), unpin AS (
+			DELETE FROM dialog_pins p USING del WHERE p.message_id = del.id
+		)
+		SELECT COUNT(*) FROM del`, messageID, dialogID).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrMessageNotFound
+	}
+	if _, err := tx.Exec(ctx, refreshMembersSQL, dialogID, nil, messageID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, dropPostsSQL, []int64{messageID}); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, channelFloorSQL, dialogID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *pgRepository) HideMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, userID uuid.UUID) error {
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO message_hidden (message_id, user_id)
+		SELECT id, $3 FROM messages WHERE id = $1 AND dialog_id = $2
+		ON CONFLICT DO NOTHING`, messageID, dialogID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, refreshMembersSQL, dialogID, userID, messageID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// AddReaction stores a reaction unless the user already has limit distinct
+// reactions on the message. It reports whether the reaction is now present.
+func (r *pgRepository) AddReaction(ctx context.Context, messageID int64, userID uuid.UUID, reaction string, limit int) (bool, error) {
+	var present bool
+	err := r.db(ctx).QueryRow(ctx, `
+		WITH ins AS (
+			INSERT INTO message_reactions (message_id, user_id, reaction)
+			SELECT $1, $2, $3
+			WHERE (SELECT COUNT(*) FROM message_reactions WHERE message_id = $1 AND user_id = $2) < $4
+			ON CONFLICT DO NOTHING
+			RETURNING 1
+		)
+		SELECT EXISTS(SELECT 1 FROM ins)
+		    OR EXISTS(SELECT 1 FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND reaction = $3)`,
+		messageID, userID, reaction, limit).Scan(&present)
+	return present, err
+}
+
+func (r *pgRepository) RemoveReaction(ctx context.Context, messageID int64, userID uuid.UUID, reaction string) error {
+	_, err := r.db(ctx).Exec(ctx, `
+		DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND reaction = $3`,
+		messageID, userID, reaction)
 	return err
 }
 
-func (r *pgRepository) MarkRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) error {
-	_, err := r.pool.Exec(ctx, `
-		INSERT INTO message_reads (message_id, user_id, read_at)
-		VALUES ($1, $2, NOW())
-		ON CONFLICT DO NOTHING
-	`, messageID, userID)
+// MessageReactions aggregates reactions per message, most popular first.
+func (r *pgRepository) MessageReactions(ctx context.Context, userID uuid.UUID, messageIDs []int64) (map[int64][]Reaction, error) {
+	res := make(map[int64][]Reaction)
+	if len(messageIDs) == 0 {
+		return res, nil
+	}
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT message_id, reaction, COUNT(*), bool_or(user_id = $1)
+		FROM message_reactions
+		WHERE message_id = ANY($2)
+		GROUP BY message_id, reaction
+		ORDER BY message_id, COUNT(*) DESC, MIN(created_at)`, userID, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id int64
+			rc Reaction
+		)
+		if err := rows.Scan(&id, &rc.Reaction, &rc.Count, &rc.Mine); err != nil {
+			return nil, err
+		}
+		res[id] = append(res[id], rc)
+	}
+	return res, rows.Err()
+}
+
+// AllowedReactions returns nil when any reaction is allowed.
+func (r *pgRepository) AllowedReactions(ctx context.Context, dialogID uuid.UUID) ([]string, error) {
+	var allowed []string
+	err := r.db(ctx).QueryRow(ctx, `SELECT allowed_reactions FROM dialogs WHERE id = $1`, dialogID).Scan(&allowed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDialogNotFound
+	}
+	return allowed, err
+}
+
+func (r *pgRepository) SetAllowedReactions(ctx context.Context, dialogID uuid.UUID, allowed []string) error {
+	_, err := r.db(ctx).Exec(ctx, `UPDATE dialogs SET allowed_reactions = $2, updated_at = NOW() WHERE id = $1`, dialogID, allowed)
 	return err
 }
+
+func (r *pgRepository) DialogEncrypted(ctx context.Context, dialogID uuid.UUID) (bool, error) {
+	var encrypted bool
+	err := r.db(ctx).QueryRow(ctx, `SELECT is_encrypted FROM dialogs WHERE id = $1`, dialogID).Scan(&encrypted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, ErrDialogNotFound
+	}
+	return encrypted, err
+}
+
+// Polls returns the polls among messageIDs with their results as seen by
+// userID. Voters are listed for public polls only, up to maxPollVoters per option.
+func (r *pgRepository) Polls(ctx context.Context, userID uuid.UUID, messageIDs []int64) (map[int64]*Poll, error) {
+	res := make(map[int64]*Poll)
+	if len(messageIDs) == 0 {
+		return res, nil
+	}
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT p.message_id, p.options, p.multiple, p.anonymous, p.closes_at,
+		       COALESCE(p.closes_at <= NOW(), FALSE),
+		       (SELECT COUNT(DISTINCT v.user_id) FROM poll_votes v WHERE v.message_id = p.message_id)
+		FROM polls p
+		WHERE p.message_id = ANY($1)`, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			id      int64
+			options []string
+			p       Poll
+		)
+		if err := rows.Scan(&id, &options, &p.Multiple, &p.Anonymous, &p.ClosesAt, &p.Closed, &p.Voters); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p.Options = make([]PollOption, len(options))
+		for i, text := range options {
+			p.Options[i] = PollOption{ID: i, Text: text}
+		}
+		res[id] = &p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return res, nil
+	}
+	rows, err = r.db(ctx).Query(ctx, `
+		SELECT v.message_id, v.option, COUNT(*), bool_or(v.user_id = $1),
+		       CASE WHEN p.anonymous THEN NULL ELSE (array_agg(v.user_id ORDER BY v.created_at))[1:$3] END
+		FROM poll_votes v
+		JOIN polls p ON p.message_id = v.message_id
+		WHERE v.message_id = ANY($2)
+		GROUP BY v.message_id, v.option, p.anonymous`, userID, messageIDs, maxPollVoters)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id     int64
+			option int
+			opt    PollOption
+		)
+		if err := rows.Scan(&id, &option, &opt.Votes, &opt.Chosen, &opt.VoterIDs); err != nil {
+			return nil, err
+		}
+		if p := res[id]; p != nil && option < len(p.Options) {
+			opt.ID, opt.Text = option, p.Options[option].Text
+			p.Options[option] = opt
+		}
+	}
+	return res, rows.Err()
+}
+
+// ThreadSummaries returns the summaries of the threads rooted at rootIDs that
+// have visible replies, with unread counts from userID's thread watermarks.
+func (r *pgRepository) ThreadSummaries(ctx context.Context, userID uuid.UUID, rootIDs []int64) (map[int64]*Thread, error) {
+	res := make(map[int64]*Thread)
+	if len(rootIDs) == 0 {
+		return res, nil
+	}
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT m.thread_root_id, COUNT(*), MAX(m.id), COALESCE(tr.last_read_message_id, 0),
+		       COUNT(*) FILTER (WHERE m.id > COALESCE(tr.last_read_message_id, 0) AND m.sender_id <> $1)
+		FROM messages m
+		LEFT JOIN thread_reads tr ON tr.root_id = m.thread_root_id AND tr.user_id = $1
+		WHERE m.thread_root_id = ANY($2) AND m.deleted_at IS NULL
+		  AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+		GROUP BY m.thread_root_id, tr.last_read_message_id`, userID, rootIDs)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			id int64
+			t  Thread
+		)
+		if err := rows.Scan(&id, &t.ReplyCount, &t.LastReplyID, &t.LastReadID, &t.UnreadCount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		res[id] = &t
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return res, nil
+	}
+	rows, err = r.db(ctx).Query(ctx, `
+		SELECT root_id, sender_id FROM (
+		    SELECT m.thread_root_id AS root_id, m.sender_id, MAX(m.id) AS last_id,
+		           ROW_NUMBER() OVER (PARTITION BY m.thread_root_id ORDER BY MAX(m.id) DESC) AS rn
+		    FROM messages m
+		    WHERE m.thread_root_id = ANY($1) AND m.deleted_at IS NULL
+		      AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		    GROUP BY m.thread_root_id, m.sender_id
+		) t
+		WHERE rn <= $2
+		ORDER BY root_id, last_id DESC`, rootIDs, maxThreadRepliers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id     int64
+			sender uuid.UUID
+		)
+		if err := rows.Scan(&id, &sender); err != nil {
+			return nil, err
+		}
+		if t := res[id]; t != nil {
+			t.RecentRepliers = append(t.RecentRepliers, sender)
+		}
+	}
+	return res, rows.Err()
+}
+
+// MarkThreadRead moves the user's read watermark in the thread of rootID
+// forward to messageID, which must be a reply in it. It reports whether the
+// watermark moved.
+func (r *pgRepository) MarkThreadRead(ctx context.Context, rootID int64, userID uuid.UUID, messageID int64) (bool, error) {
+	var moved int
+	err := r.db(ctx).QueryRow(ctx, `
+		WITH mark AS (
+			INSERT INTO thread_reads (root_id, user_id, last_read_message_id)
+			SELECT $1, $2, $3 WHERE EXISTS (SELECT 1 FROM messages WHERE id = $3 AND thread_root_id = $1)
+			ON CONFLICT (root_id, user_id) DO UPDATE SET last_read_message_id = EXCLUDED.last_read_message_id
+			WHERE thread_reads.last_read_message_id < EXCLUDED.last_read_message_id
+			RETURNING 1
+		), seen AS (
+			UPDATE message_mentions mm SET read = TRUE
+			FROM messages m
+			WHERE mm.user_id = $2 AND NOT mm.read AND mm.message_id <= $3
+			  AND m.id = mm.message_id AND m.thread_root_id = $1
+			  AND EXISTS (SELECT 1 FROM mark)
+			RETURNING mm.dialog_id, `+mentionCountedSQL+` AS counted
+		), unmention AS (
+			UPDATE dialog_members dm SET unread_mentions = GREATEST(dm.unread_mentions - s.n, 0)
+			FROM (SELECT dialog_id, COUNT(*) FILTER (WHERE counted) AS n FROM seen GROUP BY dialog_id) s
+			WHERE dm.dialog_id = s.dialog_id AND dm.user_id = $2
+		)
+		SELECT COUNT(*) FROM mark`, rootID, userID, messageID).Scan(&moved)
+	if err != nil {
+		return false, err
+	}
+	return moved > 0, nil
+}
+
+// MembersByUsername maps the lowercased usernames of dialog members to their ids.
+func (r *pgRepository) MembersByUsername(ctx context.Context, dialogID uuid.UUID, usernames []string) (map[string]uuid.UUID, error) {
+	res := make(map[string]uuid.UUID)
+	if len(usernames) == 0 {
+		return res, nil
+	}
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT lower(u.username::text), u.id
+		FROM dialog_members dm
+		JOIN users u ON u.id = dm.user_id
+		WHERE dm.dialog_id = $1 AND lower(u.username::text) = ANY($2)`, dialogID, usernames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name string
+			id   uuid.UUID
+		)
+		if err := rows.Scan(&name, &id); err != nil {
+			return nil, err
+		}
+		res[name] = id
+	}
+	return res, rows.Err()
+}
+
+// MentionRecipients returns the members among userIDs whom a mention
+// notifies: those who did not mute the dialog or let mentions through.
+func (r *pgRepository) MentionRecipients(ctx context.Context, dialogID uuid.UUID, userIDs []uuid.UUID) ([]uuid.UUID, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT user_id FROM dialog_members
+		WHERE dialog_id = $1 AND user_id = ANY($2)
+		  AND (muted_until IS NULL OR muted_until <= NOW() OR notify_mentions)`, dialogID, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+// NextMention returns the oldest unread message after the given id that
+// mentions the user, in the main timeline or a thread, like unreadMentionsSQL.
+func (r *pgRepository) NextMention(ctx context.Context, dialogID, userID uuid.UUID, after int64) (int64, error) {
+	var id int64
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT mm.message_id FROM message_mentions mm
+		JOIN messages m ON m.id = mm.message_id
+		WHERE mm.dialog_id = $1 AND mm.user_id = $2 AND NOT mm.read AND mm.message_id > $3
+		  AND m.deleted_at IS NULL AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $2)
+		ORDER BY mm.message_id
+		LIMIT 1`, dialogID, userID, after).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrMessageNotFound
+	}
+	return id, err
+}
+
+// SetPollVote replaces the user's choice in a poll; no options retracts the
+// vote. It fails with ErrPollClosed once the poll is closed and reports
+// whether the choice changed.
+func (r *pgRepository) SetPollVote(ctx context.Context, messageID int64, userID uuid.UUID, options []int) (bool, error) {
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	// votes after closing would race with it otherwise
+	var closed bool
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(closes_at <= NOW(), FALSE) FROM polls WHERE message_id = $1 FOR SHARE`, messageID).Scan(&closed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, ErrMessageNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if closed {
+		return false, ErrPollClosed
+	}
+	var current []int
+	if err := tx.QueryRow(ctx, `
+		SELECT COALESCE(array_agg(option::int ORDER BY option), '{}') FROM poll_votes
+		WHERE message_id = $1 AND user_id = $2`, messageID, userID).Scan(&current); err != nil {
+		return false, err
+	}
+	if slices.Equal(current, options) {
+		return false, nil
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM poll_votes WHERE message_id = $1 AND user_id = $2`, messageID, userID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO poll_votes (message_id, user_id, option)
+		SELECT $1, $2, unnest($3::smallint[])`, messageID, userID, options); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// SaveDraft upserts the draft if it is newer than the stored one and reports
+// whether it was applied. Either way it returns the stored draft.
+func (r *pgRepository) SaveDraft(ctx context.Context, userID uuid.UUID, d Draft) (Draft, bool, error) {
+	var stored Draft
+	err := r.db(ctx).QueryRow(ctx, `
+		INSERT INTO dialog_drafts (dialog_id, user_id, blob, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, dialog_id) DO UPDATE
+		SET blob = EXCLUDED.blob, updated_at = EXCLUDED.updated_at
+		WHERE dialog_drafts.updated_at < EXCLUDED.updated_at
+		RETURNING dialog_id, blob, updated_at`,
+		d.DialogID, userID, d.Blob, d.UpdatedAt).Scan(&stored.DialogID, &stored.Blob, &stored.UpdatedAt)
+	if err == nil {
+		return stored, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return Draft{}, false, err
+	}
+	// a newer draft won
+	err = r.db(ctx).QueryRow(ctx, `
+		SELECT dialog_id, blob, updated_at FROM dialog_drafts
+		WHERE user_id = $1 AND dialog_id = $2`, userID, d.DialogID).Scan(&stored.DialogID, &stored.Blob, &stored.UpdatedAt)
+	return stored, false, err
+}
+
+// ClearDraft empties a non-empty draft older than d and reports whether there was one.
+func (r *pgRepository) ClearDraft(ctx context.Context, userID uuid.UUID, d Draft) (bool, error) {
+	tag, err := r.db(ctx).Exec(ctx, `
+		UPDATE dialog_drafts SET blob = ''::bytea, updated_at = $3
+		WHERE user_id = $1 AND dialog_id = $2 AND blob <> ''::bytea AND updated_at < $3`,
+		userID, d.DialogID, d.UpdatedAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ListDrafts returns the user's non-empty drafts in dialogs they are a member of.
+func (r *pgRepository) ListDrafts(ctx context.Context, userID uuid.UUID) ([]Draft, error) {
+	return r.queryDrafts(ctx, `
+		SELECT d.dialog_id, d.blob, d.updated_at
+		FROM dialog_drafts d
+		JOIN dialog_members dm ON dm.dialog_id = d.dialog_id AND dm.user_id = d.user_id
+		WHERE d.user_id = $1 AND d.blob <> ''::bytea
+		ORDER BY d.updated_at DESC`, userID)
+}
+
+// DraftsByDialog returns the user's drafts in the dialogs, cleared ones included.
+func (r *pgRepository) DraftsByDialog(ctx context.Context, userID uuid.UUID, dialogIDs []uuid.UUID) ([]Draft, error) {
+	return r.queryDrafts(ctx, `
+		SELECT dialog_id, blob, updated_at FROM dialog_drafts
+		WHERE user_id = $1 AND dialog_id = ANY($2)`, userID, dialogIDs)
+}
+
+func (r *pgRepository) queryDrafts(ctx context.Context, query string, args ...any) ([]Draft, error) {
+	rows, err := r.db(ctx).Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Draft
+	for rows.Next() {
+		var d Draft
+		if err := rows.Scan(&d.DialogID, &d.Blob, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+const scheduledColumns = `id, dialog_id, sender_id, convert_from(cipher_text, 'UTF8'), reply_to, quote, send_at, failed_at, COALESCE(error, ''), created_at`
+
+func scanScheduled(row pgx.Row) (ScheduledMessage, error) {
+	var m ScheduledMessage
+	err := row.Scan(&m.ID, &m.DialogID, &m.SenderID, &m.Text, &m.ReplyTo, &m.Quote, &m.SendAt, &m.FailedAt, &m.Error, &m.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ScheduledMessage{}, ErrScheduledNotFound
+	}
+	return m, err
+}
+
+func (r *pgRepository) CreateScheduled(ctx context.Context, msg ScheduledMessage) (ScheduledMessage, error) {
+	return scanScheduled(r.db(ctx).QueryRow(ctx, `
+		INSERT INTO scheduled_messages (dialog_id, sender_id, cipher_text, reply_to, quote, send_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+scheduledColumns,
+		msg.DialogID, msg.SenderID, []byte(msg.Text), msg.ReplyTo, msg.Quote, msg.SendAt))
+}
+
+// ListScheduled lists the sender's pending and failed messages in send order.
+func (r *pgRepository) ListScheduled(ctx context.Context, dialogID, senderID uuid.UUID) ([]ScheduledMessage, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT `+scheduledColumns+` FROM scheduled_messages
+		WHERE dialog_id = $1 AND sender_id = $2
+		ORDER BY send_at, id`, dialogID, senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []ScheduledMessage
+	for rows.Next() {
+		m, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+func (r *pgRepository) CountScheduled(ctx context.Context, dialogID, senderID uuid.UUID) (int, error) {
+	var n int
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT COUNT(*) FROM scheduled_messages WHERE dialog_id = $1 AND sender_id = $2`, dialogID, senderID).Scan(&n)
+	return n, err
+}
+
+// UpdateScheduled replaces text and send time and clears a failure. A message
+// the scheduler is sending right now is locked; the update waits and then
+// finds it gone.
+func (r *pgRepository) UpdateScheduled(ctx context.Context, msg ScheduledMessage) (ScheduledMessage, error) {
+	return scanScheduled(r.db(ctx).QueryRow(ctx, `
+		UPDATE scheduled_messages
+		SET cipher_text = $4, send_at = $5, failed_at = NULL, error = NULL, updated_at = NOW()
+		WHERE id = $1 AND dialog_id = $2 AND sender_id = $3
+		RETURNING `+scheduledColumns,
+		msg.ID, msg.DialogID, msg.SenderID, []byte(msg.Text), msg.SendAt))
+}
+
+func (r *pgRepository) DeleteScheduled(ctx context.Context, dialogID, senderID uuid.UUID, id int64) error {
+	tag, err := r.db(ctx).Exec(ctx, `
+		DELETE FROM scheduled_messages WHERE id = $1 AND dialog_id = $2 AND sender_id = $3`, id, dialogID, senderID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrScheduledNotFound
+	}
+	return nil
+}
+
+// ClaimDueScheduled locks up to limit due messages, skipping rows another
+// instance holds, and passes each to send. Sent messages are deleted, failed
+// ones are kept with the error unless it wraps errRetryScheduled. The lock is
+// held until all are handled, so no other instance sends the same message
+// meanwhile. It returns how many messages were sent.
+func (r *pgRepository) ClaimDueScheduled(ctx context.Context, limit int, send func(ScheduledMessage) error) (int, error) {
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `
+		SELECT `+scheduledColumns+` FROM scheduled_messages
+		WHERE send_at <= NOW() AND failed_at IS NULL
+		ORDER BY send_at, id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return 0, err
+	}
+	var due []ScheduledMessage
+	for rows.Next() {
+		m, err := scanScheduled(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, m := range due {
+		sendErr := send(m)
+		switch {
+		case errors.Is(sendErr, errRetryScheduled):
+			continue
+		case sendErr != nil:
+			_, err = tx.Exec(ctx, `
+				UPDATE scheduled_messages SET failed_at = NOW(), error = $2, updated_at = NOW() WHERE id = $1`, m.ID, sendErr.Error())
+		default:
+			_, err = tx.Exec(ctx, `DELETE FROM scheduled_messages WHERE id = $1`, m.ID)
+			sent++
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return sent, nil
+}
+
+// PinMessage pins a message of the dialog and reports whether it was newly pinned.
+func (r *pgRepository) PinMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, userID uuid.UUID) (bool, error) {
+	tag, err := r.db(ctx).Exec(ctx, `
+		INSERT INTO dialog_pins (dialog_id, message_id, pinned_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, dialogID, messageID, userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *pgRepository) UnpinMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) (bool, error) {
+	tag, err := r.db(ctx).Exec(ctx, `DELETE FROM dialog_pins WHERE dialog_id = $1 AND message_id = $2`, dialogID, messageID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// PinnedMessages lists live pinned messages, most recently pinned first.
+func (r *pgRepository) PinnedMessages(ctx context.Context, dialogID uuid.UUID) ([]Message, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT m.id, m.sender_id, m.dialog_id, m.kind::text, convert_from(m.cipher_text,'UTF8'),
+		       m.created_at, m.edited_at, COALESCE(m.metadata, '{}'), m.expires_at
+		FROM dialog_pins p
+		JOIN messages m ON m.id = p.message_id
+		WHERE p.dialog_id = $1 AND m.deleted_at IS NULL AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		ORDER BY p.pinned_at DESC`, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Message
+	for rows.Next() {
+		var (
+			m    Message
+			meta []byte
+		)
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.DialogID, &m.Kind, &m.Text, &m.CreatedAt, &m.EditedAt, &meta, &m.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if err := applyMeta(&m, meta, nil, nil, nil, nil, nil); err != nil {
+			return nil, err
+		}
+		m.Pinned = true
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+// MarkDelivered moves the member's delivered watermark up to messageID, which
+// must belong to the dialog. It reports whether the watermark advanced.
+func (r *pgRepository) MarkDelivered(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) (bool, error) {
+	tag, err := r.db(ctx).Exec(ctx, `
+		UPDATE dialog_members SET last_delivered_message_id = $3
+		WHERE dialog_id = $1 AND user_id = $2 AND last_delivered_message_id < $3
+		  AND EXISTS (SELECT 1 FROM messages WHERE id = $3 AND dialog_id = $1)
+	`, dialogID, userID, messageID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// MarkRead moves the read watermark (and the delivered one with it) up to
+// messageID; in a channel it moves the read position to the number of the
+// last post up to messageID, posts being numbered in id order under the
+// channel row lock. It reports whether the read watermark advanced.
+func (r *pgRepository) MarkRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) (bool, error) {
+	tag, err := r.db(ctx).Exec(ctx, `
+		WITH seen AS (
+			UPDATE message_mentions mm SET read = TRUE
+			FROM messages m
+			WHERE mm.dialog_id = $1 AND mm.user_id = $2 AND NOT mm.read AND mm.message_id <= $3
+			  AND m.id = mm.message_id AND m.thread_root_id IS NULL
+			  AND EXISTS (SELECT 1 FROM dialog_members WHERE dialog_id = $1 AND user_id = $2 AND last_read_message_id < $3)
+			RETURNING `+mentionCountedSQL+` AS counted
+		)
+		UPDATE dialog_members
+		SET last_read_message_id = $3,
+		    last_delivered_message_id = GREATEST(last_delivered_message_id, $3),
+		    unread_mentions = GREATEST(unread_mentions - (SELECT COUNT(*) FROM seen WHERE counted), 0),
+		    unread_count = CASE WHEN is_channel THEN 0 ELSE (
+		        SELECT COUNT(*) FROM messages m
+		        WHERE m.dialog_id = $1 AND m.id > $3 AND m.sender_id <> $2 AND m.deleted_at IS NULL AND m.kind <> 'poll_vote'
+		          AND m.thread_root_id IS NULL
+		          AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $2)) END,
+		    read_post_seq = CASE WHEN is_channel THEN GREATEST(read_post_seq, COALESCE((
+		        SELECT m.post_seq FROM messages m
+		        WHERE m.dialog_id = $1 AND m.id <= $3 AND m.post_seq IS NOT NULL
+		        ORDER BY m.id DESC LIMIT 1), 0)) ELSE read_post_seq END
+		WHERE dialog_id = $1 AND user_id = $2 AND last_read_message_id < $3
+		  AND EXISTS (SELECT 1 FROM messages WHERE id = $3 AND dialog_id = $1)
+	`, dialogID, userID, messageID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// SaveSystemMessage stores a service message (kind 'system') authored by actor.
+func (r *pgRepository) SaveSystemMessage(ctx context.Context, dialogID, actor uuid.UUID, text string) (int64, time.Time, error) {
+	var id int64
+	var created time.Time
+	err := r.db(ctx).QueryRow(ctx, `
+		WITH seq AS (
+			UPDATE dialogs
+			SET post_seq = post_seq + 1, last_activity_at = GREATEST(last_activity_at, NOW())
+			WHERE id = $1 AND kind = 'channel'
+			RETURNING post_seq
+		), ins AS (
+			INSERT INTO messages (dialog_id, sender_id, kind, cipher_text, content_type, created_at, post_seq)
+			VALUES ($1, $2, 'system', $3, 'application/json', NOW(), (SELECT post_seq FROM seq))
+			RETURNING id, dialog_id, sender_id, kind, thread_root_id, created_at, post_seq, '{}'::uuid[] AS mentioned
+		)`+bumpMembersSQL+`
+		SELECT id, created_at FROM ins
+	`, dialogID, actor, []byte(text)).Scan(&id, &created)
+	return id, created, err
+}
+
+// CreateGroup creates a group owned by owner with the given members.
+func (r *pgRepository) CreateGroup(ctx context.Context, owner uuid.UUID, title string, members []uuid.UUID, encrypted bool) (uuid.UUID, error) {
+	dialogID := uuid.New()
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO dialogs (id, kind, title, owner_id, is_encrypted, created_at, updated_at)
+		VALUES ($1, 'group', $2, $3, $4, NOW(), NOW())`, dialogID, title, owner, encrypted)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO dialog_members (dialog_id, user_id, role)
+		VALUES ($1, $2, 'owner')`, dialogID, owner); err != nil {
+		return uuid.Nil, err
+	}
+	for _, uid := range members {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO dialog_members (dialog_id, user_id, role)
+			VALUES ($1, $2, 'member')
+			ON CONFLICT DO NOTHING`, dialogID, uid); err != nil {
+			return uuid.Nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, err
+	}
+	return dialogID, nil
+}
+
+func (r *pgRepository) DialogKind(ctx context.Context, dialogID uuid.UUID) (string, error) {
+	var kind string
+	err := r.db(ctx).QueryRow(ctx, `SELECT kind::text FROM dialogs WHERE id = $1`, dialogID).Scan(&kind)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrDialogNotFound
+	}
+	return kind, err
+}
+
+func (r *pgRepository) MemberRole(ctx context.Context, dialogID, userID uuid.UUID) (string, error) {
+	var role string
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT COALESCE(role, 'member') FROM dialog_members
+		WHERE dialog_id = $1 AND user_id = $2`, dialogID, userID).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotMember
+	}
+	return role, err
+}
+
+// ListMembers returns members ordered by join time.
+// Heir returns the member other than leaving whose role comes first in roles,
+// the longest-standing among equals; ok is false when none has such a role.
+func (r *pgRepository) Heir(ctx context.Context, dialogID, leaving uuid.UUID, roles []string) (uuid.UUID, bool, error) {
+	var heir uuid.UUID
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT user_id FROM dialog_members
+		WHERE dialog_id = $1 AND user_id <> $2 AND role = ANY($3)
+		ORDER BY array_position($3, role), joined_at, user_id
+		LIMIT 1`, dialogID, leaving, roles).Scan(&heir)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, false, nil
+	}
+	if err != nil {
+		return uuid.Nil, false, err
+	}
+	return heir, true, nil
+}
+
+func (r *pgRepository) ListMembers(ctx context.Context, dialogID uuid.UUID) ([]Member, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT user_id, COALESCE(role, 'member'), joined_at FROM dialog_members
+		WHERE dialog_id = $1
+		ORDER BY joined_at, user_id`, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+// insertMemberSQL adds user $2 with role $3 to dialog $1, unless already a
+// member. A newcomer has read everything posted before joining: only later
+// messages are unread.
+const insertMemberSQL = `
+		INSERT INTO dialog_members (dialog_id, user_id, role, last_read_message_id, last_delivered_message_id, read_post_seq, is_channel)
+		SELECT d.id, $2::uuid, $3::text, lm.id, lm.id, d.post_seq, d.kind = 'channel'
+		FROM dialogs d
+		CROSS JOIN LATERAL (SELECT COALESCE(MAX(m.id), 0) AS id FROM messages m WHERE m.dialog_id = d.id) lm
+		WHERE d.id = $1
+		ON CONFLICT DO NOTHING`
+
+// AddMember inserts a member and keeps channel subscriber_count in sync.
+func (r *pgRepository) AddMember(ctx context.Context, dialogID, userID uuid.UUID, role string) error {
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, insertMemberSQL, dialogID, userID, role)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAlreadyMember
+	}
+	if _, err := tx.Exec(ctx, refreshMembersSQL, dialogID, userID, nil); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE dialogs SET subscriber_count = subscriber_count + 1
+		WHERE id = $1 AND kind = 'channel'`, dialogID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *pgRepository) RemoveMember(ctx context.Context, dialogID, userID uuid.UUID) error {
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, `DELETE FROM dialog_members WHERE dialog_id = $1 AND user_id = $2`, dialogID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotMember
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE dialogs SET subscriber_count = GREATEST(subscriber_count - 1, 0)
+		WHERE id = $1 AND kind = 'channel'`, dialogID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *pgRepository) SetRole(ctx context.Context, dialogID, userID uuid.UUID, role string) error {
+	tag, err := r.db(ctx).Exec(ctx, `
+		UPDATE dialog_members SET role = $3
+		WHERE dialog_id = $1 AND user_id = $2`, dialogID, userID, role)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotMember
+	}
+	if role == "owner" {
+		_, err = r.db(ctx).Exec(ctx, `UPDATE dialogs SET owner_id = $2, updated_at = NOW() WHERE id = $1`, dialogID, userID)
+	}
+	return err
+}
+
+func (r *pgRepository) SetTitle(ctx context.Context, dialogID uuid.UUID, title string) error {
+	_, err := r.db(ctx).Exec(ctx, `UPDATE dialogs SET title = $2, updated_at = NOW() WHERE id = $1`, dialogID, title)
+	return err
+}
+
+// CreateChannel creates a channel owned by owner; empty username makes it private.
+func (r *pgRepository) CreateChannel(ctx context.Context, owner uuid.UUID, title, username, description string) (uuid.UUID, error) {
+	dialogID := uuid.New()
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO dialogs (id, kind, title, owner_id, is_encrypted, username, description, subscriber_count, created_at, updated_at)
+		VALUES ($1, 'channel', $2, $3, FALSE, NULLIF($4, '')::citext, NULLIF($5, ''), 1, NOW(), NOW())`,
+		dialogID, title, owner, username, description)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return uuid.Nil, ErrChannelTaken
+		}
+		return uuid.Nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO dialog_members (dialog_id, user_id, role, is_channel)
+		VALUES ($1, $2, 'owner', TRUE)`, dialogID, owner); err != nil {
+		return uuid.Nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, err
+	}
+	return dialogID, nil
+}
+
+const channelColumns = `id, COALESCE(title, ''), username::text, description, subscriber_count, created_at`
+
+func scanChannel(row pgx.Row) (Channel, error) {
+	var c Channel
+	err := row.Scan(&c.ID, &c.Title, &c.Username, &c.Description, &c.SubscriberCount, &c.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Channel{}, ErrDialogNotFound
+	}
+	return c, err
+}
+
+func (r *pgRepository) GetChannel(ctx context.Context, dialogID uuid.UUID) (Channel, error) {
+	return scanChannel(r.db(ctx).QueryRow(ctx, `
+		SELECT `+channelColumns+` FROM dialogs
+		WHERE id = $1 AND kind = 'channel'`, dialogID))
+}
+
+func (r *pgRepository) GetChannelByUsername(ctx context.Context, username string) (Channel, error) {
+	return scanChannel(r.db(ctx).QueryRow(ctx, `
+		SELECT `+channelColumns+` FROM dialogs
+		WHERE username = $1 AND kind = 'channel'`, username))
+}
+
+// UserChannels lists channels the user is subscribed to; realtime uses it for fan-out routing.
+func (r *pgRepository) UserChannels(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT d.id FROM dialog_members m
+		JOIN dialogs d ON d.id = m.dialog_id
+		WHERE m.user_id = $1 AND d.kind = 'channel'`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+const inviteColumns = `id, dialog_id, code, created_by, title, expires_at, max_uses, uses, requires_approval, revoked_at, created_at`
+
+func scanInvite(row pgx.Row) (Invite, error) {
+	var i Invite
+	err := row.Scan(&i.ID, &i.DialogID, &i.Code, &i.CreatedBy, &i.Title, &i.ExpiresAt, &i.MaxUses, &i.Uses, &i.RequiresApproval, &i.RevokedAt, &i.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Invite{}, ErrInviteInvalid
+	}
+	return i, err
+}
+
+func (r *pgRepository) CreateInvite(ctx context.Context, inv Invite) (Invite, error) {
+	return scanInvite(r.db(ctx).QueryRow(ctx, `
+		INSERT INTO dialog_invites (dialog_id, code, created_by, title, expires_at, max_uses, requires_approval)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+inviteColumns,
+		inv.DialogID, inv.Code, inv.CreatedBy, inv.Title, inv.ExpiresAt, inv.MaxUses, inv.RequiresApproval))
+}
+
+func (r *pgRepository) ListInvites(ctx context.Context, dialogID uuid.UUID) ([]Invite, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT `+inviteColumns+` FROM dialog_invites
+		WHERE dialog_id = $1
+		ORDER BY created_at DESC`, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Invite
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, inv)
+	}
+	return res, rows.Err()
+}
+
+func (r *pgRepository) GetInviteByCode(ctx context.Context, code string) (Invite, error) {
+	return scanInvite(r.db(ctx).QueryRow(ctx, `SELECT `+inviteColumns+` FROM dialog_invites WHERE code = $1`, code))
+}
+
+func (r *pgRepository) GetInvitePreview(ctx context.Context, inviteID uuid.UUID) (InvitePreview, error) {
+	var p InvitePreview
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT d.id, d.kind::text, d.title,
+		       (SELECT COUNT(*) FROM dialog_members m WHERE m.dialog_id = d.id),
+		       i.requires_approval
+		FROM dialog_invites i
+		JOIN dialogs d ON d.id = i.dialog_id
+		WHERE i.id = $1`, inviteID).Scan(&p.DialogID, &p.Kind, &p.Title, &p.MemberCount, &p.RequiresApproval)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return InvitePreview{}, ErrInviteInvalid
+	}
+	return p, err
+}
+
+func (r *pgRepository) RevokeInvite(ctx context.Context, dialogID, inviteID uuid.UUID) error {
+	tag, err := r.db(ctx).Exec(ctx, `
+		UPDATE dialog_invites SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE id = $1 AND dialog_id = $2`, inviteID, dialogID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInviteInvalid
+	}
+	return nil
+}
+
+// JoinByInvite consumes one use of the invite and adds the member atomically,
+// so concurrent joins cannot exceed max_uses.
+func (r *pgRepository) JoinByInvite(ctx context.Context, inviteID, userID uuid.UUID) error {
+	tx, err := r.db(ctx).Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var dialogID uuid.UUID
+	err = tx.QueryRow(ctx, `
+		UPDATE dialog_invites SET uses = uses + 1
+		WHERE id = $1 AND revoked_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > NOW())
+		  AND (max_uses IS NULL OR uses < max_uses)
+		RETURNING dialog_id`, inviteID).Scan(&dialogID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrInviteInvalid
+	}
+	if err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, insertMemberSQL, dialogID, userID, RoleMember)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAlreadyMember
+	}
+	if _, err := tx.Exec(ctx, refreshMembersSQL, dialogID, userID, nil); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE dialogs SET subscriber_count = subscriber_count + 1
+		WHERE id = $1 AND kind = 'channel'`, dialogID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (r *pgRepository) CreateJoinRequest(ctx context.Context, dialogID, userID, inviteID uuid.UUID) error {
+	_, err := r.db(ctx).Exec(ctx, `
+		INSERT INTO dialog_join_requests (dialog_id, user_id, invite_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (dialog_id, user_id) DO NOTHING`, dialogID, userID, inviteID)
+	return err
+}
+
+func (r *pgRepository) ListJoinRequests(ctx context.Context, dialogID uuid.UUID) ([]JoinRequest, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT user_id, invite_id, created_at FROM dialog_join_requests
+		WHERE dialog_id = $1
+		ORDER BY created_at`, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []JoinRequest
+	for rows.Next() {
+		var jr JoinRequest
+		if err := rows.Scan(&jr.UserID, &jr.InviteID, &jr.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, jr)
+	}
+	return res, rows.Err()
+}
+
+func (r *pgRepository) DeleteJoinRequest(ctx context.Context, dialogID, userID uuid.UUID) error {
+	tag, err := r.db(ctx).Exec(ctx, `DELETE FROM dialog_join_requests WHERE dialog_id = $1 AND user_id = $2`, dialogID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoRequest
+	}
+	return nil
+}
+
+// AppendUpdate gives u the next pts of every user. Users are locked in id
+// order so concurrent appends to overlapping audiences cannot deadlock.
+func (r *pgRepository) AppendUpdate(ctx context.Context, userIDs []uuid.UUID, u Update) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	ids := slices.Clone(userIDs)
+	slices.SortFunc(ids, func(a, b uuid.UUID) int { return bytes.Compare(a[:], b[:]) })
+	ids = slices.Compact(ids)
+	_, err := r.db(ctx).Exec(ctx, `
+		WITH bumped AS (
+			INSERT INTO user_update_state (user_id, pts)
+			SELECT id, 1 FROM unnest($1::uuid[]) WITH ORDINALITY AS t(id, ord)
+			ORDER BY ord
+			ON CONFLICT (user_id) DO UPDATE SET pts = user_update_state.pts + 1
+			RETURNING user_id, pts
+		)
+		INSERT INTO user_updates (user_id, pts, type, dialog_id, message_id, actor_id, subject_id, role)
+		SELECT user_id, pts, $2, $3, $4, $5, $6, NULLIF($7, '') FROM bumped`,
+		ids, u.Type, u.DialogID, u.MessageID, u.ActorID, u.UserID, u.Role)
+	return err
+}
+
+func (r *pgRepository) Updates(ctx context.Context, userID uuid.UUID, since int64, limit int) ([]Update, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT pts, type, dialog_id, message_id, actor_id, subject_id, COALESCE(role, ''), created_at
+		FROM user_updates
+		WHERE user_id = $1 AND pts > $2
+		ORDER BY pts
+		LIMIT $3`, userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Update
+	for rows.Next() {
+		var u Update
+		if err := rows.Scan(&u.Pts, &u.Type, &u.DialogID, &u.MessageID, &u.ActorID, &u.UserID, &u.Role, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, u)
+	}
+	return res, rows.Err()
+}
+
+// UpdateState returns the user's current pts and the oldest pts still stored
+// (0 when the log is empty).
+func (r *pgRepository) UpdateState(ctx context.Context, userID uuid.UUID) (int64, int64, error) {
+	var pts, minPts int64
+	err := r.db(ctx).QueryRow(ctx, `
+		SELECT COALESCE((SELECT pts FROM user_update_state WHERE user_id = $1), 0),
+		       COALESCE((SELECT MIN(pts) FROM user_updates WHERE user_id = $1), 0)`, userID).Scan(&pts, &minPts)
+	return pts, minPts, err
+}
+
+// PruneUpdates deletes up to limit updates created before the cutoff. The
+// pts counters stay, so clients behind the trimmed part get too_long.
+func (r *pgRepository) PruneUpdates(ctx context.Context, before time.Time, limit int) (int, error) {
+	tag, err := r.db(ctx).Exec(ctx, `
+		DELETE FROM user_updates
+		WHERE ctid IN (SELECT ctid FROM user_updates WHERE created_at < $1 LIMIT $2)`, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// MessagesByID loads messages as userID sees them: only from dialogs the user
+// is in and without the ones the user hid.
+func (r *pgRepository) MessagesByID(ctx context.Context, userID uuid.UUID, messageIDs []int64) ([]Message, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	rows, err := r.db(ctx).Query(ctx, `
+		SELECT m.id, m.sender_id, m.dialog_id, m.kind::text,
+		       CASE WHEN m.deleted_at IS NULL THEN convert_from(m.cipher_text,'UTF8') ELSE '' END,
+		       m.created_at, m.edited_at, m.deleted_at IS NOT NULL, COALESCE(m.metadata, '{}'),
+		       CASE WHEN m.sender_id = $1 THEN COALESCE(m.client_message_id, '') ELSE '' END, m.expires_at, m.thread_root_id,
+		       rp.id, rp.sender_id, rp.kind::text,
+		       CASE WHEN rp.deleted_at IS NULL THEN left(convert_from(rp.cipher_text,'UTF8'), $3) ELSE '' END,
+		       rp.deleted_at IS NOT NULL
+		FROM messages m
+		JOIN dialog_members dm ON dm.dialog_id = m.dialog_id AND dm.user_id = $1
+		LEFT JOIN messages rp ON rp.id = m.reply_to
+		WHERE m.id = ANY($2) AND (m.expires_at IS NULL OR m.expires_at > NOW())
+		  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+		ORDER BY m.id`, userID, messageIDs, replyPreviewLength)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Message
+	for rows.Next() {
+		var (
+			m            Message
+			meta         []byte
+			replyID      *int64
+			replySender  *uuid.UUID
+			replyKind    *string
+			replyText    *string
+			replyDeleted *bool
+		)
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.DialogID, &m.Kind, &m.Text, &m.CreatedAt, &m.EditedAt, &m.Deleted, &meta,
+			&m.ClientMessageID, &m.ExpiresAt, &m.ThreadRootID, &replyID, &replySender, &replyKind, &replyText, &replyDeleted); err != nil {
+			return nil, err
+		}
+		if err := applyMeta(&m, meta, replyID, replySender, replyKind, replyText, replyDeleted); err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+// searchHeadlineOptions marks matches with snippetMatchStart/Stop and keeps
+// snippets to a couple of short fragments.
+var searchHeadlineOptions = "StartSel=" + string(snippetMatchStart) + ", StopSel=" + string(snippetMatchStop) +
+	", MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=\" … \""
+
+// SearchMessages matches q.Text against search_tsv, which is only set for
+// messages of unencrypted dialogs, limited to userID's dialogs. Snippets keep
+// the raw match markers.
+func (r *pgRepository) SearchMessages(ctx context.Context, userID uuid.UUID, q SearchQuery) ([]SearchHit, error) {
+	rows, err := r.db(ctx).Query(ctx, `
+WITH q AS (
+  SELECT websearch_to_tsquery('russian', $2) || websearch_to_tsquery('english', $2) AS query
+)
+SELECT m.id, m.dialog_id, m.sender_id, m.thread_root_id, m.created_at,
+       ts_headline('russian', translate(convert_from(m.cipher_text, 'UTF8'), E'\x01\x02', ''), q.query, $9)
+FROM q
+JOIN messages m ON m.search_tsv @@ q.query
+JOIN dialog_members dm ON dm.dialog_id = m.dialog_id AND dm.user_id = $1
+WHERE ($3::uuid IS NULL OR m.dialog_id = $3)
+  AND ($4::uuid IS NULL OR m.sender_id = $4)
+  AND ($5::timestamptz IS NULL OR m.created_at >= $5)
+  AND ($6::timestamptz IS NULL OR m.created_at < $6)
+  AND ($7 = 0 OR m.id < $7)
+  AND (m.expires_at IS NULL OR m.expires_at > NOW())
+  AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+ORDER BY m.id DESC
+LIMIT $8
+`, userID, q.Text, q.DialogID, q.SenderID, q.From, q.To, q.Before, q.Limit, searchHeadlineOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hits []SearchHit
+	for rows.Next() {
+		var h SearchHit
+		if err := rows.Scan(&h.MessageID, &h.DialogID, &h.SenderID, &h.ThreadRootID, &h.CreatedAt, &h.Snippet); err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
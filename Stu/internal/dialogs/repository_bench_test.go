@@ -0,0 +1,133 @@
+package dialogs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// BenchmarkListDialogs lists one page of dialogs while the messages table
+// grows by an order of magnitude per step, half of it direct messages and
+// half unread posts of channels that the page includes; ns/op should stay
+// flat. It needs a migrated scratch database:
+//
+//	STU_BENCH_DATABASE_URL=postgres://... go test -run '^$' -bench ListDialogs ./internal/dialogs
+func BenchmarkListDialogs(b *testing.B) {
+	url := os.Getenv("STU_BENCH_DATABASE_URL")
+	if url == "" {
+		b.Skip("STU_BENCH_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		b.Fatalf("connect: %v", err)
+	}
+	defer pool.Close()
+	repo := NewRepository(pool)
+
+	const dialogCount = 200
+	reader := seedBenchUser(ctx, b, pool)
+	var dialogIDs []uuid.UUID
+	for range dialogCount {
+		peer := seedBenchUser(ctx, b, pool)
+		id, err := repo.CreateDirect(ctx, reader, peer, RequestAccepted)
+		if err != nil {
+			b.Fatalf("create dialog: %v", err)
+		}
+		dialogIDs = append(dialogIDs, id)
+	}
+	const channelCount = 10
+	var channelIDs []uuid.UUID
+	for i := range channelCount {
+		id, err := repo.CreateChannel(ctx, seedBenchUser(ctx, b, pool), fmt.Sprintf("bench %d", i), "", "")
+		if err != nil {
+			b.Fatalf("create channel: %v", err)
+		}
+		if err := repo.AddMember(ctx, id, reader, RoleMember); err != nil {
+			b.Fatalf("subscribe: %v", err)
+		}
+		channelIDs = append(channelIDs, id)
+	}
+
+	seeded := 0
+	for _, total := range []int{10_000, 100_000, 1_000_000} {
+		// spread the new messages over the dialogs, sent by both members
+		direct := (total - seeded) / 2
+		if _, err := pool.Exec(ctx, `
+			INSERT INTO messages (dialog_id, sender_id, cipher_text, created_at)
+			SELECT dm.dialog_id, dm.user_id, convert_to('bench ' || g, 'UTF8'), NOW() - (g || ' seconds')::interval
+			FROM generate_series(1, $2::int) g
+			JOIN LATERAL (
+				SELECT dialog_id, user_id FROM dialog_members
+				WHERE dialog_id = ($1::uuid[])[1 + g % array_length($1::uuid[], 1)]
+				ORDER BY user_id OFFSET g % 2 LIMIT 1
+			) dm ON true`, dialogIDs, direct); err != nil {
+			b.Fatalf("seed messages: %v", err)
+		}
+		// number the posts as SaveMessage does; the newest ones are a few
+		// milliseconds old, which puts every channel on the first page
+		posts := (total - seeded - direct) / channelCount
+		for _, id := range channelIDs {
+			if _, err := pool.Exec(ctx, `
+				WITH ins AS (
+					INSERT INTO messages (dialog_id, sender_id, cipher_text, created_at, post_seq)
+					SELECT d.id, d.owner_id, convert_to('post ' || g, 'UTF8'),
+					       NOW() - (($2::int - g) || ' milliseconds')::interval, d.post_seq + g
+					FROM dialogs d, generate_series(1, $2::int) g
+					WHERE d.id = $1
+				)
+				UPDATE dialogs SET post_seq = post_seq + $2, last_activity_at = NOW() WHERE id = $1`, id, posts); err != nil {
+				b.Fatalf("seed posts: %v", err)
+			}
+		}
+		seeded = total
+		for _, id := range dialogIDs {
+			if _, err := pool.Exec(ctx, refreshMembersSQL, id, nil, nil); err != nil {
+				b.Fatalf("refresh summaries: %v", err)
+			}
+		}
+		if _, err := pool.Exec(ctx, `ANALYZE messages, dialog_members, dialogs`); err != nil {
+			b.Fatalf("analyze: %v", err)
+		}
+
+		b.Run(fmt.Sprintf("messages=%d", total), func(b *testing.B) {
+			for b.Loop() {
+				list, err := repo.ListDialogs(ctx, reader, 50, DialogFilter{State: RequestAccepted})
+				if err != nil || len(list) != 50 {
+					b.Fatalf("list: %d dialogs, %v", len(list), err)
+				}
+				channels := 0
+				for _, d := range list {
+					if d.Kind == "channel" {
+						channels++
+					}
+				}
+				if channels != channelCount {
+					b.Fatalf("list: %d channels, want %d", channels, channelCount)
+				}
+			}
+		})
+	}
+}
+
+// seedBenchUser inserts a throwaway user that is removed, with its dialogs
+// and messages, when the benchmark ends.
+func seedBenchUser(ctx context.Context, b *testing.B, pool *pgxpool.Pool) uuid.UUID {
+	b.Helper()
+	id := uuid.New()
+	if _, err := pool.Exec(ctx, `
+		INSERT INTO users (id, email, password_hash) VALUES ($1, $2, '\x00')`,
+		id, "bench-"+id.String()+"@example.invalid"); err != nil {
+		b.Fatalf("seed user: %v", err)
+	}
+	b.Cleanup(func() {
+		_, _ = pool.Exec(context.Background(), `DELETE FROM dialogs WHERE owner_id = $1 OR id IN (
+			SELECT dialog_id FROM dialog_members WHERE user_id = $1)`, id)
+		_, _ = pool.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, id)
+	})
+	return id
+}
@@ -0,0 +1,163 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// Request states of a dialog member (dialog_members.request_state).
+const (
+	RequestAccepted = "accepted"
+	RequestPending  = "pending"
+	RequestDeclined = "declined"
+)
+
+// Dialog list folders.
+const (
+	FolderInbox    = ""
+	FolderRequests = "requests"
+)
+
+var (
+	ErrNoRequest     = errors.New("no message request")
+	ErrInvalidFolder = errors.New("invalid folder")
+)
+
+// SetBlocker lets the requests inbox block the sender.
+func (s *Service) SetBlocker(blocker func(ctx context.Context, owner, target uuid.UUID) error) {
+	s.blocker = blocker
+}
+
+// initialPeerState decides whether a new direct dialog is a message request for the peer.
+func (s *Service) initialPeerState(ctx context.Context, initiator, peer uuid.UUID) (string, error) {
+	if s.privacy == nil {
+		return RequestAccepted, nil
+	}
+	contact, err := s.privacy.IsContact(ctx, peer, initiator)
+	if err != nil {
+		return "", err
+	}
+	if contact {
+		return RequestAccepted, nil
+	}
+	return RequestPending, nil
+}
+
+// AcceptRequest moves a pending or declined request into the inbox.
+func (s *Service) AcceptRequest(ctx context.Context, currentUser, dialogID uuid.UUID) error {
+	state, err := s.requestState(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if state == RequestAccepted {
+		return ErrNoRequest
+	}
+	return s.repo.SetRequestState(ctx, dialogID, currentUser, RequestAccepted)
+}
+
+// DeclineRequest hides a pending request. The sender is not notified.
+func (s *Service) DeclineRequest(ctx context.Context, currentUser, dialogID uuid.UUID) error {
+	state, err := s.requestState(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if state != RequestPending {
+		return ErrNoRequest
+	}
+	return s.repo.SetRequestState(ctx, dialogID, currentUser, RequestDeclined)
+}
+
+// BlockRequest declines a request and blocks its sender.
+func (s *Service) BlockRequest(ctx context.Context, currentUser, dialogID uuid.UUID) error {
+	state, err := s.requestState(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if state == RequestAccepted || s.blocker == nil {
+		return ErrNoRequest
+	}
+	peer, ok, err := s.repo.DirectPeer(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoRequest
+	}
+	if err := s.repo.SetRequestState(ctx, dialogID, currentUser, RequestDeclined); err != nil {
+		return err
+	}
+	return s.blocker(ctx, currentUser, peer)
+}
+
+// acceptByReply accepts the message request of sender: replying to it is
+// consent. It runs in the transaction storing the reply.
+func (s *Service) acceptByReply(ctx context.Context, dialogID, sender uuid.UUID) error {
+	state, err := s.repo.RequestState(ctx, dialogID, sender)
+	if err != nil || state == RequestAccepted {
+		return err
+	}
+	return s.repo.SetRequestState(ctx, dialogID, sender, RequestAccepted)
+}
+
+func (s *Service) requestState(ctx context.Context, dialogID, userID uuid.UUID) (string, error) {
+	state, err := s.repo.RequestState(ctx, dialogID, userID)
+	if errors.Is(err, ErrNotMember) {
+		return "", ErrForbidden
+	}
+	return state, err
+}
+
+// audience returns the members that may receive events caused by actor.
+// While actor has not accepted a request, nothing reaches the sender;
+// a member who declined the request gets nothing from the dialog.
+// Receipts and typing in channels stay with the actor.
+func (s *Service) audience(ctx context.Context, dialogID, actor uuid.UUID) ([]uuid.UUID, error) {
+	kind, err := s.repo.DialogKind(ctx, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	if kind == KindChannel {
+		return []uuid.UUID{actor}, nil
+	}
+	state, err := s.repo.RequestState(ctx, dialogID, actor)
+	if err != nil {
+		return nil, err
+	}
+	if state != RequestAccepted {
+		return []uuid.UUID{actor}, nil
+	}
+	members, err := s.repo.Members(ctx, dialogID)
+	if err != nil {
+		return nil, err
+	}
+	peer, ok, err := s.repo.DirectPeer(ctx, dialogID, actor)
+	if err != nil || !ok {
+		return members, err
+	}
+	peerState, err := s.repo.RequestState(ctx, dialogID, peer)
+	if err != nil {
+		return nil, err
+	}
+	if peerState != RequestDeclined {
+		return members, nil
+	}
+	res := make([]uuid.UUID, 0, len(members))
+	for _, m := range members {
+		if m != peer {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func folderState(folder string) (string, error) {
+	switch folder {
+	case FolderInbox:
+		return RequestAccepted, nil
+	case FolderRequests:
+		return RequestPending, nil
+	}
+	return "", ErrInvalidFolder
+}
@@ -0,0 +1,14 @@
+package dialogs
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// SavedMessages returns the caller's saved messages dialog, creating it on
+// first use. It has the caller as its only member and is encrypted like a
+// direct dialog: clients encrypt notes to their own device keys.
+func (s *Service) SavedMessages(ctx context.Context, currentUser uuid.UUID) (uuid.UUID, error) {
+	return s.repo.GetOrCreateSaved(ctx, currentUser)
+}
@@ -0,0 +1,192 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	maxScheduledPerDialog = 100
+	maxScheduleAhead      = 365 * 24 * time.Hour
+	scheduleBatch         = 50
+)
+
+var (
+	ErrScheduledNotFound = errors.New("scheduled message not found")
+	ErrInvalidSchedule   = errors.New("invalid send time")
+	ErrScheduleLimit     = errors.New("too many scheduled messages")
+
+	// errRetryScheduled marks a send failure worth retrying on the next run.
+	errRetryScheduled = errors.New("retry later")
+)
+
+// ScheduledMessage is a message waiting to be sent at SendAt. It is visible
+// to its sender only. FailedAt is set when sending failed for good, e.g. the
+// sender left the dialog; Error then tells why.
+type ScheduledMessage struct {
+	ID        int64      `json:"id"`
+	DialogID  uuid.UUID  `json:"dialog_id"`
+	SenderID  uuid.UUID  `json:"sender_id"`
+	Text      string     `json:"text"`
+	ReplyTo   *int64     `json:"reply_to,omitempty"`
+	Quote     string     `json:"quote,omitempty"`
+	SendAt    time.Time  `json:"send_at"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ScheduledUpdate changes a scheduled message; nil fields stay as they are.
+type ScheduledUpdate struct {
+	Text   *string    `json:"text"`
+	SendAt *time.Time `json:"send_at"`
+}
+
+// ScheduleMessage stores out to be sent into the dialog at sendAt. The sender
+// must be able to post now; the checks run again when the message is sent.
+func (s *Service) ScheduleMessage(ctx context.Context, currentUser, dialogID uuid.UUID, out OutgoingMessage, sendAt time.Time) (ScheduledMessage, error) {
+	if strings.TrimSpace(out.Text) == "" {
+		return ScheduledMessage{}, ErrEmptyMessage
+	}
+	// scheduled messages keep no attachments
+	if len(out.Attachments) > 0 {
+		return ScheduledMessage{}, ErrInvalidAttachment
+	}
+	if err := checkSendAt(sendAt); err != nil {
+		return ScheduledMessage{}, err
+	}
+	if _, err := s.checkSend(ctx, currentUser, dialogID); err != nil {
+		return ScheduledMessage{}, err
+	}
+	if out.ReplyTo != nil {
+		_, quote, err := s.replyTarget(ctx, dialogID, *out.ReplyTo, out.Quote)
+		if err != nil {
+			return ScheduledMessage{}, err
+		}
+		out.Quote = quote
+	} else {
+		out.Quote = ""
+	}
+	n, err := s.repo.CountScheduled(ctx, dialogID, currentUser)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	if n >= maxScheduledPerDialog {
+		return ScheduledMessage{}, ErrScheduleLimit
+	}
+	return s.repo.CreateScheduled(ctx, ScheduledMessage{
+		DialogID: dialogID, SenderID: currentUser, Text: out.Text, ReplyTo: out.ReplyTo, Quote: out.Quote, SendAt: sendAt,
+	})
+}
+
+// ListScheduled returns the caller's scheduled messages in the dialog.
+func (s *Service) ListScheduled(ctx context.Context, currentUser, dialogID uuid.UUID) ([]ScheduledMessage, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrForbidden
+	}
+	return s.repo.ListScheduled(ctx, dialogID, currentUser)
+}
+
+// EditScheduled changes the text or send time of the caller's scheduled
+// message. Editing a failed message schedules it again.
+func (s *Service) EditScheduled(ctx context.Context, currentUser, dialogID uuid.UUID, id int64, upd ScheduledUpdate) (ScheduledMessage, error) {
+	list, err := s.ListScheduled(ctx, currentUser, dialogID)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	var msg *ScheduledMessage
+	for i := range list {
+		if list[i].ID == id {
+			msg = &list[i]
+		}
+	}
+	if msg == nil {
+		return ScheduledMessage{}, ErrScheduledNotFound
+	}
+	if upd.Text != nil {
+		if strings.TrimSpace(*upd.Text) == "" {
+			return ScheduledMessage{}, ErrEmptyMessage
+		}
+		msg.Text = *upd.Text
+	}
+	if upd.SendAt != nil {
+		msg.SendAt = *upd.SendAt
+	}
+	if upd.SendAt != nil || msg.FailedAt != nil {
+		if err := checkSendAt(msg.SendAt); err != nil {
+			return ScheduledMessage{}, err
+		}
+	}
+	return s.repo.UpdateScheduled(ctx, *msg)
+}
+
+// CancelScheduled deletes the caller's scheduled message.
+func (s *Service) CancelScheduled(ctx context.Context, currentUser, dialogID uuid.UUID, id int64) error {
+	return s.repo.DeleteScheduled(ctx, dialogID, currentUser, id)
+}
+
+// SendDueScheduled sends scheduled messages whose time has come through Send,
+// with the usual checks and events. Each is sent with a client message id
+// derived from its id, so a send repeated after a crash is deduplicated.
+func (s *Service) SendDueScheduled(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := s.repo.ClaimDueScheduled(ctx, scheduleBatch, func(m ScheduledMessage) error {
+			_, err := s.Send(ctx, m.SenderID, m.DialogID, OutgoingMessage{
+				Text: m.Text, ReplyTo: m.ReplyTo, Quote: m.Quote, ClientMessageID: fmt.Sprintf("scheduled:%d", m.ID),
+			})
+			if err != nil && !permanentSendError(err) {
+				return fmt.Errorf("%w: %v", errRetryScheduled, err)
+			}
+			return err
+		})
+		total += n
+		if err != nil || n < scheduleBatch {
+			return total, err
+		}
+	}
+}
+
+// RunScheduler calls SendDueScheduled every interval until ctx is done.
+func (s *Service) RunScheduler(ctx context.Context, interval time.Duration, logger zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.SendDueScheduled(ctx); err != nil {
+				logger.Warn().Err(err).Msg("send scheduled messages failed")
+			}
+		}
+	}
+}
+
+func checkSendAt(sendAt time.Time) error {
+	now := time.Now()
+	if !sendAt.After(now) || sendAt.After(now.Add(maxScheduleAhead)) {
+		return ErrInvalidSchedule
+	}
+	return nil
+}
+
+// permanentSendError reports whether retrying the send cannot help.
+func permanentSendError(err error) bool {
+	for _, target := range []error{ErrForbidden, ErrNotMember, ErrDialogNotFound, ErrInvalidReply, ErrEmptyMessage} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxSearchQuery    = 256
+	defaultSearchPage = 20
+	maxSearchPage     = 50
+)
+
+// Snippet highlight markers set by the repository; parseSnippet turns them
+// into ranges so clients never have to trust markup inside message text.
+const (
+	snippetMatchStart = '\x01'
+	snippetMatchStop  = '\x02'
+)
+
+var (
+	ErrInvalidSearch = errors.New("invalid search query")
+	// ErrSearchEncrypted: the server cannot read E2EE dialogs; clients search
+	// them with their local index.
+	ErrSearchEncrypted = errors.New("dialog is end-to-end encrypted")
+)
+
+// SearchQuery is a full-text query with optional filters. From is inclusive,
+// To exclusive; Before continues a listing after the hit with that message id.
+type SearchQuery struct {
+	Text     string
+	DialogID *uuid.UUID
+	SenderID *uuid.UUID
+	From     *time.Time
+	To       *time.Time
+	Before   int64
+	Limit    int
+}
+
+// TextRange is a span of a text, in runes.
+type TextRange struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+// SearchHit is a message matching a search, with a snippet of its text
+// around the matches; Highlights are the matched words within Snippet.
+type SearchHit struct {
+	DialogID     uuid.UUID   `json:"dialog_id"`
+	MessageID    int64       `json:"message_id"`
+	SenderID     uuid.UUID   `json:"sender_id"`
+	ThreadRootID *int64      `json:"thread_root_id,omitempty"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Snippet      string      `json:"snippet"`
+	Highlights   []TextRange `json:"highlights"`
+}
+
+// SearchMessages searches the unencrypted dialogs the caller is a member of,
+// newest messages first.
+func (s *Service) SearchMessages(ctx context.Context, currentUser uuid.UUID, q SearchQuery) ([]SearchHit, error) {
+	q.Text = strings.TrimSpace(q.Text)
+	if q.Text == "" || utf8.RuneCountInString(q.Text) > maxSearchQuery {
+		return nil, ErrInvalidSearch
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		return nil, ErrInvalidSearch
+	}
+	if q.Limit <= 0 || q.Limit > maxSearchPage {
+		q.Limit = defaultSearchPage
+	}
+	if q.DialogID != nil {
+		ok, err := s.repo.CheckMember(ctx, *q.DialogID, currentUser)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrForbidden
+		}
+		encrypted, err := s.repo.DialogEncrypted(ctx, *q.DialogID)
+		if err != nil {
+			return nil, err
+		}
+		if encrypted {
+			return nil, ErrSearchEncrypted
+		}
+	}
+	hits, err := s.repo.SearchMessages(ctx, currentUser, q)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hits {
+		hits[i].Snippet, hits[i].Highlights = parseSnippet(hits[i].Snippet)
+	}
+	return hits, nil
+}
+
+// parseSnippet strips the match markers from a snippet and returns the
+// marked ranges.
+func parseSnippet(marked string) (string, []TextRange) {
+	var (
+		b      strings.Builder
+		ranges = []TextRange{}
+		pos    int
+		start  = -1
+	)
+	for _, r := range marked {
+		switch {
+		case r == snippetMatchStart:
+			start = pos
+		case r == snippetMatchStop && start >= 0:
+			if pos > start {
+				ranges = append(ranges, TextRange{Offset: start, Length: pos - start})
+			}
+			start = -1
+		case r == snippetMatchStop:
+		default:
+			b.WriteRune(r)
+			pos++
+		}
+	}
+	return b.String(), ranges
+}
@@ -0,0 +1,89 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const maxClientMessageIDLength = 64
+
+var (
+	ErrEmptyMessage    = errors.New("text required")
+	ErrInvalidClientID = errors.New("invalid client message id")
+)
+
+// OutgoingMessage is a message as submitted by a client over HTTP or WebSocket.
+// ClientMessageID, when set, makes the send idempotent per sender and dialog.
+// Kind is "text" by default; encrypted dialogs also take "poll" and
+// "poll_vote", a vote replying to its poll. ThreadRootID posts the message
+// into the thread of that message instead of the main timeline.
+type OutgoingMessage struct {
+	Kind            string `json:"kind"`
+	Text            string `json:"text"`
+	ReplyTo         *int64 `json:"reply_to"`
+	Quote           string `json:"quote"`
+	ClientMessageID string `json:"client_message_id"`
+	ThreadRootID    *int64 `json:"thread_root_id"`
+	// Attachments are ids of media objects the sender uploaded.
+	Attachments []uuid.UUID `json:"attachments"`
+}
+
+// Send stores a message from currentUser. A retry with an already used
+// ClientMessageID returns the original message without publishing it again.
+func (s *Service) Send(ctx context.Context, currentUser, dialogID uuid.UUID, out OutgoingMessage) (Message, error) {
+	if out.Text == "" {
+		return Message{}, ErrEmptyMessage
+	}
+	// membership comes first: a retry must not hand a stored message to
+	// someone who has left or been removed since
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, ErrForbidden
+	}
+	if err := s.checkMessageKind(ctx, dialogID, out); err != nil {
+		return Message{}, err
+	}
+	if out.ClientMessageID != "" {
+		if !validClientID(out.ClientMessageID) {
+			return Message{}, ErrInvalidClientID
+		}
+		orig, err := s.repo.MessageByClientID(ctx, dialogID, currentUser, out.ClientMessageID)
+		if err == nil {
+			return orig, nil
+		}
+		if !errors.Is(err, ErrMessageNotFound) {
+			return Message{}, err
+		}
+	}
+	if out.ThreadRootID != nil {
+		return s.sendThreadReply(ctx, currentUser, dialogID, out)
+	}
+	if out.ReplyTo != nil {
+		return s.sendReply(ctx, currentUser, dialogID, out)
+	}
+	kind, err := s.checkSend(ctx, currentUser, dialogID)
+	if err != nil {
+		return Message{}, err
+	}
+	return s.store(ctx, kind, NewMessage{DialogID: dialogID, SenderID: currentUser, Kind: out.Kind, Text: out.Text, ClientMessageID: out.ClientMessageID, Attachments: out.Attachments}, nil)
+}
+
+// validClientID accepts up to maxClientMessageIDLength printable characters.
+func validClientID(id string) bool {
+	if len(id) > maxClientMessageIDLength || !utf8.ValidString(id) {
+		return false
+	}
+	for _, r := range id {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -3,6 +3,7 @@ package dialogs
 import (
 	"context"
 	"errors"
+	"strings"
 
 	"github.com/google/uuid"
 
@@ -11,13 +12,29 @@ import (
 
 var (
 	ErrForbidden = errors.New("forbidden")
+	// ErrPeerUnavailable hides whether a peer is missing or refuses contact.
+	ErrPeerUnavailable = errors.New("peer unavailable")
 )
 
+// PrivacyPolicy answers whether users may reach each other.
+type PrivacyPolicy interface {
+	CanMessage(ctx context.Context, from, to uuid.UUID) (bool, error)
+	FindableByEmail(ctx context.Context, userID uuid.UUID) (bool, error)
+	CanAddToGroup(ctx context.Context, actor, target uuid.UUID) (bool, error)
+	IsContact(ctx context.Context, owner, other uuid.UUID) (bool, error)
+	ForwardAttribution(ctx context.Context, userID uuid.UUID) (name string, link bool, err error)
+	BlockedAmong(ctx context.Context, userID uuid.UUID, others []uuid.UUID) ([]uuid.UUID, error)
+}
+
 // Service encapsulates dialog/message operations.
 type Service struct {
-	repo        Repository
-	userFetcher func(ctx context.Context, email string) (auth.User, error)
-	publisher   EventPublisher
+	repo            Repository
+	userFetcher     func(ctx context.Context, email string) (auth.User, error)
+	usernameFetcher func(ctx context.Context, username string) (auth.User, error)
+	publisher       EventPublisher
+	privacy         PrivacyPolicy
+	blocker         func(ctx context.Context, owner, target uuid.UUID) error
+	media           MediaStore
 }
 
 func NewService(repo Repository, userFetcher func(ctx context.Context, email string) (auth.User, error)) *Service {
@@ -32,50 +49,226 @@ func (s *Service) SetPublisher(publisher EventPublisher) {
 	s.publisher = publisher
 }
 
+// SetPrivacy enables privacy settings enforcement.
+func (s *Service) SetPrivacy(privacy PrivacyPolicy) {
+	s.privacy = privacy
+}
+
+// SetUsernameFetcher enables "@username" targets in CreateDirect.
+func (s *Service) SetUsernameFetcher(fetcher func(ctx context.Context, username string) (auth.User, error)) {
+	s.usernameFetcher = fetcher
+}
+
 // CreateDirect creates or returns existing direct dialog.
-func (s *Service) CreateDirect(ctx context.Context, currentUser uuid.UUID, targetEmailOrID string) (uuid.UUID, error) {
-	var peerID uuid.UUID
-	if id, err := uuid.Parse(targetEmailOrID); err == nil {
-		peerID = id
-	} else {
-		user, err := s.userFetcher(ctx, targetEmailOrID)
+// target is a user ID, an email or a username (optionally prefixed with @).
+func (s *Service) CreateDirect(ctx context.Context, currentUser uuid.UUID, target string) (uuid.UUID, error) {
+	peerID, err := s.resolvePeer(ctx, target)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if peerID == uuid.Nil {
+		return uuid.Nil, errors.New("invalid peer")
+	}
+	if peerID == currentUser {
+		return s.SavedMessages(ctx, currentUser)
+	}
+	if s.privacy != nil {
+		allowed, err := s.privacy.CanMessage(ctx, currentUser, peerID)
 		if err != nil {
 			return uuid.Nil, err
 		}
-		peerID = user.ID
+		if !allowed {
+			return uuid.Nil, ErrPeerUnavailable
+		}
 	}
-	if peerID == uuid.Nil || peerID == currentUser {
-		return uuid.Nil, errors.New("invalid peer")
+	peerState, err := s.initialPeerState(ctx, currentUser, peerID)
+	if err != nil {
+		return uuid.Nil, err
 	}
-	id, err := s.repo.GetOrCreateDirect(ctx, currentUser, peerID)
+	id, err := s.repo.GetOrCreateDirect(ctx, currentUser, peerID, peerState)
 	if err == ErrDialogExist {
 		return id, nil
 	}
 	return id, err
 }
 
-func (s *Service) ListDialogs(ctx context.Context, currentUser uuid.UUID, limit int) ([]Dialog, error) {
-	return s.repo.ListDialogs(ctx, currentUser, limit)
+func (s *Service) resolvePeer(ctx context.Context, target string) (uuid.UUID, error) {
+	target = strings.TrimSpace(target)
+	if id, err := uuid.Parse(target); err == nil {
+		return id, nil
+	}
+	if strings.Contains(target, "@") && !strings.HasPrefix(target, "@") {
+		user, err := s.userFetcher(ctx, target)
+		if err != nil {
+			if errors.Is(err, auth.ErrUserNotFound) {
+				return uuid.Nil, ErrPeerUnavailable
+			}
+			return uuid.Nil, err
+		}
+		if s.privacy != nil {
+			findable, err := s.privacy.FindableByEmail(ctx, user.ID)
+			if err != nil {
+				return uuid.Nil, err
+			}
+			if !findable {
+				return uuid.Nil, ErrPeerUnavailable
+			}
+		}
+		return user.ID, nil
+	}
+	if s.usernameFetcher == nil {
+		return uuid.Nil, ErrPeerUnavailable
+	}
+	user, err := s.usernameFetcher(ctx, strings.TrimPrefix(target, "@"))
+	if err != nil {
+		if errors.Is(err, auth.ErrUserNotFound) {
+			return uuid.Nil, ErrPeerUnavailable
+		}
+		return uuid.Nil, err
+	}
+	return user.ID, nil
+}
+
+// checkCanMessage applies the peer's allow_messages_from to direct dialogs.
+func (s *Service) checkCanMessage(ctx context.Context, dialogID, sender uuid.UUID) error {
+	if s.privacy == nil {
+		return nil
+	}
+	peer, ok, err := s.repo.DirectPeer(ctx, dialogID, sender)
+	if err != nil || !ok {
+		return err
+	}
+	allowed, err := s.privacy.CanMessage(ctx, sender, peer)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// ListDialogs lists the inbox or, for FolderRequests, pending message requests.
+// The inbox hides archived dialogs unless filter.Archived is set. Every dialog
+// carries the cursor that continues the listing after it.
+func (s *Service) ListDialogs(ctx context.Context, currentUser uuid.UUID, folder string, filter DialogFilter, limit int) ([]Dialog, error) {
+	state, err := folderState(folder)
+	if err != nil {
+		return nil, err
+	}
+	filter.State = state
+	if filter.Archived == nil && state == RequestAccepted {
+		archived := false
+		filter.Archived = &archived
+	}
+	list, err := s.repo.ListDialogs(ctx, currentUser, limit, filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i].Cursor = cursorOf(list[i]).String()
+	}
+	return list, nil
 }
 
 func (s *Service) SendMessage(ctx context.Context, currentUser uuid.UUID, dialogID uuid.UUID, text string) (Message, error) {
-	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	kind, err := s.checkSend(ctx, currentUser, dialogID)
 	if err != nil {
 		return Message{}, err
 	}
+	return s.store(ctx, kind, NewMessage{DialogID: dialogID, SenderID: currentUser, Text: text}, nil)
+}
+
+// checkSend checks that currentUser may post into the dialog and returns its
+// kind. Accepting a message request by replying is left to store, so that it
+// happens only with the reply.
+func (s *Service) checkSend(ctx context.Context, currentUser, dialogID uuid.UUID) (string, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return "", err
+	}
 	if !ok {
-		return Message{}, ErrForbidden
+		return "", ErrForbidden
 	}
-	id, created, err := s.repo.SaveMessage(ctx, dialogID, currentUser, text)
+	kind, err := s.canPost(ctx, dialogID, currentUser)
 	if err != nil {
+		return "", err
+	}
+	if err := s.checkCanMessage(ctx, dialogID, currentUser); err != nil {
+		return "", err
+	}
+	return kind, nil
+}
+
+// store saves a prepared message and publishes it; reply is the preview of in.ReplyTo.
+func (s *Service) store(ctx context.Context, kind string, in NewMessage, reply *ReplyPreview) (Message, error) {
+	if err := s.checkAttachments(ctx, in.SenderID, in.Attachments); err != nil {
 		return Message{}, err
 	}
-	msg := Message{ID: id, DialogID: dialogID, SenderID: currentUser, Text: text, CreatedAt: created, DeliveredPeer: false, ReadPeer: false}
-	if s.publisher != nil {
-		if members, err := s.repo.Members(ctx, dialogID); err == nil {
-			_ = s.publisher.PublishMessage(ctx, msg, members)
+	// forwarded copies keep their text but mention no one
+	if kind == KindGroup && in.ForwardedFrom == nil && (in.Kind == "" || in.Kind == "text") {
+		var err error
+		if in.Mentions, in.Mentioned, err = s.mentions(ctx, in.DialogID, in.SenderID, in.Text); err != nil {
+			return Message{}, err
 		}
 	}
+	var (
+		msg     Message
+		members []uuid.UUID
+	)
+	err := s.inTx(ctx, func(ctx context.Context) error {
+		if kind == KindDirect {
+			if err := s.acceptByReply(ctx, in.DialogID, in.SenderID); err != nil {
+				return err
+			}
+		}
+		var err error
+		if msg, err = s.repo.SaveMessage(ctx, in); err != nil {
+			return err
+		}
+		switch kind {
+		case KindChannel:
+			// channel posts are not in the update log
+			return nil
+		case KindSaved:
+			members = []uuid.UUID{in.SenderID}
+		default:
+			if members, err = s.audience(ctx, in.DialogID, in.SenderID); err != nil {
+				return err
+			}
+		}
+		return s.recordUpdate(ctx, members, Update{Type: EventMessageNew, DialogID: in.DialogID, MessageID: &msg.ID, ActorID: &msg.SenderID})
+	})
+	if errors.Is(err, ErrDuplicateMessage) {
+		// a concurrent retry stored it first
+		return s.repo.MessageByClientID(ctx, in.DialogID, in.SenderID, in.ClientMessageID)
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	msg.ReplyTo = reply
+	msg.Attachments = in.Attachments
+	if in.Poll != nil {
+		msg.Poll = in.Poll.open()
+	}
+	s.clearDraft(ctx, in.SenderID, in.DialogID)
+	switch kind {
+	case KindChannel:
+		if s.publisher != nil {
+			_ = s.publisher.PublishChannelMessage(ctx, msg)
+		}
+		return msg, nil
+	case KindSaved:
+		// the author is the only reader: every device gets it, the sender's too
+		if s.publisher != nil {
+			_ = s.publisher.PublishSavedMessage(ctx, msg)
+		}
+		return msg, nil
+	}
+	if s.publisher != nil {
+		_ = s.publisher.PublishMessage(ctx, msg, members)
+	}
+	s.publishMentions(ctx, msg, in.Mentioned)
 	return msg, nil
 }
 
@@ -87,7 +280,23 @@ func (s *Service) ListMessages(ctx context.Context, currentUser uuid.UUID, dialo
 	if !ok {
 		return nil, ErrForbidden
 	}
-	return s.repo.ListMessages(ctx, dialogID, currentUser, limit, before)
+	msgs, err := s.repo.ListMessages(ctx, dialogID, currentUser, limit, before)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachPolls(ctx, currentUser, msgs); err != nil {
+		return nil, err
+	}
+	if err := s.attachReactions(ctx, currentUser, msgs); err != nil {
+		return nil, err
+	}
+	if err := s.attachMedia(ctx, msgs); err != nil {
+		return nil, err
+	}
+	if err := s.attachThreads(ctx, currentUser, msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
 }
 
 func (s *Service) MarkDelivered(ctx context.Context, currentUser uuid.UUID, dialogID uuid.UUID, messageID int64) error {
@@ -98,11 +307,12 @@ func (s *Service) MarkDelivered(ctx context.Context, currentUser uuid.UUID, dial
 	if !ok {
 		return ErrForbidden
 	}
-	if err := s.repo.MarkDelivered(ctx, dialogID, currentUser, messageID); err != nil {
+	advanced, err := s.repo.MarkDelivered(ctx, dialogID, currentUser, messageID)
+	if err != nil || !advanced {
 		return err
 	}
 	if s.publisher != nil {
-		if members, err := s.repo.Members(ctx, dialogID); err == nil {
+		if members, err := s.audience(ctx, dialogID, currentUser); err == nil {
 			_ = s.publisher.PublishDelivery(ctx, dialogID, currentUser, messageID, members)
 		}
 	}
@@ -117,13 +327,47 @@ func (s *Service) MarkRead(ctx context.Context, currentUser uuid.UUID, dialogID
 	if !ok {
 		return ErrForbidden
 	}
-	if err := s.repo.MarkRead(ctx, dialogID, currentUser, messageID); err != nil {
+	return s.inTx(ctx, func(ctx context.Context) error {
+		advanced, err := s.repo.MarkRead(ctx, dialogID, currentUser, messageID)
+		if err != nil || !advanced {
+			return err
+		}
+		members, err := s.audience(ctx, dialogID, currentUser)
+		if err != nil {
+			return err
+		}
+		if err := s.recordUpdate(ctx, members, Update{Type: EventMessageRead, DialogID: dialogID, MessageID: &messageID, ActorID: &currentUser}); err != nil {
+			return err
+		}
+		s.publish(ctx, func(ctx context.Context, p EventPublisher) error {
+			return p.PublishRead(ctx, dialogID, currentUser, messageID, members)
+		})
+		return nil
+	})
+}
+
+// Typing notifies other members that currentUser is typing.
+// Nothing is sent when the peer of a direct dialog may not be messaged.
+func (s *Service) Typing(ctx context.Context, currentUser uuid.UUID, dialogID uuid.UUID) error {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
 		return err
 	}
-	if s.publisher != nil {
-		if members, err := s.repo.Members(ctx, dialogID); err == nil {
-			_ = s.publisher.PublishRead(ctx, dialogID, currentUser, messageID, members)
+	if !ok {
+		return ErrForbidden
+	}
+	if s.publisher == nil {
+		return nil
+	}
+	if err := s.checkCanMessage(ctx, dialogID, currentUser); err != nil {
+		if err == ErrForbidden {
+			return nil
 		}
+		return err
 	}
-	return nil
+	members, err := s.audience(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	return s.publisher.PublishTyping(ctx, dialogID, currentUser, members)
 }
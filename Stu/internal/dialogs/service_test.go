@@ -1,7 +1,12 @@
 package dialogs
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,126 +15,3210 @@ import (
 	"stu/internal/auth"
 )
 
+type hiddenKey struct {
+	userID    uuid.UUID
+	messageID int64
+}
+
 type memRepo struct {
 	dialogMembers map[uuid.UUID][]uuid.UUID
 	messages      map[uuid.UUID][]Message
+	states        map[[2]uuid.UUID]string
+	roles         map[[2]uuid.UUID]string
+	kinds         map[uuid.UUID]string
+	titles        map[uuid.UUID]string
+	channels      map[uuid.UUID]Channel
+	invites       map[uuid.UUID]Invite
+	joinRequests  map[[2]uuid.UUID]JoinRequest
+	hidden        map[hiddenKey]bool
+	reactions     map[int64][]memReaction
+	allowed       map[uuid.UUID][]string
+	settings      map[[2]uuid.UUID]DialogSettings
+	pins          map[uuid.UUID][]int64
+	updates       map[uuid.UUID][]Update
+	watermarks    map[[2]uuid.UUID]watermark
+	pinnedAt      map[[2]uuid.UUID]time.Time
+	ttls          map[uuid.UUID]int
+	scheduled     []ScheduledMessage
+	drafts        map[[2]uuid.UUID]Draft
+	polls         map[int64]PollInput
+	votes         map[int64]map[uuid.UUID][]int
+	threadReads   map[threadReadKey]int64
+	usernames     map[uuid.UUID]string
+	// mentions maps a mention of a user to whether it was read
+	mentions map[hiddenKey]bool
+	nextID   int64
+	// appendErr makes AppendUpdate fail
+	appendErr error
+	pts       map[uuid.UUID]int64
+	// media are the uploads; messageMedia links them to messages
+	media        map[uuid.UUID]memMedia
+	messageMedia map[int64][]uuid.UUID
+	encrypted    map[uuid.UUID]bool
+}
+
+type memMedia struct {
+	owner uuid.UUID
+	key   string
+}
+
+type threadReadKey struct {
+	root int64
+	user uuid.UUID
+}
+
+type watermark struct {
+	read, delivered int64
+}
+
+type memReaction struct {
+	userID   uuid.UUID
+	reaction string
 }
 
 func newMemRepo() *memRepo {
 	return &memRepo{
 		dialogMembers: make(map[uuid.UUID][]uuid.UUID),
 		messages:      make(map[uuid.UUID][]Message),
+		states:        make(map[[2]uuid.UUID]string),
+		roles:         make(map[[2]uuid.UUID]string),
+		kinds:         make(map[uuid.UUID]string),
+		titles:        make(map[uuid.UUID]string),
+		channels:      make(map[uuid.UUID]Channel),
+		invites:       make(map[uuid.UUID]Invite),
+		joinRequests:  make(map[[2]uuid.UUID]JoinRequest),
+		hidden:        make(map[hiddenKey]bool),
+		reactions:     make(map[int64][]memReaction),
+		allowed:       make(map[uuid.UUID][]string),
+		settings:      make(map[[2]uuid.UUID]DialogSettings),
+		pins:          make(map[uuid.UUID][]int64),
+		updates:       make(map[uuid.UUID][]Update),
+		pts:           make(map[uuid.UUID]int64),
+		watermarks:    make(map[[2]uuid.UUID]watermark),
+		pinnedAt:      make(map[[2]uuid.UUID]time.Time),
+		ttls:          make(map[uuid.UUID]int),
+		drafts:        make(map[[2]uuid.UUID]Draft),
+		polls:         make(map[int64]PollInput),
+		votes:         make(map[int64]map[uuid.UUID][]int),
+		threadReads:   make(map[threadReadKey]int64),
+		usernames:     make(map[uuid.UUID]string),
+		mentions:      make(map[hiddenKey]bool),
+		media:         make(map[uuid.UUID]memMedia),
+		messageMedia:  make(map[int64][]uuid.UUID),
+		encrypted:     make(map[uuid.UUID]bool),
 	}
 }
 
-func (m *memRepo) CreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID) (uuid.UUID, error) {
+func (m *memRepo) CreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID, peerState string) (uuid.UUID, error) {
 	id := uuid.New()
 	m.dialogMembers[id] = []uuid.UUID{initiator, peer}
+	m.states[[2]uuid.UUID{id, peer}] = peerState
+	m.kinds[id] = "direct"
 	return id, nil
 }
 
-func (m *memRepo) GetOrCreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID) (uuid.UUID, error) {
+func (m *memRepo) GetOrCreateDirect(ctx context.Context, initiator uuid.UUID, peer uuid.UUID, peerState string) (uuid.UUID, error) {
 	for id, members := range m.dialogMembers {
-		if contains(members, initiator) && contains(members, peer) && len(members) == 2 {
+		if contains(members, initiator) && contains(members, peer) && m.kinds[id] == "direct" {
 			return id, ErrDialogExist
 		}
 	}
-	return m.CreateDirect(ctx, initiator, peer)
+	return m.CreateDirect(ctx, initiator, peer, peerState)
+}
+
+func (m *memRepo) GetOrCreateSaved(ctx context.Context, userID uuid.UUID) (uuid.UUID, error) {
+	for id, members := range m.dialogMembers {
+		if m.kinds[id] == KindSaved && contains(members, userID) {
+			return id, nil
+		}
+	}
+	id := uuid.New()
+	m.dialogMembers[id] = []uuid.UUID{userID}
+	m.kinds[id] = KindSaved
+	return id, nil
 }
 
-func (m *memRepo) ListDialogs(ctx context.Context, userID uuid.UUID, limit int) ([]Dialog, error) {
+func (m *memRepo) ListDialogs(ctx context.Context, userID uuid.UUID, limit int, filter DialogFilter) ([]Dialog, error) {
 	var res []Dialog
 	for id, members := range m.dialogMembers {
-		if contains(members, userID) {
-			msgs := m.messages[id]
-			var last *Message
-			if len(msgs) > 0 {
-				lm := msgs[len(msgs)-1]
-				last = &lm
+		st, _ := m.RequestState(ctx, id, userID)
+		if !contains(members, userID) || st != filter.State {
+			continue
+		}
+		ds, _ := m.MemberSettings(ctx, id, userID)
+		if (filter.Archived != nil && ds.Archived != *filter.Archived) ||
+			(filter.Muted != nil && (ds.MutedUntil != nil) != *filter.Muted) ||
+			(filter.Pinned != nil && ds.Pinned != *filter.Pinned) {
+			continue
+		}
+		encrypted, _ := m.DialogEncrypted(ctx, id)
+		d := Dialog{ID: id, Kind: m.kinds[id], Title: m.titles[id], MessageTTL: m.ttls[id], Encrypted: encrypted, DialogSettings: ds}
+		if ds.Pinned {
+			at := m.pinnedAt[[2]uuid.UUID{id, userID}]
+			d.pinnedAt = &at
+		}
+		wm := m.watermarks[[2]uuid.UUID{id, userID}]
+		for _, msg := range m.messages[id] {
+			if msg.Deleted || m.hidden[hiddenKey{userID, msg.ID}] {
+				continue
+			}
+			last := msg
+			d.LastMessage, d.LastActivityAt = &last, msg.CreatedAt
+			if msg.ID > wm.read && msg.SenderID != userID {
+				d.UnreadCount++
+			}
+			if read, ok := m.mentions[hiddenKey{userID, msg.ID}]; ok && !read {
+				d.UnreadMentions++
 			}
-			res = append(res, Dialog{ID: id, LastMessage: last})
 		}
+		res = append(res, d)
+	}
+	slices.SortFunc(res, func(a, b Dialog) int { return compareCursors(cursorOf(b), cursorOf(a)) })
+	if filter.After != nil {
+		res = slices.DeleteFunc(res, func(d Dialog) bool { return compareCursors(cursorOf(d), *filter.After) >= 0 })
+	}
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
 	}
 	return res, nil
 }
 
+// compareCursors orders list positions; the list runs from greatest to least.
+func compareCursors(a, b DialogCursor) int {
+	if a.Pinned != b.Pinned {
+		if a.Pinned {
+			return 1
+		}
+		return -1
+	}
+	if c := a.At.Compare(b.At); c != 0 {
+		return c
+	}
+	return slices.Compare(a.ID[:], b.ID[:])
+}
+
+func (m *memRepo) MemberSettings(ctx context.Context, dialogID, userID uuid.UUID) (DialogSettings, error) {
+	if !contains(m.dialogMembers[dialogID], userID) {
+		return DialogSettings{}, ErrNotMember
+	}
+	ds, ok := m.settings[[2]uuid.UUID{dialogID, userID}]
+	if !ok {
+		ds.NotifyMentions = true
+	}
+	if ds.MutedUntil != nil && !ds.MutedUntil.After(time.Now()) {
+		ds.MutedUntil = nil
+	}
+	return ds, nil
+}
+
+func (m *memRepo) SetMemberSettings(ctx context.Context, dialogID, userID uuid.UUID, settings DialogSettings) error {
+	if !contains(m.dialogMembers[dialogID], userID) {
+		return ErrNotMember
+	}
+	key := [2]uuid.UUID{dialogID, userID}
+	if _, ok := m.pinnedAt[key]; settings.Pinned && !ok {
+		m.pinnedAt[key] = time.Now()
+	} else if !settings.Pinned {
+		delete(m.pinnedAt, key)
+	}
+	m.settings[key] = settings
+	return nil
+}
+
+func (m *memRepo) CountPinnedDialogs(ctx context.Context, userID uuid.UUID) (int, error) {
+	n := 0
+	for key, ds := range m.settings {
+		if key[1] == userID && ds.Pinned {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memRepo) RequestState(ctx context.Context, dialogID, userID uuid.UUID) (string, error) {
+	if !contains(m.dialogMembers[dialogID], userID) {
+		return "", ErrNotMember
+	}
+	if st, ok := m.states[[2]uuid.UUID{dialogID, userID}]; ok {
+		return st, nil
+	}
+	return RequestAccepted, nil
+}
+
+func (m *memRepo) SetRequestState(ctx context.Context, dialogID, userID uuid.UUID, state string) error {
+	if !contains(m.dialogMembers[dialogID], userID) {
+		return ErrNotMember
+	}
+	m.states[[2]uuid.UUID{dialogID, userID}] = state
+	return nil
+}
+
 func (m *memRepo) CheckMember(ctx context.Context, dialogID, userID uuid.UUID) (bool, error) {
 	return contains(m.dialogMembers[dialogID], userID), nil
 }
 
-func (m *memRepo) SaveMessage(ctx context.Context, dialogID, sender uuid.UUID, text string) (int64, time.Time, error) {
-	msg := Message{ID: int64(len(m.messages[dialogID]) + 1), DialogID: dialogID, SenderID: sender, Text: text, CreatedAt: time.Now()}
+func (m *memRepo) SaveMessage(ctx context.Context, in NewMessage) (Message, error) {
+	if in.ClientMessageID != "" {
+		if _, err := m.MessageByClientID(ctx, in.DialogID, in.SenderID, in.ClientMessageID); err == nil {
+			return Message{}, ErrDuplicateMessage
+		}
+	}
+	m.nextID++
+	msg := Message{
+		ID: m.nextID, DialogID: in.DialogID, SenderID: in.SenderID, Kind: cmp.Or(in.Kind, "text"), Text: in.Text, CreatedAt: time.Now(),
+		ForwardedFrom: in.ForwardedFrom, ClientMessageID: in.ClientMessageID, ThreadRootID: in.ThreadRootID, Mentions: in.Mentions,
+	}
+	for _, id := range in.Mentioned {
+		m.mentions[hiddenKey{id, msg.ID}] = false
+	}
+	if in.Poll != nil {
+		m.polls[msg.ID] = *in.Poll
+	}
+	if ttl := m.ttls[in.DialogID]; ttl > 0 {
+		expires := msg.CreatedAt.Add(time.Duration(ttl) * time.Second)
+		msg.ExpiresAt = &expires
+	}
+	if in.ReplyTo != nil {
+		orig, err := m.GetMessage(ctx, in.DialogID, *in.ReplyTo)
+		if err != nil {
+			return Message{}, err
+		}
+		msg.ReplyTo = &ReplyPreview{ID: orig.ID, SenderID: orig.SenderID, Kind: orig.Kind, Text: orig.Text, Quote: in.Quote}
+	}
+	m.messages[in.DialogID] = append(m.messages[in.DialogID], msg)
+	if len(in.Attachments) > 0 {
+		m.messageMedia[msg.ID] = in.Attachments
+	}
+	saved := msg
+	saved.ReplyTo = nil
+	saved.Attachments = in.Attachments
+	return saved, nil
+}
+
+func (m *memRepo) SetMessageTTL(ctx context.Context, dialogID uuid.UUID, seconds int) (bool, error) {
+	if m.ttls[dialogID] == seconds {
+		return false, nil
+	}
+	m.ttls[dialogID] = seconds
+	return true, nil
+}
+
+func (m *memRepo) ReapExpiredMessages(ctx context.Context, limit int) ([]ExpiredMessage, []MediaObject, error) {
+	var expired []ExpiredMessage
+	now := time.Now()
+	roots := map[int64]bool{}
+	for dialogID, msgs := range m.messages {
+		m.messages[dialogID] = slices.DeleteFunc(msgs, func(msg Message) bool {
+			if msg.ExpiresAt == nil || msg.ExpiresAt.After(now) || len(expired) >= limit {
+				return false
+			}
+			expired = append(expired, ExpiredMessage{ID: msg.ID, DialogID: dialogID, DialogKind: m.kinds[dialogID]})
+			roots[msg.ID] = true
+			return true
+		})
+	}
+	// thread replies go with their root
+	for dialogID, msgs := range m.messages {
+		m.messages[dialogID] = slices.DeleteFunc(msgs, func(msg Message) bool {
+			if msg.ThreadRootID == nil || !roots[*msg.ThreadRootID] {
+				return false
+			}
+			expired = append(expired, ExpiredMessage{ID: msg.ID, DialogID: dialogID, DialogKind: m.kinds[dialogID]})
+			return true
+		})
+	}
+	var blobs []MediaObject
+	for _, e := range expired {
+		for _, id := range m.messageMedia[e.ID] {
+			blobs = append(blobs, MediaObject{Key: m.media[id].key})
+			delete(m.media, id)
+		}
+		delete(m.messageMedia, e.ID)
+	}
+	return expired, blobs, nil
+}
+
+func (m *memRepo) UsableMedia(ctx context.Context, owner uuid.UUID, ids []uuid.UUID) (bool, error) {
+	for _, id := range ids {
+		if o, ok := m.media[id]; !ok || o.owner != owner {
+			return false, nil
+		}
+		for _, used := range m.messageMedia {
+			if slices.Contains(used, id) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func (m *memRepo) MessageMedia(ctx context.Context, messageIDs []int64) (map[int64][]uuid.UUID, error) {
+	res := map[int64][]uuid.UUID{}
+	for _, id := range messageIDs {
+		if media := m.messageMedia[id]; len(media) > 0 {
+			res[id] = media
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) CreateScheduled(ctx context.Context, msg ScheduledMessage) (ScheduledMessage, error) {
+	m.nextID++
+	msg.ID = m.nextID
+	msg.CreatedAt = time.Now()
+	m.scheduled = append(m.scheduled, msg)
+	return msg, nil
+}
+
+func (m *memRepo) ListScheduled(ctx context.Context, dialogID, senderID uuid.UUID) ([]ScheduledMessage, error) {
+	var out []ScheduledMessage
+	for _, msg := range m.scheduled {
+		if msg.DialogID == dialogID && msg.SenderID == senderID {
+			out = append(out, msg)
+		}
+	}
+	return out, nil
+}
+
+func (m *memRepo) CountScheduled(ctx context.Context, dialogID, senderID uuid.UUID) (int, error) {
+	list, _ := m.ListScheduled(ctx, dialogID, senderID)
+	return len(list), nil
+}
+
+func (m *memRepo) UpdateScheduled(ctx context.Context, msg ScheduledMessage) (ScheduledMessage, error) {
+	for i, cur := range m.scheduled {
+		if cur.ID == msg.ID && cur.DialogID == msg.DialogID && cur.SenderID == msg.SenderID {
+			cur.Text, cur.SendAt, cur.FailedAt, cur.Error = msg.Text, msg.SendAt, nil, ""
+			m.scheduled[i] = cur
+			return cur, nil
+		}
+	}
+	return ScheduledMessage{}, ErrScheduledNotFound
+}
+
+func (m *memRepo) DeleteScheduled(ctx context.Context, dialogID, senderID uuid.UUID, id int64) error {
+	for i, cur := range m.scheduled {
+		if cur.ID == id && cur.DialogID == dialogID && cur.SenderID == senderID {
+			m.scheduled = slices.Delete(m.scheduled, i, i+1)
+			return nil
+		}
+	}
+	return ErrScheduledNotFound
+}
+
+func (m *memRepo) ClaimDueScheduled(ctx context.Context, limit int, send func(ScheduledMessage) error) (int, error) {
+	sent, claimed := 0, 0
+	now := time.Now()
+	kept := m.scheduled[:0:0]
+	for _, msg := range m.scheduled {
+		if msg.FailedAt != nil || msg.SendAt.After(now) || claimed >= limit {
+			kept = append(kept, msg)
+			continue
+		}
+		claimed++
+		err := send(msg)
+		switch {
+		case errors.Is(err, errRetryScheduled):
+			kept = append(kept, msg)
+		case err != nil:
+			msg.FailedAt, msg.Error = &now, err.Error()
+			kept = append(kept, msg)
+		default:
+			sent++
+		}
+	}
+	m.scheduled = kept
+	return sent, nil
+}
+
+func (m *memRepo) DialogEncrypted(ctx context.Context, dialogID uuid.UUID) (bool, error) {
+	kind, err := m.DialogKind(ctx, dialogID)
+	return kind == "direct" || kind == KindSaved || m.encrypted[dialogID], err
+}
+
+func (m *memRepo) Polls(ctx context.Context, userID uuid.UUID, messageIDs []int64) (map[int64]*Poll, error) {
+	res := make(map[int64]*Poll)
+	for _, id := range messageIDs {
+		in, ok := m.polls[id]
+		if !ok {
+			continue
+		}
+		p := in.open()
+		p.Closed = in.ClosesAt != nil && !in.ClosesAt.After(time.Now())
+		p.Voters = len(m.votes[id])
+		for voter, options := range m.votes[id] {
+			for _, o := range options {
+				p.Options[o].Votes++
+				p.Options[o].Chosen = p.Options[o].Chosen || voter == userID
+				if !in.Anonymous {
+					p.Options[o].VoterIDs = append(p.Options[o].VoterIDs, voter)
+				}
+			}
+		}
+		res[id] = p
+	}
+	return res, nil
+}
+
+func (m *memRepo) SetPollVote(ctx context.Context, messageID int64, userID uuid.UUID, options []int) (bool, error) {
+	in, ok := m.polls[messageID]
+	if !ok {
+		return false, ErrMessageNotFound
+	}
+	if in.ClosesAt != nil && !in.ClosesAt.After(time.Now()) {
+		return false, ErrPollClosed
+	}
+	if slices.Equal(m.votes[messageID][userID], options) {
+		return false, nil
+	}
+	if m.votes[messageID] == nil {
+		m.votes[messageID] = make(map[uuid.UUID][]int)
+	}
+	if len(options) == 0 {
+		delete(m.votes[messageID], userID)
+	} else {
+		m.votes[messageID][userID] = options
+	}
+	return true, nil
+}
+
+func (m *memRepo) SaveDraft(ctx context.Context, userID uuid.UUID, d Draft) (Draft, bool, error) {
+	key := [2]uuid.UUID{d.DialogID, userID}
+	if cur, ok := m.drafts[key]; ok && !cur.UpdatedAt.Before(d.UpdatedAt) {
+		return cur, false, nil
+	}
+	m.drafts[key] = d
+	return d, true, nil
+}
+
+func (m *memRepo) ClearDraft(ctx context.Context, userID uuid.UUID, d Draft) (bool, error) {
+	key := [2]uuid.UUID{d.DialogID, userID}
+	cur, ok := m.drafts[key]
+	if !ok || len(cur.Blob) == 0 || !cur.UpdatedAt.Before(d.UpdatedAt) {
+		return false, nil
+	}
+	m.drafts[key] = d
+	return true, nil
+}
+
+func (m *memRepo) ListDrafts(ctx context.Context, userID uuid.UUID) ([]Draft, error) {
+	var out []Draft
+	for key, d := range m.drafts {
+		if key[1] == userID && len(d.Blob) > 0 && slices.Contains(m.dialogMembers[key[0]], userID) {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func (m *memRepo) DraftsByDialog(ctx context.Context, userID uuid.UUID, dialogIDs []uuid.UUID) ([]Draft, error) {
+	var out []Draft
+	for _, id := range dialogIDs {
+		if d, ok := m.drafts[[2]uuid.UUID{id, userID}]; ok {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func (m *memRepo) SaveSystemMessage(ctx context.Context, dialogID, actor uuid.UUID, text string) (int64, time.Time, error) {
+	m.nextID++
+	msg := Message{ID: m.nextID, DialogID: dialogID, SenderID: actor, Kind: "system", Text: text, CreatedAt: time.Now()}
 	m.messages[dialogID] = append(m.messages[dialogID], msg)
 	return msg.ID, msg.CreatedAt, nil
 }
 
-func (m *memRepo) ListMessages(ctx context.Context, dialogID, userID uuid.UUID, limit int, before int64) ([]Message, error) {
-	msgs := m.messages[dialogID]
-	return msgs, nil
+func (m *memRepo) CreateGroup(ctx context.Context, owner uuid.UUID, title string, members []uuid.UUID, encrypted bool) (uuid.UUID, error) {
+	id := uuid.New()
+	m.kinds[id] = "group"
+	m.encrypted[id] = encrypted
+	m.titles[id] = title
+	m.dialogMembers[id] = []uuid.UUID{owner}
+	m.roles[[2]uuid.UUID{id, owner}] = RoleOwner
+	for _, uid := range members {
+		_ = m.AddMember(ctx, id, uid, RoleMember)
+	}
+	return id, nil
+}
+
+func (m *memRepo) DialogKind(ctx context.Context, dialogID uuid.UUID) (string, error) {
+	kind, ok := m.kinds[dialogID]
+	if !ok {
+		return "", ErrDialogNotFound
+	}
+	return kind, nil
+}
+
+func (m *memRepo) MemberRole(ctx context.Context, dialogID, userID uuid.UUID) (string, error) {
+	if !contains(m.dialogMembers[dialogID], userID) {
+		return "", ErrNotMember
+	}
+	if role, ok := m.roles[[2]uuid.UUID{dialogID, userID}]; ok {
+		return role, nil
+	}
+	return RoleMember, nil
+}
+
+func (m *memRepo) ListMembers(ctx context.Context, dialogID uuid.UUID) ([]Member, error) {
+	var res []Member
+	for _, uid := range m.dialogMembers[dialogID] {
+		role, _ := m.MemberRole(ctx, dialogID, uid)
+		res = append(res, Member{UserID: uid, Role: role})
+	}
+	return res, nil
+}
+
+func (m *memRepo) Heir(ctx context.Context, dialogID, leaving uuid.UUID, roles []string) (uuid.UUID, bool, error) {
+	for _, role := range roles {
+		for _, uid := range m.dialogMembers[dialogID] {
+			if uid != leaving && m.roles[[2]uuid.UUID{dialogID, uid}] == role {
+				return uid, true, nil
+			}
+		}
+	}
+	return uuid.Nil, false, nil
+}
+
+func (m *memRepo) AddMember(ctx context.Context, dialogID, userID uuid.UUID, role string) error {
+	if contains(m.dialogMembers[dialogID], userID) {
+		return ErrAlreadyMember
+	}
+	m.dialogMembers[dialogID] = append(m.dialogMembers[dialogID], userID)
+	m.roles[[2]uuid.UUID{dialogID, userID}] = role
+	if msgs := m.messages[dialogID]; len(msgs) > 0 {
+		last := msgs[len(msgs)-1].ID
+		m.watermarks[[2]uuid.UUID{dialogID, userID}] = watermark{read: last, delivered: last}
+	}
+	return nil
+}
+
+func (m *memRepo) RemoveMember(ctx context.Context, dialogID, userID uuid.UUID) error {
+	members := m.dialogMembers[dialogID]
+	for i, uid := range members {
+		if uid == userID {
+			m.dialogMembers[dialogID] = append(members[:i:i], members[i+1:]...)
+			delete(m.roles, [2]uuid.UUID{dialogID, userID})
+			return nil
+		}
+	}
+	return ErrNotMember
 }
 
-func (m *memRepo) MarkDelivered(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) error {
+func (m *memRepo) SetRole(ctx context.Context, dialogID, userID uuid.UUID, role string) error {
+	if !contains(m.dialogMembers[dialogID], userID) {
+		return ErrNotMember
+	}
+	m.roles[[2]uuid.UUID{dialogID, userID}] = role
 	return nil
 }
 
-func (m *memRepo) MarkRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) error {
+func (m *memRepo) SetTitle(ctx context.Context, dialogID uuid.UUID, title string) error {
+	m.titles[dialogID] = title
 	return nil
 }
 
-func contains(list []uuid.UUID, id uuid.UUID) bool {
-	for _, v := range list {
-		if v == id {
-			return true
+func (m *memRepo) CreateChannel(ctx context.Context, owner uuid.UUID, title, username, description string) (uuid.UUID, error) {
+	for _, ch := range m.channels {
+		if ch.Username != nil && username != "" && strings.EqualFold(*ch.Username, username) {
+			return uuid.Nil, ErrChannelTaken
 		}
 	}
-	return false
+	id := uuid.New()
+	m.kinds[id] = KindChannel
+	m.titles[id] = title
+	m.dialogMembers[id] = []uuid.UUID{owner}
+	m.roles[[2]uuid.UUID{id, owner}] = RoleOwner
+	ch := Channel{ID: id, Title: title, CreatedAt: time.Now()}
+	if username != "" {
+		ch.Username = &username
+	}
+	m.channels[id] = ch
+	return id, nil
 }
 
-func (m *memRepo) Members(ctx context.Context, dialogID uuid.UUID) ([]uuid.UUID, error) {
-	return m.dialogMembers[dialogID], nil
+func (m *memRepo) GetChannel(ctx context.Context, dialogID uuid.UUID) (Channel, error) {
+	ch, ok := m.channels[dialogID]
+	if !ok {
+		return Channel{}, ErrDialogNotFound
+	}
+	ch.Title = m.titles[dialogID]
+	ch.SubscriberCount = int64(len(m.dialogMembers[dialogID]))
+	return ch, nil
 }
 
-func dummyFetcher(userID uuid.UUID) func(ctx context.Context, email string) (auth.User, error) {
-	return func(ctx context.Context, email string) (auth.User, error) {
-		return auth.User{ID: userID, Email: email, IsActive: true}, nil
+func (m *memRepo) GetChannelByUsername(ctx context.Context, username string) (Channel, error) {
+	for id, ch := range m.channels {
+		if ch.Username != nil && strings.EqualFold(*ch.Username, username) {
+			return m.GetChannel(ctx, id)
+		}
 	}
+	return Channel{}, ErrDialogNotFound
 }
 
-func TestCreateAndSendMessage(t *testing.T) {
-	repo := newMemRepo()
-	u1 := uuid.New()
-	u2 := uuid.New()
-	svc := NewService(repo, dummyFetcher(u2))
+func (m *memRepo) UserChannels(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for id := range m.channels {
+		if contains(m.dialogMembers[id], userID) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
 
-	dialogID, err := svc.CreateDirect(context.Background(), u1, u2.String())
-	if err != nil {
-		t.Fatalf("create direct: %v", err)
+func (m *memRepo) ListMessages(ctx context.Context, dialogID, userID uuid.UUID, limit int, before int64) ([]Message, error) {
+	return m.listMessages(ctx, dialogID, userID, 0)
+}
+
+func (m *memRepo) ListThread(ctx context.Context, dialogID, userID uuid.UUID, rootID int64, limit int, before int64) ([]Message, error) {
+	return m.listMessages(ctx, dialogID, userID, rootID)
+}
+
+func (m *memRepo) listMessages(ctx context.Context, dialogID, userID uuid.UUID, rootID int64) ([]Message, error) {
+	me := m.watermarks[[2]uuid.UUID{dialogID, userID}]
+	var peers watermark
+	for _, id := range m.dialogMembers[dialogID] {
+		st, _ := m.RequestState(ctx, dialogID, id)
+		if id == userID || st != RequestAccepted {
+			continue
+		}
+		wm := m.watermarks[[2]uuid.UUID{dialogID, id}]
+		peers.read = max(peers.read, wm.read)
+		peers.delivered = max(peers.delivered, wm.delivered)
 	}
-	msg, err := svc.SendMessage(context.Background(), u1, dialogID, "hello")
-	if err != nil {
-		t.Fatalf("send message: %v", err)
+	var msgs []Message
+	for _, msg := range m.messages[dialogID] {
+		if msg.ThreadRootID != nil && *msg.ThreadRootID != rootID || msg.ThreadRootID == nil && rootID != 0 {
+			continue
+		}
+		if !m.hidden[hiddenKey{userID, msg.ID}] && (msg.ExpiresAt == nil || msg.ExpiresAt.After(time.Now())) {
+			msg.Pinned = slices.Contains(m.pins[dialogID], msg.ID)
+			msg.DeliveredToMe, msg.ReadByMe = msg.ID <= me.delivered, msg.ID <= me.read
+			msg.DeliveredPeer, msg.ReadPeer = msg.ID <= peers.delivered, msg.ID <= peers.read
+			msgs = append(msgs, msg)
+		}
 	}
-	if msg.Text != "hello" || msg.SenderID != u1 {
-		t.Fatalf("unexpected message: %+v", msg)
+	return msgs, nil
+}
+
+func (m *memRepo) ThreadSummaries(ctx context.Context, userID uuid.UUID, rootIDs []int64) (map[int64]*Thread, error) {
+	res := make(map[int64]*Thread)
+	for _, msgs := range m.messages {
+		for i := len(msgs) - 1; i >= 0; i-- {
+			msg := msgs[i]
+			if msg.ThreadRootID == nil || msg.Deleted || !slices.Contains(rootIDs, *msg.ThreadRootID) || m.hidden[hiddenKey{userID, msg.ID}] {
+				continue
+			}
+			root := *msg.ThreadRootID
+			t := res[root]
+			if t == nil {
+				t = &Thread{LastReplyID: msg.ID, LastReadID: m.threadReads[threadReadKey{root, userID}]}
+				res[root] = t
+			}
+			t.ReplyCount++
+			if msg.ID > t.LastReadID && msg.SenderID != userID {
+				t.UnreadCount++
+			}
+			if len(t.RecentRepliers) < maxThreadRepliers && !slices.Contains(t.RecentRepliers, msg.SenderID) {
+				t.RecentRepliers = append(t.RecentRepliers, msg.SenderID)
+			}
+		}
 	}
-	msgs, err := svc.ListMessages(context.Background(), u1, dialogID, 10, 0)
-	if err != nil {
-		t.Fatalf("list messages: %v", err)
+	return res, nil
+}
+
+func (m *memRepo) MarkThreadRead(ctx context.Context, rootID int64, userID uuid.UUID, messageID int64) (bool, error) {
+	key := threadReadKey{rootID, userID}
+	if m.threadReads[key] >= messageID {
+		return false, nil
 	}
-	if len(msgs) != 1 {
-		t.Fatalf("expected 1 message, got %d", len(msgs))
+	for _, msgs := range m.messages {
+		for _, msg := range msgs {
+			if msg.ID == messageID && msg.ThreadRootID != nil && *msg.ThreadRootID == rootID {
+				m.threadReads[key] = messageID
+				for _, reply := range msgs {
+					if _, ok := m.mentions[hiddenKey{userID, reply.ID}]; ok && reply.ID <= messageID && reply.ThreadRootID != nil && *reply.ThreadRootID == rootID {
+						m.mentions[hiddenKey{userID, reply.ID}] = true
+					}
+				}
+				return true, nil
+			}
+		}
 	}
+	return false, nil
 }
 
-func TestAccessControl(t *testing.T) {
-	repo := newMemRepo()
-	u1 := uuid.New()
-	u2 := uuid.New()
-	svc := NewService(repo, dummyFetcher(u2))
-	dialogID, _ := svc.CreateDirect(context.Background(), u1, u2.String())
+func (m *memRepo) MembersByUsername(ctx context.Context, dialogID uuid.UUID, usernames []string) (map[string]uuid.UUID, error) {
+	res := make(map[string]uuid.UUID)
+	for _, id := range m.dialogMembers[dialogID] {
+		if name := strings.ToLower(m.usernames[id]); name != "" && slices.Contains(usernames, name) {
+			res[name] = id
+		}
+	}
+	return res, nil
+}
 
-	// stranger
-	if _, err := svc.SendMessage(context.Background(), uuid.New(), dialogID, "nope"); err != ErrForbidden {
-		t.Fatalf("expected forbidden, got %v", err)
+func (m *memRepo) MentionRecipients(ctx context.Context, dialogID uuid.UUID, userIDs []uuid.UUID) ([]uuid.UUID, error) {
+	var res []uuid.UUID
+	for _, id := range userIDs {
+		if ds, err := m.MemberSettings(ctx, dialogID, id); err == nil && (ds.MutedUntil == nil || ds.NotifyMentions) {
+			res = append(res, id)
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) NextMention(ctx context.Context, dialogID, userID uuid.UUID, after int64) (int64, error) {
+	for _, msg := range m.messages[dialogID] {
+		if read, ok := m.mentions[hiddenKey{userID, msg.ID}]; ok && !read && !msg.Deleted && !m.hidden[hiddenKey{userID, msg.ID}] && msg.ID > after {
+			return msg.ID, nil
+		}
+	}
+	return 0, ErrMessageNotFound
+}
+
+func (m *memRepo) hasMessage(dialogID uuid.UUID, messageID int64) bool {
+	return slices.ContainsFunc(m.messages[dialogID], func(msg Message) bool { return msg.ID == messageID })
+}
+
+func (m *memRepo) MarkDelivered(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) (bool, error) {
+	key := [2]uuid.UUID{dialogID, userID}
+	wm := m.watermarks[key]
+	if wm.delivered >= messageID || !m.hasMessage(dialogID, messageID) {
+		return false, nil
+	}
+	wm.delivered = messageID
+	m.watermarks[key] = wm
+	return true, nil
+}
+
+func (m *memRepo) MarkRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64) (bool, error) {
+	key := [2]uuid.UUID{dialogID, userID}
+	wm := m.watermarks[key]
+	if wm.read >= messageID || !m.hasMessage(dialogID, messageID) {
+		return false, nil
+	}
+	wm.read = messageID
+	wm.delivered = max(wm.delivered, messageID)
+	m.watermarks[key] = wm
+	for _, msg := range m.messages[dialogID] {
+		if _, ok := m.mentions[hiddenKey{userID, msg.ID}]; ok && msg.ID <= messageID && msg.ThreadRootID == nil {
+			m.mentions[hiddenKey{userID, msg.ID}] = true
+		}
+	}
+	return true, nil
+}
+
+func (m *memRepo) Members(ctx context.Context, dialogID uuid.UUID) ([]uuid.UUID, error) {
+	return m.dialogMembers[dialogID], nil
+}
+
+func (m *memRepo) DirectPeer(ctx context.Context, dialogID, userID uuid.UUID) (uuid.UUID, bool, error) {
+	members := m.dialogMembers[dialogID]
+	if m.kinds[dialogID] != "direct" || len(members) != 2 {
+		return uuid.Nil, false, nil
+	}
+	for _, id := range members {
+		if id != userID {
+			return id, true, nil
+		}
+	}
+	return uuid.Nil, false, nil
+}
+
+func (m *memRepo) CreateInvite(ctx context.Context, inv Invite) (Invite, error) {
+	inv.ID = uuid.New()
+	inv.CreatedAt = time.Now()
+	m.invites[inv.ID] = inv
+	return inv, nil
+}
+
+func (m *memRepo) ListInvites(ctx context.Context, dialogID uuid.UUID) ([]Invite, error) {
+	var res []Invite
+	for _, inv := range m.invites {
+		if inv.DialogID == dialogID {
+			res = append(res, inv)
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) GetInviteByCode(ctx context.Context, code string) (Invite, error) {
+	for _, inv := range m.invites {
+		if inv.Code == code {
+			return inv, nil
+		}
+	}
+	return Invite{}, ErrInviteInvalid
+}
+
+func (m *memRepo) GetInvitePreview(ctx context.Context, inviteID uuid.UUID) (InvitePreview, error) {
+	inv, ok := m.invites[inviteID]
+	if !ok {
+		return InvitePreview{}, ErrInviteInvalid
+	}
+	title := m.titles[inv.DialogID]
+	return InvitePreview{
+		DialogID:         inv.DialogID,
+		Kind:             m.kinds[inv.DialogID],
+		Title:            &title,
+		MemberCount:      int64(len(m.dialogMembers[inv.DialogID])),
+		RequiresApproval: inv.RequiresApproval,
+	}, nil
+}
+
+func (m *memRepo) RevokeInvite(ctx context.Context, dialogID, inviteID uuid.UUID) error {
+	inv, ok := m.invites[inviteID]
+	if !ok || inv.DialogID != dialogID {
+		return ErrInviteInvalid
+	}
+	now := time.Now()
+	inv.RevokedAt = &now
+	m.invites[inviteID] = inv
+	return nil
+}
+
+func (m *memRepo) JoinByInvite(ctx context.Context, inviteID, userID uuid.UUID) error {
+	inv, ok := m.invites[inviteID]
+	if !ok || !inv.Usable(time.Now()) {
+		return ErrInviteInvalid
+	}
+	if err := m.AddMember(ctx, inv.DialogID, userID, RoleMember); err != nil {
+		return err
+	}
+	inv.Uses++
+	m.invites[inviteID] = inv
+	return nil
+}
+
+func (m *memRepo) CreateJoinRequest(ctx context.Context, dialogID, userID, inviteID uuid.UUID) error {
+	key := [2]uuid.UUID{dialogID, userID}
+	if _, ok := m.joinRequests[key]; !ok {
+		m.joinRequests[key] = JoinRequest{UserID: userID, InviteID: &inviteID, CreatedAt: time.Now()}
+	}
+	return nil
+}
+
+func (m *memRepo) ListJoinRequests(ctx context.Context, dialogID uuid.UUID) ([]JoinRequest, error) {
+	var res []JoinRequest
+	for key, jr := range m.joinRequests {
+		if key[0] == dialogID {
+			res = append(res, jr)
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) DeleteJoinRequest(ctx context.Context, dialogID, userID uuid.UUID) error {
+	key := [2]uuid.UUID{dialogID, userID}
+	if _, ok := m.joinRequests[key]; !ok {
+		return ErrNoRequest
+	}
+	delete(m.joinRequests, key)
+	return nil
+}
+
+func (m *memRepo) GetMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) (Message, error) {
+	for _, msg := range m.messages[dialogID] {
+		if msg.ID == messageID {
+			return msg, nil
+		}
+	}
+	return Message{}, ErrMessageNotFound
+}
+
+func (m *memRepo) MessageByClientID(ctx context.Context, dialogID, senderID uuid.UUID, clientID string) (Message, error) {
+	for _, msg := range m.messages[dialogID] {
+		if msg.SenderID == senderID && msg.ClientMessageID == clientID {
+			return msg, nil
+		}
+	}
+	return Message{}, ErrMessageNotFound
+}
+
+func (m *memRepo) EditMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, text string, mentions []Mention) (time.Time, error) {
+	now := time.Now()
+	for i, msg := range m.messages[dialogID] {
+		if msg.ID == messageID && !msg.Deleted {
+			m.messages[dialogID][i].Text = text
+			m.messages[dialogID][i].Mentions = mentions
+			m.messages[dialogID][i].EditedAt = &now
+			return now, nil
+		}
+	}
+	return time.Time{}, ErrMessageNotFound
+}
+
+func (m *memRepo) DeleteMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) error {
+	for i, msg := range m.messages[dialogID] {
+		if msg.ID == messageID && !msg.Deleted {
+			m.messages[dialogID][i].Text = ""
+			m.messages[dialogID][i].Deleted = true
+			_, _ = m.UnpinMessage(ctx, dialogID, messageID)
+			return nil
+		}
+	}
+	return ErrMessageNotFound
+}
+
+func (m *memRepo) HideMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, userID uuid.UUID) error {
+	m.hidden[hiddenKey{userID, messageID}] = true
+	return nil
+}
+
+func (m *memRepo) AddReaction(ctx context.Context, messageID int64, userID uuid.UUID, reaction string, limit int) (bool, error) {
+	mine := 0
+	for _, r := range m.reactions[messageID] {
+		if r.userID == userID {
+			if r.reaction == reaction {
+				return true, nil
+			}
+			mine++
+		}
+	}
+	if mine >= limit {
+		return false, nil
+	}
+	m.reactions[messageID] = append(m.reactions[messageID], memReaction{userID, reaction})
+	return true, nil
+}
+
+func (m *memRepo) RemoveReaction(ctx context.Context, messageID int64, userID uuid.UUID, reaction string) error {
+	m.reactions[messageID] = slices.DeleteFunc(m.reactions[messageID], func(r memReaction) bool {
+		return r.userID == userID && r.reaction == reaction
+	})
+	return nil
+}
+
+func (m *memRepo) MessageReactions(ctx context.Context, userID uuid.UUID, messageIDs []int64) (map[int64][]Reaction, error) {
+	res := make(map[int64][]Reaction)
+	for _, id := range messageIDs {
+		for _, r := range m.reactions[id] {
+			i := slices.IndexFunc(res[id], func(a Reaction) bool { return a.Reaction == r.reaction })
+			if i < 0 {
+				res[id] = append(res[id], Reaction{Reaction: r.reaction})
+				i = len(res[id]) - 1
+			}
+			res[id][i].Count++
+			res[id][i].Mine = res[id][i].Mine || r.userID == userID
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) AllowedReactions(ctx context.Context, dialogID uuid.UUID) ([]string, error) {
+	return m.allowed[dialogID], nil
+}
+
+func (m *memRepo) PinMessage(ctx context.Context, dialogID uuid.UUID, messageID int64, userID uuid.UUID) (bool, error) {
+	if slices.Contains(m.pins[dialogID], messageID) {
+		return false, nil
+	}
+	m.pins[dialogID] = append(m.pins[dialogID], messageID)
+	return true, nil
+}
+
+func (m *memRepo) UnpinMessage(ctx context.Context, dialogID uuid.UUID, messageID int64) (bool, error) {
+	i := slices.Index(m.pins[dialogID], messageID)
+	if i < 0 {
+		return false, nil
+	}
+	m.pins[dialogID] = slices.Delete(m.pins[dialogID], i, i+1)
+	return true, nil
+}
+
+func (m *memRepo) PinnedMessages(ctx context.Context, dialogID uuid.UUID) ([]Message, error) {
+	var res []Message
+	for _, id := range slices.Backward(m.pins[dialogID]) {
+		msg, err := m.GetMessage(ctx, dialogID, id)
+		if err != nil {
+			return nil, err
+		}
+		msg.Pinned = true
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (m *memRepo) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func (m *memRepo) AppendUpdate(ctx context.Context, userIDs []uuid.UUID, u Update) error {
+	if m.appendErr != nil {
+		return m.appendErr
+	}
+	for _, id := range userIDs {
+		m.pts[id]++
+		u.Pts = m.pts[id]
+		u.CreatedAt = time.Now()
+		m.updates[id] = append(m.updates[id], u)
+	}
+	return nil
+}
+
+func (m *memRepo) Updates(ctx context.Context, userID uuid.UUID, since int64, limit int) ([]Update, error) {
+	var res []Update
+	for _, u := range m.updates[userID] {
+		if u.Pts > since && len(res) < limit {
+			res = append(res, u)
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) UpdateState(ctx context.Context, userID uuid.UUID) (int64, int64, error) {
+	list := m.updates[userID]
+	if len(list) == 0 {
+		return m.pts[userID], 0, nil
+	}
+	return m.pts[userID], list[0].Pts, nil
+}
+
+func (m *memRepo) PruneUpdates(ctx context.Context, before time.Time, limit int) (int, error) {
+	n := 0
+	for id, list := range m.updates {
+		kept := list[:0]
+		for _, u := range list {
+			if u.CreatedAt.Before(before) && n < limit {
+				n++
+				continue
+			}
+			kept = append(kept, u)
+		}
+		m.updates[id] = kept
+	}
+	return n, nil
+}
+
+func (m *memRepo) MessagesByID(ctx context.Context, userID uuid.UUID, messageIDs []int64) ([]Message, error) {
+	var res []Message
+	for dialogID, msgs := range m.messages {
+		if !contains(m.dialogMembers[dialogID], userID) {
+			continue
+		}
+		for _, msg := range msgs {
+			if slices.Contains(messageIDs, msg.ID) && !m.hidden[hiddenKey{userID, msg.ID}] {
+				res = append(res, msg)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) SetAllowedReactions(ctx context.Context, dialogID uuid.UUID, allowed []string) error {
+	if allowed == nil {
+		delete(m.allowed, dialogID)
+		return nil
+	}
+	m.allowed[dialogID] = allowed
+	return nil
+}
+
+func dummyFetcher(userID uuid.UUID) func(ctx context.Context, email string) (auth.User, error) {
+	return func(ctx context.Context, email string) (auth.User, error) {
+		return auth.User{ID: userID, Email: email, IsActive: true}, nil
+	}
+}
+
+func TestCreateAndSendMessage(t *testing.T) {
+	repo := newMemRepo()
+	u1 := uuid.New()
+	u2 := uuid.New()
+	svc := NewService(repo, dummyFetcher(u2))
+
+	dialogID, err := svc.CreateDirect(context.Background(), u1, u2.String())
+	if err != nil {
+		t.Fatalf("create direct: %v", err)
+	}
+	msg, err := svc.SendMessage(context.Background(), u1, dialogID, "hello")
+	if err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	if msg.Text != "hello" || msg.SenderID != u1 {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	msgs, err := svc.ListMessages(context.Background(), u1, dialogID, 10, 0)
+	if err != nil {
+		t.Fatalf("list messages: %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+}
+
+func TestCreateDirectByUsername(t *testing.T) {
+	repo := newMemRepo()
+	u1 := uuid.New()
+	u2 := uuid.New()
+	svc := NewService(repo, dummyFetcher(uuid.Nil))
+	svc.SetUsernameFetcher(func(ctx context.Context, username string) (auth.User, error) {
+		if username != "bob_smith" {
+			return auth.User{}, auth.ErrUserNotFound
+		}
+		return auth.User{ID: u2, IsActive: true}, nil
+	})
+
+	dialogID, err := svc.CreateDirect(context.Background(), u1, "@bob_smith")
+	if err != nil {
+		t.Fatalf("create direct by username: %v", err)
+	}
+	again, err := svc.CreateDirect(context.Background(), u1, "bob_smith")
+	if err != nil || again != dialogID {
+		t.Fatalf("expected same dialog, got %v %v", again, err)
+	}
+	if _, err := svc.CreateDirect(context.Background(), u1, "@nobody_here"); err == nil {
+		t.Fatalf("expected unknown username to fail")
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	repo := newMemRepo()
+	u1 := uuid.New()
+	u2 := uuid.New()
+	svc := NewService(repo, dummyFetcher(u2))
+	dialogID, _ := svc.CreateDirect(context.Background(), u1, u2.String())
+
+	// stranger
+	if _, err := svc.SendMessage(context.Background(), uuid.New(), dialogID, "nope"); err != ErrForbidden {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+}
+
+type stubPrivacy struct {
+	blocked  map[uuid.UUID]bool
+	findable map[uuid.UUID]bool
+	contacts map[uuid.UUID]bool
+	noGroups map[uuid.UUID]bool
+	noLinks  map[uuid.UUID]bool
+}
+
+func (p stubPrivacy) CanMessage(ctx context.Context, from, to uuid.UUID) (bool, error) {
+	return !p.blocked[to], nil
+}
+
+func (p stubPrivacy) FindableByEmail(ctx context.Context, userID uuid.UUID) (bool, error) {
+	return p.findable[userID], nil
+}
+
+func (p stubPrivacy) CanAddToGroup(ctx context.Context, actor, target uuid.UUID) (bool, error) {
+	return !p.noGroups[target], nil
+}
+
+func (p stubPrivacy) IsContact(ctx context.Context, owner, other uuid.UUID) (bool, error) {
+	return p.contacts[other], nil
+}
+
+func (p stubPrivacy) BlockedAmong(ctx context.Context, userID uuid.UUID, others []uuid.UUID) ([]uuid.UUID, error) {
+	var res []uuid.UUID
+	for _, o := range others {
+		if p.blocked[o] {
+			res = append(res, o)
+		}
+	}
+	return res, nil
+}
+
+func (p stubPrivacy) ForwardAttribution(ctx context.Context, userID uuid.UUID) (string, bool, error) {
+	return "user " + userID.String()[:8], !p.noLinks[userID], nil
+}
+
+func TestPrivacyEnforcement(t *testing.T) {
+	repo := newMemRepo()
+	u1 := uuid.New()
+	u2 := uuid.New()
+	policy := stubPrivacy{blocked: map[uuid.UUID]bool{}, findable: map[uuid.UUID]bool{}, contacts: map[uuid.UUID]bool{}}
+	svc := NewService(repo, dummyFetcher(u2))
+	svc.SetPrivacy(policy)
+	ctx := context.Background()
+
+	// email lookup is opt-in and indistinguishable from a missing account
+	if _, err := svc.CreateDirect(ctx, u1, "bob@example.com"); err != ErrPeerUnavailable {
+		t.Fatalf("expected hidden email, got %v", err)
+	}
+	policy.findable[u2] = true
+	dialogID, err := svc.CreateDirect(ctx, u1, "bob@example.com")
+	if err != nil {
+		t.Fatalf("create by email: %v", err)
+	}
+	if _, err := svc.SendMessage(ctx, u1, dialogID, "hi"); err != nil {
+		t.Fatalf("send allowed: %v", err)
+	}
+
+	policy.blocked[u2] = true
+	if _, err := svc.SendMessage(ctx, u1, dialogID, "again"); err != ErrForbidden {
+		t.Fatalf("expected forbidden, got %v", err)
+	}
+	if _, err := svc.CreateDirect(ctx, u1, u2.String()); err != ErrPeerUnavailable {
+		t.Fatalf("expected peer unavailable, got %v", err)
+	}
+	// the restricted side can still write
+	if _, err := svc.SendMessage(ctx, u2, dialogID, "reply"); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+}
+
+// SearchMessages matches every query word as a case-insensitive substring and
+// marks the matches like ts_headline does, over the whole text.
+func (m *memRepo) SearchMessages(ctx context.Context, userID uuid.UUID, q SearchQuery) ([]SearchHit, error) {
+	words := strings.Fields(strings.ToLower(q.Text))
+	var hits []SearchHit
+	for id, members := range m.dialogMembers {
+		if encrypted, _ := m.DialogEncrypted(ctx, id); encrypted || !contains(members, userID) ||
+			(q.DialogID != nil && *q.DialogID != id) {
+			continue
+		}
+		for _, msg := range m.messages[id] {
+			if msg.Deleted || (msg.Kind != "text" && msg.Kind != "poll") || m.hidden[hiddenKey{userID, msg.ID}] ||
+				(q.SenderID != nil && *q.SenderID != msg.SenderID) || (q.Before != 0 && msg.ID >= q.Before) ||
+				(q.From != nil && msg.CreatedAt.Before(*q.From)) || (q.To != nil && !msg.CreatedAt.Before(*q.To)) {
+				continue
+			}
+			snippet, lower := msg.Text, strings.ToLower(msg.Text)
+			if !slices.ContainsFunc(words, func(w string) bool { return strings.Contains(lower, w) }) {
+				continue
+			}
+			for _, w := range words {
+				i := strings.Index(strings.ToLower(snippet), w)
+				if i < 0 {
+					continue
+				}
+				snippet = snippet[:i] + string(snippetMatchStart) + snippet[i:i+len(w)] + string(snippetMatchStop) + snippet[i+len(w):]
+			}
+			hits = append(hits, SearchHit{DialogID: id, MessageID: msg.ID, SenderID: msg.SenderID, ThreadRootID: msg.ThreadRootID, CreatedAt: msg.CreatedAt, Snippet: snippet})
+		}
+	}
+	slices.SortFunc(hits, func(a, b SearchHit) int { return cmp.Compare(b.MessageID, a.MessageID) })
+	if len(hits) > q.Limit {
+		hits = hits[:q.Limit]
+	}
+	return hits, nil
+}
+
+type recordingPublisher struct {
+	typing        int
+	sent          map[uuid.UUID][]string
+	channelPosts  int
+	subscriptions map[uuid.UUID]bool
+	polls         []PollEvent
+}
+
+func (p *recordingPublisher) record(kind string, members []uuid.UUID) {
+	if p.sent == nil {
+		p.sent = make(map[uuid.UUID][]string)
+	}
+	for _, m := range members {
+		p.sent[m] = append(p.sent[m], kind)
+	}
+}
+
+func (p *recordingPublisher) PublishMessage(ctx context.Context, msg Message, members []uuid.UUID) error {
+	var to []uuid.UUID
+	for _, m := range members {
+		if m != msg.SenderID {
+			to = append(to, m)
+		}
+	}
+	p.record("message.new", to)
+	return nil
+}
+
+func (p *recordingPublisher) PublishSavedMessage(ctx context.Context, msg Message) error {
+	p.record("message.new", []uuid.UUID{msg.SenderID})
+	return nil
+}
+
+func (p *recordingPublisher) PublishDelivery(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64, members []uuid.UUID) error {
+	p.record("message.delivered", members)
+	return nil
+}
+
+func (p *recordingPublisher) PublishRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64, members []uuid.UUID) error {
+	p.record("message.read", members)
+	return nil
+}
+
+func (p *recordingPublisher) PublishTyping(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, members []uuid.UUID) error {
+	p.typing++
+	return nil
+}
+
+func (p *recordingPublisher) PublishChannelMessage(ctx context.Context, msg Message) error {
+	p.channelPosts++
+	return nil
+}
+
+func (p *recordingPublisher) PublishPoll(ctx context.Context, ev PollEvent, members []uuid.UUID) error {
+	p.record(EventPollUpdated, members)
+	p.polls = append(p.polls, ev)
+	return nil
+}
+
+func (p *recordingPublisher) PublishDraft(ctx context.Context, userID uuid.UUID, d Draft) error {
+	p.record(EventDraftUpdated, []uuid.UUID{userID})
+	return nil
+}
+
+func (p *recordingPublisher) PublishMention(ctx context.Context, msg Message, recipients []uuid.UUID) error {
+	p.record(EventMentionNew, recipients)
+	return nil
+}
+
+func (p *recordingPublisher) PublishSubscription(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, subscribed bool) error {
+	if p.subscriptions == nil {
+		p.subscriptions = make(map[uuid.UUID]bool)
+	}
+	p.subscriptions[userID] = subscribed
+	return nil
+}
+
+func (p *recordingPublisher) PublishMessageEvent(ctx context.Context, ev MessageEvent, members []uuid.UUID) error {
+	p.record(ev.Type, members)
+	return nil
+}
+
+func (p *recordingPublisher) PublishChannelEvent(ctx context.Context, ev MessageEvent) error {
+	p.channelPosts++
+	return nil
+}
+
+func (p *recordingPublisher) PublishReaction(ctx context.Context, ev ReactionEvent, members []uuid.UUID) error {
+	if members == nil {
+		p.channelPosts++
+		return nil
+	}
+	p.record(EventReactionUpdated, members)
+	return nil
+}
+
+func (p *recordingPublisher) PublishMember(ctx context.Context, dialogID uuid.UUID, ev MemberEvent, members []uuid.UUID) error {
+	p.record(ev.Type, members)
+	return nil
+}
+
+func TestTypingHiddenWhenBlocked(t *testing.T) {
+	repo := newMemRepo()
+	u1 := uuid.New()
+	u2 := uuid.New()
+	policy := stubPrivacy{blocked: map[uuid.UUID]bool{}, findable: map[uuid.UUID]bool{}, contacts: map[uuid.UUID]bool{}}
+	pub := &recordingPublisher{}
+	svc := NewService(repo, dummyFetcher(u2))
+	svc.SetPrivacy(policy)
+	svc.SetPublisher(pub)
+	ctx := context.Background()
+	policy.contacts[u1] = true
+	dialogID, err := svc.CreateDirect(ctx, u1, u2.String())
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if err := svc.Typing(ctx, u1, dialogID); err != nil || pub.typing != 1 {
+		t.Fatalf("typing: %v (%d events)", err, pub.typing)
+	}
+	policy.blocked[u2] = true
+	if err := svc.Typing(ctx, u1, dialogID); err != nil || pub.typing != 1 {
+		t.Fatalf("blocked typing must be silent: %v (%d events)", err, pub.typing)
+	}
+	if err := svc.Typing(ctx, uuid.New(), dialogID); err != ErrForbidden {
+		t.Fatalf("expected forbidden for stranger, got %v", err)
+	}
+}
+
+func TestMessageRequests(t *testing.T) {
+	repo := newMemRepo()
+	sender := uuid.New()
+	recipient := uuid.New()
+	policy := stubPrivacy{blocked: map[uuid.UUID]bool{}, findable: map[uuid.UUID]bool{}, contacts: map[uuid.UUID]bool{}}
+	pub := &recordingPublisher{}
+	svc := NewService(repo, dummyFetcher(recipient))
+	svc.SetPrivacy(policy)
+	svc.SetPublisher(pub)
+	ctx := context.Background()
+
+	dialogID, err := svc.CreateDirect(ctx, sender, recipient.String())
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	msg, err := svc.SendMessage(ctx, sender, dialogID, "hello stranger")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	inbox, _ := svc.ListDialogs(ctx, recipient, FolderInbox, DialogFilter{}, 50)
+	requests, _ := svc.ListDialogs(ctx, recipient, FolderRequests, DialogFilter{}, 50)
+	if len(inbox) != 0 || len(requests) != 1 {
+		t.Fatalf("expected request folder, inbox=%d requests=%d", len(inbox), len(requests))
+	}
+	if own, _ := svc.ListDialogs(ctx, sender, FolderInbox, DialogFilter{}, 50); len(own) != 1 {
+		t.Fatalf("sender should see dialog in inbox")
+	}
+	if _, err := svc.ListDialogs(ctx, sender, "spam", DialogFilter{}, 50); err != ErrInvalidFolder {
+		t.Fatalf("expected invalid folder, got %v", err)
+	}
+
+	// receipts and typing from the recipient never reach the sender
+	_ = svc.MarkDelivered(ctx, recipient, dialogID, msg.ID)
+	_ = svc.MarkRead(ctx, recipient, dialogID, msg.ID)
+	_ = svc.Typing(ctx, recipient, dialogID)
+	if got := pub.sent[sender]; len(got) != 0 {
+		t.Fatalf("sender received events while request pending: %v", got)
+	}
+
+	if err := svc.DeclineRequest(ctx, recipient, dialogID); err != nil {
+		t.Fatalf("decline: %v", err)
+	}
+	before := len(pub.sent[recipient])
+	again, err := svc.SendMessage(ctx, sender, dialogID, "still there?")
+	if err != nil {
+		t.Fatalf("sender must not learn about decline: %v", err)
+	}
+	if len(pub.sent[recipient]) != before {
+		t.Fatalf("declined recipient still receives events")
+	}
+	if requests, _ := svc.ListDialogs(ctx, recipient, FolderRequests, DialogFilter{}, 50); len(requests) != 0 {
+		t.Fatalf("declined request still listed")
+	}
+
+	if err := svc.AcceptRequest(ctx, recipient, dialogID); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	if err := svc.AcceptRequest(ctx, recipient, dialogID); err != ErrNoRequest {
+		t.Fatalf("expected no request, got %v", err)
+	}
+	_ = svc.MarkRead(ctx, recipient, dialogID, again.ID)
+	if got := pub.sent[sender]; len(got) != 1 || got[0] != "message.read" {
+		t.Fatalf("accepted request should expose receipts: %v", got)
+	}
+	if err := svc.DeclineRequest(ctx, uuid.New(), dialogID); err != ErrForbidden {
+		t.Fatalf("expected forbidden for stranger, got %v", err)
+	}
+	if err := svc.BlockRequest(ctx, recipient, dialogID); err != ErrNoRequest {
+		t.Fatalf("accepted dialog is not a request, got %v", err)
+	}
+}
+
+func TestRequestReplyAcceptsAndBlock(t *testing.T) {
+	repo := newMemRepo()
+	sender := uuid.New()
+	recipient := uuid.New()
+	policy := stubPrivacy{blocked: map[uuid.UUID]bool{}, findable: map[uuid.UUID]bool{}, contacts: map[uuid.UUID]bool{}}
+	var blocked [2]uuid.UUID
+	svc := NewService(repo, dummyFetcher(recipient))
+	svc.SetPrivacy(policy)
+	svc.SetBlocker(func(ctx context.Context, owner, target uuid.UUID) error {
+		blocked = [2]uuid.UUID{owner, target}
+		return nil
+	})
+	ctx := context.Background()
+
+	first, _ := svc.CreateDirect(ctx, sender, recipient.String())
+	// a reply that is not sent accepts nothing
+	missing := int64(999)
+	if _, err := svc.Send(ctx, recipient, first, OutgoingMessage{Text: "hi back", ReplyTo: &missing}); err != ErrInvalidReply {
+		t.Fatalf("expected invalid reply, got %v", err)
+	}
+	if state, _ := repo.RequestState(ctx, first, recipient); state != RequestPending {
+		t.Fatalf("failed reply accepted the request: %s", state)
+	}
+	if _, err := svc.SendMessage(ctx, recipient, first, "hi back"); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	if inbox, _ := svc.ListDialogs(ctx, recipient, FolderInbox, DialogFilter{}, 50); len(inbox) != 1 {
+		t.Fatalf("reply should accept the request")
+	}
+
+	other := uuid.New()
+	second, _ := svc.CreateDirect(ctx, other, recipient.String())
+	if err := svc.BlockRequest(ctx, recipient, second); err != nil {
+		t.Fatalf("block request: %v", err)
+	}
+	if blocked != [2]uuid.UUID{recipient, other} {
+		t.Fatalf("blocker called with %v", blocked)
+	}
+	if requests, _ := svc.ListDialogs(ctx, recipient, FolderRequests, DialogFilter{}, 50); len(requests) != 0 {
+		t.Fatalf("blocked request still listed")
+	}
+}
+
+func TestGroupRoles(t *testing.T) {
+	repo := newMemRepo()
+	owner, admin, mod, member, outsider := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	policy := stubPrivacy{noGroups: map[uuid.UUID]bool{outsider: true}}
+	pub := &recordingPublisher{}
+	svc := NewService(repo, dummyFetcher(uuid.Nil))
+	svc.SetPrivacy(policy)
+	svc.SetPublisher(pub)
+	ctx := context.Background()
+
+	if _, _, err := svc.CreateGroup(ctx, owner, "   ", nil, true); err != ErrInvalidTitle {
+		t.Fatalf("expected invalid title, got %v", err)
+	}
+	groupID, skipped, err := svc.CreateGroup(ctx, owner, "Команда", []uuid.UUID{admin, mod, member, outsider, owner}, true)
+	if err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if skipped != 1 {
+		t.Fatalf("expected one user skipped, got %d", skipped)
+	}
+	if err := svc.SetMemberRole(ctx, owner, groupID, admin, RoleAdmin); err != nil {
+		t.Fatalf("promote admin: %v", err)
+	}
+	if err := svc.SetMemberRole(ctx, admin, groupID, mod, RoleModerator); err != nil {
+		t.Fatalf("promote moderator: %v", err)
+	}
+	if err := svc.SetMemberRole(ctx, admin, groupID, member, RoleAdmin); err != ErrForbidden {
+		t.Fatalf("admin must not create admins, got %v", err)
+	}
+	if err := svc.SetMemberRole(ctx, admin, groupID, member, "root"); err != ErrInvalidRole {
+		t.Fatalf("expected invalid role, got %v", err)
+	}
+
+	// moderators remove members but not admins, members cannot add
+	if err := svc.RemoveMember(ctx, mod, groupID, admin); err != ErrForbidden {
+		t.Fatalf("moderator removed admin: %v", err)
+	}
+	if err := svc.AddMember(ctx, member, groupID, uuid.New()); err != ErrForbidden {
+		t.Fatalf("member added user: %v", err)
+	}
+	if err := svc.AddMember(ctx, admin, groupID, outsider); err != ErrCannotAdd {
+		t.Fatalf("expected privacy refusal, got %v", err)
+	}
+	if err := svc.SetTitle(ctx, mod, groupID, "Новое"); err != ErrForbidden {
+		t.Fatalf("moderator renamed group: %v", err)
+	}
+	if err := svc.SetTitle(ctx, admin, groupID, "Новое"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := svc.RemoveMember(ctx, mod, groupID, member); err != nil {
+		t.Fatalf("moderator remove member: %v", err)
+	}
+	if got := pub.sent[member]; len(got) == 0 || got[len(got)-1] != EventMemberRemoved {
+		t.Fatalf("removed member not notified: %v", got)
+	}
+	if _, err := svc.SendMessage(ctx, member, groupID, "still here?"); err != ErrForbidden {
+		t.Fatalf("removed member can still write: %v", err)
+	}
+	if err := svc.AddMember(ctx, admin, groupID, mod); err != ErrAlreadyMember {
+		t.Fatalf("expected already member, got %v", err)
+	}
+
+	// owner leaving hands over to the admin
+	if err := svc.LeaveGroup(ctx, owner, groupID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	if role, _ := repo.MemberRole(ctx, groupID, admin); role != RoleOwner {
+		t.Fatalf("expected admin to inherit ownership, got %q", role)
+	}
+
+	var system int
+	for _, m := range repo.messages[groupID] {
+		if m.Kind == "system" {
+			system++
+		}
+	}
+	// created, 2 promotions, title, removal, ownership transfer, leave
+	if system != 7 {
+		t.Fatalf("expected 7 system messages, got %d", system)
+	}
+}
+
+func TestOwnershipTransfer(t *testing.T) {
+	repo := newMemRepo()
+	owner, other := uuid.New(), uuid.New()
+	svc := NewService(repo, dummyFetcher(uuid.Nil))
+	ctx := context.Background()
+	groupID, _, err := svc.CreateGroup(ctx, owner, "g", []uuid.UUID{other}, true)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := svc.SetMemberRole(ctx, owner, groupID, other, RoleOwner); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if role, _ := repo.MemberRole(ctx, groupID, owner); role != RoleAdmin {
+		t.Fatalf("previous owner should become admin, got %q", role)
+	}
+	if err := svc.RemoveMember(ctx, owner, groupID, other); err != ErrForbidden {
+		t.Fatalf("admin removed owner: %v", err)
+	}
+	dialogID, _ := svc.CreateDirect(ctx, owner, other.String())
+	if err := svc.AddMember(ctx, owner, dialogID, uuid.New()); err != ErrNotGroup {
+		t.Fatalf("expected not a group, got %v", err)
+	}
+}
+
+// countingRepo fails the test if channel delivery enumerates subscribers.
+type countingRepo struct {
+	*memRepo
+	membersCalls int
+}
+
+func (c *countingRepo) Members(ctx context.Context, dialogID uuid.UUID) ([]uuid.UUID, error) {
+	c.membersCalls++
+	return c.memRepo.Members(ctx, dialogID)
+}
+
+func TestChannels(t *testing.T) {
+	repo := &countingRepo{memRepo: newMemRepo()}
+	owner, admin, reader := uuid.New(), uuid.New(), uuid.New()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, dummyFetcher(uuid.Nil))
+	svc.SetPublisher(pub)
+	ctx := context.Background()
+
+	if _, err := svc.CreateChannel(ctx, owner, "Новости", "admin_news", ""); err != ErrInvalidChannel {
+		t.Fatalf("expected reserved username rejection, got %v", err)
+	}
+	if _, err := svc.CreateChannel(ctx, owner, "Новости", "@stu_fans_club", ""); err != ErrInvalidChannel {
+		t.Fatalf("stu_ prefix must be reserved, got %v", err)
+	}
+	ch, err := svc.CreateChannel(ctx, owner, "Новости", "@daily_news", "Главное за день")
+	if err != nil {
+		t.Fatalf("create channel: %v", err)
+	}
+	if _, err := svc.CreateChannel(ctx, admin, "Копия", "Daily_News", ""); err != ErrChannelTaken {
+		t.Fatalf("expected taken, got %v", err)
+	}
+
+	found, err := svc.ChannelByUsername(ctx, "@DAILY_NEWS")
+	if err != nil || found.ID != ch.ID {
+		t.Fatalf("lookup by username: %+v %v", found, err)
+	}
+	if _, err := svc.JoinChannel(ctx, admin, ch.ID); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	joined, err := svc.JoinChannel(ctx, reader, ch.ID)
+	if err != nil || joined.SubscriberCount != 3 {
+		t.Fatalf("join: %+v %v", joined, err)
+	}
+	if !pub.subscriptions[reader] {
+		t.Fatalf("realtime not told about subscription")
+	}
+	if err := svc.SetMemberRole(ctx, owner, ch.ID, admin, RoleAdmin); err != nil {
+		t.Fatalf("promote: %v", err)
+	}
+
+	if _, err := svc.SendMessage(ctx, reader, ch.ID, "можно мне?"); err != ErrForbidden {
+		t.Fatalf("subscriber posted: %v", err)
+	}
+	repo.membersCalls = 0
+	posts := pub.channelPosts
+	if _, err := svc.SendMessage(ctx, admin, ch.ID, "пост"); err != nil {
+		t.Fatalf("admin post: %v", err)
+	}
+	if pub.channelPosts != posts+1 {
+		t.Fatalf("post was not published to the channel")
+	}
+	if repo.membersCalls != 0 {
+		t.Fatalf("channel delivery enumerated subscribers %d times", repo.membersCalls)
+	}
+	if _, err := svc.GroupMembers(ctx, reader, ch.ID); err != ErrForbidden {
+		t.Fatalf("subscriber listed members: %v", err)
+	}
+	if err := svc.LeaveGroup(ctx, reader, ch.ID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	if pub.subscriptions[reader] {
+		t.Fatalf("realtime not told about unsubscription")
+	}
+	if info, _ := svc.Channel(ctx, reader, ch.ID); info.SubscriberCount != 2 {
+		t.Fatalf("expected 2 subscribers, got %d", info.SubscriberCount)
+	}
+
+	private, err := svc.CreateChannel(ctx, owner, "Закрытый", "", "")
+	if err != nil {
+		t.Fatalf("create private: %v", err)
+	}
+	if _, err := svc.JoinChannel(ctx, reader, private.ID); err != ErrDialogNotFound {
+		t.Fatalf("joined private channel: %v", err)
+	}
+	if _, err := svc.Channel(ctx, reader, private.ID); err != ErrDialogNotFound {
+		t.Fatalf("private channel visible: %v", err)
+	}
+
+	history := len(repo.messages[ch.ID])
+	if err := svc.SetMemberRole(ctx, owner, ch.ID, admin, RoleOwner); err != nil {
+		t.Fatalf("transfer ownership: %v", err)
+	}
+	if len(repo.messages[ch.ID]) != history {
+		t.Fatalf("role change posted into the channel feed")
+	}
+}
+
+func TestChannelOwnerLeaves(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	svc := NewService(repo, dummyFetcher(uuid.Nil))
+	owner, reader, admin := uuid.New(), uuid.New(), uuid.New()
+	ch, err := svc.CreateChannel(ctx, owner, "Новости", "@owner_news", "")
+	if err != nil {
+		t.Fatalf("create channel: %v", err)
+	}
+	for _, id := range []uuid.UUID{reader, admin} {
+		if _, err := svc.JoinChannel(ctx, id, ch.ID); err != nil {
+			t.Fatalf("join: %v", err)
+		}
+	}
+
+	// a subscriber never inherits the right to post to everyone
+	if err := svc.LeaveGroup(ctx, owner, ch.ID); err != ErrOwnerMustTransfer {
+		t.Fatalf("expected the leave refused, got %v", err)
+	}
+	if role, _ := repo.MemberRole(ctx, ch.ID, owner); role != RoleOwner {
+		t.Fatalf("owner lost the channel: %s", role)
+	}
+	if err := svc.SetMemberRole(ctx, owner, ch.ID, admin, RoleAdmin); err != nil {
+		t.Fatalf("promote: %v", err)
+	}
+	if err := svc.LeaveGroup(ctx, owner, ch.ID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	if role, _ := repo.MemberRole(ctx, ch.ID, admin); role != RoleOwner {
+		t.Fatalf("expected the admin to inherit, got %s", role)
+	}
+	if role, _ := repo.MemberRole(ctx, ch.ID, reader); role != RoleMember {
+		t.Fatalf("subscriber's role changed to %s", role)
+	}
+}
+
+func TestInviteLinks(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, member, alice, bob := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+
+	groupID, _, err := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{member}, true)
+	if err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if _, err := svc.CreateInvite(ctx, member, groupID, InviteOptions{}); err != ErrForbidden {
+		t.Fatalf("member must not create invites, got %v", err)
+	}
+	zero := 0
+	if _, err := svc.CreateInvite(ctx, owner, groupID, InviteOptions{MaxUses: &zero}); err != ErrInvalidInvite {
+		t.Fatalf("expected invalid invite for max_uses=0, got %v", err)
+	}
+
+	one := 1
+	inv, err := svc.CreateInvite(ctx, owner, groupID, InviteOptions{MaxUses: &one})
+	if err != nil {
+		t.Fatalf("create invite: %v", err)
+	}
+	if len(inv.Code) < 20 {
+		t.Fatalf("invite code too short: %q", inv.Code)
+	}
+	preview, err := svc.PreviewInvite(ctx, inv.Code)
+	if err != nil || preview.DialogID != groupID || preview.MemberCount != 2 {
+		t.Fatalf("unexpected preview %+v, %v", preview, err)
+	}
+	for range 3 {
+		if _, err := svc.SendMessage(ctx, owner, groupID, "before alice"); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	res, err := svc.JoinByInvite(ctx, alice, inv.Code)
+	if err != nil || res.Status != JoinJoined {
+		t.Fatalf("join: %+v, %v", res, err)
+	}
+	// the history before joining is not unread
+	if list, _ := svc.ListDialogs(ctx, alice, "", DialogFilter{}, 0); len(list) != 1 || list[0].UnreadCount != 0 {
+		t.Fatalf("newcomer's unread: %+v", list)
+	}
+	if !contains(repo.dialogMembers[groupID], alice) {
+		t.Fatalf("alice must be a member")
+	}
+	if !slices.Contains(pub.sent[member], EventMemberJoined) {
+		t.Fatalf("members must get %s, got %v", EventMemberJoined, pub.sent[member])
+	}
+	if _, err := svc.JoinByInvite(ctx, bob, inv.Code); err != ErrInviteInvalid {
+		t.Fatalf("exhausted invite must be invalid, got %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	expired, _ := svc.CreateInvite(ctx, owner, groupID, InviteOptions{})
+	expired.ExpiresAt = &past
+	repo.invites[expired.ID] = expired
+	if _, err := svc.JoinByInvite(ctx, bob, expired.Code); err != ErrInviteInvalid {
+		t.Fatalf("expired invite must be invalid, got %v", err)
+	}
+
+	revoked, _ := svc.CreateInvite(ctx, owner, groupID, InviteOptions{})
+	if err := svc.RevokeInvite(ctx, owner, groupID, revoked.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := svc.PreviewInvite(ctx, revoked.Code); err != ErrInviteInvalid {
+		t.Fatalf("revoked invite must be invalid, got %v", err)
+	}
+}
+
+func TestInviteApproval(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, member, alice, bob := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{member}, true)
+	inv, err := svc.CreateInvite(ctx, owner, groupID, InviteOptions{RequiresApproval: true})
+	if err != nil {
+		t.Fatalf("create invite: %v", err)
+	}
+	for _, u := range []uuid.UUID{alice, bob} {
+		res, err := svc.JoinByInvite(ctx, u, inv.Code)
+		if err != nil || res.Status != JoinRequested {
+			t.Fatalf("join request: %+v, %v", res, err)
+		}
+	}
+	if contains(repo.dialogMembers[groupID], alice) {
+		t.Fatalf("approval mode must not add members directly")
+	}
+	if !slices.Contains(pub.sent[owner], EventJoinRequested) || slices.Contains(pub.sent[member], EventJoinRequested) {
+		t.Fatalf("only admins must see join requests")
+	}
+	if _, err := svc.JoinRequests(ctx, member, groupID); err != ErrForbidden {
+		t.Fatalf("member must not list join requests, got %v", err)
+	}
+	list, err := svc.JoinRequests(ctx, owner, groupID)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("expected 2 join requests, got %v, %v", list, err)
+	}
+
+	if err := svc.ApproveJoinRequest(ctx, owner, groupID, alice); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if !contains(repo.dialogMembers[groupID], alice) {
+		t.Fatalf("approved user must be a member")
+	}
+	if !slices.Contains(pub.sent[alice], EventMemberAdded) {
+		t.Fatalf("approved user must be notified")
+	}
+	if err := svc.DeclineJoinRequest(ctx, owner, groupID, bob); err != nil {
+		t.Fatalf("decline: %v", err)
+	}
+	if contains(repo.dialogMembers[groupID], bob) {
+		t.Fatalf("declined user must not be a member")
+	}
+	if err := svc.ApproveJoinRequest(ctx, owner, groupID, bob); err != ErrNoRequest {
+		t.Fatalf("expected ErrNoRequest, got %v", err)
+	}
+}
+
+func TestEditAndDeleteMessages(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	alice, bob := uuid.New(), uuid.New()
+	dialogID, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+
+	msg, err := svc.SendMessage(ctx, alice, dialogID, "helo")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, err := svc.EditMessage(ctx, bob, dialogID, msg.ID, "hacked"); err != ErrForbidden {
+		t.Fatalf("only the sender may edit, got %v", err)
+	}
+	edited, err := svc.EditMessage(ctx, alice, dialogID, msg.ID, "hello")
+	if err != nil || edited.Text != "hello" || edited.EditedAt == nil {
+		t.Fatalf("edit: %+v, %v", edited, err)
+	}
+	if !slices.Contains(pub.sent[bob], EventMessageEdited) {
+		t.Fatalf("peer must get %s, got %v", EventMessageEdited, pub.sent[bob])
+	}
+
+	old, _ := svc.SendMessage(ctx, alice, dialogID, "old")
+	repo.messages[dialogID][len(repo.messages[dialogID])-1].CreatedAt = time.Now().Add(-editWindow - time.Minute)
+	if _, err := svc.EditMessage(ctx, alice, dialogID, old.ID, "new"); err != ErrEditWindow {
+		t.Fatalf("expected ErrEditWindow, got %v", err)
+	}
+
+	// delete for me hides the message only from the caller
+	if err := svc.DeleteMessage(ctx, bob, dialogID, old.ID, false); err != nil {
+		t.Fatalf("delete for me: %v", err)
+	}
+	bobMsgs, _ := svc.ListMessages(ctx, bob, dialogID, 50, 0)
+	aliceMsgs, _ := svc.ListMessages(ctx, alice, dialogID, 50, 0)
+	if len(bobMsgs) != 1 || len(aliceMsgs) != 2 {
+		t.Fatalf("hidden message must disappear for bob only: bob=%d alice=%d", len(bobMsgs), len(aliceMsgs))
+	}
+	if slices.Contains(pub.sent[alice], EventMessageHidden) {
+		t.Fatalf("delete for me must not notify the peer")
+	}
+
+	// delete for everyone leaves a tombstone
+	if err := svc.DeleteMessage(ctx, bob, dialogID, msg.ID, true); err != ErrForbidden {
+		t.Fatalf("only the sender may delete for everyone, got %v", err)
+	}
+	if err := svc.DeleteMessage(ctx, alice, dialogID, msg.ID, true); err != nil {
+		t.Fatalf("delete for everyone: %v", err)
+	}
+	bobMsgs, _ = svc.ListMessages(ctx, bob, dialogID, 50, 0)
+	if len(bobMsgs) != 1 || !bobMsgs[0].Deleted || bobMsgs[0].Text != "" {
+		t.Fatalf("expected tombstone, got %+v", bobMsgs)
+	}
+	if !slices.Contains(pub.sent[bob], EventMessageDeleted) {
+		t.Fatalf("peer must get %s", EventMessageDeleted)
+	}
+	if _, err := svc.EditMessage(ctx, alice, dialogID, msg.ID, "again"); err != ErrMessageNotFound {
+		t.Fatalf("deleted message must not be editable, got %v", err)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, alice, bob := uuid.New(), uuid.New(), uuid.New()
+
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{alice}, true)
+	msg, _ := svc.SendMessage(ctx, owner, groupID, "hi")
+
+	if _, err := svc.React(ctx, bob, groupID, msg.ID, "👍", true); err != ErrForbidden {
+		t.Fatalf("non-member must not react, got %v", err)
+	}
+	if _, err := svc.React(ctx, alice, groupID, msg.ID, "a b", true); err != ErrInvalidReaction {
+		t.Fatalf("expected ErrInvalidReaction, got %v", err)
+	}
+	if _, err := svc.React(ctx, owner, groupID, msg.ID, "👍", true); err != nil {
+		t.Fatalf("react: %v", err)
+	}
+	res, err := svc.React(ctx, alice, groupID, msg.ID, "👍", true)
+	if err != nil || len(res) != 1 || res[0].Count != 2 || !res[0].Mine {
+		t.Fatalf("unexpected reactions %+v, %v", res, err)
+	}
+	if !slices.Contains(pub.sent[owner], EventReactionUpdated) {
+		t.Fatalf("members must get %s", EventReactionUpdated)
+	}
+	for _, r := range []string{"❤", "🔥"} {
+		if _, err := svc.React(ctx, alice, groupID, msg.ID, r, true); err != nil {
+			t.Fatalf("react %s: %v", r, err)
+		}
+	}
+	if _, err := svc.React(ctx, alice, groupID, msg.ID, "😂", true); err != ErrTooManyReactions {
+		t.Fatalf("expected ErrTooManyReactions, got %v", err)
+	}
+
+	msgs, err := svc.ListMessages(ctx, bob, groupID, 50, 0)
+	if err != ErrForbidden {
+		t.Fatalf("non-member must not list, got %v", err)
+	}
+	msgs, _ = svc.ListMessages(ctx, owner, groupID, 50, 0)
+	var listed Message
+	for _, m := range msgs {
+		if m.ID == msg.ID {
+			listed = m
+		}
+	}
+	if len(listed.Reactions) != 3 || listed.Reactions[0].Reaction != "👍" || !listed.Reactions[0].Mine || listed.Reactions[1].Mine {
+		t.Fatalf("unexpected listed reactions %+v", listed.Reactions)
+	}
+
+	if _, err := svc.SetAllowedReactions(ctx, alice, groupID, []string{"👍"}); err != ErrForbidden {
+		t.Fatalf("member must not configure reactions, got %v", err)
+	}
+	if _, err := svc.SetAllowedReactions(ctx, owner, groupID, []string{"👍", "👍"}); err != nil {
+		t.Fatalf("set allowed: %v", err)
+	}
+	if allowed, _ := svc.AllowedReactions(ctx, alice, groupID); len(allowed) != 1 {
+		t.Fatalf("duplicates must be dropped, got %v", allowed)
+	}
+	if _, err := svc.React(ctx, owner, groupID, msg.ID, "🔥", true); err != ErrReactionNotAllowed {
+		t.Fatalf("expected ErrReactionNotAllowed, got %v", err)
+	}
+	res, err = svc.React(ctx, alice, groupID, msg.ID, "🔥", false)
+	if err != nil || len(res) != 2 {
+		t.Fatalf("removing a no longer allowed reaction must work: %+v, %v", res, err)
+	}
+	if _, err := svc.SetAllowedReactions(ctx, owner, groupID, []string{}); err != nil {
+		t.Fatalf("disable reactions: %v", err)
+	}
+	if _, err := svc.React(ctx, owner, groupID, msg.ID, "👍", true); err != ErrReactionNotAllowed {
+		t.Fatalf("reactions must be disabled, got %v", err)
+	}
+}
+
+func TestRepliesAndForwarding(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	svc := NewService(repo, nil)
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	svc.SetPrivacy(stubPrivacy{noLinks: map[uuid.UUID]bool{bob: true}})
+	chat, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+	other, _ := repo.CreateDirect(ctx, alice, carol, RequestAccepted)
+	foreign, _ := repo.CreateDirect(ctx, bob, carol, RequestAccepted)
+
+	orig, _ := svc.SendMessage(ctx, bob, chat, "let's meet at noon")
+	reply, err := svc.SendReply(ctx, alice, chat, "ok", orig.ID, "at noon")
+	if err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	if reply.ReplyTo == nil || reply.ReplyTo.ID != orig.ID || reply.ReplyTo.Quote != "at noon" {
+		t.Fatalf("unexpected reply preview %+v", reply.ReplyTo)
+	}
+	if _, err := svc.SendReply(ctx, alice, chat, "ok", orig.ID, "at midnight"); err != ErrInvalidReply {
+		t.Fatalf("quote must come from the original, got %v", err)
+	}
+	elsewhere, _ := svc.SendMessage(ctx, carol, foreign, "secret")
+	if _, err := svc.SendReply(ctx, alice, chat, "ok", elsewhere.ID, ""); err != ErrInvalidReply {
+		t.Fatalf("reply to another dialog must fail, got %v", err)
+	}
+	msgs, _ := svc.ListMessages(ctx, bob, chat, 50, 0)
+	if msgs[len(msgs)-1].ReplyTo == nil {
+		t.Fatalf("ListMessages must include reply previews")
+	}
+
+	mine, _ := svc.SendMessage(ctx, alice, chat, "my note")
+	fwd, err := svc.ForwardMessages(ctx, alice, chat, []int64{orig.ID, mine.ID}, other, false)
+	if err != nil || len(fwd) != 2 {
+		t.Fatalf("forward: %v, %v", fwd, err)
+	}
+	if fwd[0].ForwardedFrom == nil || fwd[0].ForwardedFrom.UserID != nil || fwd[0].ForwardedFrom.Name == "" {
+		t.Fatalf("bob disallows forward links, got %+v", fwd[0].ForwardedFrom)
+	}
+	if fwd[1].ForwardedFrom == nil || fwd[1].ForwardedFrom.UserID == nil || *fwd[1].ForwardedFrom.UserID != alice {
+		t.Fatalf("alice must be linked, got %+v", fwd[1].ForwardedFrom)
+	}
+	again, err := svc.ForwardMessages(ctx, carol, other, []int64{fwd[1].ID}, foreign, false)
+	if err != nil || again[0].ForwardedFrom == nil || *again[0].ForwardedFrom.UserID != alice {
+		t.Fatalf("forwarding a forward must keep the original author: %+v, %v", again, err)
+	}
+	anon, err := svc.ForwardMessages(ctx, alice, chat, []int64{orig.ID}, other, true)
+	if err != nil || anon[0].ForwardedFrom != nil {
+		t.Fatalf("hidden sender must drop attribution: %+v, %v", anon, err)
+	}
+	if _, err := svc.ForwardMessages(ctx, carol, chat, []int64{orig.ID}, foreign, false); err != ErrForbidden {
+		t.Fatalf("forwarding from a foreign dialog must fail, got %v", err)
+	}
+	if _, err := svc.ForwardMessages(ctx, alice, chat, []int64{orig.ID}, foreign, false); err != ErrForbidden {
+		t.Fatalf("forwarding into a foreign dialog must fail, got %v", err)
+	}
+}
+
+func TestPinsAndDialogSettings(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, alice, bob := uuid.New(), uuid.New(), uuid.New()
+
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{alice}, true)
+	first, _ := svc.SendMessage(ctx, alice, groupID, "first")
+	second, _ := svc.SendMessage(ctx, alice, groupID, "second")
+
+	if err := svc.PinMessage(ctx, alice, groupID, first.ID); err != ErrForbidden {
+		t.Fatalf("plain member must not pin in a group, got %v", err)
+	}
+	for _, id := range []int64{first.ID, second.ID} {
+		if err := svc.PinMessage(ctx, owner, groupID, id); err != nil {
+			t.Fatalf("pin: %v", err)
+		}
+	}
+	if !slices.Contains(pub.sent[alice], EventMessagePinned) {
+		t.Fatalf("members must get %s, got %v", EventMessagePinned, pub.sent[alice])
+	}
+	if _, err := svc.PinnedMessages(ctx, bob, groupID); err != ErrForbidden {
+		t.Fatalf("non-member must not list pins, got %v", err)
+	}
+	pins, err := svc.PinnedMessages(ctx, alice, groupID)
+	if err != nil || len(pins) != 2 || pins[0].ID != second.ID {
+		t.Fatalf("expected newest pin first, got %+v, %v", pins, err)
+	}
+	if err := svc.DeleteMessage(ctx, alice, groupID, second.ID, true); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if pins, _ := svc.PinnedMessages(ctx, alice, groupID); len(pins) != 1 {
+		t.Fatalf("deleting a message must drop its pin, got %+v", pins)
+	}
+	if err := svc.UnpinMessage(ctx, owner, groupID, first.ID); err != nil {
+		t.Fatalf("unpin: %v", err)
+	}
+	if !slices.Contains(pub.sent[alice], EventMessageUnpinned) {
+		t.Fatalf("members must get %s", EventMessageUnpinned)
+	}
+
+	directID, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+	dm, _ := svc.SendMessage(ctx, bob, directID, "hey")
+	if err := svc.PinMessage(ctx, alice, directID, dm.ID); err != nil {
+		t.Fatalf("any member may pin in a direct dialog: %v", err)
+	}
+
+	yes, no := true, false
+	mute := int64(-1)
+	st, err := svc.UpdateDialogSettings(ctx, alice, groupID, DialogSettingsUpdate{MuteFor: &mute, Archived: &yes})
+	if err != nil || st.MutedUntil == nil || !st.Archived {
+		t.Fatalf("update settings: %+v, %v", st, err)
+	}
+	if other, _ := repo.MemberSettings(ctx, groupID, owner); other.Archived || other.MutedUntil != nil {
+		t.Fatalf("settings must be per member, got %+v", other)
+	}
+	inbox, _ := svc.ListDialogs(ctx, alice, FolderInbox, DialogFilter{}, 50)
+	if len(inbox) != 1 || inbox[0].ID != directID {
+		t.Fatalf("archived dialog must leave the inbox, got %+v", inbox)
+	}
+	archived, _ := svc.ListDialogs(ctx, alice, FolderInbox, DialogFilter{Archived: &yes}, 50)
+	if len(archived) != 1 || archived[0].ID != groupID || archived[0].MutedUntil == nil {
+		t.Fatalf("unexpected archive %+v", archived)
+	}
+	if muted, _ := svc.ListDialogs(ctx, alice, FolderInbox, DialogFilter{Archived: &no, Muted: &yes}, 50); len(muted) != 0 {
+		t.Fatalf("no unarchived dialog is muted, got %+v", muted)
+	}
+	bad := int64(-5)
+	if _, err := svc.UpdateDialogSettings(ctx, alice, groupID, DialogSettingsUpdate{MuteFor: &bad}); err != ErrInvalidSettings {
+		t.Fatalf("expected ErrInvalidSettings, got %v", err)
+	}
+	if _, err := svc.UpdateDialogSettings(ctx, bob, groupID, DialogSettingsUpdate{Pinned: &yes}); err != ErrForbidden {
+		t.Fatalf("non-member must not change settings, got %v", err)
+	}
+
+	for i := 0; i < maxPinnedDialogs; i++ {
+		id, _ := repo.CreateDirect(ctx, alice, uuid.New(), RequestAccepted)
+		if _, err := svc.UpdateDialogSettings(ctx, alice, id, DialogSettingsUpdate{Pinned: &yes}); err != nil {
+			t.Fatalf("pin dialog %d: %v", i, err)
+		}
+	}
+	if _, err := svc.UpdateDialogSettings(ctx, alice, directID, DialogSettingsUpdate{Pinned: &yes}); err != ErrPinLimit {
+		t.Fatalf("expected ErrPinLimit, got %v", err)
+	}
+	if pinned, _ := svc.ListDialogs(ctx, alice, FolderInbox, DialogFilter{Pinned: &yes}, 50); len(pinned) != maxPinnedDialogs {
+		t.Fatalf("expected %d pinned dialogs, got %d", maxPinnedDialogs, len(pinned))
+	}
+}
+
+func TestIdempotentSend(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	alice, bob := uuid.New(), uuid.New()
+	dialogID, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+
+	out := OutgoingMessage{Text: "hello", ClientMessageID: "c-1"}
+	first, err := svc.Send(ctx, alice, dialogID, out)
+	if err != nil || first.ClientMessageID != "c-1" {
+		t.Fatalf("send: %+v, %v", first, err)
+	}
+	retry, err := svc.Send(ctx, alice, dialogID, out)
+	if err != nil || retry.ID != first.ID {
+		t.Fatalf("retry must return the original, got %+v, %v", retry, err)
+	}
+	if len(repo.messages[dialogID]) != 1 || len(pub.sent[bob]) != 1 {
+		t.Fatalf("retry must not store or publish again: %d messages, events %v", len(repo.messages[dialogID]), pub.sent[bob])
+	}
+
+	// the key is scoped per sender: bob may reuse it
+	other, err := svc.Send(ctx, bob, dialogID, out)
+	if err != nil || other.ID == first.ID {
+		t.Fatalf("other sender must get a new message, got %+v, %v", other, err)
+	}
+
+	// a send racing with the retry lands on the unique constraint
+	dup := NewMessage{DialogID: dialogID, SenderID: alice, Text: "hello", ClientMessageID: "c-1"}
+	if msg, err := svc.store(ctx, KindDirect, dup, nil); err != nil || msg.ID != first.ID {
+		t.Fatalf("conflict must resolve to the original, got %+v, %v", msg, err)
+	}
+
+	// a retry after losing membership does not return the stored message
+	_ = repo.RemoveMember(ctx, dialogID, alice)
+	if msg, err := svc.Send(ctx, alice, dialogID, out); err != ErrForbidden {
+		t.Fatalf("expected ErrForbidden for a former member, got %+v, %v", msg, err)
+	}
+	_ = repo.AddMember(ctx, dialogID, alice, "member")
+
+	for _, bad := range []string{"has space", strings.Repeat("x", maxClientMessageIDLength+1)} {
+		if _, err := svc.Send(ctx, alice, dialogID, OutgoingMessage{Text: "x", ClientMessageID: bad}); err != ErrInvalidClientID {
+			t.Fatalf("expected ErrInvalidClientID for %q, got %v", bad, err)
+		}
+	}
+	if _, err := svc.Send(ctx, alice, dialogID, OutgoingMessage{}); err != ErrEmptyMessage {
+		t.Fatalf("expected ErrEmptyMessage, got %v", err)
+	}
+}
+
+func TestReadWatermarks(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	alice, bob := uuid.New(), uuid.New()
+	dialogID, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+
+	var sent []Message
+	for _, text := range []string{"one", "two", "three"} {
+		msg, err := svc.SendMessage(ctx, alice, dialogID, text)
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		sent = append(sent, msg)
+	}
+	unread := func() int64 {
+		list, _ := svc.ListDialogs(ctx, bob, FolderInbox, DialogFilter{}, 50)
+		if len(list) != 1 {
+			t.Fatalf("expected one dialog, got %d", len(list))
+		}
+		return list[0].UnreadCount
+	}
+	if got := unread(); got != 3 {
+		t.Fatalf("expected 3 unread, got %d", got)
+	}
+
+	// reading the second message marks the first one as read too
+	if err := svc.MarkRead(ctx, bob, dialogID, sent[1].ID); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := unread(); got != 1 {
+		t.Fatalf("expected 1 unread, got %d", got)
+	}
+	msgs, _ := svc.ListMessages(ctx, alice, dialogID, 50, 0)
+	for i, msg := range msgs {
+		if want := i < 2; msg.ReadPeer != want || msg.DeliveredPeer != want {
+			t.Fatalf("message %d: read=%v delivered=%v, want %v", i, msg.ReadPeer, msg.DeliveredPeer, want)
+		}
+	}
+
+	// moving the watermark backwards or repeating it is a silent no-op
+	events := len(pub.sent[alice])
+	if err := svc.MarkRead(ctx, bob, dialogID, sent[0].ID); err != nil {
+		t.Fatalf("stale read: %v", err)
+	}
+	_ = svc.MarkDelivered(ctx, bob, dialogID, sent[1].ID)
+	if len(pub.sent[alice]) != events || unread() != 1 {
+		t.Fatalf("stale receipts must not publish or change counters: %v", pub.sent[alice])
+	}
+	_ = svc.MarkDelivered(ctx, bob, dialogID, sent[2].ID)
+	if got := pub.sent[alice]; len(got) != events+1 || got[len(got)-1] != "message.delivered" {
+		t.Fatalf("expected delivery event, got %v", got)
+	}
+}
+
+func TestDialogListPagination(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	svc := NewService(repo, nil)
+	me := uuid.New()
+	var ids []uuid.UUID
+	for i := range 5 {
+		peer := uuid.New()
+		id, _ := repo.CreateDirect(ctx, me, peer, RequestAccepted)
+		if _, err := svc.SendMessage(ctx, peer, id, fmt.Sprintf("hi %d", i)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	// the oldest dialog is pinned and must come first
+	pinned := true
+	if _, err := svc.UpdateDialogSettings(ctx, me, ids[0], DialogSettingsUpdate{Pinned: &pinned}); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+
+	var seen []uuid.UUID
+	var filter DialogFilter
+	for page := 0; ; page++ {
+		list, err := svc.ListDialogs(ctx, me, FolderInbox, filter, 2)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if len(list) == 0 {
+			break
+		}
+		if page > 3 || len(list) > 2 {
+			t.Fatalf("page %d has %d dialogs", page, len(list))
+		}
+		for _, d := range list {
+			seen = append(seen, d.ID)
+			if d.UnreadCount != 1 || d.LastMessage == nil {
+				t.Fatalf("dialog summary: %+v", d)
+			}
+		}
+		after, err := ParseDialogCursor(list[len(list)-1].Cursor)
+		if err != nil {
+			t.Fatalf("cursor: %v", err)
+		}
+		filter.After = &after
+	}
+	want := []uuid.UUID{ids[0], ids[4], ids[3], ids[2], ids[1]}
+	if !slices.Equal(seen, want) {
+		t.Fatalf("order: got %v, want %v", seen, want)
+	}
+
+	if _, err := ParseDialogCursor("not a cursor"); err != ErrInvalidCursor {
+		t.Fatalf("expected invalid cursor, got %v", err)
+	}
+	c := DialogCursor{Pinned: true, At: time.Now().Truncate(time.Microsecond).UTC(), ID: uuid.New()}
+	if got, err := ParseDialogCursor(c.String()); err != nil || got != c {
+		t.Fatalf("round trip: %+v, %v", got, err)
+	}
+}
+
+func TestDisappearingMessages(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, alice := uuid.New(), uuid.New()
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Secret", []uuid.UUID{alice}, true)
+
+	if err := svc.SetMessageTTL(ctx, alice, groupID, 3); err != ErrInvalidTTL {
+		t.Fatalf("expected invalid ttl, got %v", err)
+	}
+	if err := svc.SetMessageTTL(ctx, uuid.New(), groupID, 60); err != ErrForbidden {
+		t.Fatalf("expected forbidden for stranger, got %v", err)
+	}
+	// any member may set the timer; it is announced once
+	before := len(repo.messages[groupID])
+	for range 2 {
+		if err := svc.SetMessageTTL(ctx, alice, groupID, 60); err != nil {
+			t.Fatalf("set ttl: %v", err)
+		}
+	}
+	if got := len(repo.messages[groupID]) - before; got != 1 {
+		t.Fatalf("expected one announcement, got %d", got)
+	}
+
+	msg, err := svc.SendMessage(ctx, owner, groupID, "self-destruct")
+	if err != nil || msg.ExpiresAt == nil {
+		t.Fatalf("send: %+v, %v", msg, err)
+	}
+	if d := msg.ExpiresAt.Sub(msg.CreatedAt); d != time.Minute {
+		t.Fatalf("expected a minute to live, got %v", d)
+	}
+	if n, _ := svc.ReapExpired(ctx); n != 0 {
+		t.Fatalf("nothing is expired yet, reaped %d", n)
+	}
+
+	// let it expire
+	list := repo.messages[groupID]
+	past := time.Now().Add(-time.Second)
+	list[len(list)-1].ExpiresAt = &past
+	if n, err := svc.ReapExpired(ctx); err != nil || n != 1 {
+		t.Fatalf("reap: %d, %v", n, err)
+	}
+	if got := pub.sent[alice]; got[len(got)-1] != EventMessageExpired {
+		t.Fatalf("expected message.expired, got %v", got)
+	}
+	msgs, _ := svc.ListMessages(ctx, alice, groupID, 50, 0)
+	if slices.ContainsFunc(msgs, func(m Message) bool { return m.ID == msg.ID }) {
+		t.Fatalf("expired message still listed")
+	}
+
+	if err := svc.SetMessageTTL(ctx, owner, groupID, 0); err != nil {
+		t.Fatalf("turn off: %v", err)
+	}
+	if msg, _ := svc.SendMessage(ctx, owner, groupID, "forever"); msg.ExpiresAt != nil {
+		t.Fatalf("timer is off, got expiry %v", msg.ExpiresAt)
+	}
+}
+
+type fakeMediaStore struct {
+	deleted []string
+}
+
+func (f *fakeMediaStore) DeleteObject(ctx context.Context, bucket, key string) error {
+	f.deleted = append(f.deleted, key)
+	return nil
+}
+
+func TestExpiredAttachmentsAndReplies(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	store := &fakeMediaStore{}
+	svc := NewService(repo, nil)
+	svc.SetMediaStore(store)
+	owner, alice := uuid.New(), uuid.New()
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Secret", []uuid.UUID{alice}, true)
+	photo, other := uuid.New(), uuid.New()
+	repo.media[photo] = memMedia{owner: alice, key: "photo.jpg"}
+	repo.media[other] = memMedia{owner: owner, key: "other.jpg"}
+
+	root, err := svc.SendMessage(ctx, owner, groupID, "look")
+	if err != nil {
+		t.Fatalf("root: %v", err)
+	}
+	for _, ids := range [][]uuid.UUID{{other}, {photo, photo}, {uuid.New()}} {
+		if _, err := svc.Send(ctx, alice, groupID, OutgoingMessage{Text: "nice", ThreadRootID: &root.ID, Attachments: ids}); err != ErrInvalidAttachment {
+			t.Fatalf("attachments %v: expected invalid attachment, got %v", ids, err)
+		}
+	}
+	reply, err := svc.Send(ctx, alice, groupID, OutgoingMessage{Text: "nice", ThreadRootID: &root.ID, Attachments: []uuid.UUID{photo}})
+	if err != nil || !slices.Equal(reply.Attachments, []uuid.UUID{photo}) {
+		t.Fatalf("reply: %+v, %v", reply, err)
+	}
+	if _, err := svc.Send(ctx, alice, groupID, OutgoingMessage{Text: "again", Attachments: []uuid.UUID{photo}}); err != ErrInvalidAttachment {
+		t.Fatalf("an upload belongs to one message, got %v", err)
+	}
+	replies, err := svc.ListThread(ctx, owner, groupID, root.ID, 50, 0)
+	if err != nil || len(replies) != 1 || !slices.Equal(replies[0].Attachments, []uuid.UUID{photo}) {
+		t.Fatalf("thread: %+v, %v", replies, err)
+	}
+
+	// the root expires and takes the reply with it
+	past := time.Now().Add(-time.Second)
+	for i := range repo.messages[groupID] {
+		if repo.messages[groupID][i].ID == root.ID {
+			repo.messages[groupID][i].ExpiresAt = &past
+		}
+	}
+	if n, err := svc.ReapExpired(ctx); err != nil || n != 2 {
+		t.Fatalf("reap: %d, %v", n, err)
+	}
+	var expired []int64
+	for _, u := range repo.updates[alice] {
+		if u.Type == EventMessageExpired {
+			expired = append(expired, *u.MessageID)
+		}
+	}
+	slices.Sort(expired)
+	if !slices.Equal(expired, []int64{root.ID, reply.ID}) {
+		t.Fatalf("expected both messages expired, got %v", expired)
+	}
+	if !slices.Equal(store.deleted, []string{"photo.jpg"}) {
+		t.Fatalf("expected the blob deleted, got %v", store.deleted)
+	}
+	if _, ok := repo.media[photo]; ok {
+		t.Fatalf("media row left behind")
+	}
+}
+
+func TestScheduledMessages(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, alice, bob := uuid.New(), uuid.New(), uuid.New()
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Later", []uuid.UUID{alice, bob}, true)
+	soon := time.Now().Add(time.Hour)
+
+	for _, at := range []time.Time{time.Now().Add(-time.Minute), time.Now().Add(2 * maxScheduleAhead)} {
+		if _, err := svc.ScheduleMessage(ctx, alice, groupID, OutgoingMessage{Text: "hi"}, at); err != ErrInvalidSchedule {
+			t.Fatalf("expected invalid schedule for %v, got %v", at, err)
+		}
+	}
+	if _, err := svc.ScheduleMessage(ctx, uuid.New(), groupID, OutgoingMessage{Text: "hi"}, soon); err == nil {
+		t.Fatalf("stranger scheduled a message")
+	}
+
+	msg, err := svc.ScheduleMessage(ctx, alice, groupID, OutgoingMessage{Text: "draft"}, soon)
+	if err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+	if list, _ := svc.ListScheduled(ctx, owner, groupID); len(list) != 0 {
+		t.Fatalf("scheduled messages are private, owner sees %d", len(list))
+	}
+	text := "final"
+	if msg, err = svc.EditScheduled(ctx, alice, groupID, msg.ID, ScheduledUpdate{Text: &text}); err != nil || msg.Text != "final" {
+		t.Fatalf("edit: %+v, %v", msg, err)
+	}
+	if _, err := svc.EditScheduled(ctx, owner, groupID, msg.ID, ScheduledUpdate{Text: &text}); err != ErrScheduledNotFound {
+		t.Fatalf("expected not found for another member, got %v", err)
+	}
+	cancelled, _ := svc.ScheduleMessage(ctx, alice, groupID, OutgoingMessage{Text: "never"}, soon)
+	if err := svc.CancelScheduled(ctx, alice, groupID, cancelled.ID); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if n, _ := svc.SendDueScheduled(ctx); n != 0 {
+		t.Fatalf("nothing is due yet, sent %d", n)
+	}
+
+	// its time comes: sent once through the normal path
+	repo.scheduled[0].SendAt = time.Now().Add(-time.Second)
+	before := len(repo.messages[groupID])
+	if n, err := svc.SendDueScheduled(ctx); err != nil || n != 1 {
+		t.Fatalf("send due: %d, %v", n, err)
+	}
+	if n, _ := svc.SendDueScheduled(ctx); n != 0 {
+		t.Fatalf("sent twice: %d", n)
+	}
+	msgs := repo.messages[groupID]
+	if len(msgs) != before+1 || msgs[len(msgs)-1].Text != "final" || msgs[len(msgs)-1].SenderID != alice {
+		t.Fatalf("expected the scheduled message in the dialog, got %+v", msgs[before:])
+	}
+	if got := pub.sent[owner]; !slices.Contains(got, EventMessageNew) {
+		t.Fatalf("expected message.new for owner, got %v", got)
+	}
+	if list, _ := svc.ListScheduled(ctx, alice, groupID); len(list) != 0 {
+		t.Fatalf("sent message still scheduled: %+v", list)
+	}
+
+	// a message the sender can no longer post is kept as failed
+	failing, _ := svc.ScheduleMessage(ctx, bob, groupID, OutgoingMessage{Text: "too late"}, soon)
+	if err := svc.LeaveGroup(ctx, bob, groupID); err != nil {
+		t.Fatalf("leave: %v", err)
+	}
+	repo.scheduled[0].SendAt = time.Now().Add(-time.Second)
+	if n, _ := svc.SendDueScheduled(ctx); n != 0 {
+		t.Fatalf("sent for a former member")
+	}
+	if got := repo.scheduled[0]; got.ID != failing.ID || got.FailedAt == nil || got.Error == "" {
+		t.Fatalf("expected a failed scheduled message, got %+v", got)
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, alice := uuid.New(), uuid.New()
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Notes", []uuid.UUID{alice}, true)
+	state, _ := svc.SyncState(ctx, alice)
+
+	if _, err := svc.SaveDraft(ctx, uuid.New(), Draft{DialogID: groupID, Blob: []byte("x")}); err != ErrForbidden {
+		t.Fatalf("expected forbidden for stranger, got %v", err)
+	}
+	if _, err := svc.SaveDraft(ctx, alice, Draft{DialogID: groupID, Blob: make([]byte, maxDraftSize+1)}); err != ErrDraftTooLarge {
+		t.Fatalf("expected too large, got %v", err)
+	}
+
+	// the later write wins whatever order the devices' writes arrive in
+	t0 := time.Now().Add(-time.Minute).UTC()
+	laptop := Draft{DialogID: groupID, Blob: []byte("laptop"), UpdatedAt: t0.Add(2 * time.Second)}
+	phone := Draft{DialogID: groupID, Blob: []byte("phone"), UpdatedAt: t0.Add(time.Second)}
+	if d, err := svc.SaveDraft(ctx, alice, laptop); err != nil || string(d.Blob) != "laptop" {
+		t.Fatalf("save: %+v, %v", d, err)
+	}
+	if d, _ := svc.SaveDraft(ctx, alice, phone); string(d.Blob) != "laptop" {
+		t.Fatalf("an older draft overwrote a newer one: %q", d.Blob)
+	}
+	if got := pub.sent[alice]; slices.Index(got, EventDraftUpdated) != len(got)-1 {
+		t.Fatalf("expected one draft.updated, got %v", got)
+	}
+	// a clock ahead of the server cannot pin its draft forever
+	if d, _ := svc.SaveDraft(ctx, alice, Draft{DialogID: groupID, Blob: []byte("future"), UpdatedAt: time.Now().Add(time.Hour)}); d.UpdatedAt.After(time.Now()) {
+		t.Fatalf("future timestamp kept: %v", d.UpdatedAt)
+	}
+	if drafts, _ := svc.ListDrafts(ctx, alice); len(drafts) != 1 || string(drafts[0].Blob) != "future" {
+		t.Fatalf("list: %+v", drafts)
+	}
+	if drafts, _ := svc.ListDrafts(ctx, owner); len(drafts) != 0 {
+		t.Fatalf("drafts are private, owner sees %+v", drafts)
+	}
+
+	// sending clears the draft on every device
+	if _, err := svc.SendMessage(ctx, alice, groupID, "future"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if drafts, _ := svc.ListDrafts(ctx, alice); len(drafts) != 0 {
+		t.Fatalf("draft kept after send: %+v", drafts)
+	}
+	diff, err := svc.Difference(ctx, alice, state.Pts, 0)
+	if err != nil || len(diff.Drafts) != 1 || len(diff.Drafts[0].Blob) != 0 {
+		t.Fatalf("expected the cleared draft in the difference: %+v, %v", diff.Drafts, err)
+	}
+	// a stale device cannot bring it back
+	if d, _ := svc.SaveDraft(ctx, alice, laptop); len(d.Blob) != 0 {
+		t.Fatalf("stale draft restored: %q", d.Blob)
+	}
+}
+
+func TestPolls(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, alice, bob := uuid.New(), uuid.New(), uuid.New()
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Lunch", []uuid.UUID{alice, bob}, false)
+
+	for _, bad := range []PollInput{
+		{Question: "Where?", Options: []string{"Cafe"}},
+		{Question: "Where?", Options: []string{"Cafe", " Cafe "}},
+		{Question: " ", Options: []string{"Cafe", "Park"}},
+	} {
+		if _, err := svc.CreatePoll(ctx, owner, groupID, bad, ""); err != ErrInvalidPoll {
+			t.Fatalf("expected invalid poll for %+v, got %v", bad, err)
+		}
+	}
+	msg, err := svc.CreatePoll(ctx, owner, groupID, PollInput{Question: "Where?", Options: []string{"Cafe", "Park"}}, "")
+	if err != nil || msg.Kind != "poll" || msg.Text != "Where?" || msg.Poll == nil || len(msg.Poll.Options) != 2 {
+		t.Fatalf("create: %+v, %v", msg, err)
+	}
+
+	for _, bad := range [][]int{{0, 1}, {5}, {-1}} {
+		if _, err := svc.Vote(ctx, alice, groupID, msg.ID, bad); err != ErrInvalidVote {
+			t.Fatalf("expected invalid vote for %v, got %v", bad, err)
+		}
+	}
+	poll, err := svc.Vote(ctx, alice, groupID, msg.ID, []int{1})
+	if err != nil || poll.Options[1].Votes != 1 || !poll.Options[1].Chosen || !slices.Equal(poll.Options[1].VoterIDs, []uuid.UUID{alice}) {
+		t.Fatalf("vote: %+v, %v", poll, err)
+	}
+	ev := pub.polls[len(pub.polls)-1]
+	if ev.ActorID != alice || ev.Poll.Options[1].Chosen {
+		t.Fatalf("event must name the voter and carry no per-user flags: %+v", ev)
+	}
+	if got := pub.sent[bob]; got[len(got)-1] != EventPollUpdated {
+		t.Fatalf("expected poll.updated for bob, got %v", got)
+	}
+	if _, err := svc.Vote(ctx, alice, groupID, msg.ID, []int{1}); err != nil || len(pub.polls) != 1 {
+		t.Fatalf("repeated vote must be silent: %v, %d events", err, len(pub.polls))
+	}
+	if _, err := svc.Vote(ctx, bob, groupID, msg.ID, []int{0}); err != nil {
+		t.Fatalf("vote bob: %v", err)
+	}
+	msgs, _ := svc.ListMessages(ctx, owner, groupID, 50, 0)
+	i := slices.IndexFunc(msgs, func(m Message) bool { return m.ID == msg.ID })
+	if i < 0 || msgs[i].Poll == nil || msgs[i].Poll.Voters != 2 || msgs[i].Poll.Options[0].Chosen {
+		t.Fatalf("expected results in history, got %+v", msgs[i].Poll)
+	}
+	if poll, err := svc.Vote(ctx, alice, groupID, msg.ID, nil); err != nil || poll.Voters != 1 || poll.Options[1].Votes != 0 {
+		t.Fatalf("retract: %+v, %v", poll, err)
+	}
+
+	// anonymous polls hide the voters
+	anon, _ := svc.CreatePoll(ctx, owner, groupID, PollInput{Question: "Food?", Options: []string{"Soup", "Salad", "Both"}, Multiple: true, Anonymous: true}, "")
+	if poll, err := svc.Vote(ctx, bob, groupID, anon.ID, []int{2, 0, 2}); err != nil || poll.Options[0].Votes != 1 || poll.Options[2].VoterIDs != nil {
+		t.Fatalf("anonymous vote: %+v, %v", poll, err)
+	}
+	if ev := pub.polls[len(pub.polls)-1]; ev.ActorID != uuid.Nil {
+		t.Fatalf("anonymous vote leaked the voter: %+v", ev)
+	}
+	past := time.Now().Add(-time.Second)
+	closed := repo.polls[anon.ID]
+	closed.ClosesAt = &past
+	repo.polls[anon.ID] = closed
+	if _, err := svc.Vote(ctx, alice, groupID, anon.ID, []int{1}); err != ErrPollClosed {
+		t.Fatalf("expected closed poll, got %v", err)
+	}
+
+	// encrypted dialogs carry polls and votes as opaque messages
+	directID, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+	if _, err := svc.CreatePoll(ctx, alice, directID, PollInput{Question: "Q", Options: []string{"a", "b"}}, ""); err != ErrInvalidMessageKind {
+		t.Fatalf("expected server polls to be refused in encrypted dialogs, got %v", err)
+	}
+	if _, err := svc.Send(ctx, alice, groupID, OutgoingMessage{Kind: "poll", Text: "opaque"}); err != ErrInvalidMessageKind {
+		t.Fatalf("expected opaque polls to be refused in unencrypted dialogs, got %v", err)
+	}
+	encPoll, err := svc.Send(ctx, alice, directID, OutgoingMessage{Kind: "poll", Text: "opaque"})
+	if err != nil || encPoll.Kind != "poll" {
+		t.Fatalf("send encrypted poll: %+v, %v", encPoll, err)
+	}
+	text, _ := svc.SendMessage(ctx, alice, directID, "hi")
+	for _, replyTo := range []*int64{nil, &text.ID} {
+		if _, err := svc.Send(ctx, bob, directID, OutgoingMessage{Kind: "poll_vote", Text: "opaque", ReplyTo: replyTo}); err != ErrInvalidReply {
+			t.Fatalf("vote must reply to a poll, got %v", err)
+		}
+	}
+	vote, err := svc.Send(ctx, bob, directID, OutgoingMessage{Kind: "poll_vote", Text: "opaque", ReplyTo: &encPoll.ID})
+	if err != nil || vote.Kind != "poll_vote" {
+		t.Fatalf("send encrypted vote: %+v, %v", vote, err)
+	}
+	if _, err := svc.Vote(ctx, bob, directID, encPoll.ID, []int{0}); err != ErrMessageNotFound {
+		t.Fatalf("server votes on an encrypted poll: %v", err)
+	}
+}
+
+func TestDeltaSync(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	svc := NewService(repo, nil)
+	owner, alice, bob := uuid.New(), uuid.New(), uuid.New()
+
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{alice}, true)
+	state, _ := svc.SyncState(ctx, alice)
+
+	hello, _ := svc.SendMessage(ctx, owner, groupID, "hello")
+	bye, _ := svc.SendMessage(ctx, owner, groupID, "bye")
+	if _, err := svc.EditMessage(ctx, owner, groupID, hello.ID, "hello!"); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	if err := svc.DeleteMessage(ctx, owner, groupID, bye.ID, true); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := svc.MarkRead(ctx, owner, groupID, hello.ID); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := svc.AddMember(ctx, owner, groupID, bob); err != nil {
+		t.Fatalf("add member: %v", err)
+	}
+
+	diff, err := svc.Difference(ctx, alice, state.Pts, 0)
+	if err != nil || diff.TooLong || diff.HasMore {
+		t.Fatalf("difference: %+v, %v", diff, err)
+	}
+	var types []string
+	for _, u := range diff.Updates {
+		types = append(types, u.Type)
+	}
+	for _, want := range []string{EventMessageNew, EventMessageEdited, EventMessageDeleted, EventMessageRead, EventMemberAdded} {
+		if !slices.Contains(types, want) {
+			t.Fatalf("missing %s in %v", want, types)
+		}
+	}
+	for i := 1; i < len(diff.Updates); i++ {
+		if diff.Updates[i].Pts <= diff.Updates[i-1].Pts {
+			t.Fatalf("pts must grow: %+v", diff.Updates)
+		}
+	}
+	if diff.State.Pts != diff.Updates[len(diff.Updates)-1].Pts {
+		t.Fatalf("state must point at the last update, got %d", diff.State.Pts)
+	}
+	var edited Message
+	for _, m := range diff.Messages {
+		if m.ID == hello.ID {
+			edited = m
+		}
+	}
+	if edited.Text != "hello!" {
+		t.Fatalf("messages must carry the current text, got %+v", diff.Messages)
+	}
+
+	// paging continues from the returned state
+	page, _ := svc.Difference(ctx, alice, state.Pts, 2)
+	if len(page.Updates) != 2 || !page.HasMore {
+		t.Fatalf("expected a partial page, got %+v", page)
+	}
+	rest, _ := svc.Difference(ctx, alice, page.State.Pts, 0)
+	if len(page.Updates)+len(rest.Updates) != len(diff.Updates) || rest.HasMore {
+		t.Fatalf("pages must cover the log: %d + %d of %d", len(page.Updates), len(rest.Updates), len(diff.Updates))
+	}
+	if empty, _ := svc.Difference(ctx, alice, diff.State.Pts, 0); len(empty.Updates) != 0 || empty.State.Pts != diff.State.Pts {
+		t.Fatalf("nothing new expected, got %+v", empty)
+	}
+
+	// hidden messages only reach the caller's log
+	if err := svc.DeleteMessage(ctx, alice, groupID, hello.ID, false); err != nil {
+		t.Fatalf("hide: %v", err)
+	}
+	if last := repo.updates[alice][len(repo.updates[alice])-1]; last.Type != EventMessageHidden {
+		t.Fatalf("expected %s, got %s", EventMessageHidden, last.Type)
+	}
+	if last := repo.updates[owner][len(repo.updates[owner])-1]; last.Type == EventMessageHidden {
+		t.Fatalf("hiding must not reach other members")
+	}
+
+	// a client far behind or ahead must refetch
+	for i := 0; i < maxSyncGap; i++ {
+		_ = repo.AppendUpdate(ctx, []uuid.UUID{bob}, Update{Type: EventMessageRead, DialogID: groupID})
+	}
+	if far, _ := svc.Difference(ctx, bob, 0, 0); !far.TooLong || far.State.Pts == 0 {
+		t.Fatalf("expected too_long, got %+v", far.State)
+	}
+	if ahead, _ := svc.Difference(ctx, alice, 1<<40, 0); !ahead.TooLong {
+		t.Fatalf("a client ahead of the server must refetch")
+	}
+	if _, err := svc.Difference(ctx, alice, -1, 0); err != ErrInvalidSince {
+		t.Fatalf("expected ErrInvalidSince, got %v", err)
+	}
+}
+
+func TestUpdateLogRetention(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	svc := NewService(repo, nil)
+	alice, bob := uuid.New(), uuid.New()
+	dialogID, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+	for _, text := range []string{"one", "two", "three"} {
+		if _, err := svc.SendMessage(ctx, alice, dialogID, text); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	// the first two updates are past the retention
+	for i := range repo.updates[bob][:2] {
+		repo.updates[bob][i].CreatedAt = time.Now().Add(-48 * time.Hour)
+	}
+	if n, err := svc.PruneUpdates(ctx, 24*time.Hour); err != nil || n != 2 {
+		t.Fatalf("prune: %d, %v", n, err)
+	}
+	if diff, _ := svc.Difference(ctx, bob, 0, 0); !diff.TooLong || diff.State.Pts != 3 {
+		t.Fatalf("a client behind the trimmed log must refetch, got %+v", diff)
+	}
+	if diff, _ := svc.Difference(ctx, bob, 2, 0); diff.TooLong || len(diff.Updates) != 1 {
+		t.Fatalf("the retained part is still served, got %+v", diff)
+	}
+
+	// with the whole log trimmed only an up-to-date client may continue
+	if _, err := svc.PruneUpdates(ctx, -time.Hour); err != nil || len(repo.updates[bob]) != 0 {
+		t.Fatalf("prune: %v, %d left", err, len(repo.updates[bob]))
+	}
+	if diff, _ := svc.Difference(ctx, bob, 2, 0); !diff.TooLong || diff.State.Pts != 3 {
+		t.Fatalf("expected too_long with an empty log, got %+v", diff)
+	}
+	if diff, _ := svc.Difference(ctx, bob, 3, 0); diff.TooLong {
+		t.Fatalf("an up-to-date client must not refetch, got %+v", diff)
+	}
+}
+
+func TestUpdateLogFailure(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	alice, bob := uuid.New(), uuid.New()
+	dialogID, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+	msg, err := svc.SendMessage(ctx, alice, dialogID, "hi")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// a change that cannot be logged fails and reaches no one
+	repo.appendErr = errors.New("log unavailable")
+	if _, err := svc.SendMessage(ctx, alice, dialogID, "again"); err != repo.appendErr {
+		t.Fatalf("expected the log error from send, got %v", err)
+	}
+	if err := svc.MarkRead(ctx, bob, dialogID, msg.ID); err != repo.appendErr {
+		t.Fatalf("expected the log error from read, got %v", err)
+	}
+	if err := svc.DeleteMessage(ctx, alice, dialogID, msg.ID, true); err != repo.appendErr {
+		t.Fatalf("expected the log error from delete, got %v", err)
+	}
+	if got := pub.sent[bob]; len(got) != 1 {
+		t.Fatalf("only the logged message may be published, got %v", got)
+	}
+	if got := pub.sent[alice]; len(got) != 0 {
+		t.Fatalf("a failed read must not be published, got %v", got)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, alice, bob, carol := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{alice, bob}, true)
+
+	root, _ := svc.SendMessage(ctx, owner, groupID, "release plan")
+	r1, err := svc.Send(ctx, alice, groupID, OutgoingMessage{Text: "looks good", ThreadRootID: &root.ID})
+	if err != nil || r1.ThreadRootID == nil || *r1.ThreadRootID != root.ID {
+		t.Fatalf("thread reply: %+v, %v", r1, err)
+	}
+	if _, err := svc.Send(ctx, bob, groupID, OutgoingMessage{Text: "+1", ThreadRootID: &root.ID, ReplyTo: &r1.ID}); err != nil {
+		t.Fatalf("reply inside thread: %v", err)
+	}
+	r3, _ := svc.Send(ctx, alice, groupID, OutgoingMessage{Text: "ship it", ThreadRootID: &root.ID})
+
+	if _, err := svc.Send(ctx, bob, groupID, OutgoingMessage{Text: "nested", ThreadRootID: &r1.ID}); err != ErrInvalidThread {
+		t.Fatalf("a reply cannot root a thread, got %v", err)
+	}
+	other, _ := svc.SendMessage(ctx, owner, groupID, "other topic")
+	if _, err := svc.Send(ctx, bob, groupID, OutgoingMessage{Text: "x", ThreadRootID: &root.ID, ReplyTo: &other.ID}); err != ErrInvalidReply {
+		t.Fatalf("reply target outside the thread, got %v", err)
+	}
+	if _, err := svc.Send(ctx, bob, groupID, OutgoingMessage{Text: "x", ReplyTo: &r1.ID}); err != ErrInvalidReply {
+		t.Fatalf("main timeline reply to a thread reply, got %v", err)
+	}
+
+	msgs, _ := svc.ListMessages(ctx, owner, groupID, 50, 0)
+	i := slices.IndexFunc(msgs, func(m Message) bool { return m.ID == root.ID })
+	if slices.ContainsFunc(msgs, func(m Message) bool { return m.ThreadRootID != nil }) || i < 0 {
+		t.Fatalf("thread replies leaked into the timeline: %+v", msgs)
+	}
+	th := msgs[i].Thread
+	if th == nil || th.ReplyCount != 3 || th.LastReplyID != r3.ID || th.UnreadCount != 3 ||
+		!slices.Equal(th.RecentRepliers, []uuid.UUID{alice, bob}) {
+		t.Fatalf("summary: %+v", th)
+	}
+	replies, err := svc.ListThread(ctx, owner, groupID, root.ID, 50, 0)
+	if err != nil || len(replies) != 3 {
+		t.Fatalf("list thread: %d, %v", len(replies), err)
+	}
+
+	if err := svc.MarkThreadRead(ctx, owner, groupID, root.ID, r1.ID); err != nil {
+		t.Fatalf("mark thread read: %v", err)
+	}
+	msgs, _ = svc.ListMessages(ctx, owner, groupID, 50, 0)
+	if th := msgs[slices.IndexFunc(msgs, func(m Message) bool { return m.ID == root.ID })].Thread; th.LastReadID != r1.ID || th.UnreadCount != 2 {
+		t.Fatalf("after read: %+v", th)
+	}
+	msgs, _ = svc.ListMessages(ctx, alice, groupID, 50, 0)
+	if th := msgs[slices.IndexFunc(msgs, func(m Message) bool { return m.ID == root.ID })].Thread; th.LastReadID != 0 || th.UnreadCount != 1 {
+		t.Fatalf("thread reads are per user: %+v", th)
+	}
+
+	// direct dialogs have no threads
+	directID, _ := repo.CreateDirect(ctx, alice, bob, RequestAccepted)
+	dm, _ := svc.SendMessage(ctx, alice, directID, "hi")
+	if _, err := svc.Send(ctx, bob, directID, OutgoingMessage{Text: "x", ThreadRootID: &dm.ID}); err != ErrInvalidThread {
+		t.Fatalf("expected no threads in direct dialogs, got %v", err)
+	}
+
+	// channel subscribers comment on posts they cannot write themselves
+	ch, _ := svc.CreateChannel(ctx, owner, "News", "@thread_news", "")
+	if _, err := svc.JoinChannel(ctx, carol, ch.ID); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	post, _ := svc.SendMessage(ctx, owner, ch.ID, "post")
+	if _, err := svc.SendMessage(ctx, carol, ch.ID, "not a comment"); err != ErrForbidden {
+		t.Fatalf("subscriber posted: %v", err)
+	}
+	posts := pub.channelPosts
+	comment, err := svc.Send(ctx, carol, ch.ID, OutgoingMessage{Text: "nice", ThreadRootID: &post.ID})
+	if err != nil || pub.channelPosts != posts+1 {
+		t.Fatalf("comment: %+v, %v", comment, err)
+	}
+	if _, err := svc.Send(ctx, uuid.New(), ch.ID, OutgoingMessage{Text: "spam", ThreadRootID: &post.ID}); err != ErrForbidden {
+		t.Fatalf("non-subscriber commented: %v", err)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	owner, alice, bob := uuid.New(), uuid.New(), uuid.New()
+	repo.usernames[alice] = "Alice_W"
+	repo.usernames[bob] = "bobby"
+	repo.usernames[uuid.New()] = "stranger"
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{alice, bob}, false)
+
+	if got := scanMentions("mail me@bobby, @all and @Alice_W! @@bobby @abc"); len(got) != 2 ||
+		got[0] != (mentionToken{offset: 15, length: 4, name: "all"}) || got[1].name != "alice_w" {
+		t.Fatalf("scan: %+v", got)
+	}
+
+	msg, err := svc.Send(ctx, bob, groupID, OutgoingMessage{Text: "привет @alice_w и @stranger"})
+	if err != nil || len(msg.Mentions) != 1 || *msg.Mentions[0].UserID != alice || msg.Mentions[0].Offset != 7 || msg.Mentions[0].Length != 8 {
+		t.Fatalf("mention: %+v, %v", msg.Mentions, err)
+	}
+	if got := pub.sent[alice]; got[len(got)-1] != EventMentionNew {
+		t.Fatalf("expected mention.new for alice, got %v", got)
+	}
+
+	// @all is for moderators and above
+	if msg, _ := svc.Send(ctx, bob, groupID, OutgoingMessage{Text: "@all lunch?"}); len(msg.Mentions) != 0 {
+		t.Fatalf("member used @all: %+v", msg.Mentions)
+	}
+	forever := int64(-1)
+	if _, err := svc.UpdateDialogSettings(ctx, bob, groupID, DialogSettingsUpdate{MuteFor: &forever}); err != nil {
+		t.Fatalf("mute: %v", err)
+	}
+	before := len(pub.sent[bob])
+	all, _ := svc.Send(ctx, owner, groupID, OutgoingMessage{Text: "@all standup"})
+	if len(all.Mentions) != 1 || !all.Mentions[0].All || len(pub.sent[bob]) == before {
+		t.Fatalf("@all: %+v, bob got %v", all.Mentions, pub.sent[bob][before:])
+	}
+	off := false
+	if _, err := svc.UpdateDialogSettings(ctx, bob, groupID, DialogSettingsUpdate{NotifyMentions: &off}); err != nil {
+		t.Fatalf("settings: %v", err)
+	}
+	before = len(pub.sent[bob])
+	if _, err := svc.Send(ctx, alice, groupID, OutgoingMessage{Text: "@bobby ping"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if slices.Contains(pub.sent[bob][before:], EventMentionNew) {
+		t.Fatalf("muted dialog without notify_mentions must stay silent: %v", pub.sent[bob][before:])
+	}
+
+	dialogs, _ := svc.ListDialogs(ctx, alice, "", DialogFilter{}, 0)
+	if len(dialogs) != 1 || dialogs[0].UnreadMentions != 2 {
+		t.Fatalf("expected 2 unread mentions, got %+v", dialogs)
+	}
+	next, err := svc.NextMention(ctx, alice, groupID, 0)
+	if err != nil || next.ID != msg.ID {
+		t.Fatalf("next mention: %+v, %v", next, err)
+	}
+	if err := svc.MarkRead(ctx, alice, groupID, msg.ID); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if next, err := svc.NextMention(ctx, alice, groupID, 0); err != nil || next.ID != all.ID {
+		t.Fatalf("next after read: %+v, %v", next, err)
+	}
+	dialogs, _ = svc.ListDialogs(ctx, alice, "", DialogFilter{}, 0)
+	if dialogs[0].UnreadMentions != 1 {
+		t.Fatalf("expected 1 unread mention, got %d", dialogs[0].UnreadMentions)
+	}
+
+	// forwarded copies mention no one
+	fwd, err := svc.ForwardMessages(ctx, bob, groupID, []int64{msg.ID}, groupID, false)
+	if err != nil || len(fwd[0].Mentions) != 0 {
+		t.Fatalf("forward: %+v, %v", fwd, err)
+	}
+}
+
+func TestThreadMentions(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	svc := NewService(repo, nil)
+	owner, alice := uuid.New(), uuid.New()
+	repo.usernames[alice] = "alice"
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{alice}, false)
+	unread := func() int64 {
+		t.Helper()
+		list, err := svc.ListDialogs(ctx, alice, "", DialogFilter{}, 0)
+		if err != nil || len(list) != 1 {
+			t.Fatalf("dialogs: %+v, %v", list, err)
+		}
+		return list[0].UnreadMentions
+	}
+
+	main, err := svc.SendMessage(ctx, owner, groupID, "@alice look")
+	if err != nil {
+		t.Fatalf("main: %v", err)
+	}
+	reply, err := svc.Send(ctx, owner, groupID, OutgoingMessage{Text: "@alice and here", ThreadRootID: &main.ID})
+	if err != nil || len(reply.Mentions) != 1 {
+		t.Fatalf("reply: %+v, %v", reply, err)
+	}
+	// both count and both are reachable
+	if n := unread(); n != 2 {
+		t.Fatalf("expected 2 unread mentions, got %d", n)
+	}
+	if next, err := svc.NextMention(ctx, alice, groupID, 0); err != nil || next.ID != main.ID {
+		t.Fatalf("next: %+v, %v", next, err)
+	}
+
+	// reading the timeline leaves the thread mention
+	if err := svc.MarkRead(ctx, alice, groupID, main.ID); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if n := unread(); n != 1 {
+		t.Fatalf("expected the thread mention left, got %d", n)
+	}
+	if next, err := svc.NextMention(ctx, alice, groupID, 0); err != nil || next.ID != reply.ID {
+		t.Fatalf("next in thread: %+v, %v", next, err)
+	}
+
+	// reading the thread clears it
+	if err := svc.MarkThreadRead(ctx, alice, groupID, main.ID, reply.ID); err != nil {
+		t.Fatalf("thread read: %v", err)
+	}
+	if n := unread(); n != 0 {
+		t.Fatalf("expected no unread mentions, got %d", n)
+	}
+	if _, err := svc.NextMention(ctx, alice, groupID, 0); err != ErrMessageNotFound {
+		t.Fatalf("expected no next mention, got %v", err)
+	}
+}
+
+func TestGroupsAreEncryptedByDefault(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	svc := NewService(repo, nil)
+	owner, alice := uuid.New(), uuid.New()
+	repo.usernames[alice] = "alice"
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Family", []uuid.UUID{alice}, true)
+
+	if list, _ := svc.ListDialogs(ctx, alice, "", DialogFilter{}, 0); len(list) != 1 || !list[0].Encrypted {
+		t.Fatalf("expected an encrypted group, got %+v", list)
+	}
+	// the server cannot read the text, so it finds no mentions in it
+	if msg, err := svc.Send(ctx, owner, groupID, OutgoingMessage{Text: "@alice"}); err != nil || len(msg.Mentions) != 0 {
+		t.Fatalf("mentions in an encrypted group: %+v, %v", msg.Mentions, err)
+	}
+	if _, err := svc.CreatePoll(ctx, owner, groupID, PollInput{Question: "Dinner?", Options: []string{"a", "b"}}, ""); err != ErrInvalidMessageKind {
+		t.Fatalf("expected server polls refused, got %v", err)
+	}
+	if _, err := svc.SearchMessages(ctx, owner, SearchQuery{Text: "alice", DialogID: &groupID}); err != ErrSearchEncrypted {
+		t.Fatalf("expected search refused, got %v", err)
+	}
+}
+
+func TestSavedMessages(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	pub := &recordingPublisher{}
+	svc := NewService(repo, nil)
+	svc.SetPublisher(pub)
+	alice, bob := uuid.New(), uuid.New()
+
+	saved, err := svc.CreateDirect(ctx, alice, alice.String())
+	if err != nil || repo.kinds[saved] != KindSaved {
+		t.Fatalf("direct dialog with self: %v, %v", saved, err)
+	}
+	if again, _ := svc.SavedMessages(ctx, alice); again != saved {
+		t.Fatalf("saved dialog recreated: %v != %v", again, saved)
+	}
+	if other, _ := svc.SavedMessages(ctx, bob); other == saved {
+		t.Fatal("saved dialog shared between users")
+	}
+
+	note, err := svc.SendMessage(ctx, alice, saved, "note")
+	if err != nil {
+		t.Fatalf("note: %v", err)
+	}
+	if !slices.Equal(pub.sent[alice], []string{"message.new"}) {
+		t.Fatalf("note not pushed to the author's devices: %v", pub.sent[alice])
+	}
+	if diff, _ := svc.Difference(ctx, alice, 0, 0); len(diff.Messages) != 1 || diff.Messages[0].ID != note.ID {
+		t.Fatalf("note missing from delta sync: %+v", diff)
+	}
+
+	dm, _ := svc.CreateDirect(ctx, alice, bob.String())
+	orig, _ := svc.SendMessage(ctx, bob, dm, "forward me")
+	fwd, err := svc.ForwardMessages(ctx, alice, dm, []int64{orig.ID}, saved, false)
+	if err != nil || len(fwd) != 1 || fwd[0].ForwardedFrom == nil {
+		t.Fatalf("forward to saved: %+v, %v", fwd, err)
+	}
+	if _, err := svc.SendMessage(ctx, bob, saved, "intrude"); err != ErrForbidden {
+		t.Fatalf("others cannot post, got %v", err)
+	}
+	if err := svc.AddMember(ctx, alice, saved, bob); err != ErrNotGroup {
+		t.Fatalf("saved dialog cannot gain members, got %v", err)
+	}
+
+	list, _ := svc.ListDialogs(ctx, alice, FolderInbox, DialogFilter{}, 50)
+	i := slices.IndexFunc(list, func(d Dialog) bool { return d.ID == saved })
+	if i < 0 || list[i].UnreadCount != 0 || list[i].LastMessage == nil || list[i].LastMessage.ID != fwd[0].ID {
+		t.Fatalf("dialog list: %+v", list)
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemRepo()
+	svc := NewService(repo, nil)
+	owner, alice, bob := uuid.New(), uuid.New(), uuid.New()
+	groupID, _, _ := svc.CreateGroup(ctx, owner, "Team", []uuid.UUID{alice}, false)
+	otherID, _, _ := svc.CreateGroup(ctx, bob, "Other", nil, false)
+	direct, _ := svc.CreateDirect(ctx, owner, alice.String())
+
+	release, _ := svc.SendMessage(ctx, owner, groupID, "Release plan for Friday")
+	svc.SendMessage(ctx, alice, groupID, "lunch?")
+	newer, _ := svc.SendMessage(ctx, alice, groupID, "the release is green")
+	svc.SendMessage(ctx, bob, otherID, "release notes")
+	svc.SendMessage(ctx, owner, direct, "release secret")
+
+	hits, err := svc.SearchMessages(ctx, alice, SearchQuery{Text: " release "})
+	if err != nil || len(hits) != 2 || hits[0].MessageID != newer.ID || hits[1].MessageID != release.ID {
+		t.Fatalf("search: %+v, %v", hits, err)
+	}
+	if h := hits[1]; h.Snippet != "Release plan for Friday" || !slices.Equal(h.Highlights, []TextRange{{Offset: 0, Length: 7}}) {
+		t.Fatalf("snippet: %+v", h)
+	}
+
+	page, _ := svc.SearchMessages(ctx, alice, SearchQuery{Text: "release", Limit: 1})
+	rest, _ := svc.SearchMessages(ctx, alice, SearchQuery{Text: "release", Before: page[0].MessageID})
+	if len(page) != 1 || len(rest) != 1 || rest[0].MessageID != release.ID {
+		t.Fatalf("pagination: %+v, %+v", page, rest)
+	}
+	if hits, _ := svc.SearchMessages(ctx, alice, SearchQuery{Text: "release", SenderID: &owner}); len(hits) != 1 || hits[0].MessageID != release.ID {
+		t.Fatalf("sender filter: %+v", hits)
+	}
+	future := time.Now().Add(time.Hour)
+	if hits, _ := svc.SearchMessages(ctx, alice, SearchQuery{Text: "release", From: &future}); len(hits) != 0 {
+		t.Fatalf("date filter: %+v", hits)
+	}
+
+	if _, err := svc.SearchMessages(ctx, alice, SearchQuery{Text: "release", DialogID: &otherID}); err != ErrForbidden {
+		t.Fatalf("foreign dialog, got %v", err)
+	}
+	if _, err := svc.SearchMessages(ctx, alice, SearchQuery{Text: "release", DialogID: &direct}); err != ErrSearchEncrypted {
+		t.Fatalf("encrypted dialog, got %v", err)
+	}
+	if _, err := svc.SearchMessages(ctx, alice, SearchQuery{Text: "  "}); err != ErrInvalidSearch {
+		t.Fatalf("empty query, got %v", err)
+	}
+	if _, err := svc.SearchMessages(ctx, alice, SearchQuery{Text: "x", From: &future, To: &future}); err != ErrInvalidSearch {
+		t.Fatalf("empty period, got %v", err)
+	}
+}
+
+func TestParseSnippet(t *testing.T) {
+	text, ranges := parseSnippet("\x01Привет\x02, мир \x01релиз\x02")
+	if text != "Привет, мир релиз" || !slices.Equal(ranges, []TextRange{{0, 6}, {12, 5}}) {
+		t.Fatalf("parseSnippet: %q %+v", text, ranges)
 	}
 }
@@ -0,0 +1,222 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	syncPageSize    = 100
+	maxSyncPageSize = 500
+	// maxSyncGap is the largest backlog served update by update; a client
+	// further behind refetches its dialogs instead.
+	maxSyncGap = 10000
+	pruneBatch = 5000
+)
+
+var ErrInvalidSince = errors.New("invalid since")
+
+// SyncState is the client's position in its update log.
+type SyncState struct {
+	Pts int64 `json:"pts"`
+}
+
+// Difference is a page of updates after a client's pts. Messages holds the
+// current state of messages referenced by message.new and message.edited,
+// Drafts the current drafts of dialogs with draft.updated.
+// With TooLong the client should drop its cache, reload dialogs and history
+// and continue from State.
+type Difference struct {
+	State    SyncState `json:"state"`
+	Updates  []Update  `json:"updates"`
+	Messages []Message `json:"messages"`
+	Drafts   []Draft   `json:"drafts"`
+	HasMore  bool      `json:"has_more"`
+	TooLong  bool      `json:"too_long"`
+}
+
+// SyncState returns the caller's current pts.
+func (s *Service) SyncState(ctx context.Context, currentUser uuid.UUID) (SyncState, error) {
+	pts, _, err := s.repo.UpdateState(ctx, currentUser)
+	return SyncState{Pts: pts}, err
+}
+
+// Difference returns updates after since, oldest first. Channel posts are not
+// in the log; clients catch up on channels through their history.
+func (s *Service) Difference(ctx context.Context, currentUser uuid.UUID, since int64, limit int) (Difference, error) {
+	if since < 0 {
+		return Difference{}, ErrInvalidSince
+	}
+	if limit <= 0 || limit > maxSyncPageSize {
+		limit = syncPageSize
+	}
+	pts, minPts, err := s.repo.UpdateState(ctx, currentUser)
+	if err != nil {
+		return Difference{}, err
+	}
+	diff := Difference{State: SyncState{Pts: pts}, Updates: []Update{}, Messages: []Message{}, Drafts: []Draft{}}
+	// a client ahead of the server or past the retained log cannot be patched;
+	// an empty log behind pts means everything after since was pruned
+	if since > pts || pts-since > maxSyncGap || (since < pts && (minPts == 0 || since < minPts-1)) {
+		diff.TooLong = true
+		return diff, nil
+	}
+	updates, err := s.repo.Updates(ctx, currentUser, since, limit+1)
+	if err != nil {
+		return Difference{}, err
+	}
+	if len(updates) > limit {
+		updates = updates[:limit]
+		diff.HasMore = true
+	}
+	if len(updates) == 0 {
+		return diff, nil
+	}
+	diff.Updates = updates
+	diff.State.Pts = updates[len(updates)-1].Pts
+
+	var (
+		ids      []int64
+		draftIDs []uuid.UUID
+	)
+	for _, u := range updates {
+		if u.Type == EventDraftUpdated && !contains(draftIDs, u.DialogID) {
+			draftIDs = append(draftIDs, u.DialogID)
+		}
+		if u.MessageID != nil && (u.Type == EventMessageNew || u.Type == EventMessageEdited) && !containsID(ids, *u.MessageID) {
+			ids = append(ids, *u.MessageID)
+		}
+	}
+	msgs, err := s.repo.MessagesByID(ctx, currentUser, ids)
+	if err != nil {
+		return Difference{}, err
+	}
+	if err := s.attachPolls(ctx, currentUser, msgs); err != nil {
+		return Difference{}, err
+	}
+	if err := s.attachReactions(ctx, currentUser, msgs); err != nil {
+		return Difference{}, err
+	}
+	if err := s.attachMedia(ctx, msgs); err != nil {
+		return Difference{}, err
+	}
+	if err := s.attachThreads(ctx, currentUser, msgs); err != nil {
+		return Difference{}, err
+	}
+	if msgs != nil {
+		diff.Messages = msgs
+	}
+	if len(draftIDs) > 0 {
+		drafts, err := s.repo.DraftsByDialog(ctx, currentUser, draftIDs)
+		if err != nil {
+			return Difference{}, err
+		}
+		if drafts != nil {
+			diff.Drafts = drafts
+		}
+	}
+	return diff, nil
+}
+
+// PruneUpdates drops updates older than maxAge in batches and returns how
+// many were removed.
+func (s *Service) PruneUpdates(ctx context.Context, maxAge time.Duration) (int, error) {
+	before := time.Now().Add(-maxAge)
+	total := 0
+	for {
+		n, err := s.repo.PruneUpdates(ctx, before, pruneBatch)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < pruneBatch {
+			return total, nil
+		}
+	}
+}
+
+// RunUpdatePruner calls PruneUpdates every interval until ctx is done.
+func (s *Service) RunUpdatePruner(ctx context.Context, interval, maxAge time.Duration, logger zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.PruneUpdates(ctx, maxAge); err != nil {
+				logger.Warn().Err(err).Msg("prune update log failed")
+			} else if n > 0 {
+				logger.Debug().Int("count", n).Msg("update log pruned")
+			}
+		}
+	}
+}
+
+// recordUpdate appends u to the logs of users, skipping those separated from
+// the actor by a block. Callers run it in the transaction of the change it
+// describes, so a stored change is never missing from the log.
+func (s *Service) recordUpdate(ctx context.Context, users []uuid.UUID, u Update) error {
+	if u.ActorID != nil && s.privacy != nil {
+		blocked, err := s.privacy.BlockedAmong(ctx, *u.ActorID, users)
+		if err != nil {
+			return err
+		}
+		if len(blocked) > 0 {
+			kept := make([]uuid.UUID, 0, len(users))
+			for _, id := range users {
+				if !contains(blocked, id) {
+					kept = append(kept, id)
+				}
+			}
+			users = kept
+		}
+	}
+	return s.repo.AppendUpdate(ctx, users, u)
+}
+
+type afterCommitKey struct{}
+
+// inTx runs fn in a repository transaction and then delivers the events fn
+// queued with publish. Nested calls join the outer transaction, whose commit
+// delivers everything.
+func (s *Service) inTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, nested := ctx.Value(afterCommitKey{}).(*[]func(context.Context)); nested {
+		return s.repo.InTx(ctx, fn)
+	}
+	var queued []func(context.Context)
+	if err := s.repo.InTx(context.WithValue(ctx, afterCommitKey{}, &queued), fn); err != nil {
+		return err
+	}
+	for _, deliver := range queued {
+		deliver(ctx)
+	}
+	return nil
+}
+
+// publish hands an event to the publisher once the transaction of ctx
+// commits, or right away outside of one. Delivery is best effort.
+func (s *Service) publish(ctx context.Context, fn func(ctx context.Context, p EventPublisher) error) {
+	if s.publisher == nil {
+		return
+	}
+	deliver := func(ctx context.Context) { _ = fn(ctx, s.publisher) }
+	if queued, ok := ctx.Value(afterCommitKey{}).(*[]func(context.Context)); ok {
+		*queued = append(*queued, deliver)
+		return
+	}
+	deliver(ctx)
+}
+
+func containsID(list []int64, id int64) bool {
+	for _, v := range list {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
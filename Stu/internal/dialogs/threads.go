@@ -0,0 +1,151 @@
+package dialogs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// maxThreadRepliers caps the latest repliers listed in a thread summary.
+const maxThreadRepliers = 3
+
+var ErrInvalidThread = errors.New("invalid thread")
+
+// Thread summarizes the replies to a root message. LastReadID and
+// UnreadCount are the caller's own read state in the thread.
+type Thread struct {
+	ReplyCount  int   `json:"reply_count"`
+	LastReplyID int64 `json:"last_reply_id"`
+	// RecentRepliers lists the latest distinct repliers, most recent first.
+	RecentRepliers []uuid.UUID `json:"recent_repliers"`
+	LastReadID     int64       `json:"last_read_id"`
+	UnreadCount    int         `json:"unread_count"`
+}
+
+// sendThreadReply posts out into the thread of out.ThreadRootID. Threads
+// exist in groups and channels; in a channel they are its comment section,
+// so any member may reply there, not only the admins who post.
+func (s *Service) sendThreadReply(ctx context.Context, currentUser, dialogID uuid.UUID, out OutgoingMessage) (Message, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, ErrForbidden
+	}
+	kind, root, err := s.threadRoot(ctx, dialogID, *out.ThreadRootID)
+	if err != nil {
+		return Message{}, err
+	}
+	if err := s.checkCanMessage(ctx, dialogID, currentUser); err != nil {
+		return Message{}, err
+	}
+	in := NewMessage{
+		DialogID: dialogID, SenderID: currentUser, Kind: out.Kind, Text: out.Text, ClientMessageID: out.ClientMessageID, ThreadRootID: &root.ID,
+		Attachments: out.Attachments,
+	}
+	var preview *ReplyPreview
+	if out.ReplyTo != nil {
+		orig, quote, err := s.replyTarget(ctx, dialogID, *out.ReplyTo, out.Quote)
+		if err != nil {
+			return Message{}, err
+		}
+		// within a thread, replies go to the root or to another reply of it
+		if orig.ID != root.ID && (orig.ThreadRootID == nil || *orig.ThreadRootID != root.ID) {
+			return Message{}, ErrInvalidReply
+		}
+		in.ReplyTo, in.Quote = &orig.ID, quote
+		preview = &ReplyPreview{ID: orig.ID, SenderID: orig.SenderID, Kind: orig.Kind, Text: truncateRunes(orig.Text, replyPreviewLength), Quote: quote}
+	}
+	return s.store(ctx, kind, in, preview)
+}
+
+// threadRoot loads a message that can root a thread and returns it with the
+// dialog kind: a live main-timeline message of a group or a channel.
+func (s *Service) threadRoot(ctx context.Context, dialogID uuid.UUID, rootID int64) (string, Message, error) {
+	kind, err := s.repo.DialogKind(ctx, dialogID)
+	if err != nil {
+		return "", Message{}, err
+	}
+	if kind != KindGroup && kind != KindChannel {
+		return "", Message{}, ErrInvalidThread
+	}
+	root, err := s.repo.GetMessage(ctx, dialogID, rootID)
+	if errors.Is(err, ErrMessageNotFound) {
+		return "", Message{}, ErrInvalidThread
+	}
+	if err != nil {
+		return "", Message{}, err
+	}
+	if root.Deleted || root.Kind == "system" || root.Kind == "poll_vote" || root.ThreadRootID != nil {
+		return "", Message{}, ErrInvalidThread
+	}
+	return kind, root, nil
+}
+
+// ListThread returns the replies in the thread of rootID, newest first.
+func (s *Service) ListThread(ctx context.Context, currentUser, dialogID uuid.UUID, rootID int64, limit int, before int64) ([]Message, error) {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrForbidden
+	}
+	if _, _, err := s.threadRoot(ctx, dialogID, rootID); err != nil {
+		return nil, err
+	}
+	msgs, err := s.repo.ListThread(ctx, dialogID, currentUser, rootID, limit, before)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.attachPolls(ctx, currentUser, msgs); err != nil {
+		return nil, err
+	}
+	if err := s.attachReactions(ctx, currentUser, msgs); err != nil {
+		return nil, err
+	}
+	if err := s.attachMedia(ctx, msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// MarkThreadRead records that the caller read the thread of rootID up to
+// messageID. Thread reads are private and are not published to other members.
+func (s *Service) MarkThreadRead(ctx context.Context, currentUser, dialogID uuid.UUID, rootID, messageID int64) error {
+	ok, err := s.repo.CheckMember(ctx, dialogID, currentUser)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrForbidden
+	}
+	if _, _, err := s.threadRoot(ctx, dialogID, rootID); err != nil {
+		return err
+	}
+	_, err = s.repo.MarkThreadRead(ctx, rootID, currentUser, messageID)
+	return err
+}
+
+// attachThreads fills Thread of the listed main-timeline messages for the viewer.
+func (s *Service) attachThreads(ctx context.Context, viewer uuid.UUID, msgs []Message) error {
+	var ids []int64
+	for _, m := range msgs {
+		if m.ThreadRootID == nil && !m.Deleted {
+			ids = append(ids, m.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	byRoot, err := s.repo.ThreadSummaries(ctx, viewer, ids)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		msgs[i].Thread = byRoot[msgs[i].ID]
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package minio
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"stu/internal/config"
+)
+
+// region is what MinIO expects in signatures unless configured otherwise.
+const region = "us-east-1"
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Client talks to MinIO over the S3 API, signing requests with AWS
+// Signature Version 4. It covers only what the services use.
+type Client struct {
+	scheme    string
+	host      string
+	accessKey string
+	secretKey string
+	bucket    string
+	http      *http.Client
+}
+
+// New creates a client from config.
+func New(cfg config.MinIOConfig) *Client {
+	scheme := "http"
+	if cfg.UseSSL {
+		scheme = "https"
+	}
+	return &Client{
+		scheme:    scheme,
+		host:      cfg.Endpoint,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		bucket:    cfg.Bucket,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// DeleteObject removes key from bucket, the configured one when empty.
+// A missing object is not an error, so deletes can be retried.
+func (c *Client) DeleteObject(ctx context.Context, bucket, key string) error {
+	if bucket == "" {
+		bucket = c.bucket
+	}
+	path := "/" + bucket + "/" + key
+	u := &url.URL{Scheme: c.scheme, Host: c.host, Path: path, RawPath: "/" + escapePath(bucket) + "/" + escapePath(key)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	c.sign(req, time.Now().UTC())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("minio: delete %s/%s: %s", bucket, key, resp.Status)
+}
+
+// sign adds the SigV4 headers for a request without a body.
+func (c *Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + emptyPayloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath percent-encodes an object key the way S3 canonicalizes it:
+// everything but unreserved characters and slashes.
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		ch := p[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
@@ -0,0 +1,146 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+const (
+	eventChannelSubscribed   = "channel.subscribed"
+	eventChannelUnsubscribed = "channel.unsubscribed"
+)
+
+// ChannelSource lists the channels a user is subscribed to.
+type ChannelSource interface {
+	UserChannels(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
+}
+
+func dialogChannel(dialogID string) string {
+	return "dialog:" + dialogID
+}
+
+// channelFanout routes channel posts. A post is published once to
+// dialog:<id>; every realtime node holds a single Redis subscription per
+// channel that has at least one locally connected subscriber and copies
+// the payload to those connections only. Publishing cost does not depend
+// on the subscriber count and each node only sees channels it serves.
+type channelFanout struct {
+	logger zerolog.Logger
+	pubsub *redis.PubSub
+	send   func(userID string, payload []byte)
+
+	mu     sync.Mutex
+	local  map[string]map[string]struct{} // dialogID -> connected userIDs
+	byUser map[string]map[string]struct{} // userID -> dialogIDs
+}
+
+func newChannelFanout(rdb *redis.Client, logger zerolog.Logger, send func(userID string, payload []byte)) *channelFanout {
+	f := &channelFanout{
+		logger: logger,
+		pubsub: rdb.Subscribe(context.Background()),
+		send:   send,
+		local:  make(map[string]map[string]struct{}),
+		byUser: make(map[string]map[string]struct{}),
+	}
+	go f.run()
+	return f
+}
+
+func (f *channelFanout) run() {
+	for msg := range f.pubsub.Channel() {
+		dialogID := strings.TrimPrefix(msg.Channel, "dialog:")
+		f.mu.Lock()
+		users := make([]string, 0, len(f.local[dialogID]))
+		for u := range f.local[dialogID] {
+			users = append(users, u)
+		}
+		f.mu.Unlock()
+		for _, u := range users {
+			f.send(u, []byte(msg.Payload))
+		}
+	}
+}
+
+// add routes posts of dialogIDs to userID.
+func (f *channelFanout) add(ctx context.Context, userID string, dialogIDs ...string) {
+	var subscribe []string
+	f.mu.Lock()
+	if f.byUser[userID] == nil {
+		f.byUser[userID] = make(map[string]struct{})
+	}
+	for _, id := range dialogIDs {
+		if _, ok := f.byUser[userID][id]; ok {
+			continue
+		}
+		f.byUser[userID][id] = struct{}{}
+		if f.local[id] == nil {
+			f.local[id] = make(map[string]struct{})
+			subscribe = append(subscribe, dialogChannel(id))
+		}
+		f.local[id][userID] = struct{}{}
+	}
+	f.mu.Unlock()
+	if len(subscribe) > 0 {
+		if err := f.pubsub.Subscribe(ctx, subscribe...); err != nil {
+			f.logger.Warn().Err(err).Msg("channel subscribe failed")
+		}
+	}
+}
+
+// remove stops routing dialogIDs to userID; without ids, all of the user's channels.
+func (f *channelFanout) remove(ctx context.Context, userID string, dialogIDs ...string) {
+	var unsubscribe []string
+	f.mu.Lock()
+	if len(dialogIDs) == 0 {
+		for id := range f.byUser[userID] {
+			dialogIDs = append(dialogIDs, id)
+		}
+	}
+	for _, id := range dialogIDs {
+		if _, ok := f.byUser[userID][id]; !ok {
+			continue
+		}
+		delete(f.byUser[userID], id)
+		delete(f.local[id], userID)
+		if len(f.local[id]) == 0 {
+			delete(f.local, id)
+			unsubscribe = append(unsubscribe, dialogChannel(id))
+		}
+	}
+	if len(f.byUser[userID]) == 0 {
+		delete(f.byUser, userID)
+	}
+	f.mu.Unlock()
+	if len(unsubscribe) > 0 {
+		if err := f.pubsub.Unsubscribe(ctx, unsubscribe...); err != nil {
+			f.logger.Warn().Err(err).Msg("channel unsubscribe failed")
+		}
+	}
+}
+
+// handleUserEvent keeps routing in sync with subscription changes
+// delivered on the user's own channel.
+func (f *channelFanout) handleUserEvent(ctx context.Context, userID string, payload []byte) {
+	if !strings.Contains(string(payload), "channel.") {
+		return
+	}
+	var ev struct {
+		Type     string `json:"type"`
+		DialogID string `json:"dialog_id"`
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return
+	}
+	switch ev.Type {
+	case eventChannelSubscribed:
+		f.add(ctx, userID, ev.DialogID)
+	case eventChannelUnsubscribed:
+		f.remove(ctx, userID, ev.DialogID)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
@@ -25,18 +26,43 @@ type Hub struct {
 	upgrader  websocket.Upgrader
 	rdb       *redis.Client
 	validator AccessValidator
+	presence  *Presence
+	channels  ChannelSource
+	sender    MessageSender
+	fanout    *channelFanout
 	connsMu   sync.RWMutex
-	conns     map[string]*websocket.Conn // userID -> conn (single per user for simplicity)
+	conns     map[string]*wsConn // userID -> conn (single per user for simplicity)
+}
+
+// wsConn serializes writes: user events and channel posts arrive from
+// different goroutines, and websocket.Conn allows one writer at a time.
+type wsConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (c *wsConn) write(payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(websocket.TextMessage, payload)
 }
 
 func NewHub(logger zerolog.Logger, rdb *redis.Client, validator AccessValidator) *Hub {
-	return &Hub{
+	h := &Hub{
 		logger:    logger,
 		upgrader:  websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
 		rdb:       rdb,
 		validator: validator,
-		conns:     make(map[string]*websocket.Conn),
+		presence:  NewPresence(rdb),
+		conns:     make(map[string]*wsConn),
 	}
+	h.fanout = newChannelFanout(rdb, logger, h.sendTo)
+	return h
+}
+
+// SetChannelSource enables delivery of channel posts.
+func (h *Hub) SetChannelSource(src ChannelSource) {
+	h.channels = src
 }
 
 func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request) {
@@ -65,28 +91,70 @@ func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := h.upgrader.Upgrade(w, r, nil)
+	ws, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.logger.Warn().Err(err).Msg("ws upgrade failed")
 		return
 	}
+	conn := &wsConn{Conn: ws}
 	userID := session.UserID
 	h.storeConn(userID, conn)
-	go h.subscribeUser(context.Background(), userID)
+	h.touchPresence(userID)
+	subCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.subscribeUser(subCtx, userID)
+	h.subscribeChannels(subCtx, userID)
 
 	// basic ping/pong loop
-	conn.SetReadLimit(1024)
+	conn.SetReadLimit(maxInboundFrame)
 	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.SetPongHandler(func(string) error {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		h.touchPresence(userID)
 		return nil
 	})
 	for {
-		if _, _, err := conn.NextReader(); err != nil {
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
 			break
 		}
+		h.touchPresence(userID)
+		if typ == websocket.TextMessage {
+			h.handleFrame(userID, hash[:], conn, data)
+		}
+	}
+	if h.removeConn(userID, conn) {
+		h.fanout.remove(context.Background(), userID)
+		if err := h.presence.Offline(context.Background(), userID); err != nil {
+			h.logger.Warn().Err(err).Msg("presence offline failed")
+		}
+	}
+}
+
+func (h *Hub) subscribeChannels(ctx context.Context, userID string) {
+	if h.channels == nil {
+		return
+	}
+	uid, err := uuid.Parse(userID)
+	if err != nil {
+		return
+	}
+	ids, err := h.channels.UserChannels(ctx, uid)
+	if err != nil {
+		h.logger.Warn().Err(err).Msg("load user channels failed")
+		return
+	}
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, id.String())
+	}
+	h.fanout.add(ctx, userID, names...)
+}
+
+func (h *Hub) touchPresence(userID string) {
+	if err := h.presence.Touch(context.Background(), userID); err != nil {
+		h.logger.Warn().Err(err).Msg("presence update failed")
 	}
-	h.removeConn(userID)
 }
 
 func (h *Hub) subscribeUser(ctx context.Context, userID string) {
@@ -94,8 +162,17 @@ func (h *Hub) subscribeUser(ctx context.Context, userID string) {
 	sub := h.rdb.Subscribe(ctx, channel)
 	defer sub.Close()
 	ch := sub.Channel()
-	for msg := range ch {
-		h.sendTo(userID, []byte(msg.Payload))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			h.fanout.handleUserEvent(ctx, userID, []byte(msg.Payload))
+			h.sendTo(userID, []byte(msg.Payload))
+		}
 	}
 }
 
@@ -110,10 +187,10 @@ func (h *Hub) sendTo(userID string, payload []byte) {
 	if !ok {
 		return
 	}
-	_ = conn.WriteMessage(websocket.TextMessage, payload)
+	_ = conn.write(payload)
 }
 
-func (h *Hub) storeConn(userID string, conn *websocket.Conn) {
+func (h *Hub) storeConn(userID string, conn *wsConn) {
 	h.connsMu.Lock()
 	defer h.connsMu.Unlock()
 	// close existing
@@ -123,8 +200,13 @@ func (h *Hub) storeConn(userID string, conn *websocket.Conn) {
 	h.conns[userID] = conn
 }
 
-func (h *Hub) removeConn(userID string) {
+// removeConn drops conn unless it was already replaced by a newer one.
+func (h *Hub) removeConn(userID string, conn *wsConn) bool {
 	h.connsMu.Lock()
 	defer h.connsMu.Unlock()
+	if cur, ok := h.conns[userID]; ok && cur != conn {
+		return false
+	}
 	delete(h.conns, userID)
+	return true
 }
@@ -2,8 +2,10 @@ package realtime
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,14 +16,19 @@ import (
 	"github.com/rs/zerolog"
 
 	"stu/internal/auth"
+	"stu/internal/dialogs"
 )
 
 type stubAuthRepo struct {
 	userID   uuid.UUID
 	deviceID uuid.UUID
+	banned   atomic.Bool
 }
 
 func (s *stubAuthRepo) ValidateAccessToken(ctx context.Context, accessHash []byte) (auth.SessionInfo, error) {
+	if s.banned.Load() {
+		return auth.SessionInfo{UserID: s.userID.String(), DeviceID: s.deviceID.String(), Banned: true}, auth.ErrBanned
+	}
 	return auth.SessionInfo{
 		UserID:   s.userID.String(),
 		DeviceID: s.deviceID.String(),
@@ -66,6 +73,189 @@ func TestHubReceivesEvent(t *testing.T) {
 	}
 }
 
+type stubBlocks map[uuid.UUID]bool
+
+func (s stubBlocks) BlockedAmong(ctx context.Context, userID uuid.UUID, others []uuid.UUID) ([]uuid.UUID, error) {
+	var res []uuid.UUID
+	for _, o := range others {
+		if s[o] {
+			res = append(res, o)
+		}
+	}
+	return res, nil
+}
+
+func TestPublisherSkipsBlockedRecipients(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := context.Background()
+	actor, friend, blocked := uuid.New(), uuid.New(), uuid.New()
+
+	pub := NewRedisPublisher(rdb)
+	pub.SetBlockFilter(stubBlocks{blocked: true})
+
+	sub := rdb.Subscribe(ctx, channelForUser(friend), channelForUser(blocked))
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if err := pub.PublishTyping(ctx, uuid.New(), actor, []uuid.UUID{actor, friend, blocked}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	select {
+	case msg := <-sub.Channel():
+		if msg.Channel != channelForUser(friend) {
+			t.Fatalf("event leaked to %s", msg.Channel)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("friend did not receive typing")
+	}
+	select {
+	case msg := <-sub.Channel():
+		t.Fatalf("unexpected event on %s", msg.Channel)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type stubChannels []uuid.UUID
+
+func (s stubChannels) UserChannels(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	return s, nil
+}
+
+func TestHubChannelFanout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := zerolog.New(zerolog.NewTestWriter(t))
+	repo := &stubAuthRepo{userID: uuid.New(), deviceID: uuid.New()}
+	subscribed, joined := uuid.New(), uuid.New()
+	hub := NewHub(logger, rdb, repo)
+	hub.SetChannelSource(stubChannels{subscribed})
+
+	srv := httptest.NewServer(hubHandler(hub))
+	defer srv.Close()
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer abc")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[len("http"):]+"/v1/ws", header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx := context.Background()
+	pub := NewRedisPublisher(rdb)
+	post := dialogs.Message{ID: 7, DialogID: subscribed, SenderID: uuid.New(), Kind: "text", Text: "пост", CreatedAt: time.Now()}
+	if err := pub.PublishChannelMessage(ctx, post); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	expectEvent(t, conn, "message.new", subscribed)
+
+	// joining while connected starts routing without reconnect
+	if err := pub.PublishSubscription(ctx, joined, repo.userID, true); err != nil {
+		t.Fatalf("publish subscription: %v", err)
+	}
+	expectEvent(t, conn, eventChannelSubscribed, joined)
+	time.Sleep(50 * time.Millisecond)
+	post.DialogID = joined
+	if err := pub.PublishChannelMessage(ctx, post); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	expectEvent(t, conn, "message.new", joined)
+}
+
+func expectEvent(t *testing.T, conn *websocket.Conn, typ string, dialogID uuid.UUID) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, raw, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read %s: %v", typ, err)
+	}
+	var ev event
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if ev.Type != typ || ev.DialogID != dialogID.String() {
+		t.Fatalf("expected %s for %s, got %s", typ, dialogID, raw)
+	}
+}
+
+// stubSender stores one message per client id, like the dialogs service.
+type stubSender struct {
+	byClientID map[string]dialogs.Message
+}
+
+func (s *stubSender) Send(ctx context.Context, currentUser, dialogID uuid.UUID, out dialogs.OutgoingMessage) (dialogs.Message, error) {
+	if out.Text == "" {
+		return dialogs.Message{}, dialogs.ErrEmptyMessage
+	}
+	if msg, ok := s.byClientID[out.ClientMessageID]; ok {
+		return msg, nil
+	}
+	msg := dialogs.Message{
+		ID: int64(len(s.byClientID) + 1), DialogID: dialogID, SenderID: currentUser, Text: out.Text, ClientMessageID: out.ClientMessageID,
+	}
+	s.byClientID[out.ClientMessageID] = msg
+	return msg, nil
+}
+
+func TestHubMessageSend(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	logger := zerolog.New(zerolog.NewTestWriter(t))
+	repo := &stubAuthRepo{userID: uuid.New(), deviceID: uuid.New()}
+	hub := NewHub(logger, rdb, repo)
+	hub.SetMessageSender(&stubSender{byClientID: make(map[string]dialogs.Message)})
+
+	srv := httptest.NewServer(hubHandler(hub))
+	defer srv.Close()
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer abc")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+srv.URL[len("http"):]+"/v1/ws", header)
+	if err != nil {
+		t.Fatalf("ws dial: %v", err)
+	}
+	defer conn.Close()
+
+	dialogID := uuid.New()
+	send := func(frame map[string]any) sendReply {
+		t.Helper()
+		if err := conn.WriteJSON(frame); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var res sendReply
+		if err := conn.ReadJSON(&res); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		return res
+	}
+
+	frame := map[string]any{"type": frameMessageSend, "dialog_id": dialogID, "text": "привет", "client_message_id": "c-1"}
+	first := send(frame)
+	if first.Type != frameMessageSent || first.Message == nil || first.Message.SenderID != repo.userID {
+		t.Fatalf("unexpected reply %+v", first)
+	}
+	retry := send(frame)
+	if retry.Type != frameMessageSent || retry.Message.ID != first.Message.ID {
+		t.Fatalf("retry must return the original message, got %+v", retry)
+	}
+	failed := send(map[string]any{"type": frameMessageSend, "dialog_id": dialogID, "client_message_id": "c-2"})
+	if failed.Type != frameMessageFailed || failed.ClientMessageID != "c-2" || failed.Error != dialogs.ErrEmptyMessage.Error() {
+		t.Fatalf("unexpected failure reply %+v", failed)
+	}
+	if res := send(map[string]any{"type": "bogus"}); res.Type != frameError {
+		t.Fatalf("unknown frames must be rejected, got %+v", res)
+	}
+
+	repo.banned.Store(true)
+	banned := send(map[string]any{"type": frameMessageSend, "dialog_id": dialogID, "text": "ещё", "client_message_id": "c-3"})
+	if banned.Type != frameMessageFailed || banned.Error != "banned" {
+		t.Fatalf("a ban must stop sends on an open socket, got %+v", banned)
+	}
+}
+
 // helper to wrap hub.HandleWS into http.Handler
 func hubHandler(h *Hub) http.Handler {
 	mux := http.NewServeMux()
@@ -0,0 +1,119 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"stu/internal/auth"
+	"stu/internal/dialogs"
+)
+
+// Inbound frame types and their replies.
+const (
+	frameMessageSend   = "message.send"
+	frameMessageSent   = "message.sent"
+	frameMessageFailed = "message.failed"
+	frameError         = "error"
+)
+
+// maxInboundFrame bounds client frames; message text dominates the size.
+const maxInboundFrame = 64 << 10
+
+const sendTimeout = 10 * time.Second
+
+// MessageSender stores messages sent over the socket.
+type MessageSender interface {
+	Send(ctx context.Context, currentUser, dialogID uuid.UUID, out dialogs.OutgoingMessage) (dialogs.Message, error)
+}
+
+// inboundFrame is a client request. For message.send it carries the same
+// fields as POST /v1/dialogs/{id}/messages plus dialog_id.
+type inboundFrame struct {
+	Type     string    `json:"type"`
+	DialogID uuid.UUID `json:"dialog_id"`
+	dialogs.OutgoingMessage
+}
+
+// sendReply answers a message.send; retries with the same client_message_id
+// get the original message.
+type sendReply struct {
+	Type            string           `json:"type"`
+	ClientMessageID string           `json:"client_message_id,omitempty"`
+	Message         *dialogs.Message `json:"message,omitempty"`
+	Error           string           `json:"error,omitempty"`
+}
+
+// SetMessageSender enables message.send frames.
+func (h *Hub) SetMessageSender(sender MessageSender) {
+	h.sender = sender
+}
+
+func (h *Hub) handleFrame(userID string, tokenHash []byte, conn *wsConn, data []byte) {
+	var frame inboundFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		h.reply(conn, sendReply{Type: frameError, Error: "invalid frame"})
+		return
+	}
+	switch frame.Type {
+	case frameMessageSend:
+		h.handleSend(userID, tokenHash, conn, frame)
+	default:
+		h.reply(conn, sendReply{Type: frameError, Error: "unknown frame type"})
+	}
+}
+
+// handleSend re-validates the connection's token on every frame: a ban or a
+// revoked session must stop sends on sockets opened before it, as it stops
+// them over HTTP.
+func (h *Hub) handleSend(userID string, tokenHash []byte, conn *wsConn, frame inboundFrame) {
+	res := sendReply{Type: frameMessageFailed, ClientMessageID: frame.ClientMessageID}
+	if h.sender == nil {
+		res.Error = "sending over websocket is disabled"
+		h.reply(conn, res)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if _, err := h.validator.ValidateAccessToken(ctx, tokenHash); err != nil {
+		res.Error = "unauthorized"
+		if errors.Is(err, auth.ErrBanned) {
+			res.Error = "banned"
+		}
+		h.reply(conn, res)
+		return
+	}
+	msg, err := h.sender.Send(ctx, uuid.MustParse(userID), frame.DialogID, frame.OutgoingMessage)
+	if err != nil {
+		res.Error = sendErrorText(err)
+		if res.Error == "internal error" {
+			h.logger.Error().Err(err).Msg("ws send failed")
+		}
+		h.reply(conn, res)
+		return
+	}
+	res.Type = frameMessageSent
+	res.Message = &msg
+	h.reply(conn, res)
+}
+
+func (h *Hub) reply(conn *wsConn, res sendReply) {
+	payload, _ := json.Marshal(res)
+	_ = conn.write(payload)
+}
+
+// sendErrorText mirrors the HTTP error texts of message sending.
+func sendErrorText(err error) string {
+	for _, known := range []error{
+		dialogs.ErrForbidden, dialogs.ErrInvalidReply, dialogs.ErrEmptyMessage, dialogs.ErrInvalidClientID,
+		dialogs.ErrInvalidMessageKind, dialogs.ErrInvalidThread, dialogs.ErrInvalidAttachment,
+	} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "internal error"
+}
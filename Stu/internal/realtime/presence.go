@@ -0,0 +1,68 @@
+package realtime
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	presenceTTL         = 90 * time.Second
+	presenceLastSeenKey = "presence:last_seen"
+)
+
+// Presence keeps online flags and last seen timestamps in Redis.
+type Presence struct {
+	rdb *redis.Client
+}
+
+func NewPresence(rdb *redis.Client) *Presence {
+	return &Presence{rdb: rdb}
+}
+
+func presenceKey(userID string) string {
+	return "presence:online:" + userID
+}
+
+// Touch marks the user online for presenceTTL.
+func (p *Presence) Touch(ctx context.Context, userID string) error {
+	pipe := p.rdb.TxPipeline()
+	pipe.Set(ctx, presenceKey(userID), 1, presenceTTL)
+	pipe.HSet(ctx, presenceLastSeenKey, userID, time.Now().Unix())
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Offline clears the online flag and records last seen.
+func (p *Presence) Offline(ctx context.Context, userID string) error {
+	pipe := p.rdb.TxPipeline()
+	pipe.Del(ctx, presenceKey(userID))
+	pipe.HSet(ctx, presenceLastSeenKey, userID, time.Now().Unix())
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Status returns the raw (unfiltered) presence of a user.
+func (p *Presence) Status(ctx context.Context, userID uuid.UUID) (bool, *time.Time, error) {
+	id := userID.String()
+	n, err := p.rdb.Exists(ctx, presenceKey(id)).Result()
+	if err != nil {
+		return false, nil, err
+	}
+	raw, err := p.rdb.HGet(ctx, presenceLastSeenKey, id).Result()
+	if err == redis.Nil {
+		return n > 0, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return n > 0, nil, nil
+	}
+	seen := time.Unix(ts, 0).UTC()
+	return n > 0, &seen, nil
+}
@@ -11,42 +11,93 @@ import (
 	"stu/internal/dialogs"
 )
 
+// BlockFilter tells which users are separated from an actor by a block.
+type BlockFilter interface {
+	BlockedAmong(ctx context.Context, userID uuid.UUID, others []uuid.UUID) ([]uuid.UUID, error)
+}
+
 // RedisPublisher publishes dialog events into per-user channels.
 type RedisPublisher struct {
-	rdb *redis.Client
+	rdb    *redis.Client
+	blocks BlockFilter
 }
 
 func NewRedisPublisher(rdb *redis.Client) *RedisPublisher {
 	return &RedisPublisher{rdb: rdb}
 }
 
+// SetBlockFilter drops events between users that blocked each other.
+func (p *RedisPublisher) SetBlockFilter(blocks BlockFilter) {
+	p.blocks = blocks
+}
+
 type event struct {
-	Type      string `json:"type"`
-	DialogID  string `json:"dialog_id"`
-	MessageID int64  `json:"message_id,omitempty"`
-	SenderID  string `json:"sender_id,omitempty"`
-	Text      string `json:"text,omitempty"`
-	CreatedAt string `json:"created_at,omitempty"`
-	UserID    string `json:"user_id,omitempty"`
+	Type          string                 `json:"type"`
+	DialogID      string                 `json:"dialog_id"`
+	MessageID     int64                  `json:"message_id,omitempty"`
+	SenderID      string                 `json:"sender_id,omitempty"`
+	Text          string                 `json:"text,omitempty"`
+	CreatedAt     string                 `json:"created_at,omitempty"`
+	UserID        string                 `json:"user_id,omitempty"`
+	Kind          string                 `json:"kind,omitempty"`
+	ActorID       string                 `json:"actor_id,omitempty"`
+	Role          string                 `json:"role,omitempty"`
+	EditedAt      string                 `json:"edited_at,omitempty"`
+	Reaction      string                 `json:"reaction,omitempty"`
+	Added         *bool                  `json:"added,omitempty"`
+	Reactions     []dialogs.Reaction     `json:"reactions,omitempty"`
+	ReplyTo       *dialogs.ReplyPreview  `json:"reply_to,omitempty"`
+	ForwardedFrom *dialogs.ForwardedFrom `json:"forwarded_from,omitempty"`
+	ExpiresAt     string                 `json:"expires_at,omitempty"`
+	Poll          *dialogs.Poll          `json:"poll,omitempty"`
+	Blob          []byte                 `json:"blob,omitempty"`
+	UpdatedAt     string                 `json:"updated_at,omitempty"`
+	ThreadRootID  *int64                 `json:"thread_root_id,omitempty"`
+	Mentions      []dialogs.Mention      `json:"mentions,omitempty"`
+	Attachments   []uuid.UUID            `json:"attachments,omitempty"`
 }
 
 func channelForUser(userID uuid.UUID) string {
 	return "user:" + userID.String()
 }
 
-// PublishMessage sends message.new to members (excluding sender handled by consumer if needed).
-func (p *RedisPublisher) PublishMessage(ctx context.Context, msg dialogs.Message, members []uuid.UUID) error {
-	payload, _ := json.Marshal(event{
-		Type:      "message.new",
-		DialogID:  msg.DialogID.String(),
-		MessageID: msg.ID,
-		SenderID:  msg.SenderID.String(),
-		Text:      msg.Text,
-		CreatedAt: msg.CreatedAt.UTC().Format(time.RFC3339),
-	})
+func channelForDialog(dialogID uuid.UUID) string {
+	return dialogChannel(dialogID.String())
+}
+
+// recipients removes the actor's blocked/blocking peers from members.
+func (p *RedisPublisher) recipients(ctx context.Context, actor uuid.UUID, members []uuid.UUID) ([]uuid.UUID, error) {
+	if p.blocks == nil {
+		return members, nil
+	}
+	blocked, err := p.blocks.BlockedAmong(ctx, actor, members)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocked) == 0 {
+		return members, nil
+	}
+	skip := make(map[uuid.UUID]struct{}, len(blocked))
+	for _, id := range blocked {
+		skip[id] = struct{}{}
+	}
+	res := make([]uuid.UUID, 0, len(members))
+	for _, m := range members {
+		if _, ok := skip[m]; !ok {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+func (p *RedisPublisher) publish(ctx context.Context, actor uuid.UUID, members []uuid.UUID, payload []byte, skipActor bool) error {
+	members, err := p.recipients(ctx, actor, members)
+	if err != nil {
+		return err
+	}
 	for _, m := range members {
-		if m == msg.SenderID {
-			continue // не шлём отправителю
+		if skipActor && m == actor {
+			continue
 		}
 		if err := p.rdb.Publish(ctx, channelForUser(m), payload).Err(); err != nil {
 			return err
@@ -55,6 +106,40 @@ func (p *RedisPublisher) PublishMessage(ctx context.Context, msg dialogs.Message
 	return nil
 }
 
+func newMessagePayload(msg dialogs.Message) []byte {
+	e := event{
+		Type:          dialogs.EventMessageNew,
+		DialogID:      msg.DialogID.String(),
+		MessageID:     msg.ID,
+		SenderID:      msg.SenderID.String(),
+		Kind:          msg.Kind,
+		Text:          msg.Text,
+		CreatedAt:     msg.CreatedAt.UTC().Format(time.RFC3339),
+		ReplyTo:       msg.ReplyTo,
+		ForwardedFrom: msg.ForwardedFrom,
+		Poll:          msg.Poll,
+		ThreadRootID:  msg.ThreadRootID,
+		Mentions:      msg.Mentions,
+		Attachments:   msg.Attachments,
+	}
+	if msg.ExpiresAt != nil {
+		e.ExpiresAt = msg.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	payload, _ := json.Marshal(e)
+	return payload
+}
+
+// PublishMessage sends message.new to members (excluding sender handled by consumer if needed).
+func (p *RedisPublisher) PublishMessage(ctx context.Context, msg dialogs.Message, members []uuid.UUID) error {
+	payload := newMessagePayload(msg)
+	// не шлём отправителю
+	return p.publish(ctx, msg.SenderID, members, payload, true)
+}
+
+func (p *RedisPublisher) PublishSavedMessage(ctx context.Context, msg dialogs.Message) error {
+	return p.rdb.Publish(ctx, channelForUser(msg.SenderID), newMessagePayload(msg)).Err()
+}
+
 func (p *RedisPublisher) PublishDelivery(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64, members []uuid.UUID) error {
 	payload, _ := json.Marshal(event{
 		Type:      "message.delivered",
@@ -62,25 +147,152 @@ func (p *RedisPublisher) PublishDelivery(ctx context.Context, dialogID uuid.UUID
 		MessageID: messageID,
 		UserID:    userID.String(),
 	})
-	for _, m := range members {
-		if err := p.rdb.Publish(ctx, channelForUser(m), payload).Err(); err != nil {
-			return err
-		}
-	}
-	return nil
+	return p.publish(ctx, userID, members, payload, false)
 }
 
 func (p *RedisPublisher) PublishRead(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, messageID int64, members []uuid.UUID) error {
 	payload, _ := json.Marshal(event{
-		Type:      "message.read",
+		Type:      dialogs.EventMessageRead,
 		DialogID:  dialogID.String(),
 		MessageID: messageID,
 		UserID:    userID.String(),
 	})
-	for _, m := range members {
-		if err := p.rdb.Publish(ctx, channelForUser(m), payload).Err(); err != nil {
-			return err
-		}
+	return p.publish(ctx, userID, members, payload, false)
+}
+
+func (p *RedisPublisher) PublishTyping(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, members []uuid.UUID) error {
+	payload, _ := json.Marshal(event{
+		Type:     "typing",
+		DialogID: dialogID.String(),
+		UserID:   userID.String(),
+	})
+	return p.publish(ctx, userID, members, payload, true)
+}
+
+func (p *RedisPublisher) PublishMember(ctx context.Context, dialogID uuid.UUID, ev dialogs.MemberEvent, members []uuid.UUID) error {
+	payload, _ := json.Marshal(event{
+		Type:     ev.Type,
+		DialogID: dialogID.String(),
+		UserID:   ev.UserID.String(),
+		ActorID:  ev.ActorID.String(),
+		Role:     ev.Role,
+	})
+	return p.publish(ctx, ev.ActorID, members, payload, false)
+}
+
+// PublishChannelMessage publishes a channel post once to dialog:<id>.
+// Each realtime node forwards it to its locally connected subscribers.
+func (p *RedisPublisher) PublishChannelMessage(ctx context.Context, msg dialogs.Message) error {
+	payload := newMessagePayload(msg)
+	return p.rdb.Publish(ctx, channelForDialog(msg.DialogID), payload).Err()
+}
+
+func messageEventPayload(ev dialogs.MessageEvent) []byte {
+	e := event{
+		Type:      ev.Type,
+		DialogID:  ev.DialogID.String(),
+		MessageID: ev.MessageID,
+		Text:      ev.Text,
+		Mentions:  ev.Mentions,
 	}
-	return nil
+	// expiry has no actor
+	if ev.ActorID != uuid.Nil {
+		e.ActorID = ev.ActorID.String()
+	}
+	if ev.EditedAt != nil {
+		e.EditedAt = ev.EditedAt.UTC().Format(time.RFC3339)
+	}
+	payload, _ := json.Marshal(e)
+	return payload
+}
+
+// PublishMessageEvent sends an edit/delete of an existing message to members,
+// including the actor's other connections.
+func (p *RedisPublisher) PublishMessageEvent(ctx context.Context, ev dialogs.MessageEvent, members []uuid.UUID) error {
+	return p.publish(ctx, ev.ActorID, members, messageEventPayload(ev), false)
+}
+
+// PublishChannelEvent publishes a message change once to dialog:<id>.
+func (p *RedisPublisher) PublishChannelEvent(ctx context.Context, ev dialogs.MessageEvent) error {
+	return p.rdb.Publish(ctx, channelForDialog(ev.DialogID), messageEventPayload(ev)).Err()
+}
+
+// PublishReaction sends reaction.updated to members, or once to the channel
+// topic when members is nil.
+func (p *RedisPublisher) PublishReaction(ctx context.Context, ev dialogs.ReactionEvent, members []uuid.UUID) error {
+	reactions := ev.Reactions
+	if reactions == nil {
+		reactions = []dialogs.Reaction{}
+	}
+	payload, _ := json.Marshal(event{
+		Type:      dialogs.EventReactionUpdated,
+		DialogID:  ev.DialogID.String(),
+		MessageID: ev.MessageID,
+		ActorID:   ev.ActorID.String(),
+		Reaction:  ev.Reaction,
+		Added:     &ev.Added,
+		Reactions: reactions,
+	})
+	if members == nil {
+		return p.rdb.Publish(ctx, channelForDialog(ev.DialogID), payload).Err()
+	}
+	return p.publish(ctx, ev.ActorID, members, payload, false)
+}
+
+// PublishPoll sends poll.updated to members, or once to the channel topic
+// when members is nil. Anonymous polls come without actor_id.
+func (p *RedisPublisher) PublishPoll(ctx context.Context, ev dialogs.PollEvent, members []uuid.UUID) error {
+	e := event{
+		Type:      dialogs.EventPollUpdated,
+		DialogID:  ev.DialogID.String(),
+		MessageID: ev.MessageID,
+		Poll:      &ev.Poll,
+	}
+	if ev.ActorID != uuid.Nil {
+		e.ActorID = ev.ActorID.String()
+	}
+	payload, _ := json.Marshal(e)
+	if members == nil {
+		return p.rdb.Publish(ctx, channelForDialog(ev.DialogID), payload).Err()
+	}
+	return p.publish(ctx, ev.ActorID, members, payload, false)
+}
+
+// PublishSubscription lets the user's realtime node start or stop routing channel posts.
+func (p *RedisPublisher) PublishSubscription(ctx context.Context, dialogID uuid.UUID, userID uuid.UUID, subscribed bool) error {
+	typ := eventChannelUnsubscribed
+	if subscribed {
+		typ = eventChannelSubscribed
+	}
+	payload, _ := json.Marshal(event{
+		Type:     typ,
+		DialogID: dialogID.String(),
+		UserID:   userID.String(),
+	})
+	return p.rdb.Publish(ctx, channelForUser(userID), payload).Err()
+}
+
+// PublishMention sends mention.new to the mentioned recipients, except those
+// who blocked the sender.
+func (p *RedisPublisher) PublishMention(ctx context.Context, msg dialogs.Message, recipients []uuid.UUID) error {
+	payload, _ := json.Marshal(event{
+		Type:         dialogs.EventMentionNew,
+		DialogID:     msg.DialogID.String(),
+		MessageID:    msg.ID,
+		SenderID:     msg.SenderID.String(),
+		ThreadRootID: msg.ThreadRootID,
+	})
+	return p.publish(ctx, msg.SenderID, recipients, payload, true)
+}
+
+// PublishDraft sends draft.updated to the user's own connections; a cleared
+// draft comes without blob.
+func (p *RedisPublisher) PublishDraft(ctx context.Context, userID uuid.UUID, d dialogs.Draft) error {
+	payload, _ := json.Marshal(event{
+		Type:      dialogs.EventDraftUpdated,
+		DialogID:  d.DialogID.String(),
+		Blob:      d.Blob,
+		UpdatedAt: d.UpdatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	return p.rdb.Publish(ctx, channelForUser(userID), payload).Err()
 }
@@ -0,0 +1,55 @@
+package users
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidBlock = errors.New("invalid block target")
+
+// Block adds target to owner's block list. Blocking is idempotent.
+func (s *Service) Block(ctx context.Context, owner, target uuid.UUID) error {
+	if owner == target {
+		return ErrInvalidBlock
+	}
+	if _, err := s.repo.GetProfile(ctx, target); err != nil {
+		return err
+	}
+	return s.repo.Block(ctx, owner, target)
+}
+
+// Unblock removes target from owner's block list.
+func (s *Service) Unblock(ctx context.Context, owner, target uuid.UUID) error {
+	return s.repo.Unblock(ctx, owner, target)
+}
+
+// Blocked lists users blocked by owner.
+func (s *Service) Blocked(ctx context.Context, owner uuid.UUID) ([]BlockedUser, error) {
+	list, err := s.repo.ListBlocked(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []BlockedUser{}
+	}
+	return list, nil
+}
+
+// HasBlock reports whether either user blocked the other.
+func (s *Service) HasBlock(ctx context.Context, a, b uuid.UUID) (bool, error) {
+	if a == b {
+		return false, nil
+	}
+	ids, err := s.repo.BlockedAmong(ctx, a, []uuid.UUID{b})
+	if err != nil {
+		return false, err
+	}
+	return len(ids) > 0, nil
+}
+
+// BlockedAmong returns members of others that are separated from userID by a block.
+func (s *Service) BlockedAmong(ctx context.Context, userID uuid.UUID, others []uuid.UUID) ([]uuid.UUID, error) {
+	return s.repo.BlockedAmong(ctx, userID, others)
+}
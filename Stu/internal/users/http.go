@@ -0,0 +1,250 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"stu/internal/auth"
+)
+
+// RegisterMeHandlers mounts /me/profile, /me/settings and /me/blocks routes on the authenticated /v1 router.
+func RegisterMeHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Get("/me/profile", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		profile, err := svc.Me(req.Context(), uuid.MustParse(curUser))
+		if err != nil {
+			logger.Error().Err(err).Msg("get profile failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, profile, http.StatusOK)
+	})
+
+	r.Patch("/me/profile", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if auth.IsBanned(req.Context()) {
+			http.Error(w, `{"error":"banned"}`, http.StatusForbidden)
+			return
+		}
+		var payload ProfileUpdate
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		profile, err := svc.UpdateMe(req.Context(), uuid.MustParse(curUser), payload)
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrInvalidUsername):
+				http.Error(w, "invalid username", http.StatusBadRequest)
+			case errors.Is(err, ErrReservedUsername):
+				http.Error(w, "username is reserved", http.StatusBadRequest)
+			case errors.Is(err, ErrUsernameTaken):
+				http.Error(w, "username already taken", http.StatusConflict)
+			case errors.Is(err, ErrInvalidProfile):
+				http.Error(w, "invalid profile", http.StatusBadRequest)
+			default:
+				logger.Error().Err(err).Msg("update profile failed")
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+			return
+		}
+		writeJSON(w, profile, http.StatusOK)
+	})
+
+	r.Get("/me/settings", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		st, err := svc.Settings(req.Context(), uuid.MustParse(curUser))
+		if err != nil {
+			logger.Error().Err(err).Msg("get settings failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, st, http.StatusOK)
+	})
+
+	r.Patch("/me/settings", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var payload SettingsUpdate
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		st, err := svc.UpdateSettings(req.Context(), uuid.MustParse(curUser), payload)
+		if err != nil {
+			if errors.Is(err, ErrInvalidSettings) {
+				http.Error(w, "invalid settings", http.StatusBadRequest)
+				return
+			}
+			logger.Error().Err(err).Msg("update settings failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, st, http.StatusOK)
+	})
+
+	r.Get("/me/blocks", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		list, err := svc.Blocked(req.Context(), uuid.MustParse(curUser))
+		if err != nil {
+			logger.Error().Err(err).Msg("list blocks failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list, http.StatusOK)
+	})
+
+	r.Post("/me/blocks", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var payload struct {
+			UserID string `json:"user_id"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		target, err := uuid.Parse(payload.UserID)
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		if err := svc.Block(req.Context(), uuid.MustParse(curUser), target); err != nil {
+			if errors.Is(err, ErrInvalidBlock) {
+				http.Error(w, "cannot block yourself", http.StatusBadRequest)
+				return
+			}
+			writeLookupError(w, err, logger)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Delete("/me/blocks/{id}", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		target, err := uuid.Parse(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		if err := svc.Unblock(req.Context(), uuid.MustParse(curUser), target); err != nil {
+			logger.Error().Err(err).Msg("unblock failed")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// RegisterHandlers mounts user lookup routes under /v1/users.
+func RegisterHandlers(r chi.Router, svc *Service, logger zerolog.Logger) {
+	r.Get("/lookup", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var (
+			profile Profile
+			err     error
+		)
+		switch q := req.URL.Query(); {
+		case q.Get("username") != "":
+			profile, err = svc.Lookup(req.Context(), uuid.MustParse(curUser), q.Get("username"))
+		case q.Get("email") != "":
+			profile, err = svc.LookupByEmail(req.Context(), uuid.MustParse(curUser), q.Get("email"))
+		default:
+			http.Error(w, "username or email required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeLookupError(w, err, logger)
+			return
+		}
+		writeJSON(w, profile, http.StatusOK)
+	})
+
+	r.Get("/{id}", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, err := uuid.Parse(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		profile, err := svc.Get(req.Context(), uuid.MustParse(curUser), userID)
+		if err != nil {
+			writeLookupError(w, err, logger)
+			return
+		}
+		writeJSON(w, profile, http.StatusOK)
+	})
+
+	r.Get("/{id}/presence", func(w http.ResponseWriter, req *http.Request) {
+		curUser, _, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, err := uuid.Parse(chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, "invalid user id", http.StatusBadRequest)
+			return
+		}
+		presence, err := svc.Presence(req.Context(), uuid.MustParse(curUser), userID)
+		if err != nil {
+			writeLookupError(w, err, logger)
+			return
+		}
+		writeJSON(w, presence, http.StatusOK)
+	})
+}
+
+func writeLookupError(w http.ResponseWriter, err error, logger zerolog.Logger) {
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	logger.Error().Err(err).Msg("user lookup failed")
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, payload any, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
@@ -0,0 +1,250 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Audience values for allow_messages_from / allow_add_to_group.
+const (
+	AudienceEveryone = "everyone"
+	AudienceContacts = "contacts"
+	AudienceNobody   = "nobody"
+)
+
+var ErrInvalidSettings = errors.New("invalid settings")
+
+// PresenceReader exposes realtime online state.
+type PresenceReader interface {
+	Status(ctx context.Context, userID uuid.UUID) (online bool, lastSeen *time.Time, err error)
+}
+
+// Presence is what a viewer may see about another user's activity.
+type Presence struct {
+	UserID   uuid.UUID  `json:"user_id"`
+	Online   *bool      `json:"online,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// SetPresence plugs the realtime presence store.
+func (s *Service) SetPresence(presence PresenceReader) {
+	s.presence = presence
+}
+
+// Settings returns the caller's privacy settings.
+func (s *Service) Settings(ctx context.Context, userID uuid.UUID) (Settings, error) {
+	return s.repo.GetSettings(ctx, userID)
+}
+
+// UpdateSettings validates and stores privacy settings.
+func (s *Service) UpdateSettings(ctx context.Context, userID uuid.UUID, upd SettingsUpdate) (Settings, error) {
+	st, err := s.repo.GetSettings(ctx, userID)
+	if err != nil {
+		return Settings{}, err
+	}
+	if upd.AllowMessagesFrom != nil {
+		if st.AllowMessagesFrom, err = normalizeAudience(*upd.AllowMessagesFrom); err != nil {
+			return Settings{}, err
+		}
+	}
+	if upd.AllowAddToGroup != nil {
+		if st.AllowAddToGroup, err = normalizeAudience(*upd.AllowAddToGroup); err != nil {
+			return Settings{}, err
+		}
+	}
+	if upd.ShowLastSeen != nil {
+		st.ShowLastSeen = *upd.ShowLastSeen
+	}
+	if upd.ShowOnline != nil {
+		st.ShowOnline = *upd.ShowOnline
+	}
+	if upd.AllowProfileByEmail != nil {
+		st.AllowProfileByEmail = *upd.AllowProfileByEmail
+	}
+	if upd.AllowForwardLink != nil {
+		st.AllowForwardLink = *upd.AllowForwardLink
+	}
+	return s.repo.SaveSettings(ctx, userID, st)
+}
+
+// CanMessage reports whether from may start or continue a direct conversation with to.
+func (s *Service) CanMessage(ctx context.Context, from, to uuid.UUID) (bool, error) {
+	if from == to {
+		return true, nil
+	}
+	if blocked, err := s.HasBlock(ctx, from, to); err != nil || blocked {
+		return false, err
+	}
+	st, err := s.repo.GetSettings(ctx, to)
+	if err != nil {
+		return false, err
+	}
+	return s.audienceAllows(ctx, st.AllowMessagesFrom, to, from)
+}
+
+// CanAddToGroup reports whether actor may add target to a group or channel.
+func (s *Service) CanAddToGroup(ctx context.Context, actor, target uuid.UUID) (bool, error) {
+	if actor == target {
+		return true, nil
+	}
+	if _, err := s.repo.GetProfile(ctx, target); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if blocked, err := s.HasBlock(ctx, actor, target); err != nil || blocked {
+		return false, err
+	}
+	st, err := s.repo.GetSettings(ctx, target)
+	if err != nil {
+		return false, err
+	}
+	return s.audienceAllows(ctx, st.AllowAddToGroup, target, actor)
+}
+
+// IsContact reports whether owner has written to other in a direct dialog.
+func (s *Service) IsContact(ctx context.Context, owner, other uuid.UUID) (bool, error) {
+	return s.repo.IsContact(ctx, owner, other)
+}
+
+// FindableByEmail reports whether the user opted in to lookup by e-mail.
+func (s *Service) FindableByEmail(ctx context.Context, userID uuid.UUID) (bool, error) {
+	st, err := s.repo.GetSettings(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return st.AllowProfileByEmail, nil
+}
+
+// ForwardAttribution returns the name shown on messages forwarded from userID
+// and whether the attribution may link to the account.
+func (s *Service) ForwardAttribution(ctx context.Context, userID uuid.UUID) (string, bool, error) {
+	p, err := s.repo.GetProfile(ctx, userID)
+	if errors.Is(err, ErrNotFound) {
+		return deletedAccountName, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	st, err := s.repo.GetSettings(ctx, userID)
+	if err != nil {
+		return "", false, err
+	}
+	return displayName(p), st.AllowForwardLink, nil
+}
+
+// LookupByEmail finds a profile only if its owner allows e-mail lookup.
+// Hidden and missing users are indistinguishable for the caller.
+func (s *Service) LookupByEmail(ctx context.Context, viewer uuid.UUID, email string) (Profile, error) {
+	p, err := s.repo.GetProfileByEmail(ctx, strings.TrimSpace(email))
+	if err != nil {
+		return Profile{}, err
+	}
+	if p.ID == viewer {
+		return p, nil
+	}
+	ok, err := s.FindableByEmail(ctx, p.ID)
+	if err != nil {
+		return Profile{}, err
+	}
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	return s.visibleProfile(ctx, viewer, p)
+}
+
+// visibleProfile hides a profile from users its owner blocked; they get the
+// same not-found as for a missing user. Blocking someone does not hide their
+// profile from the blocker.
+func (s *Service) visibleProfile(ctx context.Context, viewer uuid.UUID, p Profile) (Profile, error) {
+	if p.ID == viewer {
+		return p, nil
+	}
+	blocked, err := s.repo.IsBlocked(ctx, p.ID, viewer)
+	if err != nil {
+		return Profile{}, err
+	}
+	if blocked {
+		return Profile{}, ErrNotFound
+	}
+	return p, nil
+}
+
+// Presence returns online/last seen filtered by the target's settings.
+// A block in either direction or an unanswered message request from
+// the viewer hides presence completely.
+func (s *Service) Presence(ctx context.Context, viewer, userID uuid.UUID) (Presence, error) {
+	if _, err := s.repo.GetProfile(ctx, userID); err != nil {
+		return Presence{}, err
+	}
+	res := Presence{UserID: userID}
+	if s.presence == nil {
+		return res, nil
+	}
+	if blocked, err := s.HasBlock(ctx, viewer, userID); err != nil || blocked {
+		return res, err
+	}
+	if viewer != userID {
+		if open, err := s.repo.HasOpenRequest(ctx, userID, viewer); err != nil || open {
+			return res, err
+		}
+	}
+	online, lastSeen, err := s.presence.Status(ctx, userID)
+	if err != nil {
+		return Presence{}, err
+	}
+	st := DefaultSettings()
+	if viewer != userID {
+		if st, err = s.repo.GetSettings(ctx, userID); err != nil {
+			return Presence{}, err
+		}
+	}
+	if st.ShowOnline {
+		res.Online = &online
+	}
+	if st.ShowLastSeen {
+		res.LastSeen = lastSeen
+	}
+	return res, nil
+}
+
+const deletedAccountName = "Deleted account"
+
+func displayName(p Profile) string {
+	switch {
+	case p.DisplayName != nil && *p.DisplayName != "":
+		return *p.DisplayName
+	case p.Username != nil:
+		return "@" + *p.Username
+	}
+	return ""
+}
+
+func (s *Service) audienceAllows(ctx context.Context, audience string, owner, other uuid.UUID) (bool, error) {
+	switch audience {
+	case AudienceEveryone:
+		return true, nil
+	case AudienceContacts:
+		return s.repo.IsContact(ctx, owner, other)
+	default:
+		return false, nil
+	}
+}
+
+// normalizeAudience accepts the legacy "friends" value as contacts.
+func normalizeAudience(v string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case AudienceEveryone:
+		return AudienceEveryone, nil
+	case AudienceContacts, "friends":
+		return AudienceContacts, nil
+	case AudienceNobody:
+		return AudienceNobody, nil
+	}
+	return "", ErrInvalidSettings
+}
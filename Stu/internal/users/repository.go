@@ -0,0 +1,288 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrNotFound      = errors.New("user not found")
+	ErrUsernameTaken = errors.New("username already taken")
+)
+
+// Profile is the public part of a user record.
+type Profile struct {
+	ID          uuid.UUID `json:"id"`
+	Username    *string   `json:"username"`
+	DisplayName *string   `json:"display_name"`
+	Bio         *string   `json:"bio"`
+	AvatarURL   *string   `json:"avatar_url"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ProfileUpdate holds PATCH fields; nil means unchanged, empty string clears the field.
+type ProfileUpdate struct {
+	Username    *string `json:"username"`
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	AvatarURL   *string `json:"avatar_url"`
+}
+
+// Settings are the privacy options from user_settings.
+type Settings struct {
+	AllowMessagesFrom   string `json:"allow_messages_from"`
+	AllowAddToGroup     string `json:"allow_add_to_group"`
+	ShowLastSeen        bool   `json:"show_last_seen"`
+	ShowOnline          bool   `json:"show_online"`
+	AllowProfileByEmail bool   `json:"allow_profile_by_email"`
+	AllowForwardLink    bool   `json:"allow_forward_link"`
+}
+
+// SettingsUpdate holds PATCH fields; nil means unchanged.
+type SettingsUpdate struct {
+	AllowMessagesFrom   *string `json:"allow_messages_from"`
+	AllowAddToGroup     *string `json:"allow_add_to_group"`
+	ShowLastSeen        *bool   `json:"show_last_seen"`
+	ShowOnline          *bool   `json:"show_online"`
+	AllowProfileByEmail *bool   `json:"allow_profile_by_email"`
+	AllowForwardLink    *bool   `json:"allow_forward_link"`
+}
+
+// DefaultSettings mirrors column defaults for users without a settings row.
+func DefaultSettings() Settings {
+	return Settings{
+		AllowMessagesFrom:   AudienceEveryone,
+		AllowAddToGroup:     AudienceEveryone,
+		ShowLastSeen:        true,
+		ShowOnline:          true,
+		AllowProfileByEmail: false,
+		AllowForwardLink:    true,
+	}
+}
+
+// BlockedUser is an entry of the caller's block list.
+type BlockedUser struct {
+	UserID      uuid.UUID `json:"user_id"`
+	Username    *string   `json:"username"`
+	DisplayName *string   `json:"display_name"`
+	BlockedAt   time.Time `json:"blocked_at"`
+}
+
+type Repository interface {
+	GetProfile(ctx context.Context, id uuid.UUID) (Profile, error)
+	GetProfileByUsername(ctx context.Context, username string) (Profile, error)
+	GetProfileByEmail(ctx context.Context, email string) (Profile, error)
+	UpdateProfile(ctx context.Context, id uuid.UUID, upd ProfileUpdate) (Profile, error)
+	GetSettings(ctx context.Context, id uuid.UUID) (Settings, error)
+	SaveSettings(ctx context.Context, id uuid.UUID, st Settings) (Settings, error)
+	IsContact(ctx context.Context, owner, other uuid.UUID) (bool, error)
+	HasOpenRequest(ctx context.Context, recipient, sender uuid.UUID) (bool, error)
+	Block(ctx context.Context, owner, target uuid.UUID) error
+	Unblock(ctx context.Context, owner, target uuid.UUID) error
+	ListBlocked(ctx context.Context, owner uuid.UUID) ([]BlockedUser, error)
+	IsBlocked(ctx context.Context, owner, target uuid.UUID) (bool, error)
+	BlockedAmong(ctx context.Context, userID uuid.UUID, others []uuid.UUID) ([]uuid.UUID, error)
+}
+
+type pgRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewRepository(pool *pgxpool.Pool) Repository {
+	return &pgRepository{pool: pool}
+}
+
+const profileColumns = `id, username, display_name, bio, avatar_url, created_at`
+
+func scanProfile(row pgx.Row) (Profile, error) {
+	var p Profile
+	err := row.Scan(&p.ID, &p.Username, &p.DisplayName, &p.Bio, &p.AvatarURL, &p.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Profile{}, ErrNotFound
+	}
+	return p, err
+}
+
+func (r *pgRepository) GetProfile(ctx context.Context, id uuid.UUID) (Profile, error) {
+	return scanProfile(r.pool.QueryRow(ctx, `
+		SELECT `+profileColumns+` FROM users
+		WHERE id = $1 AND is_deleted = FALSE AND is_active = TRUE`, id))
+}
+
+func (r *pgRepository) GetProfileByUsername(ctx context.Context, username string) (Profile, error) {
+	return scanProfile(r.pool.QueryRow(ctx, `
+		SELECT `+profileColumns+` FROM users
+		WHERE username = $1 AND is_deleted = FALSE AND is_active = TRUE`, username))
+}
+
+func (r *pgRepository) GetProfileByEmail(ctx context.Context, email string) (Profile, error) {
+	return scanProfile(r.pool.QueryRow(ctx, `
+		SELECT `+profileColumns+` FROM users
+		WHERE email = $1 AND is_deleted = FALSE AND is_active = TRUE`, email))
+}
+
+// UpdateProfile applies non-nil fields; empty strings are stored as NULL.
+func (r *pgRepository) UpdateProfile(ctx context.Context, id uuid.UUID, upd ProfileUpdate) (Profile, error) {
+	p, err := scanProfile(r.pool.QueryRow(ctx, `
+		UPDATE users SET
+		    username     = CASE WHEN $2 THEN NULLIF($3, '')::citext ELSE username END,
+		    display_name = CASE WHEN $4 THEN NULLIF($5, '') ELSE display_name END,
+		    bio          = CASE WHEN $6 THEN NULLIF($7, '') ELSE bio END,
+		    avatar_url   = CASE WHEN $8 THEN NULLIF($9, '') ELSE avatar_url END,
+		    updated_at   = NOW()
+		WHERE id = $1 AND is_deleted = FALSE
+		RETURNING `+profileColumns,
+		id,
+		upd.Username != nil, deref(upd.Username),
+		upd.DisplayName != nil, deref(upd.DisplayName),
+		upd.Bio != nil, deref(upd.Bio),
+		upd.AvatarURL != nil, deref(upd.AvatarURL),
+	))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return Profile{}, ErrUsernameTaken
+		}
+		return Profile{}, err
+	}
+	return p, nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+const settingsColumns = `COALESCE(allow_messages_from, 'everyone'), COALESCE(allow_add_to_group, 'everyone'),
+	COALESCE(show_last_seen, TRUE), COALESCE(show_online, TRUE), COALESCE(allow_profile_by_email, FALSE),
+	COALESCE(allow_forward_link, TRUE)`
+
+func (r *pgRepository) GetSettings(ctx context.Context, id uuid.UUID) (Settings, error) {
+	var st Settings
+	err := r.pool.QueryRow(ctx, `SELECT `+settingsColumns+` FROM user_settings WHERE user_id = $1`, id).
+		Scan(&st.AllowMessagesFrom, &st.AllowAddToGroup, &st.ShowLastSeen, &st.ShowOnline, &st.AllowProfileByEmail, &st.AllowForwardLink)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return DefaultSettings(), nil
+	}
+	return st, err
+}
+
+func (r *pgRepository) SaveSettings(ctx context.Context, id uuid.UUID, st Settings) (Settings, error) {
+	var out Settings
+	err := r.pool.QueryRow(ctx, `
+		INSERT INTO user_settings (user_id, allow_messages_from, allow_add_to_group, show_last_seen, show_online, allow_profile_by_email, allow_forward_link)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id) DO UPDATE SET
+		    allow_messages_from = EXCLUDED.allow_messages_from,
+		    allow_add_to_group = EXCLUDED.allow_add_to_group,
+		    show_last_seen = EXCLUDED.show_last_seen,
+		    show_online = EXCLUDED.show_online,
+		    allow_profile_by_email = EXCLUDED.allow_profile_by_email,
+		    allow_forward_link = EXCLUDED.allow_forward_link,
+		    updated_at = NOW()
+		RETURNING `+settingsColumns,
+		id, st.AllowMessagesFrom, st.AllowAddToGroup, st.ShowLastSeen, st.ShowOnline, st.AllowProfileByEmail, st.AllowForwardLink,
+	).Scan(&out.AllowMessagesFrom, &out.AllowAddToGroup, &out.ShowLastSeen, &out.ShowOnline, &out.AllowProfileByEmail, &out.AllowForwardLink)
+	return out, err
+}
+
+// IsContact reports whether owner has written to other in a direct dialog.
+func (r *pgRepository) IsContact(ctx context.Context, owner, other uuid.UUID) (bool, error) {
+	var exists bool
+	err := r.pool.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM dialogs d
+			JOIN dialog_members a ON a.dialog_id = d.id AND a.user_id = $1
+			JOIN dialog_members b ON b.dialog_id = d.id AND b.user_id = $2
+			WHERE d.kind = 'direct'
+			  AND EXISTS (SELECT 1 FROM messages m WHERE m.dialog_id = d.id AND m.sender_id = $1)
+		)`, owner, other).Scan(&exists)
+	return exists, err
+}
+
+// HasOpenRequest reports whether recipient has not accepted a direct dialog with sender.
+func (r *pgRepository) HasOpenRequest(ctx context.Context, recipient, sender uuid.UUID) (bool, error) {
+	var exists bool
+	err := r.pool.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM dialogs d
+			JOIN dialog_members a ON a.dialog_id = d.id AND a.user_id = $1
+			JOIN dialog_members b ON b.dialog_id = d.id AND b.user_id = $2
+			WHERE d.kind = 'direct' AND a.request_state <> 'accepted'
+		)`, recipient, sender).Scan(&exists)
+	return exists, err
+}
+
+func (r *pgRepository) Block(ctx context.Context, owner, target uuid.UUID) error {
+	_, err := r.pool.Exec(ctx, `
+		INSERT INTO blocks (user_id, blocked_user_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, owner, target)
+	return err
+}
+
+func (r *pgRepository) Unblock(ctx context.Context, owner, target uuid.UUID) error {
+	_, err := r.pool.Exec(ctx, `DELETE FROM blocks WHERE user_id = $1 AND blocked_user_id = $2`, owner, target)
+	return err
+}
+
+// IsBlocked reports whether owner blocked target.
+func (r *pgRepository) IsBlocked(ctx context.Context, owner, target uuid.UUID) (bool, error) {
+	var exists bool
+	err := r.pool.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM blocks WHERE user_id = $1 AND blocked_user_id = $2)`, owner, target).Scan(&exists)
+	return exists, err
+}
+
+func (r *pgRepository) ListBlocked(ctx context.Context, owner uuid.UUID) ([]BlockedUser, error) {
+	rows, err := r.pool.Query(ctx, `
+		SELECT b.blocked_user_id, u.username, u.display_name, b.created_at
+		FROM blocks b
+		JOIN users u ON u.id = b.blocked_user_id
+		WHERE b.user_id = $1
+		ORDER BY b.created_at DESC`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []BlockedUser
+	for rows.Next() {
+		var b BlockedUser
+		if err := rows.Scan(&b.UserID, &b.Username, &b.DisplayName, &b.BlockedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, b)
+	}
+	return res, rows.Err()
+}
+
+// BlockedAmong returns users from others that block userID or are blocked by it.
+func (r *pgRepository) BlockedAmong(ctx context.Context, userID uuid.UUID, others []uuid.UUID) ([]uuid.UUID, error) {
+	if len(others) == 0 {
+		return nil, nil
+	}
+	rows, err := r.pool.Query(ctx, `
+		SELECT blocked_user_id FROM blocks WHERE user_id = $1 AND blocked_user_id = ANY($2)
+		UNION
+		SELECT user_id FROM blocks WHERE blocked_user_id = $1 AND user_id = ANY($2)`, userID, others)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
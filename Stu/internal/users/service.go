@@ -0,0 +1,134 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidUsername  = errors.New("invalid username")
+	ErrReservedUsername = errors.New("username is reserved")
+	ErrInvalidProfile   = errors.New("invalid profile")
+)
+
+const (
+	maxDisplayName = 64
+	maxBio         = 140
+	maxAvatarURL   = 512
+)
+
+// usernamePattern: 5-32 chars, latin letters, digits and underscore, starts with a letter.
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{4,31}$`)
+
+// reservedUsernames cannot be claimed by users (compared case-insensitively).
+var reservedUsernames = map[string]struct{}{
+	"admin": {}, "administrator": {}, "root": {}, "system": {}, "support": {},
+	"help": {}, "stu": {}, "stuteam": {}, "official": {},
+	"moderator": {}, "moderation": {}, "security": {}, "abuse": {}, "staff": {},
+	"settings": {}, "profile": {}, "username": {}, "everyone": {}, "channel": {},
+	"group": {}, "saved": {}, "notifications": {}, "null": {}, "undefined": {},
+}
+
+// Service handles profiles, usernames and privacy settings.
+type Service struct {
+	repo     Repository
+	presence PresenceReader
+}
+
+func NewService(repo Repository) *Service {
+	return &Service{repo: repo}
+}
+
+// Me returns the caller's own profile.
+func (s *Service) Me(ctx context.Context, userID uuid.UUID) (Profile, error) {
+	return s.repo.GetProfile(ctx, userID)
+}
+
+// UpdateMe validates and applies profile changes.
+func (s *Service) UpdateMe(ctx context.Context, userID uuid.UUID, upd ProfileUpdate) (Profile, error) {
+	if upd.Username != nil {
+		name := strings.TrimPrefix(strings.TrimSpace(*upd.Username), "@")
+		if name != "" {
+			if err := ValidateUsername(name); err != nil {
+				return Profile{}, err
+			}
+		}
+		upd.Username = &name
+	}
+	if upd.DisplayName != nil {
+		v := strings.TrimSpace(*upd.DisplayName)
+		if utf8.RuneCountInString(v) > maxDisplayName || strings.ContainsAny(v, "\n\r") {
+			return Profile{}, ErrInvalidProfile
+		}
+		upd.DisplayName = &v
+	}
+	if upd.Bio != nil {
+		v := strings.TrimSpace(*upd.Bio)
+		if utf8.RuneCountInString(v) > maxBio {
+			return Profile{}, ErrInvalidProfile
+		}
+		upd.Bio = &v
+	}
+	if upd.AvatarURL != nil {
+		v := strings.TrimSpace(*upd.AvatarURL)
+		if v != "" && !validAvatarURL(v) {
+			return Profile{}, ErrInvalidProfile
+		}
+		upd.AvatarURL = &v
+	}
+	return s.repo.UpdateProfile(ctx, userID, upd)
+}
+
+// Get returns another user's public profile.
+func (s *Service) Get(ctx context.Context, viewer, userID uuid.UUID) (Profile, error) {
+	p, err := s.repo.GetProfile(ctx, userID)
+	if err != nil {
+		return Profile{}, err
+	}
+	return s.visibleProfile(ctx, viewer, p)
+}
+
+// Lookup finds a public profile by username (with or without leading @).
+func (s *Service) Lookup(ctx context.Context, viewer uuid.UUID, username string) (Profile, error) {
+	name := strings.TrimPrefix(strings.TrimSpace(username), "@")
+	if !usernamePattern.MatchString(name) {
+		return Profile{}, ErrNotFound
+	}
+	p, err := s.repo.GetProfileByUsername(ctx, name)
+	if err != nil {
+		return Profile{}, err
+	}
+	return s.visibleProfile(ctx, viewer, p)
+}
+
+// ValidateUsername checks format and reserved names.
+func ValidateUsername(name string) error {
+	if !usernamePattern.MatchString(name) || strings.Contains(name, "__") || strings.HasSuffix(name, "_") {
+		return ErrInvalidUsername
+	}
+	lower := strings.ToLower(name)
+	if _, ok := reservedUsernames[lower]; ok {
+		return ErrReservedUsername
+	}
+	if strings.HasPrefix(lower, "admin") || strings.HasPrefix(lower, "stu_") {
+		return ErrReservedUsername
+	}
+	return nil
+}
+
+func validAvatarURL(raw string) bool {
+	if len(raw) > maxAvatarURL {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
@@ -0,0 +1,440 @@
+package users
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type memRepo struct {
+	profiles map[uuid.UUID]Profile
+	emails   map[string]uuid.UUID
+	settings map[uuid.UUID]Settings
+	contacts map[[2]uuid.UUID]bool
+	blocks   map[[2]uuid.UUID]time.Time
+	requests map[[2]uuid.UUID]bool
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{
+		profiles: make(map[uuid.UUID]Profile),
+		emails:   make(map[string]uuid.UUID),
+		settings: make(map[uuid.UUID]Settings),
+		contacts: make(map[[2]uuid.UUID]bool),
+		blocks:   make(map[[2]uuid.UUID]time.Time),
+		requests: make(map[[2]uuid.UUID]bool),
+	}
+}
+
+func (m *memRepo) add() uuid.UUID {
+	id := uuid.New()
+	m.profiles[id] = Profile{ID: id, CreatedAt: time.Now()}
+	return id
+}
+
+func (m *memRepo) GetProfile(ctx context.Context, id uuid.UUID) (Profile, error) {
+	p, ok := m.profiles[id]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (m *memRepo) GetProfileByUsername(ctx context.Context, username string) (Profile, error) {
+	for _, p := range m.profiles {
+		if p.Username != nil && strings.EqualFold(*p.Username, username) {
+			return p, nil
+		}
+	}
+	return Profile{}, ErrNotFound
+}
+
+func (m *memRepo) GetProfileByEmail(ctx context.Context, email string) (Profile, error) {
+	id, ok := m.emails[email]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	return m.GetProfile(ctx, id)
+}
+
+func (m *memRepo) GetSettings(ctx context.Context, id uuid.UUID) (Settings, error) {
+	st, ok := m.settings[id]
+	if !ok {
+		return DefaultSettings(), nil
+	}
+	return st, nil
+}
+
+func (m *memRepo) SaveSettings(ctx context.Context, id uuid.UUID, st Settings) (Settings, error) {
+	m.settings[id] = st
+	return st, nil
+}
+
+func (m *memRepo) IsContact(ctx context.Context, owner, other uuid.UUID) (bool, error) {
+	return m.contacts[[2]uuid.UUID{owner, other}], nil
+}
+
+func (m *memRepo) HasOpenRequest(ctx context.Context, recipient, sender uuid.UUID) (bool, error) {
+	return m.requests[[2]uuid.UUID{recipient, sender}], nil
+}
+
+func (m *memRepo) Block(ctx context.Context, owner, target uuid.UUID) error {
+	m.blocks[[2]uuid.UUID{owner, target}] = time.Now()
+	return nil
+}
+
+func (m *memRepo) Unblock(ctx context.Context, owner, target uuid.UUID) error {
+	delete(m.blocks, [2]uuid.UUID{owner, target})
+	return nil
+}
+
+func (m *memRepo) ListBlocked(ctx context.Context, owner uuid.UUID) ([]BlockedUser, error) {
+	var res []BlockedUser
+	for k, at := range m.blocks {
+		if k[0] == owner {
+			res = append(res, BlockedUser{UserID: k[1], BlockedAt: at})
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) IsBlocked(ctx context.Context, owner, target uuid.UUID) (bool, error) {
+	_, ok := m.blocks[[2]uuid.UUID{owner, target}]
+	return ok, nil
+}
+
+func (m *memRepo) BlockedAmong(ctx context.Context, userID uuid.UUID, others []uuid.UUID) ([]uuid.UUID, error) {
+	var res []uuid.UUID
+	for _, o := range others {
+		_, out := m.blocks[[2]uuid.UUID{userID, o}]
+		_, in := m.blocks[[2]uuid.UUID{o, userID}]
+		if out || in {
+			res = append(res, o)
+		}
+	}
+	return res, nil
+}
+
+func (m *memRepo) UpdateProfile(ctx context.Context, id uuid.UUID, upd ProfileUpdate) (Profile, error) {
+	p, ok := m.profiles[id]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	if upd.Username != nil {
+		if other, err := m.GetProfileByUsername(ctx, *upd.Username); err == nil && other.ID != id {
+			return Profile{}, ErrUsernameTaken
+		}
+		p.Username = nullIfEmpty(*upd.Username)
+	}
+	if upd.DisplayName != nil {
+		p.DisplayName = nullIfEmpty(*upd.DisplayName)
+	}
+	if upd.Bio != nil {
+		p.Bio = nullIfEmpty(*upd.Bio)
+	}
+	if upd.AvatarURL != nil {
+		p.AvatarURL = nullIfEmpty(*upd.AvatarURL)
+	}
+	m.profiles[id] = p
+	return p, nil
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func strPtr(s string) *string { return &s }
+
+func TestValidateUsername(t *testing.T) {
+	cases := map[string]error{
+		"alice_w":  nil,
+		"Bob2024":  nil,
+		"abc":      ErrInvalidUsername,
+		"1alice":   ErrInvalidUsername,
+		"alice__b": ErrInvalidUsername,
+		"alice_":   ErrInvalidUsername,
+		"алиса123": ErrInvalidUsername,
+		"Support":  ErrReservedUsername,
+		"admin_ru": ErrReservedUsername,
+		"stu_news": ErrReservedUsername,
+	}
+	for name, want := range cases {
+		if got := ValidateUsername(name); got != want {
+			t.Errorf("ValidateUsername(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestUsernameUniqueCaseInsensitive(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	ctx := context.Background()
+	u1, u2 := repo.add(), repo.add()
+
+	if _, err := svc.UpdateMe(ctx, u1, ProfileUpdate{Username: strPtr("@Alice_W")}); err != nil {
+		t.Fatalf("set username: %v", err)
+	}
+	if _, err := svc.UpdateMe(ctx, u2, ProfileUpdate{Username: strPtr("alice_w")}); err != ErrUsernameTaken {
+		t.Fatalf("expected taken, got %v", err)
+	}
+	p, err := svc.Lookup(ctx, u2, "@ALICE_W")
+	if err != nil || p.ID != u1 {
+		t.Fatalf("lookup by username: %+v %v", p, err)
+	}
+
+	// clearing frees the name
+	if _, err := svc.UpdateMe(ctx, u1, ProfileUpdate{Username: strPtr("")}); err != nil {
+		t.Fatalf("clear username: %v", err)
+	}
+	if _, err := svc.UpdateMe(ctx, u2, ProfileUpdate{Username: strPtr("alice_w")}); err != nil {
+		t.Fatalf("expected free username, got %v", err)
+	}
+}
+
+func TestUpdateProfileValidation(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	ctx := context.Background()
+	u := repo.add()
+
+	if _, err := svc.UpdateMe(ctx, u, ProfileUpdate{AvatarURL: strPtr("javascript:alert(1)")}); err != ErrInvalidProfile {
+		t.Fatalf("expected invalid avatar, got %v", err)
+	}
+	if _, err := svc.UpdateMe(ctx, u, ProfileUpdate{Bio: strPtr(strings.Repeat("я", maxBio+1))}); err != ErrInvalidProfile {
+		t.Fatalf("expected bio too long, got %v", err)
+	}
+	p, err := svc.UpdateMe(ctx, u, ProfileUpdate{DisplayName: strPtr("  Алиса  "), Bio: strPtr(strings.Repeat("я", maxBio))})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if p.DisplayName == nil || *p.DisplayName != "Алиса" {
+		t.Fatalf("display name not trimmed: %v", p.DisplayName)
+	}
+}
+
+type stubPresence struct {
+	online   bool
+	lastSeen time.Time
+}
+
+func (p stubPresence) Status(ctx context.Context, userID uuid.UUID) (bool, *time.Time, error) {
+	seen := p.lastSeen
+	return p.online, &seen, nil
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestAllowMessagesFrom(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	ctx := context.Background()
+	owner, friend, stranger := repo.add(), repo.add(), repo.add()
+	repo.contacts[[2]uuid.UUID{owner, friend}] = true
+
+	cases := []struct {
+		audience string
+		friend   bool
+		stranger bool
+	}{
+		{"everyone", true, true},
+		{"contacts", true, false},
+		{"friends", true, false},
+		{"nobody", false, false},
+	}
+	for _, c := range cases {
+		if _, err := svc.UpdateSettings(ctx, owner, SettingsUpdate{AllowMessagesFrom: strPtr(c.audience)}); err != nil {
+			t.Fatalf("%s: update: %v", c.audience, err)
+		}
+		if ok, _ := svc.CanMessage(ctx, friend, owner); ok != c.friend {
+			t.Errorf("%s: contact allowed = %v, want %v", c.audience, ok, c.friend)
+		}
+		if ok, _ := svc.CanMessage(ctx, stranger, owner); ok != c.stranger {
+			t.Errorf("%s: stranger allowed = %v, want %v", c.audience, ok, c.stranger)
+		}
+	}
+	if _, err := svc.UpdateSettings(ctx, owner, SettingsUpdate{AllowMessagesFrom: strPtr("anyone")}); err != ErrInvalidSettings {
+		t.Fatalf("expected invalid settings, got %v", err)
+	}
+}
+
+func TestAllowAddToGroup(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	ctx := context.Background()
+	target, friend, stranger := repo.add(), repo.add(), repo.add()
+	repo.contacts[[2]uuid.UUID{target, friend}] = true
+
+	if ok, _ := svc.CanAddToGroup(ctx, stranger, target); !ok {
+		t.Fatalf("default should allow everyone")
+	}
+	if _, err := svc.UpdateSettings(ctx, target, SettingsUpdate{AllowAddToGroup: strPtr("contacts")}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if ok, _ := svc.CanAddToGroup(ctx, stranger, target); ok {
+		t.Fatalf("stranger must not add to group")
+	}
+	if ok, _ := svc.CanAddToGroup(ctx, friend, target); !ok {
+		t.Fatalf("contact should add to group")
+	}
+	if _, err := svc.UpdateSettings(ctx, target, SettingsUpdate{AllowAddToGroup: strPtr("nobody")}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if ok, _ := svc.CanAddToGroup(ctx, friend, target); ok {
+		t.Fatalf("nobody must block contacts too")
+	}
+}
+
+func TestPresenceVisibility(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	svc.SetPresence(stubPresence{online: true, lastSeen: time.Now()})
+	ctx := context.Background()
+	user, viewer := repo.add(), repo.add()
+
+	p, err := svc.Presence(ctx, viewer, user)
+	if err != nil || p.Online == nil || !*p.Online || p.LastSeen == nil {
+		t.Fatalf("default presence should be visible: %+v %v", p, err)
+	}
+
+	if _, err := svc.UpdateSettings(ctx, user, SettingsUpdate{ShowOnline: boolPtr(false)}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	p, _ = svc.Presence(ctx, viewer, user)
+	if p.Online != nil || p.LastSeen == nil {
+		t.Fatalf("show_online=false should hide only online: %+v", p)
+	}
+
+	if _, err := svc.UpdateSettings(ctx, user, SettingsUpdate{ShowLastSeen: boolPtr(false)}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	p, _ = svc.Presence(ctx, viewer, user)
+	if p.Online != nil || p.LastSeen != nil {
+		t.Fatalf("show_last_seen=false should hide last seen: %+v", p)
+	}
+
+	// own presence is never filtered
+	p, _ = svc.Presence(ctx, user, user)
+	if p.Online == nil || p.LastSeen == nil {
+		t.Fatalf("own presence hidden: %+v", p)
+	}
+}
+
+func TestAllowProfileByEmail(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	ctx := context.Background()
+	user, viewer := repo.add(), repo.add()
+	repo.emails["alice@example.com"] = user
+
+	if _, err := svc.LookupByEmail(ctx, viewer, "alice@example.com"); err != ErrNotFound {
+		t.Fatalf("email lookup must be off by default, got %v", err)
+	}
+	if _, err := svc.LookupByEmail(ctx, viewer, "missing@example.com"); err != ErrNotFound {
+		t.Fatalf("missing email: %v", err)
+	}
+	if _, err := svc.UpdateSettings(ctx, user, SettingsUpdate{AllowProfileByEmail: boolPtr(true)}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	p, err := svc.LookupByEmail(ctx, viewer, "alice@example.com")
+	if err != nil || p.ID != user {
+		t.Fatalf("lookup after opt-in: %+v %v", p, err)
+	}
+}
+
+func TestBlockingBothDirections(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	svc.SetPresence(stubPresence{online: true, lastSeen: time.Now()})
+	ctx := context.Background()
+	blocker, blocked := repo.add(), repo.add()
+
+	if err := svc.Block(ctx, blocker, blocker); err != ErrInvalidBlock {
+		t.Fatalf("expected self-block rejection, got %v", err)
+	}
+	if err := svc.Block(ctx, blocker, uuid.New()); err != ErrNotFound {
+		t.Fatalf("expected unknown target, got %v", err)
+	}
+	if err := svc.Block(ctx, blocker, blocked); err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	if list, _ := svc.Blocked(ctx, blocker); len(list) != 1 || list[0].UserID != blocked {
+		t.Fatalf("unexpected block list: %+v", list)
+	}
+
+	for _, pair := range [][2]uuid.UUID{{blocked, blocker}, {blocker, blocked}} {
+		if ok, _ := svc.CanMessage(ctx, pair[0], pair[1]); ok {
+			t.Errorf("message %v -> %v must be denied", pair[0], pair[1])
+		}
+		if ok, _ := svc.CanAddToGroup(ctx, pair[0], pair[1]); ok {
+			t.Errorf("add %v -> %v must be denied", pair[0], pair[1])
+		}
+		p, err := svc.Presence(ctx, pair[0], pair[1])
+		if err != nil || p.Online != nil || p.LastSeen != nil {
+			t.Errorf("presence must be hidden: %+v %v", p, err)
+		}
+	}
+
+	if _, err := svc.Get(ctx, blocked, blocker); err != ErrNotFound {
+		t.Fatalf("blocked user must not see the blocker's profile, got %v", err)
+	}
+	if p, err := svc.Get(ctx, blocker, blocked); err != nil || p.ID != blocked {
+		t.Fatalf("blocker still sees the profile: %+v %v", p, err)
+	}
+
+	if err := svc.Unblock(ctx, blocker, blocked); err != nil {
+		t.Fatalf("unblock: %v", err)
+	}
+	if _, err := svc.Get(ctx, blocked, blocker); err != nil {
+		t.Fatalf("unblock should restore the profile: %v", err)
+	}
+	if ok, _ := svc.CanMessage(ctx, blocked, blocker); !ok {
+		t.Fatalf("unblock should restore messaging")
+	}
+}
+
+func TestPresenceHiddenFromRequestSender(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	svc.SetPresence(stubPresence{online: true, lastSeen: time.Now()})
+	ctx := context.Background()
+	recipient, sender, other := repo.add(), repo.add(), repo.add()
+	repo.requests[[2]uuid.UUID{recipient, sender}] = true
+
+	if p, _ := svc.Presence(ctx, sender, recipient); p.Online != nil || p.LastSeen != nil {
+		t.Fatalf("presence leaked to request sender: %+v", p)
+	}
+	if p, _ := svc.Presence(ctx, other, recipient); p.Online == nil {
+		t.Fatalf("presence hidden from unrelated user: %+v", p)
+	}
+}
+
+func TestForwardAttribution(t *testing.T) {
+	repo := newMemRepo()
+	svc := NewService(repo)
+	ctx := context.Background()
+	user := repo.add()
+	p := repo.profiles[user]
+	p.DisplayName = strPtr("Alice")
+	repo.profiles[user] = p
+
+	name, link, err := svc.ForwardAttribution(ctx, user)
+	if err != nil || name != "Alice" || !link {
+		t.Fatalf("default attribution: %q %v %v", name, link, err)
+	}
+	if _, err := svc.UpdateSettings(ctx, user, SettingsUpdate{AllowForwardLink: boolPtr(false)}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	name, link, err = svc.ForwardAttribution(ctx, user)
+	if err != nil || name != "Alice" || link {
+		t.Fatalf("link must be hidden: %q %v %v", name, link, err)
+	}
+	if name, link, _ := svc.ForwardAttribution(ctx, uuid.New()); link || name != deletedAccountName {
+		t.Fatalf("missing user: %q %v", name, link)
+	}
+}
@@ -0,0 +1,6 @@
+-- Privacy settings: "friends" is now called "contacts".
+UPDATE user_settings SET allow_messages_from = 'contacts' WHERE allow_messages_from = 'friends';
+UPDATE user_settings SET allow_add_to_group = 'contacts' WHERE allow_add_to_group = 'friends';
+
+-- Contact checks look for messages a user has sent in a dialog.
+CREATE INDEX IF NOT EXISTS idx_messages_dialog_sender ON messages(dialog_id, sender_id);
@@ -0,0 +1,2 @@
+-- Reverse lookups: who blocked this user
+CREATE INDEX IF NOT EXISTS idx_blocks_blocked_user ON blocks(blocked_user_id);
@@ -0,0 +1,5 @@
+-- Message requests: first contact from a non-contact lands in the recipient's "requests" folder
+ALTER TABLE IF EXISTS dialog_members
+    ADD COLUMN IF NOT EXISTS request_state TEXT NOT NULL DEFAULT 'accepted'; -- accepted/pending/declined
+
+CREATE INDEX IF NOT EXISTS idx_dialog_members_user_state ON dialog_members(user_id, request_state);
@@ -0,0 +1,11 @@
+-- Broadcast channels: public username for join-by-link and a denormalized subscriber count
+ALTER TABLE IF EXISTS dialogs
+    ADD COLUMN IF NOT EXISTS username CITEXT,
+    ADD COLUMN IF NOT EXISTS description TEXT,
+    ADD COLUMN IF NOT EXISTS subscriber_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_dialogs_username ON dialogs(username) WHERE username IS NOT NULL;
+
+UPDATE dialogs d
+SET subscriber_count = (SELECT COUNT(*) FROM dialog_members m WHERE m.dialog_id = d.id)
+WHERE d.kind = 'channel';
@@ -0,0 +1,25 @@
+-- Invite links for groups and channels
+CREATE TABLE IF NOT EXISTS dialog_invites (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    dialog_id UUID NOT NULL REFERENCES dialogs(id) ON DELETE CASCADE,
+    code TEXT NOT NULL UNIQUE,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title TEXT,
+    expires_at TIMESTAMPTZ,
+    max_uses INTEGER,
+    uses INTEGER NOT NULL DEFAULT 0,
+    requires_approval BOOLEAN NOT NULL DEFAULT FALSE,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_dialog_invites_dialog ON dialog_invites(dialog_id, created_at DESC);
+
+-- Pending joins through links that require admin approval
+CREATE TABLE IF NOT EXISTS dialog_join_requests (
+    dialog_id UUID NOT NULL REFERENCES dialogs(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    invite_id UUID REFERENCES dialog_invites(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (dialog_id, user_id)
+);
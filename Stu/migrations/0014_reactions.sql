@@ -0,0 +1,2 @@
+-- Allowed reactions per dialog: NULL means any reaction, an empty array disables reactions
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS allowed_reactions TEXT[];
@@ -0,0 +1,4 @@
+-- Whether forwarded messages may link to the original sender's account
+ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS allow_forward_link BOOLEAN DEFAULT TRUE;
+
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to) WHERE reply_to IS NOT NULL;
@@ -0,0 +1,20 @@
+-- Per-member dialog state: archive and pinning are personal, muted_until already is
+ALTER TABLE dialog_members
+    ADD COLUMN IF NOT EXISTS archived BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS pinned_at TIMESTAMPTZ;
+
+-- dialogs.archived used to be global; carry it over to every member
+UPDATE dialog_members dm SET archived = TRUE
+FROM dialogs d
+WHERE d.id = dm.dialog_id AND d.archived AND NOT dm.archived;
+
+CREATE INDEX IF NOT EXISTS idx_dialog_members_pinned ON dialog_members (user_id, pinned_at) WHERE pinned_at IS NOT NULL;
+
+-- Pinned messages
+CREATE TABLE IF NOT EXISTS dialog_pins (
+    dialog_id UUID NOT NULL REFERENCES dialogs(id) ON DELETE CASCADE,
+    message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    pinned_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    pinned_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (dialog_id, message_id)
+);
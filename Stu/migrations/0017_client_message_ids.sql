@@ -0,0 +1,7 @@
+-- Client-generated message ids make sending idempotent: a retried send
+-- returns the stored message instead of inserting a duplicate
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_message_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_id
+    ON messages (dialog_id, sender_id, client_message_id)
+    WHERE client_message_id IS NOT NULL;
@@ -0,0 +1,22 @@
+-- Per-user update sequence (pts) for delta sync. Every change a user must
+-- learn about gets the next pts of that user; clients catch up with
+-- GET /v1/sync?since=<pts>.
+CREATE TABLE IF NOT EXISTS user_update_state (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    pts BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS user_updates (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pts BIGINT NOT NULL,
+    type TEXT NOT NULL,
+    dialog_id UUID NOT NULL REFERENCES dialogs(id) ON DELETE CASCADE,
+    message_id BIGINT,
+    actor_id UUID,
+    subject_id UUID,
+    role TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, pts)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_updates_created ON user_updates (created_at);
@@ -0,0 +1,32 @@
+-- Read/delivered watermarks: a member has read (received) every message of
+-- the dialog with id <= the watermark. Replaces per-message receipts.
+ALTER TABLE dialog_members
+    ADD COLUMN IF NOT EXISTS last_read_message_id BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_delivered_message_id BIGINT NOT NULL DEFAULT 0;
+
+-- Unread counts scan messages of a dialog by id
+CREATE INDEX IF NOT EXISTS idx_messages_dialog_id ON messages (dialog_id, id);
+
+-- Carry over existing receipts: the highest receipted message becomes the watermark
+UPDATE dialog_members dm SET last_read_message_id = r.max_id
+FROM (
+    SELECT m.dialog_id, mr.user_id, MAX(m.id) AS max_id
+    FROM message_reads mr JOIN messages m ON m.id = mr.message_id
+    GROUP BY m.dialog_id, mr.user_id
+) r
+WHERE dm.dialog_id = r.dialog_id AND dm.user_id = r.user_id AND dm.last_read_message_id < r.max_id;
+
+UPDATE dialog_members dm SET last_delivered_message_id = d.max_id
+FROM (
+    SELECT m.dialog_id, md.user_id, MAX(m.id) AS max_id
+    FROM message_deliveries md JOIN messages m ON m.id = md.message_id
+    GROUP BY m.dialog_id, md.user_id
+) d
+WHERE dm.dialog_id = d.dialog_id AND dm.user_id = d.user_id AND dm.last_delivered_message_id < d.max_id;
+
+-- Read implies delivered
+UPDATE dialog_members SET last_delivered_message_id = last_read_message_id
+WHERE last_delivered_message_id < last_read_message_id;
+
+DROP TABLE IF EXISTS message_reads;
+DROP TABLE IF EXISTS message_deliveries;
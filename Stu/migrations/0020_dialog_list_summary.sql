@@ -0,0 +1,28 @@
+-- Denormalized dialog list: every member row carries its last visible message,
+-- unread counter and last activity time, maintained on write.
+ALTER TABLE dialog_members
+    ADD COLUMN IF NOT EXISTS last_message_id BIGINT,
+    ADD COLUMN IF NOT EXISTS unread_count INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_activity_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- Backfill from the current messages and read watermarks
+UPDATE dialog_members dm
+SET last_message_id = (
+        SELECT m.id FROM messages m
+        WHERE m.dialog_id = dm.dialog_id AND m.deleted_at IS NULL
+          AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = dm.user_id)
+        ORDER BY m.id DESC LIMIT 1),
+    unread_count = (
+        SELECT COUNT(*) FROM messages m
+        WHERE m.dialog_id = dm.dialog_id AND m.id > dm.last_read_message_id
+          AND m.sender_id <> dm.user_id AND m.deleted_at IS NULL
+          AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = dm.user_id));
+
+UPDATE dialog_members dm
+SET last_activity_at = COALESCE((SELECT created_at FROM messages WHERE id = dm.last_message_id), d.created_at)
+FROM dialogs d
+WHERE d.id = dm.dialog_id;
+
+-- Keyset pagination of a user's dialogs by last activity
+CREATE INDEX IF NOT EXISTS idx_dialog_members_activity
+    ON dialog_members (user_id, request_state, last_activity_at DESC, dialog_id DESC);
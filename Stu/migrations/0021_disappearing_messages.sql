@@ -0,0 +1,23 @@
+-- Disappearing messages: a per-dialog timer stamps new messages with an
+-- expiry, a reaper hard-deletes them once it passes.
+ALTER TABLE dialogs
+    ADD COLUMN IF NOT EXISTS message_ttl_seconds INT NOT NULL DEFAULT 0;
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_messages_expires ON messages (expires_at) WHERE expires_at IS NOT NULL;
+
+-- Replies outlive the messages they quote
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_reply_to_fkey;
+ALTER TABLE messages
+    ADD CONSTRAINT messages_reply_to_fkey FOREIGN KEY (reply_to) REFERENCES messages(id) ON DELETE SET NULL;
+
+-- Media attached to a message; removed together with the message
+CREATE TABLE IF NOT EXISTS message_media (
+    message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    media_id UUID NOT NULL REFERENCES media_objects(id) ON DELETE CASCADE,
+    PRIMARY KEY (message_id, media_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_media_media ON message_media (media_id);
@@ -0,0 +1,18 @@
+-- Scheduled messages: stored until send_at, then sent by the scheduler worker.
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+    id BIGSERIAL PRIMARY KEY,
+    dialog_id UUID NOT NULL REFERENCES dialogs(id) ON DELETE CASCADE,
+    sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    cipher_text BYTEA NOT NULL,
+    reply_to BIGINT,
+    quote TEXT NOT NULL DEFAULT '',
+    send_at TIMESTAMPTZ NOT NULL,
+    -- set when sending failed for good; the sender may reschedule or cancel
+    failed_at TIMESTAMPTZ,
+    error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_due ON scheduled_messages (send_at) WHERE failed_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_scheduled_messages_sender ON scheduled_messages (sender_id, dialog_id, send_at);
@@ -0,0 +1,10 @@
+-- Per-user dialog drafts, synced across devices. The blob is encrypted by the
+-- client; an empty blob is a cleared draft kept for its timestamp so an older
+-- write cannot bring it back.
+CREATE TABLE IF NOT EXISTS dialog_drafts (
+    dialog_id UUID NOT NULL REFERENCES dialogs(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    blob BYTEA NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, dialog_id)
+);
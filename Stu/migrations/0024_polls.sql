@@ -0,0 +1,21 @@
+-- Polls. In unencrypted dialogs the server keeps options and votes; in
+-- encrypted ones a poll is an opaque 'poll' message and votes are opaque
+-- 'poll_vote' control messages replying to it, tallied by clients.
+ALTER TYPE message_kind ADD VALUE IF NOT EXISTS 'poll';
+ALTER TYPE message_kind ADD VALUE IF NOT EXISTS 'poll_vote';
+
+CREATE TABLE IF NOT EXISTS polls (
+    message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    options TEXT[] NOT NULL,
+    multiple BOOLEAN NOT NULL DEFAULT FALSE,
+    anonymous BOOLEAN NOT NULL DEFAULT TRUE,
+    closes_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+    message_id BIGINT NOT NULL REFERENCES polls(message_id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    option SMALLINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id, option)
+);
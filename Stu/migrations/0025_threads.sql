@@ -0,0 +1,13 @@
+-- Threads: replies attached to a root message of a group or a channel post.
+-- They stay out of the main timeline, the dialog summary and its unread count;
+-- each member keeps a separate read watermark per thread.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_root_id BIGINT REFERENCES messages(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_messages_thread ON messages(thread_root_id, id) WHERE thread_root_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS thread_reads (
+    root_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    last_read_message_id BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (root_id, user_id)
+);
@@ -0,0 +1,17 @@
+-- Mentions in groups. The entities live in messages.metadata for rendering;
+-- message_mentions keeps one row per mentioned member with its read state,
+-- and dialog_members.unread_mentions counts the unread ones.
+ALTER TABLE dialog_members
+    ADD COLUMN IF NOT EXISTS unread_mentions INT NOT NULL DEFAULT 0,
+    -- whether mentions still notify while the dialog is muted
+    ADD COLUMN IF NOT EXISTS notify_mentions BOOLEAN NOT NULL DEFAULT TRUE;
+
+CREATE TABLE IF NOT EXISTS message_mentions (
+    message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    dialog_id UUID NOT NULL REFERENCES dialogs(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    read BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_mentions_unread ON message_mentions(dialog_id, user_id, message_id) WHERE NOT read;
@@ -0,0 +1,12 @@
+-- Saved messages: a per-user dialog with a single member used for notes and
+-- forwarded messages. Like direct dialogs it is end-to-end encrypted; clients
+-- encrypt to the owner's own device keys.
+ALTER TYPE dialog_kind ADD VALUE IF NOT EXISTS 'saved';
+
+-- One saved dialog per user. Kept in a separate table rather than a partial
+-- index on dialogs.kind because the new enum value cannot be referenced in
+-- the transaction that adds it.
+CREATE TABLE IF NOT EXISTS saved_dialogs (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    dialog_id UUID NOT NULL UNIQUE REFERENCES dialogs(id) ON DELETE CASCADE
+);
@@ -0,0 +1,34 @@
+-- Full-text search over messages of unencrypted dialogs (groups, channels).
+-- search_tsv holds Russian and English lexemes of the text; it stays NULL for
+-- end-to-end encrypted dialogs, service messages and deleted messages, so
+-- those never match. Clients search E2EE history with their local index.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_tsv tsvector;
+
+CREATE OR REPLACE FUNCTION messages_search_tsv(body BYTEA) RETURNS tsvector AS $$
+    SELECT to_tsvector('russian', convert_from(body, 'UTF8'))
+        || to_tsvector('english', convert_from(body, 'UTF8'))
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION messages_search_update() RETURNS trigger AS $$
+BEGIN
+    IF NEW.deleted_at IS NULL AND NEW.kind::text IN ('text', 'poll')
+       AND NOT (SELECT is_encrypted FROM dialogs WHERE id = NEW.dialog_id) THEN
+        NEW.search_tsv := messages_search_tsv(NEW.cipher_text);
+    ELSE
+        NEW.search_tsv := NULL;
+    END IF;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS messages_search ON messages;
+CREATE TRIGGER messages_search
+    BEFORE INSERT OR UPDATE OF cipher_text, deleted_at ON messages
+    FOR EACH ROW EXECUTE FUNCTION messages_search_update();
+
+UPDATE messages m SET search_tsv = messages_search_tsv(m.cipher_text)
+FROM dialogs d
+WHERE d.id = m.dialog_id AND NOT d.is_encrypted
+  AND m.deleted_at IS NULL AND m.kind::text IN ('text', 'poll') AND m.search_tsv IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN (search_tsv) WHERE search_tsv IS NOT NULL;
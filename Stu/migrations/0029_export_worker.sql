@@ -0,0 +1,8 @@
+-- Export jobs are claimed by a worker loop instead of a request goroutine, so
+-- jobs survive restarts. started_at lets another worker reclaim a job whose
+-- worker died; attempts bounds retries of a job that keeps failing that way.
+ALTER TABLE data_exports
+    ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_active ON data_exports(created_at) WHERE status IN ('pending', 'processing');
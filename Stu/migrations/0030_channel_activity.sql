@@ -0,0 +1,11 @@
+-- Channel posts no longer touch every subscriber row: the channel keeps its
+-- last activity time, and the dialog list derives a subscriber's last post
+-- and unread count at read time.
+ALTER TABLE dialogs ADD COLUMN IF NOT EXISTS last_activity_at TIMESTAMPTZ;
+
+UPDATE dialogs d
+SET last_activity_at = COALESCE((
+        SELECT MAX(m.created_at) FROM messages m
+        WHERE m.dialog_id = d.id AND m.deleted_at IS NULL AND m.kind <> 'poll_vote' AND m.thread_root_id IS NULL),
+    d.created_at)
+WHERE d.kind = 'channel';
@@ -0,0 +1,3 @@
+-- The heir of a leaving owner is looked up by role, without scanning every
+-- subscriber of a channel.
+CREATE INDEX IF NOT EXISTS idx_dialog_members_role ON dialog_members (dialog_id, role, joined_at);
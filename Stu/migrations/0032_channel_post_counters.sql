@@ -0,0 +1,58 @@
+-- Channel summaries in O(1) per listed dialog: every main-timeline post of a
+-- channel takes the next number of the channel's post counter, a subscriber
+-- keeps the number of the last post read, and posts removed later are
+-- recorded as gaps. Unread is then the counter minus the read number minus
+-- the gaps after it. Gaps at or below post_floor, the number under the
+-- oldest remaining post, are pruned.
+ALTER TABLE dialogs
+    ADD COLUMN IF NOT EXISTS post_seq BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS post_floor BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS post_seq BIGINT;
+
+ALTER TABLE dialog_members
+    ADD COLUMN IF NOT EXISTS read_post_seq BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS is_channel BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS channel_post_gaps (
+    dialog_id UUID NOT NULL REFERENCES dialogs(id) ON DELETE CASCADE,
+    post_seq BIGINT NOT NULL,
+    PRIMARY KEY (dialog_id, post_seq)
+);
+
+UPDATE messages m
+SET post_seq = n.seq
+FROM (
+    SELECT m.id, ROW_NUMBER() OVER (PARTITION BY m.dialog_id ORDER BY m.id) AS seq
+    FROM messages m
+    JOIN dialogs d ON d.id = m.dialog_id AND d.kind = 'channel'
+    WHERE m.thread_root_id IS NULL AND m.kind <> 'poll_vote'
+) n
+WHERE m.id = n.id;
+
+INSERT INTO channel_post_gaps (dialog_id, post_seq)
+SELECT dialog_id, post_seq FROM messages
+WHERE post_seq IS NOT NULL AND deleted_at IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+UPDATE dialogs d
+SET post_seq = COALESCE((SELECT MAX(m.post_seq) FROM messages m WHERE m.dialog_id = d.id), 0)
+WHERE d.kind = 'channel';
+
+UPDATE dialog_members dm
+SET is_channel = TRUE,
+    read_post_seq = COALESCE((
+        SELECT MAX(m.post_seq) FROM messages m
+        WHERE m.dialog_id = dm.dialog_id AND m.id <= dm.last_read_message_id), 0)
+FROM dialogs d
+WHERE d.id = dm.dialog_id AND d.kind = 'channel';
+
+-- The last post of a channel and its post_floor come from the ends of this
+-- index.
+CREATE INDEX IF NOT EXISTS idx_messages_channel_posts
+    ON messages (dialog_id, post_seq) WHERE post_seq IS NOT NULL AND deleted_at IS NULL;
+
+-- ListDialogs reads a user's channels through this index: their activity
+-- lives on the channel row, so idx_dialog_members_activity cannot order them.
+CREATE INDEX IF NOT EXISTS idx_dialog_members_channels
+    ON dialog_members (user_id, request_state) WHERE is_channel;